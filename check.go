@@ -0,0 +1,435 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/gepis/strge/context"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// CheckFindingType identifies the kind of inconsistency which a CheckFinding
+// describes.
+type CheckFindingType string
+
+const (
+	// CheckLayerDataMissing is reported for a layer record for which the
+	// storage driver has no data.
+	CheckLayerDataMissing CheckFindingType = "layer-data-missing"
+	// CheckLayerMetadataError is reported for a layer for which the storage
+	// driver has data, but which the driver can not describe.  This usually
+	// means that one of the layer's lower directories is gone.
+	CheckLayerMetadataError CheckFindingType = "layer-metadata-error"
+	// CheckLayerParentMissing is reported for a layer whose parent layer is
+	// not known to any of the layer stores.
+	CheckLayerParentMissing CheckFindingType = "layer-parent-missing"
+	// CheckLayerOrphaned is reported for data which the storage driver is
+	// holding for a layer that no layer store has a record of.
+	CheckLayerOrphaned CheckFindingType = "layer-orphaned"
+	// CheckImageTopLayerMissing is reported for an image whose top layer is
+	// not known to any of the layer stores.
+	CheckImageTopLayerMissing CheckFindingType = "image-top-layer-missing"
+	// CheckImageMappedLayerMissing is reported for an image which lists a
+	// mapped top layer that is not known to the layer store.
+	CheckImageMappedLayerMissing CheckFindingType = "image-mapped-layer-missing"
+	// CheckContainerLayerMissing is reported for a container whose layer is
+	// not known to the layer store.
+	CheckContainerLayerMissing CheckFindingType = "container-layer-missing"
+	// CheckContainerImageMissing is reported for a container which was
+	// created from an image that is not known to any of the image stores.
+	CheckContainerImageMissing CheckFindingType = "container-image-missing"
+)
+
+// CheckFinding describes a single inconsistency which was found by Check().
+type CheckFinding struct {
+	// Type is the kind of inconsistency.
+	Type CheckFindingType `json:"type"`
+	// ID is the ID of the layer, image, or container which is affected.
+	ID string `json:"id"`
+	// Reference is the ID of the item which ID refers to, if the finding is
+	// about a reference to something which is missing or broken.
+	Reference string `json:"reference,omitempty"`
+	// ReadOnly is set if the affected item lives in a read-only store, in
+	// which case Repair() will leave it alone.
+	ReadOnly bool `json:"read-only,omitempty"`
+	// Message is a human-readable description of the finding.
+	Message string `json:"message"`
+}
+
+// CheckReport is the list of inconsistencies found by Check().
+type CheckReport struct {
+	Findings []CheckFinding `json:"findings"`
+}
+
+// CheckOptions is used for passing options to a Store's Check() method.
+type CheckOptions struct {
+	// LayerMetadata causes the storage driver to be asked to describe each
+	// layer for which it has data, which catches breakage that a simple
+	// existence check does not.
+	LayerMetadata bool
+	// OrphanedLayers causes the storage driver's list of layers to be
+	// compared with the layer stores' records, if the driver is able to
+	// produce such a list.
+	OrphanedLayers bool
+}
+
+// CheckEverything returns a CheckOptions with every check enabled.
+func CheckEverything() *CheckOptions {
+	return &CheckOptions{
+		LayerMetadata:  true,
+		OrphanedLayers: true,
+	}
+}
+
+// RepairOptions is used for passing options to a Store's Repair() method.
+type RepairOptions struct {
+	// RemoveContainers allows Repair() to delete containers whose layers
+	// are missing or broken.  If it is not set, such containers are left
+	// in place, along with the layers they are built on, and an error is
+	// returned for each of them.
+	RemoveContainers bool
+}
+
+func (s *store) Check(options *CheckOptions) (CheckReport, error) {
+	var report CheckReport
+	if options == nil {
+		options = CheckEverything()
+	}
+
+	driver, err := s.GraphDriver()
+	if err != nil {
+		return report, err
+	}
+	rlstore, err := s.LayerStore()
+	if err != nil {
+		return report, err
+	}
+	lstores, err := s.ROLayerStores()
+	if err != nil {
+		return report, err
+	}
+	ristore, err := s.ImageStore()
+	if err != nil {
+		return report, err
+	}
+	istores, err := s.ROImageStores()
+	if err != nil {
+		return report, err
+	}
+	rcstore, err := s.ContainerStore()
+	if err != nil {
+		return report, err
+	}
+
+	add := func(finding CheckFinding) {
+		report.Findings = append(report.Findings, finding)
+	}
+
+	layersByID := make(map[string]bool)
+	layerIsReadOnly := make(map[string]bool)
+	var allLayers []Layer
+	for _, store := range append([]ROLayerStore{rlstore}, lstores...) {
+		if err := s.startReading(store); err != nil {
+			return report, err
+		}
+		defer store.Unlock()
+		layers, err := store.Layers()
+		if err != nil {
+			return report, err
+		}
+		for _, layer := range layers {
+			layersByID[layer.ID] = true
+			layerIsReadOnly[layer.ID] = store != ROLayerStore(rlstore)
+		}
+		allLayers = append(allLayers, layers...)
+	}
+	for _, layer := range allLayers {
+		readOnly := layerIsReadOnly[layer.ID]
+		if layer.Parent != "" && !layersByID[layer.Parent] {
+			add(CheckFinding{
+				Type:      CheckLayerParentMissing,
+				ID:        layer.ID,
+				Reference: layer.Parent,
+				ReadOnly:  readOnly,
+				Message:   fmt.Sprintf("layer %q has parent %q, which does not exist", layer.ID, layer.Parent),
+			})
+		}
+		if !driver.Exists(layer.ID) {
+			add(CheckFinding{
+				Type:     CheckLayerDataMissing,
+				ID:       layer.ID,
+				ReadOnly: readOnly,
+				Message:  fmt.Sprintf("layer %q has no data in the %q driver", layer.ID, driver.String()),
+			})
+			continue
+		}
+		if options.LayerMetadata {
+			if _, err := driver.Metadata(layer.ID); err != nil {
+				add(CheckFinding{
+					Type:     CheckLayerMetadataError,
+					ID:       layer.ID,
+					ReadOnly: readOnly,
+					Message:  fmt.Sprintf("error reading metadata for layer %q: %v", layer.ID, err),
+				})
+			}
+		}
+	}
+	if options.OrphanedLayers {
+		if lister, ok := driver.(context.LayerListerDriver); ok {
+			ids, err := lister.ListLayers()
+			if err != nil {
+				return report, errors.Wrapf(err, "error listing layers in the %q driver", driver.String())
+			}
+			for _, id := range ids {
+				if !layersByID[id] {
+					add(CheckFinding{
+						Type:    CheckLayerOrphaned,
+						ID:      id,
+						Message: fmt.Sprintf("the %q driver has data for layer %q, which has no record", driver.String(), id),
+					})
+				}
+			}
+		} else {
+			logrus.Debugf("the %q driver can not list its layers, not checking for orphaned layers", driver.String())
+		}
+	}
+
+	imagesByID := make(map[string]bool)
+	for _, store := range append([]ROImageStore{ristore}, istores...) {
+		if err := s.startReading(store); err != nil {
+			return report, err
+		}
+		defer store.Unlock()
+		images, err := store.Images()
+		if err != nil {
+			return report, err
+		}
+		readOnly := store != ROImageStore(ristore)
+		for _, image := range images {
+			imagesByID[image.ID] = true
+			if image.TopLayer != "" && !layersByID[image.TopLayer] {
+				add(CheckFinding{
+					Type:      CheckImageTopLayerMissing,
+					ID:        image.ID,
+					Reference: image.TopLayer,
+					ReadOnly:  readOnly,
+					Message:   fmt.Sprintf("image %q has top layer %q, which does not exist", image.ID, image.TopLayer),
+				})
+			}
+			for _, layer := range image.MappedTopLayers {
+				if !layersByID[layer] {
+					add(CheckFinding{
+						Type:      CheckImageMappedLayerMissing,
+						ID:        image.ID,
+						Reference: layer,
+						ReadOnly:  readOnly,
+						Message:   fmt.Sprintf("image %q has mapped top layer %q, which does not exist", image.ID, layer),
+					})
+				}
+			}
+		}
+	}
+
+	if err := s.startReading(rcstore); err != nil {
+		return report, err
+	}
+	defer rcstore.Unlock()
+	containers, err := rcstore.Containers()
+	if err != nil {
+		return report, err
+	}
+	for _, container := range containers {
+		if !layersByID[container.LayerID] {
+			add(CheckFinding{
+				Type:      CheckContainerLayerMissing,
+				ID:        container.ID,
+				Reference: container.LayerID,
+				Message:   fmt.Sprintf("container %q has layer %q, which does not exist", container.ID, container.LayerID),
+			})
+		}
+		if container.ImageID != "" && !imagesByID[container.ImageID] {
+			add(CheckFinding{
+				Type:      CheckContainerImageMissing,
+				ID:        container.ID,
+				Reference: container.ImageID,
+				Message:   fmt.Sprintf("container %q was created from image %q, which does not exist", container.ID, container.ImageID),
+			})
+		}
+	}
+
+	return report, nil
+}
+
+func (s *store) Repair(report CheckReport, options *RepairOptions) []error {
+	var errs []error
+	if options == nil {
+		options = &RepairOptions{}
+	}
+
+	driver, err := s.GraphDriver()
+	if err != nil {
+		return []error{err}
+	}
+	rlstore, err := s.LayerStore()
+	if err != nil {
+		return []error{err}
+	}
+	ristore, err := s.ImageStore()
+	if err != nil {
+		return []error{err}
+	}
+	rcstore, err := s.ContainerStore()
+	if err != nil {
+		return []error{err}
+	}
+
+	if err := s.startWriting(rlstore); err != nil {
+		return []error{err}
+	}
+	defer rlstore.Unlock()
+	if err := s.startWriting(ristore); err != nil {
+		return []error{err}
+	}
+	defer ristore.Unlock()
+	if err := s.startWriting(rcstore); err != nil {
+		return []error{err}
+	}
+	defer rcstore.Unlock()
+
+	// Work out which layers have to go: the broken ones, and every layer
+	// which is built on top of one of them.
+	layers, err := rlstore.Layers()
+	if err != nil {
+		return []error{err}
+	}
+	brokenLayers := make(map[string]bool)
+	var orphanedLayers []string
+	for _, finding := range report.Findings {
+		if finding.ReadOnly {
+			continue
+		}
+		switch finding.Type {
+		case CheckLayerDataMissing, CheckLayerMetadataError, CheckLayerParentMissing:
+			if rlstore.Exists(finding.ID) {
+				brokenLayers[finding.ID] = true
+			}
+		case CheckLayerOrphaned:
+			orphanedLayers = append(orphanedLayers, finding.ID)
+		}
+	}
+	for changed := true; changed; {
+		changed = false
+		for _, layer := range layers {
+			if !brokenLayers[layer.ID] && brokenLayers[layer.Parent] {
+				brokenLayers[layer.ID] = true
+				changed = true
+			}
+		}
+	}
+	parents := make(map[string]string)
+	for _, layer := range layers {
+		parents[layer.ID] = layer.Parent
+	}
+	layerGone := func(id string) bool {
+		return brokenLayers[id] || !rlstore.Exists(id)
+	}
+
+	// Containers whose layers are going away, or are already gone.
+	containers, err := rcstore.Containers()
+	if err != nil {
+		return []error{err}
+	}
+	middleDir := s.graphDriverName + "-containers"
+	for _, container := range containers {
+		if !layerGone(container.LayerID) {
+			continue
+		}
+		if !options.RemoveContainers {
+			errs = append(errs, errors.Wrapf(ErrLayerUnknown, "container %q depends on missing or broken layer %q, not removing it", container.ID, container.LayerID))
+			// The container is staying, so the layers it is built on
+			// have to stay as well, broken or not.
+			for id := container.LayerID; brokenLayers[id]; id = parents[id] {
+				delete(brokenLayers, id)
+				errs = append(errs, errors.Wrapf(ErrLayerUsedByContainer, "broken layer %q is used by container %q, not removing it", id, container.ID))
+			}
+			continue
+		}
+		if err := rcstore.Delete(container.ID); err != nil {
+			errs = append(errs, errors.Wrapf(err, "error removing container %q", container.ID))
+			continue
+		}
+		s.notify(Event{Type: EventDelete, Object: EventContainer, ID: container.ID})
+		if err := os.RemoveAll(filepath.Join(s.GraphRoot(), middleDir, container.ID)); err != nil {
+			errs = append(errs, err)
+		}
+		if err := os.RemoveAll(filepath.Join(s.RunRoot(), middleDir, container.ID)); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	// Images whose top layers are going away are removed, and mapped top
+	// layers which are going away are unlinked from their images.
+	images, err := ristore.Images()
+	if err != nil {
+		return append(errs, err)
+	}
+	for _, image := range images {
+		if image.TopLayer != "" && layerGone(image.TopLayer) {
+			if err := ristore.Delete(image.ID); err != nil {
+				errs = append(errs, errors.Wrapf(err, "error removing image %q", image.ID))
+			} else {
+				s.notify(Event{Type: EventDelete, Object: EventImage, ID: image.ID})
+			}
+			continue
+		}
+		for _, layer := range image.MappedTopLayers {
+			if !layerGone(layer) {
+				continue
+			}
+			if istore, ok := ristore.(*imageStore); ok {
+				if err := istore.removeMappedTopLayer(image.ID, layer); err != nil {
+					errs = append(errs, errors.Wrapf(err, "error unlinking mapped top layer %q from image %q", layer, image.ID))
+				}
+			}
+		}
+	}
+
+	// Remove broken layers, children before their parents.
+	for len(brokenLayers) > 0 {
+		hasChildren := make(map[string]bool)
+		for _, layer := range layers {
+			if brokenLayers[layer.ID] {
+				hasChildren[layer.Parent] = true
+			}
+		}
+		progress := false
+		for id := range brokenLayers {
+			if hasChildren[id] {
+				continue
+			}
+			if err := rlstore.Delete(id); err != nil {
+				errs = append(errs, errors.Wrapf(err, "error removing layer %q", id))
+			} else {
+				s.notify(Event{Type: EventDelete, Object: EventLayer, ID: id})
+			}
+			delete(brokenLayers, id)
+			progress = true
+		}
+		if !progress {
+			break
+		}
+	}
+
+	for _, id := range orphanedLayers {
+		if rlstore.Exists(id) {
+			continue
+		}
+		if err := driver.Remove(id); err != nil {
+			errs = append(errs, errors.Wrapf(err, "error removing orphaned layer %q from the %q driver", id, driver.String()))
+		}
+	}
+
+	return errs
+}
@@ -0,0 +1,136 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/gepis/strge/context/copy"
+	"github.com/opencontainers/selinux/go-selinux/label"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+func (s *store) CloneContainer(srcID, newID string, names []string, options *ContainerOptions) (*Container, error) {
+	rlstore, err := s.LayerStore()
+	if err != nil {
+		return nil, err
+	}
+	rcstore, err := s.ContainerStore()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.startWriting(rlstore); err != nil {
+		return nil, err
+	}
+	defer rlstore.Unlock()
+	if err := s.startWriting(rcstore); err != nil {
+		return nil, err
+	}
+	defer rcstore.Unlock()
+
+	src, err := rcstore.Get(srcID)
+	if err != nil {
+		return nil, err
+	}
+	if newID != "" && rcstore.Exists(newID) {
+		return nil, errors.Wrapf(ErrDuplicateID, "container with ID %q already exists", newID)
+	}
+
+	// Start with the source container's settings, so that the new layer's
+	// ID mappings match the ones that the copy of the source container's
+	// layer uses, and let the caller override the flags.  The clone gets
+	// its own SELinux labels unless the caller supplies them, since
+	// sharing the source container's would defeat the point of them.
+	cloneOptions := ContainerOptions{}
+	if options != nil {
+		cloneOptions = *options
+	}
+	cloneOptions.IDMappingOptions = IDMappingOptions{
+		HostUIDMapping: len(src.UIDMap) == 0,
+		HostGIDMapping: len(src.GIDMap) == 0,
+		UIDMap:         copyIDMap(src.UIDMap),
+		GIDMap:         copyIDMap(src.GIDMap),
+	}
+	cloneOptions.Flags = copyStringInterfaceMap(src.Flags)
+	delete(cloneOptions.Flags, "ProcessLabel")
+	delete(cloneOptions.Flags, "MountLabel")
+	if options != nil {
+		for flag, value := range options.Flags {
+			cloneOptions.Flags[flag] = value
+		}
+	}
+	processLabel, _ := cloneOptions.Flags["ProcessLabel"].(string)
+	mountLabel, _ := cloneOptions.Flags["MountLabel"].(string)
+	if (processLabel == "") != (mountLabel == "") {
+		return nil, errors.Errorf("ProcessLabel and Mountlabel must either not be specified or both specified")
+	}
+	if processLabel == "" {
+		processLabel, mountLabel, err = label.InitLabels(cloneOptions.LabelOpts)
+		if err != nil {
+			return nil, err
+		}
+		cloneOptions.Flags["ProcessLabel"] = processLabel
+		cloneOptions.Flags["MountLabel"] = mountLabel
+	}
+
+	layer, err := rlstore.(*layerStore).clone("", src.LayerID, mountLabel, nil)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error copying layer %q of container %q", src.LayerID, src.ID)
+	}
+	container, err := rcstore.Create(newID, names, src.ImageID, layer.ID, src.Metadata, &cloneOptions)
+	if err != nil {
+		if err2 := rlstore.Delete(layer.ID); err2 != nil {
+			logrus.Debugf("error removing layer %q after failing to create a container using it: %v", layer.ID, err2)
+		}
+		return nil, err
+	}
+	events := []Event{
+		{Type: EventCreate, Object: EventLayer, ID: layer.ID},
+		{Type: EventCreate, Object: EventContainer, ID: container.ID, Names: container.Names},
+	}
+
+	cleanup := func() {
+		if err2 := rcstore.Delete(container.ID); err2 != nil {
+			logrus.Debugf("error removing container %q after failing to finish cloning it: %v", container.ID, err2)
+		}
+		if err2 := rlstore.Delete(layer.ID); err2 != nil {
+			logrus.Debugf("error removing layer %q after failing to finish cloning a container: %v", layer.ID, err2)
+		}
+	}
+	for _, key := range src.BigDataNames {
+		data, err := rcstore.BigData(src.ID, key)
+		if err != nil {
+			cleanup()
+			return nil, errors.Wrapf(err, "error reading data item %q of container %q", key, src.ID)
+		}
+		if err := rcstore.SetBigData(container.ID, key, data); err != nil {
+			cleanup()
+			return nil, errors.Wrapf(err, "error copying data item %q of container %q", key, src.ID)
+		}
+		events = append(events, Event{Type: EventSetBigData, Object: EventContainer, ID: container.ID, Key: key})
+	}
+
+	middleDir := s.graphDriverName + "-containers"
+	srcDir := filepath.Join(s.GraphRoot(), middleDir, src.ID, "userdata")
+	if _, err := os.Stat(srcDir); err == nil {
+		dstDir := filepath.Join(s.GraphRoot(), middleDir, container.ID, "userdata")
+		if err := os.MkdirAll(dstDir, 0700); err != nil {
+			cleanup()
+			return nil, err
+		}
+		if err := copy.DirCopy(srcDir, dstDir, copy.Content, true); err != nil {
+			cleanup()
+			return nil, errors.Wrapf(err, "error copying directory of container %q", src.ID)
+		}
+	} else if !os.IsNotExist(err) {
+		cleanup()
+		return nil, err
+	}
+
+	s.notify(events...)
+	if container, err = rcstore.Get(container.ID); err != nil {
+		return nil, err
+	}
+	return container, nil
+}
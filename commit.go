@@ -0,0 +1,140 @@
+package storage
+
+import (
+	"github.com/gepis/strge/pkg/stringutils"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// CommitOptions is used for passing options to a Store's CommitContainer()
+// method.
+type CommitOptions struct {
+	// LayerID is the ID to assign to the new layer.  If it is not set, a
+	// random one is generated.
+	LayerID string
+	// LayerNames are names to assign to the new layer.
+	LayerNames []string
+	// LayerFlags are flags to set on the new layer.
+	LayerFlags map[string]interface{}
+	// CreateImage, if set, causes an image which uses the new layer as its
+	// top layer to be created.
+	CreateImage bool
+	// ImageID is the ID to assign to the new image.  If it is not set, a
+	// random one is generated.
+	ImageID string
+	// ImageNames are names to assign to the new image.
+	ImageNames []string
+	// ImageMetadata is the metadata to record for the new image.
+	ImageMetadata string
+	// ImageOptions are passed to CreateImage() when creating the image.
+	ImageOptions *ImageOptions
+}
+
+func (s *store) CommitContainer(id string, options *CommitOptions) (*Layer, *Image, error) {
+	if options == nil {
+		options = &CommitOptions{}
+	}
+
+	layer, err := func() (*Layer, error) {
+		rlstore, err := s.LayerStore()
+		if err != nil {
+			return nil, err
+		}
+		ristore, err := s.ImageStore()
+		if err != nil {
+			return nil, err
+		}
+		rcstore, err := s.ContainerStore()
+		if err != nil {
+			return nil, err
+		}
+
+		if err := s.startWriting(rlstore); err != nil {
+			return nil, err
+		}
+		defer rlstore.Unlock()
+		if err := s.startReading(ristore); err != nil {
+			return nil, err
+		}
+		defer ristore.Unlock()
+		if err := s.startReading(rcstore); err != nil {
+			return nil, err
+		}
+		defer rcstore.Unlock()
+
+		container, err := rcstore.Get(id)
+		if err != nil {
+			return nil, err
+		}
+		fromLayer, err := rlstore.Get(container.LayerID)
+		if err != nil {
+			return nil, err
+		}
+		parentLayer, err := s.commitParent(rlstore, ristore, container, fromLayer)
+		if err != nil {
+			return nil, err
+		}
+		layer, err := rlstore.(*layerStore).commit(options.LayerID, fromLayer.ID, parentLayer, options.LayerNames, options.LayerFlags)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error committing layer %q of container %q", container.LayerID, container.ID)
+		}
+		return layer, nil
+	}()
+	if err != nil {
+		return nil, nil, err
+	}
+	s.notify(Event{Type: EventCreate, Object: EventLayer, ID: layer.ID, Names: layer.Names})
+
+	if !options.CreateImage {
+		return layer, nil, nil
+	}
+
+	imageOptions := options.ImageOptions
+	if imageOptions == nil {
+		imageOptions = &ImageOptions{}
+	}
+	image, err := s.CreateImage(options.ImageID, options.ImageNames, layer.ID, options.ImageMetadata, imageOptions)
+	if err != nil {
+		if err2 := s.DeleteLayer(layer.ID); err2 != nil {
+			logrus.Debugf("error removing layer %q after failing to create an image using it: %v", layer.ID, err2)
+		}
+		return nil, nil, err
+	}
+	return layer, image, nil
+}
+
+// commitParent returns the layer which a layer committed from a container's
+// layer should use as its parent.  That's usually the parent of the
+// container's layer, but if that's a copy of the container's image's top
+// layer which was created with the container's ID mappings, it's the image's
+// top layer, since the committed layer won't use those mappings.  The caller
+// should be holding the layer and image stores' locks.
+func (s *store) commitParent(rlstore LayerStore, ristore ImageStore, container *Container, fromLayer *Layer) (*Layer, error) {
+	if fromLayer.Parent == "" {
+		return nil, nil
+	}
+	parent := fromLayer.Parent
+	if container.ImageID != "" {
+		if image, err := ristore.Get(container.ImageID); err == nil && stringutils.InSlice(image.MappedTopLayers, parent) {
+			parent = image.TopLayer
+		}
+	}
+	if layer, err := rlstore.Get(parent); err == nil {
+		return layer, nil
+	}
+	lstores, err := s.ROLayerStores()
+	if err != nil {
+		return nil, err
+	}
+	for _, store := range lstores {
+		if err := s.startReading(store); err != nil {
+			return nil, err
+		}
+		layer, err := store.Get(parent)
+		store.Unlock()
+		if err == nil {
+			return layer, nil
+		}
+	}
+	return nil, ErrLayerUnknown
+}
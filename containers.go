@@ -1,6 +1,7 @@
 package storage
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -72,6 +73,7 @@ type containerStore struct {
 	bylayer    map[string]*Container
 	byname     map[string]*Container
 	loadMut    sync.Mutex
+	metadata   metadataBackend
 }
 
 func copyContainer(c *Container) *Container {
@@ -149,41 +151,23 @@ func (r *containerStore) datapath(id, key string) string {
 
 func (r *containerStore) Load() error {
 	needSave := false
-	rpath := r.containerspath()
-	data, err := ioutil.ReadFile(rpath)
-	if err != nil && !os.IsNotExist(err) {
+	changes, reloaded, err := r.metadata.Load()
+	if err != nil {
 		return err
 	}
-
-	containers := []*Container{}
-	layers := make(map[string]*Container)
-	idlist := []string{}
-	ids := make(map[string]*Container)
-	names := make(map[string]*Container)
-
-	if err = json.Unmarshal(data, &containers); len(data) == 0 || err == nil {
-		idlist = make([]string, 0, len(containers))
-		for n, container := range containers {
-			idlist = append(idlist, container.ID)
-			ids[container.ID] = containers[n]
-			layers[container.LayerID] = containers[n]
-			for _, name := range container.Names {
-				if conflict, ok := names[name]; ok {
-					r.removeName(conflict, name)
-					needSave = true
-				}
-
-				names[name] = containers[n]
-			}
+	if reloaded {
+		r.containers = make([]*Container, 0, len(changes))
+		r.idindex = truncindex.NewTruncIndex(nil)
+		r.byid = make(map[string]*Container)
+		r.bylayer = make(map[string]*Container)
+		r.byname = make(map[string]*Container)
+	}
+	for _, change := range changes {
+		if r.applyChange(change) {
+			needSave = true
 		}
 	}
 
-	r.containers = containers
-	r.idindex = truncindex.NewTruncIndex(idlist)
-	r.byid = ids
-	r.bylayer = layers
-	r.byname = names
-
 	if needSave {
 		return r.Save()
 	}
@@ -191,26 +175,69 @@ func (r *containerStore) Load() error {
 	return nil
 }
 
+// applyChange updates our copy of a container, and our indexes, to match a
+// container record which Load() found had been added, changed, or removed.
+// It returns true if it had to take names away from other containers.
+func (r *containerStore) applyChange(change metadataChange) bool {
+	needSave := false
+	container := r.byid[change.ID]
+	if container != nil {
+		for _, name := range container.Names {
+			if r.byname[name] == container {
+				delete(r.byname, name)
+			}
+		}
+		if r.bylayer[container.LayerID] == container {
+			delete(r.bylayer, container.LayerID)
+		}
+	}
+	if change.Record == nil {
+		if container != nil {
+			delete(r.byid, container.ID)
+			r.idindex.Delete(container.ID)
+			for i := range r.containers {
+				if r.containers[i] == container {
+					r.containers = append(r.containers[:i], r.containers[i+1:]...)
+					break
+				}
+			}
+		}
+		return false
+	}
+	if container != nil {
+		*container = *copyContainer(change.Record.(*Container))
+	} else {
+		container = copyContainer(change.Record.(*Container))
+		r.containers = append(r.containers, container)
+		r.byid[container.ID] = container
+		r.idindex.Add(container.ID)
+	}
+	r.bylayer[container.LayerID] = container
+	for _, name := range container.Names {
+		if conflict, ok := r.byname[name]; ok && conflict != container {
+			r.removeName(conflict, name)
+			needSave = true
+		}
+		r.byname[name] = container
+	}
+	return needSave
+}
+
 func (r *containerStore) Save() error {
 	if !r.Locked() {
 		return errors.New("container store is not locked")
 	}
 
-	rpath := r.containerspath()
-	if err := os.MkdirAll(filepath.Dir(rpath), 0700); err != nil {
-		return err
-	}
-
-	jdata, err := json.Marshal(&r.containers)
-	if err != nil {
-		return err
+	records := make([]interface{}, len(r.containers))
+	for i := range r.containers {
+		records[i] = r.containers[i]
 	}
 
 	defer r.Touch()
-	return ioutils.AtomicWriteFile(rpath, jdata, 0600)
+	return r.metadata.Save(records)
 }
 
-func newContainerStore(dir string) (ContainerStore, error) {
+func newContainerStore(ctx context.Context, dir, metadataBackend string) (ContainerStore, error) {
 	if err := os.MkdirAll(dir, 0700); err != nil {
 		return nil, err
 	}
@@ -220,8 +247,15 @@ func newContainerStore(dir string) (ContainerStore, error) {
 		return nil, err
 	}
 
-	lockfile.Lock()
+	if err := lockfile.LockWithContext(ctx); err != nil {
+		return nil, err
+	}
 	defer lockfile.Unlock()
+	metadata, err := newContainerMetadataBackend(metadataBackend, filepath.Join(dir, "containers.json"))
+	if err != nil {
+		return nil, err
+	}
+
 	cstore := containerStore{
 		lockfile:   lockfile,
 		dir:        dir,
@@ -229,6 +263,7 @@ func newContainerStore(dir string) (ContainerStore, error) {
 		byid:       make(map[string]*Container),
 		bylayer:    make(map[string]*Container),
 		byname:     make(map[string]*Container),
+		metadata:   metadata,
 	}
 
 	if err := cstore.Load(); err != nil {
@@ -238,6 +273,16 @@ func newContainerStore(dir string) (ContainerStore, error) {
 	return &cstore, nil
 }
 
+// newContainerMetadataBackend returns a metadataBackend which reads and writes
+// the list of containers in the containers.json file at path.
+func newContainerMetadataBackend(kind, path string) (metadataBackend, error) {
+	return newMetadataBackend(kind, path, func() interface{} {
+		return &Container{}
+	}, func(record interface{}) string {
+		return record.(*Container).ID
+	})
+}
+
 func (r *containerStore) lookup(id string) (*Container, bool) {
 	if container, ok := r.byid[id]; ok {
 		return container, ok
@@ -261,6 +306,7 @@ func (r *containerStore) ClearFlag(id string, flag string) error {
 	}
 
 	delete(container.Flags, flag)
+	r.metadata.Changed(container.ID)
 	return r.Save()
 }
 
@@ -275,6 +321,7 @@ func (r *containerStore) SetFlag(id string, flag string, value interface{}) erro
 	}
 
 	container.Flags[flag] = value
+	r.metadata.Changed(container.ID)
 	return r.Save()
 }
 
@@ -350,6 +397,7 @@ func (r *containerStore) Metadata(id string) (string, error) {
 func (r *containerStore) SetMetadata(id, metadata string) error {
 	if container, ok := r.lookup(id); ok {
 		container.Metadata = metadata
+		r.metadata.Changed(container.ID)
 		return r.Save()
 	}
 
@@ -358,6 +406,7 @@ func (r *containerStore) SetMetadata(id, metadata string) error {
 
 func (r *containerStore) removeName(container *Container, name string) {
 	container.Names = stringSliceWithoutValue(container.Names, name)
+	r.metadata.Changed(container.ID)
 }
 
 func (r *containerStore) SetNames(id string, names []string) error {
@@ -375,6 +424,7 @@ func (r *containerStore) SetNames(id string, names []string) error {
 		}
 
 		container.Names = names
+		r.metadata.Changed(container.ID)
 		return r.Save()
 	}
 
@@ -586,6 +636,7 @@ func (r *containerStore) SetBigData(id, key string, data []byte) error {
 		}
 
 		if save {
+			r.metadata.Changed(c.ID)
 			err = r.Save()
 		}
 	}
@@ -620,6 +671,22 @@ func (r *containerStore) RLock() {
 	r.lockfile.RLock()
 }
 
+func (r *containerStore) TryLock() error {
+	return r.lockfile.TryLock()
+}
+
+func (r *containerStore) TryRLock() error {
+	return r.lockfile.TryRLock()
+}
+
+func (r *containerStore) LockWithContext(ctx context.Context) error {
+	return r.lockfile.LockWithContext(ctx)
+}
+
+func (r *containerStore) RLockWithContext(ctx context.Context) error {
+	return r.lockfile.RLockWithContext(ctx)
+}
+
 func (r *containerStore) Unlock() {
 	r.lockfile.Unlock()
 }
@@ -239,6 +239,12 @@ func (a *Driver) Exists(id string) bool {
 	return true
 }
 
+// ListLayers returns the IDs of the layers which are registered with this
+// driver
+func (a *Driver) ListLayers() ([]string, error) {
+	return loadIds(path.Join(a.rootPath(), "layers"))
+}
+
 // AdditionalImageStores returns additional image stores supported by the driver
 func (a *Driver) AdditionalImageStores() []string {
 	return nil
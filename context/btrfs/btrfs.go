@@ -467,6 +467,12 @@ func (d *Driver) CreateFromTemplate(id, template string, templateIDMappings *idt
 	return d.Create(id, template, opts)
 }
 
+// CopiesTemplates returns true, since CreateFromTemplate() creates a snapshot
+// of the template layer's subvolume, which does not depend on it.
+func (d *Driver) CopiesTemplates() bool {
+	return true
+}
+
 // CreateReadWrite creates a layer that is writable for use as a container
 // file constants.
 func (d *Driver) CreateReadWrite(id, parent string, opts *context.CreateOpts) error {
@@ -1,6 +1,7 @@
 package context
 
 import (
+	gocontext "context"
 	"fmt"
 	"io"
 	"os"
@@ -72,6 +73,9 @@ type ApplyDiffOpts struct {
 	MountLabel        string
 	IgnoreChownErrors bool
 	ForceMask         *os.FileMode
+	// Context, if set, is used to stop applying the diff, and to kill
+	// any process which was started to apply it, if it is done first.
+	Context gocontext.Context
 }
 
 // InitFunc initializes the storage driver.
@@ -221,6 +225,16 @@ type CapabilityDriver interface {
 	Capabilities() Capabilities
 }
 
+// TemplateCopierDriver is the interface for layered file system drivers
+// whose CreateFromTemplate() can make a copy of a layer which does not depend
+// on the template layer continuing to exist.
+type TemplateCopierDriver interface {
+	Driver
+	// CopiesTemplates returns true if layers created using
+	// CreateFromTemplate() are independent of their template layers.
+	CopiesTemplates() bool
+}
+
 // AdditionalLayer reprents a layer that is stored in the additional layer store
 // This API is experimental and can be changed without bumping the major version number.
 type AdditionalLayer interface {
@@ -252,6 +266,15 @@ type AdditionalLayerStoreDriver interface {
 	LookupAdditionalLayerByID(id string) (AdditionalLayer, error)
 }
 
+// LayerListerDriver is the interface for layered file system drivers that
+// can enumerate the layers for which they are holding data.
+type LayerListerDriver interface {
+	Driver
+	// ListLayers returns the IDs of all of the layers which the driver
+	// has data for, whether or not they are still referenced.
+	ListLayers() ([]string, error)
+}
+
 // DiffGetterDriver is the interface for layered file system drivers that
 // provide a specialized function for getting file contents for tar-split.
 type DiffGetterDriver interface {
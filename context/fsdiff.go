@@ -16,6 +16,10 @@ var (
 	// ApplyUncompressedLayer defines the unpack method used by the graph
 	// driver.
 	ApplyUncompressedLayer = chrootarchive.ApplyUncompressedLayer
+
+	// ApplyUncompressedLayerWithContext defines the unpack method used by
+	// the graph driver when ApplyDiffOpts includes a Context.
+	ApplyUncompressedLayerWithContext = chrootarchive.ApplyUncompressedLayerWithContext
 )
 
 // NaiveDiffDriver takes a ProtoDriver and adds the
@@ -179,7 +183,12 @@ func (gdw *NaiveDiffDriver) ApplyDiff(id, parent string, options ApplyDiffOpts)
 	}
 	start := time.Now().UTC()
 	logrus.Debug("Start untar layer")
-	if size, err = ApplyUncompressedLayer(layerFs, options.Diff, tarOptions); err != nil {
+	if options.Context != nil {
+		size, err = ApplyUncompressedLayerWithContext(options.Context, layerFs, options.Diff, tarOptions)
+	} else {
+		size, err = ApplyUncompressedLayer(layerFs, options.Diff, tarOptions)
+	}
+	if err != nil {
 		logrus.Errorf("Error while applying layer: %s", err)
 		return
 	}
@@ -45,6 +45,10 @@ import (
 var (
 	// untar defines the untar method
 	untar = chrootarchive.UntarUncompressed
+
+	// untarWithContext defines the untar method used when ApplyDiffOpts
+	// includes a Context
+	untarWithContext = chrootarchive.UntarUncompressedWithContext
 )
 
 const (
@@ -1542,6 +1546,26 @@ func (d *Driver) Exists(id string) bool {
 	return err == nil
 }
 
+// ListLayers returns the IDs of the layers which have directories in the
+// driver's home, skipping the link and staging directories.
+func (d *Driver) ListLayers() ([]string, error) {
+	entries, err := ioutil.ReadDir(d.home)
+	if err != nil {
+		return nil, err
+	}
+	layers := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if !entry.IsDir() || entry.Name() == linkDir || entry.Name() == filepath.Base(d.getStagingDir()) {
+			continue
+		}
+		if _, err := os.Stat(path.Join(d.home, entry.Name(), "diff")); err != nil {
+			continue
+		}
+		layers = append(layers, entry.Name())
+	}
+	return layers, nil
+}
+
 // isParent returns if the passed in parent is the direct parent of the passed in layer
 func (d *Driver) isParent(id, parent string) bool {
 	lowers, err := d.getLowerDirs(id)
@@ -1690,14 +1714,20 @@ func (d *Driver) ApplyDiff(id, parent string, options context.ApplyDiffOpts) (si
 
 	logrus.Debugf("Applying tar in %s", applyDir)
 	// Overlay doesn't need the parent id to apply the diff
-	if err := untar(options.Diff, applyDir, &archive.TarOptions{
+	tarOptions := &archive.TarOptions{
 		UIDMaps:           idMappings.UIDs(),
 		GIDMaps:           idMappings.GIDs(),
 		IgnoreChownErrors: d.options.ignoreChownErrors,
 		ForceMask:         d.options.forceMask,
 		WhiteoutFormat:    d.getWhiteoutFormat(),
 		InUserNS:          userns.RunningInUserNS(),
-	}); err != nil {
+	}
+	if options.Context != nil {
+		err = untarWithContext(options.Context, options.Diff, applyDir, tarOptions)
+	} else {
+		err = untar(options.Diff, applyDir, tarOptions)
+	}
+	if err != nil {
 		return 0, err
 	}
 
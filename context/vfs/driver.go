@@ -3,6 +3,7 @@ package vfs
 import (
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strconv"
@@ -128,6 +129,12 @@ func (d *Driver) CreateFromTemplate(id, template string, templateIDMappings *idt
 	return d.Create(id, template, opts)
 }
 
+// CopiesTemplates returns true, since CreateFromTemplate() copies the contents
+// of the template layer's directory.
+func (d *Driver) CopiesTemplates() bool {
+	return true
+}
+
 // ApplyDiff applies the new layer into a root
 func (d *Driver) ApplyDiff(id, parent string, options context.ApplyDiffOpts) (size int64, err error) {
 	if d.ignoreChownErrors {
@@ -260,6 +267,25 @@ func (d *Driver) Exists(id string) bool {
 	return err == nil
 }
 
+// ListLayers returns the IDs of the layers which have directories in the
+// driver's primary home.
+func (d *Driver) ListLayers() ([]string, error) {
+	entries, err := ioutil.ReadDir(filepath.Join(d.homes[0], "dir"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	layers := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() {
+			layers = append(layers, entry.Name())
+		}
+	}
+	return layers, nil
+}
+
 // AdditionalImageStores returns additional image stores supported by the driver
 func (d *Driver) AdditionalImageStores() []string {
 	if len(d.homes) > 1 {
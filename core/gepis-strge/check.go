@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/gepis/strge"
+	"github.com/gepis/strge/pkg/mflag"
+)
+
+var (
+	checkQuick             = false
+	repairRemoveContainers = false
+)
+
+func checkOptions() *storage.CheckOptions {
+	options := storage.CheckEverything()
+	if checkQuick {
+		options.LayerMetadata = false
+		options.OrphanedLayers = false
+	}
+	return options
+}
+
+func printFindings(report storage.CheckReport) {
+	for _, finding := range report.Findings {
+		readOnly := ""
+		if finding.ReadOnly {
+			readOnly = " (read-only)"
+		}
+		fmt.Printf("%s: %s%s\n", finding.Type, finding.Message, readOnly)
+	}
+}
+
+func check(flags *mflag.FlagSet, action string, m storage.Store, args []string) int {
+	report, err := m.Check(checkOptions())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%+v\n", err)
+		return 1
+	}
+	if jsonOutput {
+		json.NewEncoder(os.Stdout).Encode(report)
+	} else {
+		printFindings(report)
+	}
+	if len(report.Findings) > 0 {
+		return 1
+	}
+	return 0
+}
+
+func repair(flags *mflag.FlagSet, action string, m storage.Store, args []string) int {
+	report, err := m.Check(checkOptions())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%+v\n", err)
+		return 1
+	}
+	errs := m.Repair(report, &storage.RepairOptions{
+		RemoveContainers: repairRemoveContainers,
+	})
+	if jsonOutput {
+		output := struct {
+			Findings []storage.CheckFinding `json:"findings"`
+			Errors   []string               `json:"errors,omitempty"`
+		}{
+			Findings: report.Findings,
+		}
+		for _, err := range errs {
+			output.Errors = append(output.Errors, err.Error())
+		}
+		json.NewEncoder(os.Stdout).Encode(output)
+	} else {
+		printFindings(report)
+		for _, err := range errs {
+			fmt.Fprintf(os.Stderr, "%s: %+v\n", action, err)
+		}
+	}
+	if len(errs) > 0 {
+		return 1
+	}
+	return 0
+}
+
+func init() {
+	commands = append(commands, command{
+		names:   []string{"check"},
+		usage:   "Check storage for inconsistencies",
+		minArgs: 0,
+		maxArgs: 0,
+		action:  check,
+		addFlags: func(flags *mflag.FlagSet, cmd *command) {
+			flags.BoolVar(&checkQuick, []string{"-quick", "q"}, checkQuick, "Skip driver metadata and orphaned layer checks")
+			flags.BoolVar(&jsonOutput, []string{"-json", "j"}, jsonOutput, "Prefer JSON output")
+		},
+	})
+	commands = append(commands, command{
+		names:   []string{"repair"},
+		usage:   "Check storage for inconsistencies and remove broken items",
+		minArgs: 0,
+		maxArgs: 0,
+		action:  repair,
+		addFlags: func(flags *mflag.FlagSet, cmd *command) {
+			flags.BoolVar(&checkQuick, []string{"-quick", "q"}, checkQuick, "Skip driver metadata and orphaned layer checks")
+			flags.BoolVar(&repairRemoveContainers, []string{"-remove-containers"}, repairRemoveContainers, "Remove containers whose layers are missing or broken")
+			flags.BoolVar(&jsonOutput, []string{"-json", "j"}, jsonOutput, "Prefer JSON output")
+		},
+	})
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/gepis/strge"
+	"github.com/gepis/strge/internal/opt"
+	"github.com/gepis/strge/pkg/mflag"
+	digest "github.com/opencontainers/go-digest"
+)
+
+var (
+	paramLayerOnly = false
+	paramLayerID   = ""
+)
+
+func commitContainer(flags *mflag.FlagSet, action string, m storage.Store, args []string) int {
+	if paramMetadataFile != "" {
+		b, err := ioutil.ReadFile(paramMetadataFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			return 1
+		}
+		paramMetadata = string(b)
+	}
+
+	options := &storage.CommitOptions{
+		LayerID:       paramLayerID,
+		CreateImage:   !paramLayerOnly,
+		ImageID:       paramID,
+		ImageNames:    paramNames,
+		ImageMetadata: paramMetadata,
+		ImageOptions: &storage.ImageOptions{
+			Digest: digest.Digest(paramDigest),
+		},
+	}
+	layer, image, err := m.CommitContainer(args[0], options)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%+v\n", err)
+		return 1
+	}
+
+	if jsonOutput {
+		output := struct {
+			Layer *storage.Layer `json:"layer"`
+			Image *storage.Image `json:"image,omitempty"`
+		}{
+			Layer: layer,
+			Image: image,
+		}
+		json.NewEncoder(os.Stdout).Encode(output)
+		return 0
+	}
+	if image != nil {
+		fmt.Printf("%s\n", image.ID)
+		for _, name := range image.Names {
+			fmt.Printf("\t%s\n", name)
+		}
+	} else {
+		fmt.Printf("%s\n", layer.ID)
+	}
+	return 0
+}
+
+func init() {
+	commands = append(commands, command{
+		names:       []string{"commit"},
+		optionsHelp: "[options [...]] containerNameOrID",
+		usage:       "Create an image from a container's writable layer",
+		minArgs:     1,
+		maxArgs:     1,
+		action:      commitContainer,
+		addFlags: func(flags *mflag.FlagSet, cmd *command) {
+			flags.Var(opt.NewListOptRef(&paramNames, nil), []string{"-name", "n"}, "Image name")
+			flags.StringVar(&paramID, []string{"-id", "i"}, "", "Image ID")
+			flags.StringVar(&paramLayerID, []string{"-layer-id"}, "", "Layer ID")
+			flags.StringVar(&paramDigest, []string{"-digest", "d"}, "", "Image Digest")
+			flags.StringVar(&paramMetadata, []string{"-metadata", "m"}, "", "Metadata")
+			flags.StringVar(&paramMetadataFile, []string{"-metadata-file", "f"}, "", "Metadata File")
+			flags.BoolVar(&paramLayerOnly, []string{"-layer-only"}, false, "Only create a layer, not an image")
+			flags.BoolVar(&jsonOutput, []string{"-json", "j"}, jsonOutput, "Prefer JSON output")
+		},
+	})
+}
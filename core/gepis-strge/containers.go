@@ -6,11 +6,17 @@ import (
 	"os"
 
 	"github.com/gepis/strge"
+	"github.com/gepis/strge/internal/opt"
 	"github.com/gepis/strge/pkg/mflag"
 )
 
 func containers(flags *mflag.FlagSet, action string, m storage.Store, args []string) int {
-	containers, err := m.Containers()
+	filter, err := queryFilter()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+	containers, err := m.QueryContainers(filter)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "%+v\n", err)
 		return 1
@@ -40,6 +46,8 @@ func init() {
 		maxArgs:     0,
 		addFlags: func(flags *mflag.FlagSet, cmd *command) {
 			flags.BoolVar(&jsonOutput, []string{"-json", "j"}, jsonOutput, "Prefer JSON output")
+			flags.Var(opt.NewListOptRef(&paramFilters, nil), []string{"-filter"}, filterHelp)
+			flags.StringVar(&paramSortBy, []string{"-sort"}, paramSortBy, "Sort by \"id\", \"name\", or \"created\" time, oldest first")
 		},
 	})
 }
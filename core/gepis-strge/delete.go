@@ -9,7 +9,10 @@ import (
 	"github.com/gepis/strge/pkg/mflag"
 )
 
-var testDeleteImage = false
+var (
+	testDeleteImage = false
+	ignorePins      = false
+)
 
 func deleteThing(flags *mflag.FlagSet, action string, m storage.Store, args []string) int {
 	if len(args) < 1 {
@@ -17,7 +20,7 @@ func deleteThing(flags *mflag.FlagSet, action string, m storage.Store, args []st
 	}
 	deleted := make(map[string]string)
 	for _, what := range args {
-		err := m.Delete(what)
+		err := m.DeleteWithOptions(what, &storage.DeleteOptions{IgnorePins: ignorePins})
 		if err != nil {
 			deleted[what] = err.Error()
 		} else {
@@ -47,7 +50,7 @@ func deleteLayer(flags *mflag.FlagSet, action string, m storage.Store, args []st
 	}
 	deleted := make(map[string]string)
 	for _, what := range args {
-		err := m.DeleteLayer(what)
+		err := m.DeleteLayerWithOptions(what, &storage.DeleteOptions{IgnorePins: ignorePins})
 		if err != nil {
 			deleted[what] = err.Error()
 		} else {
@@ -82,7 +85,7 @@ func deleteImage(flags *mflag.FlagSet, action string, m storage.Store, args []st
 	}
 	deleted := make(map[string]deletedImage)
 	for _, what := range args {
-		layers, err := m.DeleteImage(what, !testDeleteImage)
+		layers, err := m.DeleteImageWithOptions(what, !testDeleteImage, &storage.DeleteOptions{IgnorePins: ignorePins})
 		errText := ""
 		if err != nil {
 			errText = err.Error()
@@ -151,6 +154,7 @@ func init() {
 		minArgs:     1,
 		action:      deleteThing,
 		addFlags: func(flags *mflag.FlagSet, cmd *command) {
+			flags.BoolVar(&ignorePins, []string{"-ignore-pins"}, ignorePins, "Delete pinned images and layers")
 			flags.BoolVar(&jsonOutput, []string{"-json", "j"}, jsonOutput, "Prefer JSON output")
 		},
 	})
@@ -161,6 +165,7 @@ func init() {
 		minArgs:     1,
 		action:      deleteLayer,
 		addFlags: func(flags *mflag.FlagSet, cmd *command) {
+			flags.BoolVar(&ignorePins, []string{"-ignore-pins"}, ignorePins, "Delete pinned images and layers")
 			flags.BoolVar(&jsonOutput, []string{"-json", "j"}, jsonOutput, "Prefer JSON output")
 		},
 	})
@@ -172,6 +177,7 @@ func init() {
 		action:      deleteImage,
 		addFlags: func(flags *mflag.FlagSet, cmd *command) {
 			flags.BoolVar(&testDeleteImage, []string{"-test", "t"}, jsonOutput, "Only test removal")
+			flags.BoolVar(&ignorePins, []string{"-ignore-pins"}, ignorePins, "Delete pinned images and layers")
 			flags.BoolVar(&jsonOutput, []string{"-json", "j"}, jsonOutput, "Prefer JSON output")
 		},
 	})
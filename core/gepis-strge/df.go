@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/docker/go-units"
+	"github.com/gepis/strge"
+	"github.com/gepis/strge/pkg/mflag"
+)
+
+func df(flags *mflag.FlagSet, action string, m storage.Store, args []string) int {
+	report, err := m.DiskUsage()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%+v\n", err)
+		return 1
+	}
+	if jsonOutput {
+		json.NewEncoder(os.Stdout).Encode(report)
+		return 0
+	}
+	size := func(n int64) string {
+		return units.HumanSize(float64(n))
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "IMAGE\tNAMES\tCONTAINERS\tSIZE\tSHARED\tEXCLUSIVE\n")
+	for _, image := range report.Images {
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\t%s\n", image.ID, strings.Join(image.Names, ","), image.Containers, size(image.Size), size(image.SharedSize), size(image.ExclusiveSize))
+	}
+	w.Flush()
+	if len(report.Containers) > 0 {
+		fmt.Printf("\n")
+		fmt.Fprintf(w, "CONTAINER\tNAMES\tIMAGE\tSIZE\tINODES\n")
+		for _, container := range report.Containers {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\n", container.ID, strings.Join(container.Names, ","), container.ImageID, size(container.Size), container.InodeCount)
+		}
+		w.Flush()
+	}
+	fmt.Printf("\nlayers: %s (%s unreferenced)\n", size(report.LayersSize), size(report.UnreferencedLayersSize))
+	return 0
+}
+
+func init() {
+	commands = append(commands, command{
+		names:   []string{"df", "disk-usage"},
+		usage:   "Show how much space images and containers are using",
+		minArgs: 0,
+		maxArgs: 0,
+		action:  df,
+		addFlags: func(flags *mflag.FlagSet, cmd *command) {
+			flags.BoolVar(&jsonOutput, []string{"-json", "j"}, jsonOutput, "Prefer JSON output")
+		},
+	})
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/gepis/strge"
+	"github.com/gepis/strge/pkg/mflag"
+)
+
+var (
+	eventsFollow = false
+)
+
+func printEvent(event storage.Event) {
+	if jsonOutput {
+		json.NewEncoder(os.Stdout).Encode(event)
+		return
+	}
+	details := ""
+	if len(event.Names) > 0 {
+		details += " names=" + strings.Join(event.Names, ",")
+	}
+	if event.Key != "" {
+		details += " key=" + event.Key
+	}
+	fmt.Printf("%s %s %s %s%s (pid %d)\n", event.Time.Local().Format(time.RFC3339Nano), event.Object, event.Type, event.ID, details, event.PID)
+}
+
+func events(flags *mflag.FlagSet, action string, m storage.Store, args []string) int {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	var ch <-chan storage.Event
+	if eventsFollow {
+		// Subscribe before reading the journal so that nothing gets
+		// lost in between.
+		var err error
+		if ch, err = m.Events(ctx); err != nil {
+			fmt.Fprintf(os.Stderr, "%+v\n", err)
+			return 1
+		}
+	}
+	recorded, err := m.RecordedEvents()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%+v\n", err)
+		return 1
+	}
+	for _, event := range recorded {
+		printEvent(event)
+	}
+	if !eventsFollow {
+		return 0
+	}
+	for event := range ch {
+		printEvent(event)
+	}
+	return 0
+}
+
+func init() {
+	commands = append(commands, command{
+		names:   []string{"events"},
+		usage:   "List changes made to layers, images, and containers",
+		minArgs: 0,
+		maxArgs: 0,
+		action:  events,
+		addFlags: func(flags *mflag.FlagSet, cmd *command) {
+			flags.BoolVar(&eventsFollow, []string{"-follow", "f"}, eventsFollow, "Keep listing changes as they are made")
+			flags.BoolVar(&jsonOutput, []string{"-json", "j"}, jsonOutput, "Prefer JSON output")
+		},
+	})
+}
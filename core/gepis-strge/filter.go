@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gepis/strge"
+	"github.com/gepis/strge/internal/opt"
+	"github.com/gepis/strge/pkg/mflag"
+	digest "github.com/opencontainers/go-digest"
+)
+
+var (
+	paramFilters   = []string{}
+	paramSortBy    = ""
+	paramUnusedFor time.Duration
+)
+
+const filterHelp = "Filter results (name=PATTERN, regexp=REGEXP, before=TIME, after=TIME, dangling=BOOL, has-container=BOOL, flag=KEY[=VALUE], digest=DIGEST)"
+
+// parseFilterTime accepts either an RFC 3339 timestamp, or a duration which
+// is treated as being relative to the current time.
+func parseFilterTime(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%q is neither a timestamp nor a duration", value)
+	}
+	return time.Now().Add(-d), nil
+}
+
+// queryFilter builds a filter from the --filter, --sort, and --unused-for
+// flags.
+func queryFilter() (*storage.QueryFilter, error) {
+	filter := &storage.QueryFilter{
+		SortBy: paramSortBy,
+	}
+	if paramUnusedFor > 0 {
+		filter.UnusedSince = time.Now().Add(-paramUnusedFor)
+	}
+	for _, f := range paramFilters {
+		kv := strings.SplitN(f, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("filter %q is not of the form key=value", f)
+		}
+		key, value := kv[0], kv[1]
+		var err error
+		switch key {
+		case "name":
+			filter.Name = value
+		case "regexp":
+			filter.NameRegexp = value
+		case "before":
+			filter.CreatedBefore, err = parseFilterTime(value)
+		case "after":
+			filter.CreatedAfter, err = parseFilterTime(value)
+		case "dangling", "has-container":
+			var b bool
+			if b, err = strconv.ParseBool(value); err == nil {
+				if key == "dangling" {
+					filter.Dangling = &b
+				} else {
+					filter.HasContainer = &b
+				}
+			}
+		case "flag":
+			if filter.Flags == nil {
+				filter.Flags = make(map[string]string)
+			}
+			flag := strings.SplitN(value, "=", 2)
+			if len(flag) == 2 {
+				filter.Flags[flag[0]] = flag[1]
+			} else {
+				filter.Flags[flag[0]] = ""
+			}
+		case "digest":
+			d := digest.Digest(value)
+			if err = d.Validate(); err == nil {
+				filter.Digest = d
+			}
+		default:
+			err = fmt.Errorf("unknown filter %q", key)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error parsing filter %q: %v", f, err)
+		}
+	}
+	return filter, nil
+}
+
+// addQueryFlags adds the --filter, --sort, and --unused-for flags.
+func addQueryFlags(flags *mflag.FlagSet, what string) {
+	flags.Var(opt.NewListOptRef(&paramFilters, nil), []string{"-filter"}, filterHelp)
+	flags.StringVar(&paramSortBy, []string{"-sort"}, paramSortBy, "Sort by \"id\", \"name\", \"created\", or \"last-used\" time, oldest first")
+	flags.DurationVar(&paramUnusedFor, []string{"-unused-for"}, paramUnusedFor, fmt.Sprintf("Only list %s which have not been used for at least this long", what))
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/docker/go-units"
+	"github.com/gepis/strge"
+	"github.com/gepis/strge/pkg/mflag"
+)
+
+var (
+	gcUntaggedImages = false
+	gcOlderThan      time.Duration
+	gcKeepLast       = 0
+	gcFreeSpace      = ""
+	gcDryRun         = false
+)
+
+func gc(flags *mflag.FlagSet, action string, m storage.Store, args []string) int {
+	policy := storage.GCPolicy{
+		UntaggedImages: gcUntaggedImages,
+		OlderThan:      gcOlderThan,
+		KeepLast:       gcKeepLast,
+		DryRun:         gcDryRun,
+	}
+	if gcFreeSpace != "" {
+		freeSpace, err := units.RAMInBytes(gcFreeSpace)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", gcFreeSpace, err)
+			return 1
+		}
+		policy.FreeSpace = uint64(freeSpace)
+	}
+	report, err := m.GarbageCollect(&policy)
+	if jsonOutput {
+		json.NewEncoder(os.Stdout).Encode(report)
+	} else {
+		verb := "removed"
+		if gcDryRun {
+			verb = "would remove"
+		}
+		for _, image := range report.Images {
+			fmt.Printf("%s image %s\n", verb, image)
+		}
+		for _, layer := range report.Layers {
+			fmt.Printf("%s layer %s\n", verb, layer)
+		}
+		fmt.Printf("reclaimed: %s\n", units.HumanSize(float64(report.Reclaimed)))
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %+v\n", action, err)
+		return 1
+	}
+	return 0
+}
+
+func init() {
+	commands = append(commands, command{
+		names:   []string{"gc"},
+		usage:   "Remove unreferenced layers and, optionally, unused untagged images",
+		minArgs: 0,
+		maxArgs: 0,
+		action:  gc,
+		addFlags: func(flags *mflag.FlagSet, cmd *command) {
+			flags.BoolVar(&gcUntaggedImages, []string{"-images", "i"}, gcUntaggedImages, "Also remove unused images which have no names")
+			flags.DurationVar(&gcOlderThan, []string{"-older-than"}, gcOlderThan, "Only remove items created at least this long ago")
+			flags.IntVar(&gcKeepLast, []string{"-keep-last"}, gcKeepLast, "Keep this many of the most recently created removable items")
+			flags.StringVar(&gcFreeSpace, []string{"-free-space"}, gcFreeSpace, "Stop once this much space is available (e.g. 10GB)")
+			flags.BoolVar(&gcDryRun, []string{"-dry-run", "n"}, gcDryRun, "Only report what would be removed")
+			flags.BoolVar(&jsonOutput, []string{"-json", "j"}, jsonOutput, "Prefer JSON output")
+		},
+	})
+}
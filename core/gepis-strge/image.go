@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"time"
 
 	"github.com/gepis/strge"
 	"github.com/gepis/strge/pkg/mflag"
@@ -49,6 +50,12 @@ func image(flags *mflag.FlagSet, action string, m storage.Store, args []string)
 			if image.ReadOnly {
 				fmt.Printf("Read Only: true\n")
 			}
+			if pinned, _ := image.Flags[storage.PinnedFlag].(bool); pinned {
+				fmt.Printf("Pinned: true\n")
+			}
+			if !image.LastUsed.IsZero() {
+				fmt.Printf("Last Used: %s\n", image.LastUsed.Local().Format(time.RFC3339))
+			}
 		}
 	}
 	if len(matched) != len(args) {
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/gepis/strge"
+	"github.com/gepis/strge/pkg/mflag"
+)
+
+func exportImage(flags *mflag.FlagSet, action string, m storage.Store, args []string) int {
+	if err := m.ExportImage(args[0], args[1]); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %+v\n", action, err)
+		return 1
+	}
+	return 0
+}
+
+func importImage(flags *mflag.FlagSet, action string, m storage.Store, args []string) int {
+	images, err := m.ImportImage(args[0])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %+v\n", action, err)
+		return 1
+	}
+	if jsonOutput {
+		json.NewEncoder(os.Stdout).Encode(images)
+	} else {
+		for _, image := range images {
+			fmt.Printf("%s\n", image.ID)
+			for _, name := range image.Names {
+				fmt.Printf("\tname: %s\n", name)
+			}
+		}
+	}
+	return 0
+}
+
+func init() {
+	commands = append(commands, command{
+		names:       []string{"export-image", "exportimage"},
+		optionsHelp: "[options [...]] imageNameOrID directory",
+		usage:       "Write an image to a directory as an OCI image layout",
+		minArgs:     2,
+		maxArgs:     2,
+		action:      exportImage,
+	})
+	commands = append(commands, command{
+		names:       []string{"import-image", "importimage"},
+		optionsHelp: "[options [...]] directory",
+		usage:       "Read images from an OCI image layout directory",
+		minArgs:     1,
+		maxArgs:     1,
+		action:      importImage,
+		addFlags: func(flags *mflag.FlagSet, cmd *command) {
+			flags.BoolVar(&jsonOutput, []string{"-json", "j"}, jsonOutput, "Prefer JSON output")
+		},
+	})
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"time"
 
 	"github.com/gepis/strge"
 	"github.com/gepis/strge/pkg/mflag"
@@ -15,7 +16,12 @@ var (
 )
 
 func images(flags *mflag.FlagSet, action string, m storage.Store, args []string) int {
-	images, err := m.Images()
+	filter, err := queryFilter()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+	images, err := m.QueryImages(filter)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "%+v\n", err)
 		return 1
@@ -37,6 +43,9 @@ func images(flags *mflag.FlagSet, action string, m storage.Store, args []string)
 			for _, name := range image.BigDataNames {
 				fmt.Printf("\tdata: %s\n", name)
 			}
+			if !image.LastUsed.IsZero() {
+				fmt.Printf("\tlast used: %s\n", image.LastUsed.Local().Format(time.RFC3339))
+			}
 		}
 	}
 	return 0
@@ -91,6 +100,7 @@ func init() {
 		addFlags: func(flags *mflag.FlagSet, cmd *command) {
 			flags.BoolVar(&jsonOutput, []string{"-json", "j"}, jsonOutput, "Prefer JSON output")
 			flags.BoolVar(&imagesQuiet, []string{"-quiet", "q"}, imagesQuiet, "Only print IDs")
+			addQueryFlags(flags, "images")
 		},
 	})
 	commands = append(commands, command{
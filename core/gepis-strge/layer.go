@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"time"
 
 	"github.com/gepis/strge"
 	"github.com/gepis/strge/pkg/mflag"
@@ -111,6 +112,12 @@ func layer(flags *mflag.FlagSet, action string, m storage.Store, args []string)
 			if layer.ReadOnly {
 				fmt.Printf("Read Only: true\n")
 			}
+			if pinned, _ := layer.Flags[storage.PinnedFlag].(bool); pinned {
+				fmt.Printf("Pinned: true\n")
+			}
+			if !layer.LastUsed.IsZero() {
+				fmt.Printf("Last Used: %s\n", layer.LastUsed.Local().Format(time.RFC3339))
+			}
 		}
 	}
 	if len(matched) != len(args) {
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"time"
 
 	"github.com/gepis/strge"
 	"github.com/gepis/strge/pkg/mflag"
@@ -12,7 +13,12 @@ import (
 var listLayersTree = false
 
 func layers(flags *mflag.FlagSet, action string, m storage.Store, args []string) int {
-	layers, err := m.Layers()
+	filter, err := queryFilter()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+	layers, err := m.QueryLayers(filter)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "%+v\n", err)
 		return 1
@@ -78,6 +84,9 @@ func layers(flags *mflag.FlagSet, action string, m storage.Store, args []string)
 			for _, name := range layer.Names {
 				fmt.Printf("\tname: %s\n", name)
 			}
+			if !layer.LastUsed.IsZero() {
+				fmt.Printf("\tlast used: %s\n", layer.LastUsed.Local().Format(time.RFC3339))
+			}
 			if imageList, ok := imageMap[layer.ID]; ok && imageList != nil {
 				for _, image := range *imageList {
 					fmt.Printf("\timage: %s\n", image.ID)
@@ -110,6 +119,7 @@ func init() {
 		addFlags: func(flags *mflag.FlagSet, cmd *command) {
 			flags.BoolVar(&listLayersTree, []string{"-tree", "t"}, listLayersTree, "Use a tree")
 			flags.BoolVar(&jsonOutput, []string{"-json", "j"}, jsonOutput, "Prefer JSON output")
+			addQueryFlags(flags, "layers")
 		},
 	})
 }
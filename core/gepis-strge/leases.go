@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/gepis/strge"
+	"github.com/gepis/strge/pkg/mflag"
+)
+
+func leases(flags *mflag.FlagSet, action string, m storage.Store, args []string) int {
+	leases, err := m.Leases()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%+v\n", err)
+		return 1
+	}
+	if jsonOutput {
+		json.NewEncoder(os.Stdout).Encode(leases)
+		return 0
+	}
+	for _, lease := range leases {
+		fmt.Printf("%s\n", lease.ID)
+		fmt.Printf("\texpires: %s\n", lease.Expires.Local().Format(time.RFC3339))
+		for _, layer := range lease.Layers {
+			fmt.Printf("\tlayer: %s\n", layer)
+		}
+		for _, image := range lease.Images {
+			fmt.Printf("\timage: %s\n", image)
+		}
+	}
+	return 0
+}
+
+func releaseLease(flags *mflag.FlagSet, action string, m storage.Store, args []string) int {
+	for _, arg := range args {
+		if err := m.ReleaseLease(arg); err != nil {
+			fmt.Fprintf(os.Stderr, "%+v\n", err)
+			return 1
+		}
+	}
+	return 0
+}
+
+func init() {
+	commands = append(commands, command{
+		names:   []string{"leases"},
+		usage:   "List leases which protect layers and images from removal",
+		minArgs: 0,
+		maxArgs: 0,
+		action:  leases,
+		addFlags: func(flags *mflag.FlagSet, cmd *command) {
+			flags.BoolVar(&jsonOutput, []string{"-json", "j"}, jsonOutput, "Prefer JSON output")
+		},
+	}, command{
+		names:       []string{"release-lease", "releaselease"},
+		optionsHelp: "leaseID [...]",
+		usage:       "Release leases",
+		minArgs:     1,
+		action:      releaseLease,
+	})
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/gepis/strge"
+	"github.com/gepis/strge/pkg/mflag"
+	"github.com/gepis/strge/types"
+)
+
+var locksHeldOnly = false
+
+func describeLockHolder(verb string, holder storage.LockHolder) string {
+	description := fmt.Sprintf("%s by %d", verb, holder.PID)
+	if holder.Process != "" {
+		description += fmt.Sprintf(" (%s)", holder.Process)
+	}
+	if holder.Type != "" {
+		description += fmt.Sprintf(" for %s", holder.Type)
+	}
+	if !holder.Since.IsZero() {
+		description += fmt.Sprintf(" since %s", holder.Since.Local().Format(time.RFC3339))
+	}
+	return description
+}
+
+func locks(flags *mflag.FlagSet, action string, options types.StoreOptions, args []string) int {
+	statuses, err := storage.LockStatuses(options)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%+v\n", err)
+		return 1
+	}
+	if locksHeldOnly {
+		held := []storage.LockStatus{}
+		for _, status := range statuses {
+			if len(status.Holders) > 0 || len(status.Waiters) > 0 {
+				held = append(held, status)
+			}
+		}
+		statuses = held
+	}
+	if jsonOutput {
+		json.NewEncoder(os.Stdout).Encode(statuses)
+		return 0
+	}
+	for _, status := range statuses {
+		fmt.Printf("%s\n", status.Path)
+		if len(status.Holders) == 0 && len(status.Waiters) == 0 {
+			fmt.Printf("\tnot held\n")
+		}
+		for _, holder := range status.Holders {
+			fmt.Printf("\t%s\n", describeLockHolder("held", holder))
+		}
+		for _, waiter := range status.Waiters {
+			fmt.Printf("\t%s\n", describeLockHolder("awaited", waiter))
+		}
+	}
+	return 0
+}
+
+func init() {
+	commands = append(commands, command{
+		names:         []string{"locks"},
+		usage:         "List the processes which hold, or are waiting for, the store's locks",
+		minArgs:       0,
+		maxArgs:       0,
+		optionsAction: locks,
+		addFlags: func(flags *mflag.FlagSet, cmd *command) {
+			flags.BoolVar(&locksHeldOnly, []string{"-held", "H"}, locksHeldOnly, "Only list locks which are held or awaited")
+			flags.BoolVar(&jsonOutput, []string{"-json", "j"}, jsonOutput, "Prefer JSON output")
+		},
+	})
+}
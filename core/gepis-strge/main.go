@@ -20,6 +20,9 @@ type command struct {
 	usage       string
 	addFlags    func(*mflag.FlagSet, *command)
 	action      func(*mflag.FlagSet, string, storage.Store, []string) int
+	// optionsAction, if set, is called instead of action, without opening
+	// the store, for commands which need to work even when that blocks.
+	optionsAction func(*mflag.FlagSet, string, types.StoreOptions, []string) int
 }
 
 var (
@@ -42,6 +45,8 @@ func main() {
 		flags.StringVar(&options.GraphRoot, []string{"-graph", "g"}, options.GraphRoot, "Root of the storage tree")
 		flags.StringVar(&options.GraphDriverName, []string{"-storage-driver", "s"}, options.GraphDriverName, "Storage driver to use ($STORAGE_DRIVER)")
 		flags.Var(opt.NewListOptRef(&options.GraphDriverOptions, nil), []string{"-storage-opt"}, "Set storage driver options ($STORAGE_OPT)")
+		flags.DurationVar(&options.LockTimeout, []string{"-lock-timeout"}, options.LockTimeout, "Give up on waiting for locks after this long")
+		flags.StringVar(&options.MetadataBackend, []string{"-metadata-backend"}, options.MetadataBackend, "How to save layer, image, and container metadata (json or journal)")
 		flags.BoolVar(&debug, []string{"-debug", "D"}, debug, "Print debugging information")
 		return flags
 	}
@@ -70,7 +75,15 @@ func main() {
 	}
 
 	if options.GraphRoot == "" && options.RunRoot == "" && options.GraphDriverName == "" && len(options.GraphDriverOptions) == 0 {
+		lockTimeout := options.LockTimeout
+		metadataBackend := options.MetadataBackend
 		options, _ = types.DefaultStoreOptionsAutoDetectUID()
+		if lockTimeout != 0 {
+			options.LockTimeout = lockTimeout
+		}
+		if metadataBackend != "" {
+			options.MetadataBackend = metadataBackend
+		}
 	}
 
 	args := flags.Args()
@@ -126,6 +139,10 @@ func main() {
 					logrus.SetLevel(logrus.ErrorLevel)
 				}
 
+				if command.optionsAction != nil {
+					os.Exit(command.optionsAction(flags, cmd, options, args))
+				}
+
 				store, err := storage.GetStore(options)
 				if err != nil {
 					fmt.Printf("error initializing: %+v\n", err)
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/gepis/strge"
+	"github.com/gepis/strge/pkg/mflag"
+)
+
+var migrateMetadataVersion = storage.MetadataVersion
+
+func migrateMetadata(flags *mflag.FlagSet, action string, m storage.Store, args []string) int {
+	if err := m.MigrateMetadata(migrateMetadataVersion); err != nil {
+		fmt.Fprintf(os.Stderr, "%+v\n", err)
+		return 1
+	}
+	return 0
+}
+
+func init() {
+	commands = append(commands, command{
+		names:       []string{"migrate-metadata", "migratemetadata"},
+		optionsHelp: "[options [...]]",
+		usage:       "Convert the store's metadata files to a different version of their format (\"--to 1\" for tools which predate versioning)",
+		minArgs:     0,
+		maxArgs:     0,
+		action:      migrateMetadata,
+		addFlags: func(flags *mflag.FlagSet, cmd *command) {
+			flags.IntVar(&migrateMetadataVersion, []string{"-to", "t"}, migrateMetadataVersion, "Version of the metadata format to convert to")
+		},
+	})
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/gepis/strge"
+	"github.com/gepis/strge/pkg/mflag"
+)
+
+func pin(flags *mflag.FlagSet, action string, m storage.Store, args []string) int {
+	for _, arg := range args {
+		if err := m.Pin(arg); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %+v\n", arg, err)
+			return 1
+		}
+	}
+	return 0
+}
+
+func unpin(flags *mflag.FlagSet, action string, m storage.Store, args []string) int {
+	for _, arg := range args {
+		if err := m.Unpin(arg); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %+v\n", arg, err)
+			return 1
+		}
+	}
+	return 0
+}
+
+func init() {
+	commands = append(commands, command{
+		names:       []string{"pin"},
+		optionsHelp: "ImageOrLayerNameOrID [...]",
+		usage:       "Protect images or layers from being deleted",
+		minArgs:     1,
+		action:      pin,
+	}, command{
+		names:       []string{"unpin"},
+		optionsHelp: "ImageOrLayerNameOrID [...]",
+		usage:       "Allow pinned images or layers to be deleted",
+		minArgs:     1,
+		action:      unpin,
+	})
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/gepis/strge"
+	"github.com/gepis/strge/internal/opt"
+	"github.com/gepis/strge/pkg/mflag"
+)
+
+func rebaseLayer(flags *mflag.FlagSet, action string, m storage.Store, args []string) int {
+	layer, conflicts, err := m.RebaseLayer(args[0], args[1], paramNames)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%+v\n", err)
+		return 1
+	}
+	if jsonOutput {
+		output := struct {
+			Layer     *storage.Layer `json:"layer"`
+			Conflicts []string       `json:"conflicts,omitempty"`
+		}{
+			Layer:     layer,
+			Conflicts: conflicts,
+		}
+		json.NewEncoder(os.Stdout).Encode(output)
+		return 0
+	}
+	fmt.Printf("%s\n", layer.ID)
+	for _, name := range layer.Names {
+		fmt.Printf("\t%s\n", name)
+	}
+	for _, conflict := range conflicts {
+		fmt.Fprintf(os.Stderr, "conflict: %s\n", conflict)
+	}
+	return 0
+}
+
+func init() {
+	commands = append(commands, command{
+		names:       []string{"rebase-layer", "rebaselayer"},
+		optionsHelp: "[options [...]] layerNameOrID newParentNameOrID",
+		usage:       "Create a copy of a layer with a different parent",
+		minArgs:     2,
+		maxArgs:     2,
+		action:      rebaseLayer,
+		addFlags: func(flags *mflag.FlagSet, cmd *command) {
+			flags.Var(opt.NewListOptRef(&paramNames, nil), []string{"-name", "n"}, "Layer name")
+			flags.BoolVar(&jsonOutput, []string{"-json", "j"}, jsonOutput, "Prefer JSON output")
+		},
+	})
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/gepis/strge"
+	"github.com/gepis/strge/pkg/mflag"
+)
+
+func resetContainer(flags *mflag.FlagSet, action string, m storage.Store, args []string) int {
+	for _, arg := range args {
+		if err := m.ResetContainer(arg, force); err != nil {
+			fmt.Fprintf(os.Stderr, "%+v\n", err)
+			return 1
+		}
+	}
+	return 0
+}
+
+func init() {
+	commands = append(commands, command{
+		names:       []string{"reset-container", "resetcontainer"},
+		optionsHelp: "[options [...]] containerNameOrID [...]",
+		usage:       "Discard the changes made to containers' layers",
+		minArgs:     1,
+		action:      resetContainer,
+		addFlags: func(flags *mflag.FlagSet, cmd *command) {
+			flags.BoolVar(&force, []string{"-force", "f"}, false, "Unmount the container's layer if it is mounted")
+		},
+	})
+}
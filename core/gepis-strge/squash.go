@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/gepis/strge"
+	"github.com/gepis/strge/internal/opt"
+	"github.com/gepis/strge/pkg/mflag"
+)
+
+var (
+	paramSquashImage     = ""
+	paramSquashImageData []string
+)
+
+func squashLayers(flags *mflag.FlagSet, action string, m storage.Store, args []string) int {
+	base := ""
+	if len(args) > 1 {
+		base = args[1]
+	}
+	options := &storage.SquashOptions{
+		LayerID:        paramID,
+		LayerNames:     paramNames,
+		Image:          paramSquashImage,
+		DigestManifest: wrongManifestDigest,
+	}
+	for _, item := range paramSquashImageData {
+		kv := strings.SplitN(item, "=", 2)
+		if len(kv) != 2 {
+			fmt.Fprintf(os.Stderr, "image data %q is not of the form key=file\n", item)
+			return 1
+		}
+		b, err := ioutil.ReadFile(kv[1])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			return 1
+		}
+		if options.ImageBigData == nil {
+			options.ImageBigData = make(map[string][]byte)
+		}
+		options.ImageBigData[kv[0]] = b
+	}
+	layer, err := m.SquashLayers(args[0], base, options)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%+v\n", err)
+		return 1
+	}
+	if jsonOutput {
+		json.NewEncoder(os.Stdout).Encode(layer)
+	} else {
+		fmt.Printf("%s\n", layer.ID)
+		for _, name := range layer.Names {
+			fmt.Printf("\t%s\n", name)
+		}
+	}
+	return 0
+}
+
+func init() {
+	commands = append(commands, command{
+		names:       []string{"squash"},
+		optionsHelp: "[options [...]] topLayerNameOrID [baseLayerNameOrID]",
+		usage:       "Create a layer with the merged contents of a chain of layers",
+		minArgs:     1,
+		maxArgs:     2,
+		action:      squashLayers,
+		addFlags: func(flags *mflag.FlagSet, cmd *command) {
+			flags.Var(opt.NewListOptRef(&paramNames, nil), []string{"-name", "n"}, "Layer name")
+			flags.StringVar(&paramID, []string{"-id", "i"}, "", "Layer ID")
+			flags.StringVar(&paramSquashImage, []string{"-image"}, "", "Image to use the new layer as its top layer")
+			flags.Var(opt.NewListOptRef(&paramSquashImageData, nil), []string{"-image-data"}, "Replacement image data item, as key=file")
+			flags.BoolVar(&jsonOutput, []string{"-json", "j"}, jsonOutput, "Prefer JSON output")
+		},
+	})
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/gepis/strge"
+	"github.com/gepis/strge/pkg/mflag"
+)
+
+func printVerification(verification *storage.LayerVerification) {
+	status := "ok"
+	if !verification.Verified() {
+		status = "FAILED"
+	}
+	fmt.Printf("%s: %s\n", verification.ID, status)
+	if !verification.Verified() {
+		fmt.Printf("\texpected: %s\n", verification.Expected)
+		fmt.Printf("\tactual: %s\n", verification.Actual)
+		if !verification.TarSplit {
+			fmt.Printf("\tno tar-split data, diff was generated by the driver\n")
+		}
+	}
+	for _, file := range verification.Files {
+		fmt.Printf("\t%s: %s\n", file.Problem, file.Path)
+	}
+}
+
+func verifyLayers(m storage.Store, ids []string) int {
+	verifications := []*storage.LayerVerification{}
+	failed := false
+	for _, id := range ids {
+		verification, err := m.VerifyLayer(id)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %+v\n", id, err)
+			return 1
+		}
+		if !verification.Verified() {
+			failed = true
+		}
+		verifications = append(verifications, verification)
+	}
+	if jsonOutput {
+		json.NewEncoder(os.Stdout).Encode(verifications)
+	} else {
+		for _, verification := range verifications {
+			printVerification(verification)
+		}
+	}
+	if failed {
+		return 1
+	}
+	return 0
+}
+
+func verifyLayer(flags *mflag.FlagSet, action string, m storage.Store, args []string) int {
+	return verifyLayers(m, args)
+}
+
+func verifyImage(flags *mflag.FlagSet, action string, m storage.Store, args []string) int {
+	ids := []string{}
+	for _, arg := range args {
+		image, err := m.Image(arg)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %+v\n", arg, err)
+			return 1
+		}
+		layerID := image.TopLayer
+		for layerID != "" {
+			layer, err := m.Layer(layerID)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s: %+v\n", layerID, err)
+				return 1
+			}
+			ids = append(ids, layer.ID)
+			layerID = layer.Parent
+		}
+	}
+	return verifyLayers(m, ids)
+}
+
+func init() {
+	commands = append(commands, command{
+		names:       []string{"verify-layer", "verifylayer"},
+		optionsHelp: "[options [...]] layerNameOrID [...]",
+		usage:       "Verify the contents of layers against their recorded digests",
+		minArgs:     1,
+		action:      verifyLayer,
+		addFlags: func(flags *mflag.FlagSet, cmd *command) {
+			flags.BoolVar(&jsonOutput, []string{"-json", "j"}, jsonOutput, "Prefer JSON output")
+		},
+	})
+	commands = append(commands, command{
+		names:       []string{"verify-image", "verifyimage"},
+		optionsHelp: "[options [...]] imageNameOrID [...]",
+		usage:       "Verify the contents of images' layers against their recorded digests",
+		minArgs:     1,
+		action:      verifyImage,
+		addFlags: func(flags *mflag.FlagSet, cmd *command) {
+			flags.BoolVar(&jsonOutput, []string{"-json", "j"}, jsonOutput, "Prefer JSON output")
+		},
+	})
+}
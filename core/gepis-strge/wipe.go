@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"os"
@@ -10,7 +11,7 @@ import (
 )
 
 func wipe(flags *mflag.FlagSet, action string, m storage.Store, args []string) int {
-	err := m.Wipe()
+	err := m.WipeWithOptions(context.Background(), &storage.DeleteOptions{IgnorePins: ignorePins})
 	if jsonOutput {
 		if err == nil {
 			json.NewEncoder(os.Stdout).Encode(string(""))
@@ -35,6 +36,7 @@ func init() {
 		minArgs: 0,
 		action:  wipe,
 		addFlags: func(flags *mflag.FlagSet, cmd *command) {
+			flags.BoolVar(&ignorePins, []string{"-ignore-pins"}, ignorePins, "Remove pinned images and layers")
 			flags.BoolVar(&jsonOutput, []string{"-json", "j"}, jsonOutput, "Prefer JSON output")
 		},
 	})
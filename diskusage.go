@@ -0,0 +1,249 @@
+package storage
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ImageDiskUsage describes how much space an image's layers and big data
+// items take up.
+type ImageDiskUsage struct {
+	ID      string    `json:"id"`
+	Names   []string  `json:"names,omitempty"`
+	Created time.Time `json:"created"`
+	// ReadOnly is set if the image is in one of the additional image stores.
+	ReadOnly bool `json:"read-only,omitempty"`
+	// Size is the total size of the image's layers and big data items.
+	Size int64 `json:"size"`
+	// SharedSize is the size of the image's layers which are also used by
+	// other images, or by containers which are based on other images.
+	SharedSize int64 `json:"shared-size"`
+	// ExclusiveSize is the size of everything else, which deleting the
+	// image would reclaim.
+	ExclusiveSize int64 `json:"exclusive-size"`
+	// Containers is the number of containers which are based on the image.
+	Containers int `json:"containers"`
+}
+
+// ContainerDiskUsage describes how much space a container's writable layer
+// takes up.
+type ContainerDiskUsage struct {
+	ID         string   `json:"id"`
+	Names      []string `json:"names,omitempty"`
+	ImageID    string   `json:"image,omitempty"`
+	LayerID    string   `json:"layer"`
+	Size       int64    `json:"size"`
+	InodeCount int64    `json:"inodes"`
+}
+
+// DiskUsageReport is what a Store's DiskUsage() method returns.
+type DiskUsageReport struct {
+	Images     []ImageDiskUsage     `json:"images,omitempty"`
+	Containers []ContainerDiskUsage `json:"containers,omitempty"`
+	// LayersSize is the size of all of the layers in the store, with each
+	// layer counted once, no matter how many images use it.
+	LayersSize int64 `json:"layers-size"`
+	// UnreferencedLayersSize is the size of the layers which are not used
+	// by any image or container.
+	UnreferencedLayersSize int64 `json:"unreferenced-layers-size"`
+}
+
+func (s *store) DiskUsage() (*DiskUsageReport, error) {
+	report := &DiskUsageReport{}
+
+	rlstore, err := s.LayerStore()
+	if err != nil {
+		return nil, errors.Wrapf(err, "error loading primary layer store data")
+	}
+	rlstores, err := s.ROLayerStores()
+	if err != nil {
+		return nil, errors.Wrapf(err, "error loading additional layer stores")
+	}
+	ristore, err := s.ImageStore()
+	if err != nil {
+		return nil, errors.Wrapf(err, "error loading primary image store data")
+	}
+	ristores, err := s.ROImageStores()
+	if err != nil {
+		return nil, errors.Wrapf(err, "error loading additional image stores")
+	}
+	rcstore, err := s.ContainerStore()
+	if err != nil {
+		return nil, err
+	}
+
+	lstores := append([]ROLayerStore{rlstore}, rlstores...)
+	for _, store := range lstores {
+		if err := s.startReading(store); err != nil {
+			return nil, err
+		}
+		defer store.Unlock()
+	}
+	istores := append([]ROImageStore{ristore}, ristores...)
+	for _, store := range istores {
+		if err := s.startReading(store); err != nil {
+			return nil, err
+		}
+		defer store.Unlock()
+	}
+	if err := s.startReading(rcstore); err != nil {
+		return nil, err
+	}
+	defer rcstore.Unlock()
+
+	// Find every layer, preferring the copy in the primary layer store.
+	layersByID := make(map[string]*Layer)
+	layerStores := make(map[string]ROLayerStore)
+	for _, store := range lstores {
+		layers, err := store.Layers()
+		if err != nil {
+			return nil, err
+		}
+		for i := range layers {
+			if _, ok := layersByID[layers[i].ID]; ok {
+				continue
+			}
+			layersByID[layers[i].ID] = &layers[i]
+			layerStores[layers[i].ID] = store
+		}
+	}
+	layerSizes := make(map[string]int64)
+	for id, layer := range layersByID {
+		// The UncompressedSize is only valid if there's a digest to go with it.
+		n := layer.UncompressedSize
+		if layer.UncompressedDigest == "" {
+			if n, err = layerStores[id].DiffSize("", id); err != nil {
+				return nil, errors.Wrapf(err, "size/digest of layer with ID %q could not be calculated", id)
+			}
+		}
+		layerSizes[id] = n
+		report.LayersSize += n
+	}
+
+	// chain returns the IDs of the layers that the top layers are built
+	// from, including the top layers themselves.
+	chain := func(topLayers ...string) map[string]bool {
+		ids := make(map[string]bool)
+		for _, id := range topLayers {
+			for id != "" && !ids[id] {
+				ids[id] = true
+				layer, ok := layersByID[id]
+				if !ok {
+					break
+				}
+				id = layer.Parent
+			}
+		}
+		return ids
+	}
+
+	// Note who uses each layer.  Containers are counted as users of their
+	// images' layers on behalf of the images that they're based on.
+	var images []Image
+	readOnly := make(map[string]bool)
+	imageStores := make(map[string]ROImageStore)
+	for _, store := range istores {
+		storeImages, err := store.Images()
+		if err != nil {
+			return nil, err
+		}
+		for _, image := range storeImages {
+			if _, ok := imageStores[image.ID]; ok {
+				continue
+			}
+			imageStores[image.ID] = store
+			readOnly[image.ID] = store != ristore
+			images = append(images, image)
+		}
+	}
+	users := make(map[string]map[string]bool)
+	addUser := func(layers map[string]bool, user string) {
+		for id := range layers {
+			if users[id] == nil {
+				users[id] = make(map[string]bool)
+			}
+			users[id][user] = true
+		}
+	}
+	imageLayers := make(map[string]map[string]bool)
+	for _, image := range images {
+		imageLayers[image.ID] = chain(append([]string{image.TopLayer}, image.MappedTopLayers...)...)
+		addUser(imageLayers[image.ID], image.ID)
+	}
+	containers, err := rcstore.Containers()
+	if err != nil {
+		return nil, err
+	}
+	containerCounts := make(map[string]int)
+	for _, container := range containers {
+		user := container.ID
+		if _, ok := imageStores[container.ImageID]; ok {
+			user = container.ImageID
+			containerCounts[container.ImageID]++
+		}
+		addUser(chain(container.LayerID), user)
+	}
+	for id, size := range layerSizes {
+		if len(users[id]) == 0 {
+			report.UnreferencedLayersSize += size
+		}
+	}
+
+	for _, image := range images {
+		usage := ImageDiskUsage{
+			ID:         image.ID,
+			Names:      copyStringSlice(image.Names),
+			Created:    image.Created,
+			ReadOnly:   readOnly[image.ID],
+			Containers: containerCounts[image.ID],
+		}
+		for id := range imageLayers[image.ID] {
+			if _, ok := layersByID[id]; !ok {
+				continue
+			}
+			usage.Size += layerSizes[id]
+			if len(users[id]) > 1 {
+				usage.SharedSize += layerSizes[id]
+			} else {
+				usage.ExclusiveSize += layerSizes[id]
+			}
+		}
+		store := imageStores[image.ID]
+		names, err := store.BigDataNames(image.ID)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error reading list of big data items for image %q", image.ID)
+		}
+		for _, name := range names {
+			n, err := store.BigDataSize(image.ID, name)
+			if err != nil {
+				return nil, errors.Wrapf(err, "error reading size of big data item %q for image %q", name, image.ID)
+			}
+			usage.Size += n
+			usage.ExclusiveSize += n
+		}
+		report.Images = append(report.Images, usage)
+	}
+
+	driver, err := s.GraphDriver()
+	if err != nil {
+		return nil, err
+	}
+	for _, container := range containers {
+		usage := ContainerDiskUsage{
+			ID:      container.ID,
+			Names:   copyStringSlice(container.Names),
+			ImageID: container.ImageID,
+			LayerID: container.LayerID,
+		}
+		du, err := driver.ReadWriteDiskUsage(container.LayerID)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error determining disk usage of layer %q for container %q", container.LayerID, container.ID)
+		}
+		usage.Size = du.Size
+		usage.InodeCount = du.InodeCount
+		report.Containers = append(report.Containers, usage)
+	}
+
+	return report, nil
+}
@@ -17,6 +17,10 @@ var (
 	ErrDuplicateLayerNames = types.ErrDuplicateLayerNames
 	// ErrDuplicateName indicates that a name which is to be assigned to a new item is already being used.
 	ErrDuplicateName = types.ErrDuplicateName
+	// ErrImageLeased is returned when the caller attempts to delete an image that is attached to a lease.
+	ErrImageLeased = types.ErrImageLeased
+	// ErrImagePinned is returned when the caller attempts to delete an image that is pinned.
+	ErrImagePinned = types.ErrImagePinned
 	// ErrImageUnknown indicates that there was no image with the specified name or ID.
 	ErrImageUnknown = types.ErrImageUnknown
 	// ErrImageUsedByContainer is returned when the caller attempts to delete an image that is a container's image.
@@ -25,18 +29,34 @@ var (
 	ErrIncompleteOptions = types.ErrIncompleteOptions
 	// ErrInvalidBigDataName indicates that the name for a big data item is not acceptable; it may be empty.
 	ErrInvalidBigDataName = types.ErrInvalidBigDataName
+	// ErrInvalidMetadataBackend is returned when the configured metadata backend is not one that we know how to use.
+	ErrInvalidMetadataBackend = types.ErrInvalidMetadataBackend
 	// ErrLayerHasChildren is returned when the caller attempts to delete a layer that has children.
 	ErrLayerHasChildren = types.ErrLayerHasChildren
+	// ErrLayerIncomplete is returned when the caller attempts to delete a layer whose contents are still being written.
+	ErrLayerIncomplete = types.ErrLayerIncomplete
+	// ErrLayerLeased is returned when the caller attempts to delete a layer that is attached to a lease.
+	ErrLayerLeased = types.ErrLayerLeased
+	// ErrLayerMounted is returned when the caller attempts to modify a layer in a way which requires that it not be mounted, and it is.
+	ErrLayerMounted = types.ErrLayerMounted
 	// ErrLayerNotMounted is returned when the requested information can only be computed for a mounted layer, and the layer is not mounted.
 	ErrLayerNotMounted = types.ErrLayerNotMounted
+	// ErrLayerPinned is returned when the caller attempts to delete a layer that is pinned.
+	ErrLayerPinned = types.ErrLayerPinned
 	// ErrLayerUnknown indicates that there was no layer with the specified name or ID.
 	ErrLayerUnknown = types.ErrLayerUnknown
 	// ErrLayerUsedByContainer is returned when the caller attempts to delete a layer that is a container's layer.
 	ErrLayerUsedByContainer = types.ErrLayerUsedByContainer
 	// ErrLayerUsedByImage is returned when the caller attempts to delete a layer that is an image's top layer.
 	ErrLayerUsedByImage = types.ErrLayerUsedByImage
+	// ErrLeaseUnknown indicates that there was no lease with the specified ID, or that it has expired.
+	ErrLeaseUnknown = types.ErrLeaseUnknown
 	// ErrLoadError indicates that there was an initialization error.
 	ErrLoadError = types.ErrLoadError
+	// ErrLockTimeout is returned when a lock could not be acquired before the configured lock timeout passed.
+	ErrLockTimeout = types.ErrLockTimeout
+	// ErrMetadataVersion is returned when the caller attempts to modify metadata which is stored in a newer format than we know how to write, or to convert metadata to a format we do not know.
+	ErrMetadataVersion = types.ErrMetadataVersion
 	// ErrNotAContainer is returned when the caller attempts to delete a container that isn't a container.
 	ErrNotAContainer = types.ErrNotAContainer
 	// ErrNotALayer is returned when the caller attempts to delete a layer that isn't a layer.
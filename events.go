@@ -0,0 +1,277 @@
+package storage
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// EventType identifies the kind of change which an Event describes.
+type EventType string
+
+const (
+	// EventCreate is emitted when a layer, image, or container is created.
+	EventCreate EventType = "create"
+	// EventDelete is emitted when a layer, image, or container is deleted.
+	EventDelete EventType = "delete"
+	// EventRename is emitted when the names of a layer, image, or
+	// container are changed.
+	EventRename EventType = "rename"
+	// EventMount is emitted when a layer or container is mounted.
+	EventMount EventType = "mount"
+	// EventUnmount is emitted when a layer or container is unmounted.
+	EventUnmount EventType = "unmount"
+	// EventSetBigData is emitted when a big data item is stored for a
+	// layer, image, or container.
+	EventSetBigData EventType = "set-big-data"
+	// EventSetTopLayer is emitted when an image's top layer is changed.
+	EventSetTopLayer EventType = "set-top-layer"
+	// EventReset is emitted when a container's layer is reset, discarding
+	// the changes which were made to it.
+	EventReset EventType = "reset"
+	// EventPin is emitted when an image or layer is pinned.
+	EventPin EventType = "pin"
+	// EventUnpin is emitted when an image or layer is unpinned.
+	EventUnpin EventType = "unpin"
+)
+
+// EventObject identifies the kind of item which an Event is about.
+type EventObject string
+
+const (
+	// EventLayer marks an Event as being about a layer.
+	EventLayer EventObject = "layer"
+	// EventImage marks an Event as being about an image.
+	EventImage EventObject = "image"
+	// EventContainer marks an Event as being about a container.
+	EventContainer EventObject = "container"
+)
+
+// Event describes a change which was made to the store, either by this
+// process or by another process which shares the same run root.
+type Event struct {
+	// Time is when the change was made.
+	Time time.Time `json:"time"`
+	// Type is the kind of change.
+	Type EventType `json:"type"`
+	// Object is the kind of item which was changed.
+	Object EventObject `json:"object"`
+	// ID is the ID of the item which was changed.
+	ID string `json:"id"`
+	// Names is the list of names which the item has after the change, if
+	// the change was a creation or a rename.
+	Names []string `json:"names,omitempty"`
+	// Key is the name of the big data item, for EventSetBigData events.
+	Key string `json:"key,omitempty"`
+	// PID is the ID of the process which made the change.
+	PID int `json:"pid"`
+}
+
+const (
+	eventsJournalName = "events.log"
+	// eventsJournalMaxSize is the size past which the journal is rotated.
+	eventsJournalMaxSize = 4 * 1024 * 1024
+	// eventsPollInterval is how often readers check the journal for
+	// new entries.
+	eventsPollInterval = 250 * time.Millisecond
+)
+
+func (s *store) eventsJournalPath() string {
+	return filepath.Join(s.runRoot, eventsJournalName)
+}
+
+// notify appends events to the journal in the run root, where every process
+// which is watching the store will find them.  Failing to record an event
+// is not treated as a failure of the operation which caused it.
+func (s *store) notify(events ...Event) {
+	if len(events) == 0 {
+		return
+	}
+	journal := s.eventsJournalPath()
+	if st, err := os.Stat(journal); err == nil && st.Size() > eventsJournalMaxSize {
+		s.rotateEventsJournal(journal)
+	}
+	// Hold the events lock while we write, so that the journal can't be
+	// rotated out from under us after we've opened it.
+	if err := s.rlock(s.eventsLock); err != nil {
+		logrus.Debugf("error locking events journal %q: %v", journal, err)
+		return
+	}
+	defer s.eventsLock.Unlock()
+	f, err := os.OpenFile(journal, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		logrus.Debugf("error opening events journal %q: %v", journal, err)
+		return
+	}
+	defer f.Close()
+	now := time.Now().UTC()
+	pid := os.Getpid()
+	var buf []byte
+	for _, event := range events {
+		if event.Time.IsZero() {
+			event.Time = now
+		}
+		event.PID = pid
+		line, err := json.Marshal(&event)
+		if err != nil {
+			logrus.Debugf("error encoding event %+v: %v", event, err)
+			continue
+		}
+		buf = append(buf, line...)
+		buf = append(buf, '\n')
+	}
+	// A single write to a file opened for appending keeps entries from
+	// different processes from being interleaved.
+	if _, err := f.Write(buf); err != nil {
+		logrus.Debugf("error writing to events journal %q: %v", journal, err)
+	}
+}
+
+// rotateEventsJournal moves the journal aside once it has grown too large.
+// Processes which share the run root hold the events lock for reading while
+// they append to the journal, and we hold it for writing while we rotate it,
+// so that nobody appends to a journal after it has been moved aside, and one
+// process can't rotate away the journal which another has only just started.
+func (s *store) rotateEventsJournal(journal string) {
+	if err := s.lock(s.eventsLock); err != nil {
+		logrus.Debugf("error locking events journal %q: %v", journal, err)
+		return
+	}
+	defer s.eventsLock.Unlock()
+	// Another process may have rotated the journal while we waited.
+	if st, err := os.Stat(journal); err != nil || st.Size() <= eventsJournalMaxSize {
+		return
+	}
+	// Readers which still have the old file open will finish reading it
+	// before switching to the new one.
+	if err := os.Rename(journal, journal+".1"); err != nil && !os.IsNotExist(err) {
+		logrus.Debugf("error rotating events journal %q: %v", journal, err)
+	}
+}
+
+// notifyUnlessError records events if err is nil, and returns err.
+func (s *store) notifyUnlessError(err error, events ...Event) error {
+	if err == nil {
+		s.notify(events...)
+	}
+	return err
+}
+
+// RecordedEvents returns the events which are still present in the journal
+// in the run root, oldest first.
+func (s *store) RecordedEvents() ([]Event, error) {
+	var events []Event
+	journal := s.eventsJournalPath()
+	if err := s.rlock(s.eventsLock); err != nil {
+		return nil, err
+	}
+	defer s.eventsLock.Unlock()
+	for _, path := range []string{journal + ".1", journal} {
+		f, err := os.Open(path)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			var event Event
+			if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+				logrus.Debugf("error decoding entry in events journal %q: %v", path, err)
+				continue
+			}
+			events = append(events, event)
+		}
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return events, nil
+}
+
+// Events returns a channel on which every change which is made to the store
+// from this point on will be delivered, until ctx is cancelled, at which
+// point the channel is closed.
+func (s *store) Events(ctx context.Context) (<-chan Event, error) {
+	journal := s.eventsJournalPath()
+	f, err := os.OpenFile(journal, os.O_RDONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Seek(0, io.SeekEnd); err != nil {
+		f.Close()
+		return nil, err
+	}
+	ch := make(chan Event)
+	go func() {
+		defer close(ch)
+		var next *os.File
+		defer func() {
+			f.Close()
+			if next != nil {
+				next.Close()
+			}
+		}()
+		reader := bufio.NewReader(f)
+		var partial []byte
+		ticker := time.NewTicker(eventsPollInterval)
+		defer ticker.Stop()
+		for {
+			// Deliver everything that has been written so far.
+			for {
+				line, err := reader.ReadBytes('\n')
+				if err != nil {
+					partial = append(partial, line...)
+					break
+				}
+				if len(partial) > 0 {
+					line = append(partial, line...)
+					partial = nil
+				}
+				var event Event
+				if err := json.Unmarshal(line, &event); err != nil {
+					logrus.Debugf("error decoding entry in events journal %q: %v", journal, err)
+					continue
+				}
+				select {
+				case ch <- event:
+				case <-ctx.Done():
+					return
+				}
+			}
+			// If the journal was rotated, switch to the new one once
+			// we've read everything from the old one.  Nothing is
+			// appended to it once it's been rotated, but something
+			// may have been appended since we last read from it, so
+			// read from it once more before switching.
+			if next != nil {
+				f.Close()
+				f, next = next, nil
+				reader.Reset(f)
+				partial = nil
+				continue
+			}
+			if current, err := os.Stat(journal); err == nil {
+				if st, err := f.Stat(); err == nil && !os.SameFile(st, current) {
+					if next, err = os.Open(journal); err == nil {
+						continue
+					}
+				}
+			}
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch, nil
+}
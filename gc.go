@@ -0,0 +1,280 @@
+package storage
+
+import (
+	"sort"
+	"time"
+
+	"github.com/gepis/strge/pkg/directory"
+	"github.com/pkg/errors"
+)
+
+// GCPolicy controls which items a Store's GarbageCollect() method removes.
+// Layers which are not used by any image or container, and which do not
+// have names, are always candidates for removal.
+type GCPolicy struct {
+	// UntaggedImages allows images which have no names, and which are not
+	// being used by any containers, to be removed along with any layers
+	// which are only used by them.
+	UntaggedImages bool
+	// OlderThan, if not zero, limits removal to images and layers which
+	// were created at least this long ago.
+	OlderThan time.Duration
+	// KeepLast is the number of the most recently created removable
+	// images, and of the most recently created unreferenced layers, which
+	// are left in place.
+	KeepLast int
+	// FreeSpace, if not zero, is the number of bytes which should be
+	// available on the filesystem which holds the graph root.  Items are
+	// removed oldest first, and removal stops once that much space is
+	// available.
+	FreeSpace uint64
+	// DryRun causes the items which would be removed to be reported
+	// without actually removing anything.
+	DryRun bool
+}
+
+// GCReport lists the items which GarbageCollect() removed, or would have
+// removed if the policy had not called for a dry run.
+type GCReport struct {
+	Images []string `json:"images,omitempty"`
+	Layers []string `json:"layers,omitempty"`
+	// Reclaimed is an estimate of the number of bytes which were freed,
+	// based on the recorded sizes of the removed layers' diffs.
+	Reclaimed int64 `json:"reclaimed"`
+}
+
+func (s *store) GarbageCollect(policy *GCPolicy) (*GCReport, error) {
+	report := &GCReport{}
+	if policy == nil {
+		policy = &GCPolicy{}
+	}
+
+	rlstore, err := s.LayerStore()
+	if err != nil {
+		return report, err
+	}
+	ristore, err := s.ImageStore()
+	if err != nil {
+		return report, err
+	}
+	istores, err := s.ROImageStores()
+	if err != nil {
+		return report, err
+	}
+	rcstore, err := s.ContainerStore()
+	if err != nil {
+		return report, err
+	}
+
+	if err := s.startWriting(rlstore); err != nil {
+		return report, err
+	}
+	defer rlstore.Unlock()
+	if err := s.startWriting(ristore); err != nil {
+		return report, err
+	}
+	defer ristore.Unlock()
+	for _, store := range istores {
+		if err := s.startReading(store); err != nil {
+			return report, err
+		}
+		defer store.Unlock()
+	}
+	if err := s.startWriting(rcstore); err != nil {
+		return report, err
+	}
+	defer rcstore.Unlock()
+
+	now := time.Now()
+	eligible := func(created time.Time) bool {
+		return policy.OlderThan == 0 || now.Sub(created) >= policy.OlderThan
+	}
+	enoughSpace := func() (bool, error) {
+		if policy.FreeSpace == 0 {
+			return false, nil
+		}
+		free, err := directory.Free(s.GraphRoot())
+		if err != nil {
+			return false, errors.Wrapf(err, "error checking free space under %q", s.GraphRoot())
+		}
+		if policy.DryRun {
+			free += uint64(report.Reclaimed)
+		}
+		return free >= policy.FreeSpace, nil
+	}
+
+	layers, err := rlstore.Layers()
+	if err != nil {
+		return report, err
+	}
+	layersByID := make(map[string]*Layer)
+	children := make(map[string]int)
+	for i := range layers {
+		layersByID[layers[i].ID] = &layers[i]
+		if layers[i].Parent != "" {
+			children[layers[i].Parent]++
+		}
+	}
+
+	// Everything that refers to a layer directly: containers, images that
+	// we aren't removing, and the layers' own names.
+	containers, err := rcstore.Containers()
+	if err != nil {
+		return report, err
+	}
+	imagesInUse := make(map[string]bool)
+	references := make(map[string]int)
+	for _, container := range containers {
+		imagesInUse[container.ImageID] = true
+		references[container.LayerID]++
+	}
+	for _, layer := range layers {
+		if len(layer.Names) > 0 {
+			references[layer.ID]++
+		}
+	}
+	images, err := ristore.Images()
+	if err != nil {
+		return report, err
+	}
+	for _, s := range istores {
+		roImages, err := s.Images()
+		if err != nil {
+			return report, err
+		}
+		images = append(images, roImages...)
+	}
+	for _, image := range images {
+		references[image.TopLayer]++
+		for _, layer := range image.MappedTopLayers {
+			references[layer]++
+		}
+	}
+	// Leases count as references to the layers that they protect.
+	leasedLayers, leasedImages, err := s.leasedItems()
+	if err != nil {
+		return report, err
+	}
+	for id := range protectedLayers(layers, images, leasedLayers, leasedImages) {
+		references[id]++
+	}
+	// So do pins, and the writers of layers which are still being written.
+	for _, layer := range layers {
+		if isPinned(layer.Flags) {
+			references[layer.ID]++
+		}
+		if isIncomplete(layer.Flags) && rlstore.(*layerStore).isBeingWritten(layer.ID) {
+			references[layer.ID]++
+		}
+	}
+
+	// removeChain removes a layer, and then its parents, for as long as
+	// nothing else refers to them and they're old enough to be removed.
+	removeChain := func(id string) error {
+		for id != "" {
+			layer, ok := layersByID[id]
+			if !ok || references[id] > 0 || children[id] > 0 || layer.MountCount > 0 || !eligible(layer.Created) {
+				return nil
+			}
+			if !policy.DryRun {
+				if err := rlstore.Delete(id); err != nil {
+					return errors.Wrapf(err, "error removing layer %q", id)
+				}
+				s.notify(Event{Type: EventDelete, Object: EventLayer, ID: id})
+			}
+			report.Layers = append(report.Layers, id)
+			if layer.UncompressedSize > 0 {
+				report.Reclaimed += layer.UncompressedSize
+			}
+			delete(layersByID, id)
+			children[layer.Parent]--
+			id = layer.Parent
+		}
+		return nil
+	}
+
+	if policy.UntaggedImages {
+		var candidates []Image
+		for _, image := range images {
+			if len(image.Names) == 0 && !imagesInUse[image.ID] && !leasedImages[image.ID] && !isPinned(image.Flags) && eligible(image.Created) && ristore.Exists(image.ID) {
+				candidates = append(candidates, image)
+			}
+		}
+		sort.Slice(candidates, func(i, j int) bool {
+			return candidates[i].Created.After(candidates[j].Created)
+		})
+		if policy.KeepLast < len(candidates) {
+			candidates = candidates[policy.KeepLast:]
+		} else {
+			candidates = nil
+		}
+		for i := len(candidates) - 1; i >= 0; i-- {
+			image := candidates[i]
+			done, err := enoughSpace()
+			if err != nil {
+				return report, err
+			}
+			if done {
+				return report, nil
+			}
+			if !policy.DryRun {
+				if err := ristore.Delete(image.ID); err != nil {
+					return report, errors.Wrapf(err, "error removing image %q", image.ID)
+				}
+				s.notify(Event{Type: EventDelete, Object: EventImage, ID: image.ID})
+			}
+			report.Images = append(report.Images, image.ID)
+			topLayers := append([]string{image.TopLayer}, image.MappedTopLayers...)
+			for _, layer := range topLayers {
+				references[layer]--
+			}
+			for _, layer := range topLayers {
+				if err := removeChain(layer); err != nil {
+					return report, err
+				}
+			}
+		}
+	}
+
+	// Whatever is left over that isn't reachable from something that
+	// refers to it can go, starting with the layers that have no children.
+	reachable := make(map[string]bool)
+	for id, count := range references {
+		for count > 0 && id != "" && !reachable[id] {
+			reachable[id] = true
+			layer, ok := layersByID[id]
+			if !ok {
+				break
+			}
+			id = layer.Parent
+		}
+	}
+	var dangling []*Layer
+	for _, layer := range layersByID {
+		if !reachable[layer.ID] && children[layer.ID] == 0 && eligible(layer.Created) {
+			dangling = append(dangling, layer)
+		}
+	}
+	sort.Slice(dangling, func(i, j int) bool {
+		return dangling[i].Created.After(dangling[j].Created)
+	})
+	if policy.KeepLast < len(dangling) {
+		dangling = dangling[policy.KeepLast:]
+	} else {
+		dangling = nil
+	}
+	for i := len(dangling) - 1; i >= 0; i-- {
+		done, err := enoughSpace()
+		if err != nil {
+			return report, err
+		}
+		if done {
+			return report, nil
+		}
+		if err := removeChain(dangling[i].ID); err != nil {
+			return report, err
+		}
+	}
+
+	return report, nil
+}
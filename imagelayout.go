@@ -0,0 +1,460 @@
+package storage
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/gepis/strge/pkg/archive"
+	"github.com/gepis/strge/pkg/ioutils"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// The subset of the OCI image-layout and image-spec formats which we read and
+// write when exporting and importing images.
+const (
+	ociLayoutFile          = "oci-layout"
+	ociLayoutVersion       = "1.0.0"
+	ociIndexFile           = "index.json"
+	ociBlobsDir            = "blobs"
+	ociMediaTypeIndex      = "application/vnd.oci.image.index.v1+json"
+	ociMediaTypeManifest   = "application/vnd.oci.image.manifest.v1+json"
+	ociMediaTypeConfig     = "application/vnd.oci.image.config.v1+json"
+	ociMediaTypeLayer      = "application/vnd.oci.image.layer.v1.tar"
+	ociMediaTypeLayerGzip  = "application/vnd.oci.image.layer.v1.tar+gzip"
+	ociMediaTypeLayerZstd  = "application/vnd.oci.image.layer.v1.tar+zstd"
+	ociAnnotationRefName   = "org.opencontainers.image.ref.name"
+	ociAnnotationID        = "io.github.gepis.strge.image.id"
+	ociAnnotationNames     = "io.github.gepis.strge.image.names"
+	ociAnnotationMetadata  = "io.github.gepis.strge.image.metadata"
+	ociAnnotationBigData   = "io.github.gepis.strge.image.big-data."
+	dockerMediaTypeLayer   = "application/vnd.docker.image.rootfs.diff.tar"
+	dockerMediaTypeLayerGz = "application/vnd.docker.image.rootfs.diff.tar.gzip"
+)
+
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      digest.Digest     `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+type ociIndex struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	MediaType     string          `json:"mediaType,omitempty"`
+	Manifests     []ociDescriptor `json:"manifests"`
+}
+
+type ociManifest struct {
+	SchemaVersion int               `json:"schemaVersion"`
+	MediaType     string            `json:"mediaType,omitempty"`
+	Config        ociDescriptor     `json:"config"`
+	Layers        []ociDescriptor   `json:"layers"`
+	Annotations   map[string]string `json:"annotations,omitempty"`
+}
+
+type ociRootFS struct {
+	Type    string          `json:"type"`
+	DiffIDs []digest.Digest `json:"diff_ids"`
+}
+
+type ociConfig struct {
+	Architecture string    `json:"architecture"`
+	OS           string    `json:"os"`
+	RootFS       ociRootFS `json:"rootfs"`
+}
+
+func ociBlobPath(dir string, d digest.Digest) string {
+	return filepath.Join(dir, ociBlobsDir, d.Algorithm().String(), d.Hex())
+}
+
+// writeOCIBlob copies the contents of r into the layout's blob directory,
+// returning its digest and size.
+func writeOCIBlob(dir string, r io.Reader) (digest.Digest, int64, error) {
+	blobDir := filepath.Join(dir, ociBlobsDir, digest.Canonical.String())
+	if err := os.MkdirAll(blobDir, 0755); err != nil {
+		return "", -1, err
+	}
+	f, err := ioutil.TempFile(blobDir, ".tmp-blob-")
+	if err != nil {
+		return "", -1, err
+	}
+	defer func() {
+		if f != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+	digester := digest.Canonical.Digester()
+	size, err := io.Copy(io.MultiWriter(f, digester.Hash()), r)
+	if err != nil {
+		return "", -1, err
+	}
+	if err := f.Close(); err != nil {
+		return "", -1, err
+	}
+	d := digester.Digest()
+	if err := os.Rename(f.Name(), ociBlobPath(dir, d)); err != nil {
+		return "", -1, err
+	}
+	f = nil
+	return d, size, nil
+}
+
+func writeOCIBlobBytes(dir string, data []byte) (digest.Digest, int64, error) {
+	return writeOCIBlob(dir, bytes.NewReader(data))
+}
+
+func readOCIBlob(dir string, desc ociDescriptor) ([]byte, error) {
+	if err := desc.Digest.Validate(); err != nil {
+		return nil, errors.Wrapf(err, "invalid blob digest %q", desc.Digest)
+	}
+	data, err := ioutil.ReadFile(ociBlobPath(dir, desc.Digest))
+	if err != nil {
+		return nil, err
+	}
+	if actual := desc.Digest.Algorithm().FromBytes(data); actual != desc.Digest {
+		return nil, errors.Errorf("blob %q has digest %q", desc.Digest, actual)
+	}
+	return data, nil
+}
+
+func (s *store) ExportImage(id, dir string) error {
+	image, err := s.Image(id)
+	if err != nil {
+		return err
+	}
+
+	// Collect the layer chain, base layer first.
+	var layers []*Layer
+	for layerID := image.TopLayer; layerID != ""; {
+		layer, err := s.Layer(layerID)
+		if err != nil {
+			return errors.Wrapf(err, "error locating layer %q of image %q", layerID, image.ID)
+		}
+		layers = append([]*Layer{layer}, layers...)
+		layerID = layer.Parent
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	if err := ioutils.AtomicWriteFile(filepath.Join(dir, ociLayoutFile), []byte(`{"imageLayoutVersion":"`+ociLayoutVersion+`"}`), 0644); err != nil {
+		return err
+	}
+
+	manifest := ociManifest{
+		SchemaVersion: 2,
+		MediaType:     ociMediaTypeManifest,
+	}
+	var diffIDs []digest.Digest
+	uncompressed := archive.Uncompressed
+	for _, layer := range layers {
+		diff, err := s.Diff("", layer.ID, &DiffOptions{Compression: &uncompressed})
+		if err != nil {
+			return errors.Wrapf(err, "error reading contents of layer %q", layer.ID)
+		}
+		d, size, err := writeOCIBlob(dir, diff)
+		diff.Close()
+		if err != nil {
+			return errors.Wrapf(err, "error exporting layer %q", layer.ID)
+		}
+		manifest.Layers = append(manifest.Layers, ociDescriptor{
+			MediaType: ociMediaTypeLayer,
+			Digest:    d,
+			Size:      size,
+		})
+		diffIDs = append(diffIDs, d)
+	}
+
+	// Reuse the image's configuration blob if the stored manifest points
+	// to one that we have, updating its list of diff IDs to match the
+	// layer blobs we just wrote.
+	var config []byte
+	if stored, err := s.ImageBigData(image.ID, ImageDigestBigDataKey); err == nil {
+		var storedManifest ociManifest
+		if err := json.Unmarshal(stored, &storedManifest); err == nil && storedManifest.Config.Digest != "" {
+			if storedConfig, err := s.ImageBigData(image.ID, storedManifest.Config.Digest.String()); err == nil {
+				config = storedConfig
+			}
+		}
+	}
+	if config != nil {
+		var parsed map[string]interface{}
+		var rootfs struct {
+			RootFS ociRootFS `json:"rootfs"`
+		}
+		if err := json.Unmarshal(config, &parsed); err != nil {
+			return errors.Wrapf(err, "error parsing configuration of image %q", image.ID)
+		}
+		if err := json.Unmarshal(config, &rootfs); err != nil || !digestSlicesEqual(rootfs.RootFS.DiffIDs, diffIDs) {
+			parsed["rootfs"] = ociRootFS{Type: "layers", DiffIDs: diffIDs}
+			if config, err = json.Marshal(parsed); err != nil {
+				return err
+			}
+		}
+	} else {
+		if config, err = json.Marshal(ociConfig{
+			Architecture: runtime.GOARCH,
+			OS:           runtime.GOOS,
+			RootFS:       ociRootFS{Type: "layers", DiffIDs: diffIDs},
+		}); err != nil {
+			return err
+		}
+	}
+	configDigest, configSize, err := writeOCIBlobBytes(dir, config)
+	if err != nil {
+		return errors.Wrapf(err, "error exporting configuration of image %q", image.ID)
+	}
+	manifest.Config = ociDescriptor{
+		MediaType: ociMediaTypeConfig,
+		Digest:    configDigest,
+		Size:      configSize,
+	}
+
+	manifestBytes, err := json.Marshal(&manifest)
+	if err != nil {
+		return err
+	}
+	manifestDigest, manifestSize, err := writeOCIBlobBytes(dir, manifestBytes)
+	if err != nil {
+		return errors.Wrapf(err, "error exporting manifest of image %q", image.ID)
+	}
+
+	// Everything else that the store knows about the image goes into the
+	// index entry's annotations, with big data items saved as blobs.
+	annotations := map[string]string{
+		ociAnnotationID: image.ID,
+	}
+	if len(image.Names) > 0 {
+		annotations[ociAnnotationRefName] = image.Names[0]
+		annotations[ociAnnotationNames] = strings.Join(image.Names, ",")
+	}
+	if image.Metadata != "" {
+		annotations[ociAnnotationMetadata] = image.Metadata
+	}
+	for _, key := range image.BigDataNames {
+		data, err := s.ImageBigData(image.ID, key)
+		if err != nil {
+			return errors.Wrapf(err, "error reading big data item %q of image %q", key, image.ID)
+		}
+		d, _, err := writeOCIBlobBytes(dir, data)
+		if err != nil {
+			return errors.Wrapf(err, "error exporting big data item %q of image %q", key, image.ID)
+		}
+		annotations[ociAnnotationBigData+key] = d.String()
+	}
+
+	index := ociIndex{
+		SchemaVersion: 2,
+		MediaType:     ociMediaTypeIndex,
+		Manifests: []ociDescriptor{{
+			MediaType:   ociMediaTypeManifest,
+			Digest:      manifestDigest,
+			Size:        manifestSize,
+			Annotations: annotations,
+		}},
+	}
+	indexBytes, err := json.Marshal(&index)
+	if err != nil {
+		return err
+	}
+	return ioutils.AtomicWriteFile(filepath.Join(dir, ociIndexFile), indexBytes, 0644)
+}
+
+func digestSlicesEqual(a, b []digest.Digest) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *store) ImportImage(dir string) ([]*Image, error) {
+	indexBytes, err := ioutil.ReadFile(filepath.Join(dir, ociIndexFile))
+	if err != nil {
+		return nil, err
+	}
+	var index ociIndex
+	if err := json.Unmarshal(indexBytes, &index); err != nil {
+		return nil, errors.Wrapf(err, "error parsing %q", filepath.Join(dir, ociIndexFile))
+	}
+	var images []*Image
+	for _, desc := range index.Manifests {
+		if desc.MediaType != ociMediaTypeManifest {
+			continue
+		}
+		image, err := s.importOCIManifest(dir, desc)
+		if err != nil {
+			return images, errors.Wrapf(err, "error importing image from manifest %q", desc.Digest)
+		}
+		images = append(images, image)
+	}
+	if len(images) == 0 {
+		return nil, errors.Wrapf(ErrNotAnImage, "no image manifests found in %q", dir)
+	}
+	return images, nil
+}
+
+func (s *store) importOCIManifest(dir string, desc ociDescriptor) (_ *Image, err error) {
+	manifestBytes, err := readOCIBlob(dir, desc)
+	if err != nil {
+		return nil, err
+	}
+	var manifest ociManifest
+	if err := json.Unmarshal(manifestBytes, &manifest); err != nil {
+		return nil, err
+	}
+	configBytes, err := readOCIBlob(dir, manifest.Config)
+	if err != nil {
+		return nil, err
+	}
+	var config ociConfig
+	if err := json.Unmarshal(configBytes, &config); err != nil {
+		return nil, err
+	}
+
+	// If we don't get all the way through, remove the image and the layers
+	// that we created for it, newest first, leaving the layers that we
+	// reused alone.
+	var created []string
+	imageID := ""
+	defer func() {
+		if err == nil {
+			return
+		}
+		if imageID != "" {
+			if err2 := s.Delete(imageID); err2 != nil {
+				logrus.Debugf("error removing partially imported image %q: %v", imageID, err2)
+			}
+		}
+		for i := len(created) - 1; i >= 0; i-- {
+			if err2 := s.DeleteLayer(created[i]); err2 != nil {
+				logrus.Debugf("error removing partially imported layer %q: %v", created[i], err2)
+			}
+		}
+	}()
+
+	parent := ""
+	for i, layerDesc := range manifest.Layers {
+		// The diff ID tells us what the layer's uncompressed digest
+		// will be, which lets us reuse a layer that we already have.
+		var diffID digest.Digest
+		if i < len(config.RootFS.DiffIDs) {
+			diffID = config.RootFS.DiffIDs[i]
+		} else if layerDesc.MediaType == ociMediaTypeLayer || layerDesc.MediaType == dockerMediaTypeLayer {
+			diffID = layerDesc.Digest
+		}
+		reused := ""
+		if diffID != "" {
+			if layers, err := s.LayersByUncompressedDigest(diffID); err == nil {
+				for _, layer := range layers {
+					if layer.Parent == parent {
+						reused = layer.ID
+						break
+					}
+				}
+			}
+		}
+		if reused != "" {
+			parent = reused
+			continue
+		}
+		switch layerDesc.MediaType {
+		case ociMediaTypeLayer, ociMediaTypeLayerGzip, ociMediaTypeLayerZstd, dockerMediaTypeLayer, dockerMediaTypeLayerGz:
+		default:
+			return nil, errors.Errorf("layer %q has unsupported media type %q", layerDesc.Digest, layerDesc.MediaType)
+		}
+		if err := layerDesc.Digest.Validate(); err != nil {
+			return nil, errors.Wrapf(err, "invalid layer digest %q", layerDesc.Digest)
+		}
+		blob, err := os.Open(ociBlobPath(dir, layerDesc.Digest))
+		if err != nil {
+			return nil, err
+		}
+		// Digest everything in the blob, including anything that
+		// follows the end of the archive, so that we can tell if it
+		// doesn't match the manifest.
+		digester := layerDesc.Digest.Algorithm().Digester()
+		counter := ioutils.NewWriteCounter(digester.Hash())
+		contents := io.TeeReader(blob, counter)
+		layer, _, err := s.PutLayer("", parent, nil, "", false, nil, contents)
+		if err == nil {
+			_, err = io.Copy(ioutil.Discard, contents)
+		}
+		blob.Close()
+		if layer != nil {
+			created = append(created, layer.ID)
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "error importing layer %q", layerDesc.Digest)
+		}
+		if actual := digester.Digest(); actual != layerDesc.Digest {
+			return nil, errors.Errorf("layer blob %q has digest %q", layerDesc.Digest, actual)
+		}
+		if counter.Count != layerDesc.Size {
+			return nil, errors.Errorf("layer blob %q is %d bytes long, expected %d", layerDesc.Digest, counter.Count, layerDesc.Size)
+		}
+		if diffID != "" && layer.UncompressedDigest != "" && layer.UncompressedDigest != diffID {
+			return nil, errors.Errorf("layer %q has uncompressed digest %q, expected %q", layerDesc.Digest, layer.UncompressedDigest, diffID)
+		}
+		parent = layer.ID
+	}
+
+	var names []string
+	if desc.Annotations[ociAnnotationNames] != "" {
+		names = strings.Split(desc.Annotations[ociAnnotationNames], ",")
+	} else if desc.Annotations[ociAnnotationRefName] != "" {
+		names = []string{desc.Annotations[ociAnnotationRefName]}
+	}
+	id := manifest.Config.Digest.Hex()
+	if desc.Annotations[ociAnnotationID] != "" {
+		id = desc.Annotations[ociAnnotationID]
+	}
+	image, err := s.CreateImage(id, names, parent, desc.Annotations[ociAnnotationMetadata], &ImageOptions{Digest: desc.Digest})
+	if err != nil {
+		return nil, err
+	}
+	imageID = image.ID
+
+	digestManifest := func(data []byte) (digest.Digest, error) {
+		return digest.Canonical.FromBytes(data), nil
+	}
+	bigData := map[string][]byte{
+		ImageDigestBigDataKey:           manifestBytes,
+		manifest.Config.Digest.String(): configBytes,
+	}
+	for key, value := range desc.Annotations {
+		if !strings.HasPrefix(key, ociAnnotationBigData) {
+			continue
+		}
+		// The manifest that we just read is the one that describes
+		// the image as it's being imported, so it wins over any
+		// manifest that was saved with the image when it was exported.
+		name := strings.TrimPrefix(key, ociAnnotationBigData)
+		if name == ImageDigestBigDataKey {
+			continue
+		}
+		data, err := readOCIBlob(dir, ociDescriptor{Digest: digest.Digest(value)})
+		if err != nil {
+			return nil, errors.Wrapf(err, "error reading big data item %q", name)
+		}
+		bigData[name] = data
+	}
+	for key, data := range bigData {
+		if err := s.SetImageBigData(image.ID, key, data, digestManifest); err != nil {
+			return nil, errors.Wrapf(err, "error saving big data item %q for image %q", key, image.ID)
+		}
+	}
+	return s.Image(image.ID)
+}
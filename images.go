@@ -1,6 +1,7 @@
 package storage
 
 import (
+	"context"
 	"io/ioutil"
 	"os"
 	"path/filepath"
@@ -88,6 +89,11 @@ type Image struct {
 	// is set before using it.
 	Created time.Time `json:"created,omitempty"`
 
+	// LastUsed is the datestamp for when this image was last mounted, or
+	// last used to create a container.  It is recorded lazily, so it can
+	// lag behind by up to ten minutes.
+	LastUsed time.Time `json:"last-used,omitempty"`
+
 	// ReadOnly is true if this image resides in a read-only layer store.
 	ReadOnly bool `json:"-"`
 
@@ -154,6 +160,7 @@ type imageStore struct {
 	byname   map[string]*Image
 	bydigest map[digest.Digest][]*Image
 	loadMut  sync.Mutex
+	metadata metadataBackend
 }
 
 func copyImage(i *Image) *Image {
@@ -170,6 +177,7 @@ func copyImage(i *Image) *Image {
 		BigDataSizes:    copyStringInt64Map(i.BigDataSizes),
 		BigDataDigests:  copyStringDigestMap(i.BigDataDigests),
 		Created:         i.Created,
+		LastUsed:        i.LastUsed,
 		ReadOnly:        i.ReadOnly,
 		Flags:           copyStringInterfaceMap(i.Flags),
 	}
@@ -257,46 +265,25 @@ func (i *Image) recomputeDigests() error {
 
 func (r *imageStore) Load() error {
 	shouldSave := false
-	rpath := r.imagespath()
-	data, err := ioutil.ReadFile(rpath)
-	if err != nil && !os.IsNotExist(err) {
+	changes, reloaded, err := r.metadata.Load()
+	if err != nil {
 		return err
 	}
-
-	images := []*Image{}
-	idlist := []string{}
-	ids := make(map[string]*Image)
-	names := make(map[string]*Image)
-	digests := make(map[digest.Digest][]*Image)
-
-	if err = json.Unmarshal(data, &images); len(data) == 0 || err == nil {
-		idlist = make([]string, 0, len(images))
-		for n, image := range images {
-			ids[image.ID] = images[n]
-			idlist = append(idlist, image.ID)
-			for _, name := range image.Names {
-				if conflict, ok := names[name]; ok {
-					r.removeName(conflict, name)
-					shouldSave = true
-				}
-			}
-
-			// Compute the digest list.
-			err = image.recomputeDigests()
-			if err != nil {
-				return errors.Wrapf(err, "error computing digests for image with ID %q (%v)", image.ID, image.Names)
-			}
-
-			for _, name := range image.Names {
-				names[name] = image
-			}
-
-			for _, digest := range image.Digests {
-				list := digests[digest]
-				digests[digest] = append(list, image)
-			}
-
-			image.ReadOnly = !r.IsReadWrite()
+	if reloaded {
+		r.images = make([]*Image, 0, len(changes))
+		r.idindex = truncindex.NewTruncIndex(nil)
+		r.byid = make(map[string]*Image)
+		r.byname = make(map[string]*Image)
+		r.bydigest = make(map[digest.Digest][]*Image)
+	}
+	for _, change := range changes {
+		changed, err := r.applyChange(change)
+		if err != nil {
+			r.metadata.Forget()
+			return err
+		}
+		if changed {
+			shouldSave = true
 		}
 	}
 
@@ -304,12 +291,6 @@ func (r *imageStore) Load() error {
 		return ErrDuplicateImageNames
 	}
 
-	r.images = images
-	r.idindex = truncindex.NewTruncIndex(idlist)
-	r.byid = ids
-	r.byname = names
-	r.bydigest = digests
-
 	if shouldSave {
 		return r.Save()
 	}
@@ -317,6 +298,71 @@ func (r *imageStore) Load() error {
 	return nil
 }
 
+// applyChange updates our copy of an image, and our indexes, to match an
+// image record which Load() found had been added, changed, or removed.  It
+// returns true if it had to take names away from other images.
+func (r *imageStore) applyChange(change metadataChange) (bool, error) {
+	shouldSave := false
+	var updated *Image
+	if change.Record != nil {
+		updated = copyImage(change.Record.(*Image))
+		// Compute the digest list.
+		if err := updated.recomputeDigests(); err != nil {
+			return false, errors.Wrapf(err, "error computing digests for image with ID %q (%v)", updated.ID, updated.Names)
+		}
+		updated.ReadOnly = !r.IsReadWrite()
+	}
+
+	image := r.byid[change.ID]
+	digestsChanged := image == nil || updated == nil || !digestSlicesEqual(image.Digests, updated.Digests)
+	if image != nil {
+		for _, name := range image.Names {
+			if r.byname[name] == image {
+				delete(r.byname, name)
+			}
+		}
+		if digestsChanged {
+			for _, digest := range image.Digests {
+				if list := imageSliceWithoutValue(r.bydigest[digest], image); len(list) > 0 {
+					r.bydigest[digest] = list
+				} else {
+					delete(r.bydigest, digest)
+				}
+			}
+		}
+	}
+	if updated == nil {
+		if image != nil {
+			delete(r.byid, image.ID)
+			r.idindex.Delete(image.ID)
+			r.images = imageSliceWithoutValue(r.images, image)
+		}
+		return false, nil
+	}
+	if image != nil {
+		*image = *updated
+	} else {
+		image = updated
+		r.images = append(r.images, image)
+		r.byid[image.ID] = image
+		r.idindex.Add(image.ID)
+	}
+
+	for _, name := range image.Names {
+		if conflict, ok := r.byname[name]; ok && conflict != image {
+			r.removeName(conflict, name)
+			shouldSave = true
+		}
+		r.byname[name] = image
+	}
+	if digestsChanged {
+		for _, digest := range image.Digests {
+			r.bydigest[digest] = append(r.bydigest[digest], image)
+		}
+	}
+	return shouldSave, nil
+}
+
 func (r *imageStore) Save() error {
 	if !r.IsReadWrite() {
 		return errors.Wrapf(ErrStoreIsReadOnly, "not allowed to modify the image store at %q", r.imagespath())
@@ -326,21 +372,16 @@ func (r *imageStore) Save() error {
 		return errors.New("image store is not locked for writing")
 	}
 
-	rpath := r.imagespath()
-	if err := os.MkdirAll(filepath.Dir(rpath), 0700); err != nil {
-		return err
-	}
-
-	jdata, err := json.Marshal(&r.images)
-	if err != nil {
-		return err
+	records := make([]interface{}, len(r.images))
+	for i := range r.images {
+		records[i] = r.images[i]
 	}
 
 	defer r.Touch()
-	return ioutils.AtomicWriteFile(rpath, jdata, 0600)
+	return r.metadata.Save(records)
 }
 
-func newImageStore(dir string) (ImageStore, error) {
+func newImageStore(ctx context.Context, dir, metadataBackend string) (ImageStore, error) {
 	if err := os.MkdirAll(dir, 0700); err != nil {
 		return nil, err
 	}
@@ -350,8 +391,15 @@ func newImageStore(dir string) (ImageStore, error) {
 		return nil, err
 	}
 
-	lockfile.Lock()
+	if err := lockfile.LockWithContext(ctx); err != nil {
+		return nil, err
+	}
 	defer lockfile.Unlock()
+	metadata, err := newImageMetadataBackend(metadataBackend, filepath.Join(dir, "images.json"))
+	if err != nil {
+		return nil, err
+	}
+
 	istore := imageStore{
 		lockfile: lockfile,
 		dir:      dir,
@@ -359,6 +407,7 @@ func newImageStore(dir string) (ImageStore, error) {
 		byid:     make(map[string]*Image),
 		byname:   make(map[string]*Image),
 		bydigest: make(map[digest.Digest][]*Image),
+		metadata: metadata,
 	}
 
 	if err := istore.Load(); err != nil {
@@ -368,14 +417,21 @@ func newImageStore(dir string) (ImageStore, error) {
 	return &istore, nil
 }
 
-func newROImageStore(dir string) (ROImageStore, error) {
+func newROImageStore(ctx context.Context, dir string) (ROImageStore, error) {
 	lockfile, err := GetROLockfile(filepath.Join(dir, "images.lock"))
 	if err != nil {
 		return nil, err
 	}
 
-	lockfile.RLock()
+	if err := lockfile.RLockWithContext(ctx); err != nil {
+		return nil, err
+	}
 	defer lockfile.Unlock()
+	metadata, err := newImageMetadataBackend(MetadataBackendJSON, filepath.Join(dir, "images.json"))
+	if err != nil {
+		return nil, err
+	}
+
 	istore := imageStore{
 		lockfile: lockfile,
 		dir:      dir,
@@ -383,6 +439,7 @@ func newROImageStore(dir string) (ROImageStore, error) {
 		byid:     make(map[string]*Image),
 		byname:   make(map[string]*Image),
 		bydigest: make(map[digest.Digest][]*Image),
+		metadata: metadata,
 	}
 
 	if err := istore.Load(); err != nil {
@@ -392,6 +449,16 @@ func newROImageStore(dir string) (ROImageStore, error) {
 	return &istore, nil
 }
 
+// newImageMetadataBackend returns a metadataBackend which reads and writes the
+// list of images in the images.json file at path.
+func newImageMetadataBackend(kind, path string) (metadataBackend, error) {
+	return newMetadataBackend(kind, path, func() interface{} {
+		return &Image{}
+	}, func(record interface{}) string {
+		return record.(*Image).ID
+	})
+}
+
 func (r *imageStore) lookup(id string) (*Image, bool) {
 	if image, ok := r.byid[id]; ok {
 		return image, ok
@@ -416,6 +483,7 @@ func (r *imageStore) ClearFlag(id string, flag string) error {
 	}
 
 	delete(image.Flags, flag)
+	r.metadata.Changed(image.ID)
 	return r.Save()
 }
 
@@ -434,6 +502,28 @@ func (r *imageStore) SetFlag(id string, flag string, value interface{}) error {
 	}
 
 	image.Flags[flag] = value
+	r.metadata.Changed(image.ID)
+	return r.Save()
+}
+
+// touch records that an image was used at the specified time.  The image
+// list is only rewritten if the previously-recorded time is at least
+// lastUsedInterval older than the new one.  Otherwise, the new time is
+// discarded, so that the recorded time always matches the one in the list,
+// and it's the one that we compare against the next time.
+func (r *imageStore) touch(id string, when time.Time) error {
+	if !r.IsReadWrite() {
+		return nil
+	}
+	image, ok := r.lookup(id)
+	if !ok {
+		return errors.Wrapf(ErrImageUnknown, "error locating image with ID %q", id)
+	}
+	if when.Sub(image.LastUsed) < lastUsedInterval {
+		return nil
+	}
+	image.LastUsed = when
+	r.metadata.Changed(image.ID)
 	return r.Save()
 }
 
@@ -508,6 +598,7 @@ func (r *imageStore) Create(id string, names []string, layer, metadata string, c
 func (r *imageStore) addMappedTopLayer(id, layer string) error {
 	if image, ok := r.lookup(id); ok {
 		image.MappedTopLayers = append(image.MappedTopLayers, layer)
+		r.metadata.Changed(image.ID)
 		return r.Save()
 	}
 
@@ -523,6 +614,23 @@ func (r *imageStore) removeMappedTopLayer(id, layer string) error {
 			return nil
 		}
 
+		r.metadata.Changed(image.ID)
+		return r.Save()
+	}
+
+	return errors.Wrapf(ErrImageUnknown, "error locating image with ID %q", id)
+}
+
+// setTopLayer changes an image's top layer.  Any mapped copies of the old top
+// layer no longer describe the image, so they are forgotten.
+func (r *imageStore) setTopLayer(id, layer string) error {
+	if !r.IsReadWrite() {
+		return errors.Wrapf(ErrStoreIsReadOnly, "not allowed to modify the top layer of images at %q", r.imagespath())
+	}
+	if image, ok := r.lookup(id); ok {
+		image.TopLayer = layer
+		image.MappedTopLayers = nil
+		r.metadata.Changed(image.ID)
 		return r.Save()
 	}
 
@@ -544,6 +652,7 @@ func (r *imageStore) SetMetadata(id, metadata string) error {
 
 	if image, ok := r.lookup(id); ok {
 		image.Metadata = metadata
+		r.metadata.Changed(image.ID)
 		return r.Save()
 	}
 
@@ -552,6 +661,7 @@ func (r *imageStore) SetMetadata(id, metadata string) error {
 
 func (r *imageStore) removeName(image *Image, name string) {
 	image.Names = stringSliceWithoutValue(image.Names, name)
+	r.metadata.Changed(image.ID)
 }
 
 func (i *Image) addNameToHistory(name string) {
@@ -579,6 +689,7 @@ func (r *imageStore) SetNames(id string, names []string) error {
 		}
 
 		image.Names = names
+		r.metadata.Changed(image.ID)
 		return r.Save()
 	}
 
@@ -840,6 +951,7 @@ func (r *imageStore) SetBigData(id, key string, data []byte, digestManifest func
 		}
 
 		if save {
+			r.metadata.Changed(image.ID)
 			err = r.Save()
 		}
 	}
@@ -878,6 +990,22 @@ func (r *imageStore) RLock() {
 	r.lockfile.RLock()
 }
 
+func (r *imageStore) TryLock() error {
+	return r.lockfile.TryLock()
+}
+
+func (r *imageStore) TryRLock() error {
+	return r.lockfile.TryRLock()
+}
+
+func (r *imageStore) LockWithContext(ctx context.Context) error {
+	return r.lockfile.LockWithContext(ctx)
+}
+
+func (r *imageStore) RLockWithContext(ctx context.Context) error {
+	return r.lockfile.RLockWithContext(ctx)
+}
+
 func (r *imageStore) Unlock() {
 	r.lockfile.Unlock()
 }
@@ -0,0 +1,35 @@
+package storage
+
+import (
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// lastUsedInterval is how much newer than the recorded last-used time of a
+// layer or image a new one has to be before we record it, which causes the
+// layer or image list to be rewritten.  This keeps us from rewriting the
+// lists every time a layer is mounted.
+const lastUsedInterval = 10 * time.Minute
+
+// touchLayer records that a layer in the read-write layer store was used.
+// The caller should be holding the layer store's lock.
+func touchLayer(rlstore LayerStore, id string, when time.Time) {
+	if !rlstore.Exists(id) {
+		return
+	}
+	if err := rlstore.(*layerStore).touch(id, when); err != nil {
+		logrus.Debugf("error recording that layer %q was used: %v", id, err)
+	}
+}
+
+// touchImage records that an image in the read-write image store was used.
+// The caller should be holding the image store's lock.
+func touchImage(ristore ImageStore, id string, when time.Time) {
+	if !ristore.Exists(id) {
+		return
+	}
+	if err := ristore.(*imageStore).touch(id, when); err != nil {
+		logrus.Debugf("error recording that image %q was used: %v", id, err)
+	}
+}
@@ -2,6 +2,7 @@ package storage
 
 import (
 	"bytes"
+	gocontext "context"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -77,6 +78,11 @@ type Layer struct {
 	// is set before using it.
 	Created time.Time `json:"created,omitempty"`
 
+	// LastUsed is the datestamp for when this layer was last mounted, or
+	// last used as the parent of a container's layer.  It is recorded
+	// lazily, so it can lag behind by up to ten minutes.
+	LastUsed time.Time `json:"last-used,omitempty"`
+
 	// CompressedDigest is the digest of the blob that was last passed to
 	// ApplyDiff() or Put(), as it was presented to us.
 	CompressedDigest digest.Digest `json:"compressed-diff-digest,omitempty"`
@@ -116,6 +122,11 @@ type Layer struct {
 	UIDMap []idtools.IDMap `json:"uidmap,omitempty"`
 	GIDMap []idtools.IDMap `json:"gidmap,omitempty"`
 
+	// StorageOpt is the set of driver-specific options, such as a size
+	// limit, which the layer was created with.  Older versions of the
+	// library did not record them, in which case it is nil.
+	StorageOpt map[string]string `json:"storage-opt"`
+
 	// ReadOnly is true if this layer resides in a read-only layer store.
 	ReadOnly bool `json:"-"`
 
@@ -288,10 +299,13 @@ type layerStore struct {
 	gidMap             []idtools.IDMap
 	loadMut            sync.Mutex
 	layerspathModified time.Time
+	metadata           metadataBackend
+	mountsVersion      int
+	lockTimeout        time.Duration
 }
 
 func copyLayer(l *Layer) *Layer {
-	return &Layer{
+	c := &Layer{
 		ID:                 l.ID,
 		Names:              copyStringSlice(l.Names),
 		Parent:             l.Parent,
@@ -300,6 +314,7 @@ func copyLayer(l *Layer) *Layer {
 		MountPoint:         l.MountPoint,
 		MountCount:         l.MountCount,
 		Created:            l.Created,
+		LastUsed:           l.LastUsed,
 		CompressedDigest:   l.CompressedDigest,
 		CompressedSize:     l.CompressedSize,
 		UncompressedDigest: l.UncompressedDigest,
@@ -313,6 +328,10 @@ func copyLayer(l *Layer) *Layer {
 		UIDs:               copyUint32Slice(l.UIDs),
 		GIDs:               copyUint32Slice(l.GIDs),
 	}
+	if l.StorageOpt != nil {
+		c.StorageOpt = copyStringStringMap(l.StorageOpt)
+	}
+	return c
 }
 
 func (r *layerStore) Layers() ([]Layer, error) {
@@ -333,58 +352,35 @@ func (r *layerStore) layerspath() string {
 
 func (r *layerStore) Load() error {
 	shouldSave := false
-	rpath := r.layerspath()
-	data, err := ioutil.ReadFile(rpath)
-	if err != nil && !os.IsNotExist(err) {
+	changes, reloaded, err := r.metadata.Load()
+	if err != nil {
 		return err
 	}
-	layers := []*Layer{}
-	idlist := []string{}
-	ids := make(map[string]*Layer)
-	names := make(map[string]*Layer)
-	compressedsums := make(map[digest.Digest][]string)
-	uncompressedsums := make(map[digest.Digest][]string)
-	if r.IsReadWrite() {
-		label.ClearLabels()
-	}
-	if err = json.Unmarshal(data, &layers); len(data) == 0 || err == nil {
-		idlist = make([]string, 0, len(layers))
-		for n, layer := range layers {
-			ids[layer.ID] = layers[n]
-			idlist = append(idlist, layer.ID)
-			for _, name := range layer.Names {
-				if conflict, ok := names[name]; ok {
-					r.removeName(conflict, name)
-					shouldSave = true
-				}
-				names[name] = layers[n]
-			}
-			if layer.CompressedDigest != "" {
-				compressedsums[layer.CompressedDigest] = append(compressedsums[layer.CompressedDigest], layer.ID)
-			}
-			if layer.UncompressedDigest != "" {
-				uncompressedsums[layer.UncompressedDigest] = append(uncompressedsums[layer.UncompressedDigest], layer.ID)
-			}
-			if layer.MountLabel != "" {
-				label.ReserveLabel(layer.MountLabel)
-			}
-			layer.ReadOnly = !r.IsReadWrite()
+	if reloaded {
+		r.layers = make([]*Layer, 0, len(changes))
+		r.idindex = truncindex.NewTruncIndex(nil)
+		r.byid = make(map[string]*Layer)
+		r.byname = make(map[string]*Layer)
+		r.bycompressedsum = make(map[digest.Digest][]string)
+		r.byuncompressedsum = make(map[digest.Digest][]string)
+		if r.IsReadWrite() {
+			label.ClearLabels()
+		}
+	}
+	for _, change := range changes {
+		if r.applyChange(change) {
+			shouldSave = true
 		}
-		err = nil
 	}
 	if shouldSave && (!r.IsReadWrite() || !r.Locked()) {
 		return ErrDuplicateLayerNames
 	}
-	r.layers = layers
-	r.idindex = truncindex.NewTruncIndex(idlist)
-	r.byid = ids
-	r.byname = names
-	r.bycompressedsum = compressedsums
-	r.byuncompressedsum = uncompressedsums
 
 	// Load and merge information about which layers are mounted, and where.
 	if r.IsReadWrite() {
-		r.mountsLockfile.RLock()
+		if err = r.rlockMounts(); err != nil {
+			return err
+		}
 		defer r.mountsLockfile.Unlock()
 		if err = r.loadMounts(); err != nil {
 			return err
@@ -399,7 +395,9 @@ func (r *layerStore) Load() error {
 					layer.Flags = make(map[string]interface{})
 				}
 				if cleanup, ok := layer.Flags[incompleteFlag]; ok {
-					if b, ok := cleanup.(bool); ok && b {
+					// Leave the layer alone if someone is still
+					// writing it.
+					if b, ok := cleanup.(bool); ok && b && !r.isBeingWritten(layer.ID) {
 						err = r.deleteInternal(layer.ID)
 						if err != nil {
 							break
@@ -417,6 +415,64 @@ func (r *layerStore) Load() error {
 	return err
 }
 
+// applyChange updates our copy of a layer, and our indexes, to match a layer
+// record which Load() found had been added, changed, or removed.  It returns
+// true if it had to take names away from other layers.
+func (r *layerStore) applyChange(change metadataChange) bool {
+	shouldSave := false
+	layer := r.byid[change.ID]
+	var compressedDigest, uncompressedDigest digest.Digest
+	if layer != nil {
+		for _, name := range layer.Names {
+			if r.byname[name] == layer {
+				delete(r.byname, name)
+			}
+		}
+		compressedDigest, uncompressedDigest = layer.CompressedDigest, layer.UncompressedDigest
+	}
+	if change.Record == nil {
+		if layer != nil {
+			updateDigestMap(&r.bycompressedsum, compressedDigest, "", layer.ID)
+			updateDigestMap(&r.byuncompressedsum, uncompressedDigest, "", layer.ID)
+			delete(r.byid, layer.ID)
+			r.idindex.Delete(layer.ID)
+			for i := range r.layers {
+				if r.layers[i] == layer {
+					r.layers = append(r.layers[:i], r.layers[i+1:]...)
+					break
+				}
+			}
+		}
+		return false
+	}
+	if layer != nil {
+		*layer = *copyLayer(change.Record.(*Layer))
+	} else {
+		layer = copyLayer(change.Record.(*Layer))
+		r.layers = append(r.layers, layer)
+		r.byid[layer.ID] = layer
+		r.idindex.Add(layer.ID)
+	}
+	for _, name := range layer.Names {
+		if conflict, ok := r.byname[name]; ok && conflict != layer {
+			r.removeName(conflict, name)
+			shouldSave = true
+		}
+		r.byname[name] = layer
+	}
+	if layer.CompressedDigest != compressedDigest {
+		updateDigestMap(&r.bycompressedsum, compressedDigest, layer.CompressedDigest, layer.ID)
+	}
+	if layer.UncompressedDigest != uncompressedDigest {
+		updateDigestMap(&r.byuncompressedsum, uncompressedDigest, layer.UncompressedDigest, layer.ID)
+	}
+	if layer.MountLabel != "" {
+		label.ReserveLabel(layer.MountLabel)
+	}
+	layer.ReadOnly = !r.IsReadWrite()
+	return shouldSave
+}
+
 func (r *layerStore) LoadLocked() error {
 	r.lockfile.Lock()
 	defer r.lockfile.Unlock()
@@ -430,8 +486,16 @@ func (r *layerStore) loadMounts() error {
 	if err != nil && !os.IsNotExist(err) {
 		return err
 	}
+	// mountpoints.json is usually on a filesystem which is cleared at
+	// boot, so when it's recreated, use the version of the format that
+	// layers.json is in.
+	version, list, err := decodeMetadataFile(mpath, data, r.metadata.Version())
+	if err != nil {
+		return err
+	}
+	r.mountsVersion = version
 	layerMounts := []layerMountPoint{}
-	if err = json.Unmarshal(data, &layerMounts); len(data) == 0 || err == nil {
+	if err = json.Unmarshal(list, &layerMounts); len(list) == 0 || err == nil {
 		// Clear all of our mount information.  If another process
 		// unmounted something, it (along with its zero count) won't
 		// have been encoded into the version of mountpoints.json that
@@ -461,7 +525,9 @@ func (r *layerStore) loadMounts() error {
 }
 
 func (r *layerStore) Save() error {
-	r.mountsLockfile.Lock()
+	if err := r.lockMounts(); err != nil {
+		return err
+	}
 	defer r.mountsLockfile.Unlock()
 	defer r.mountsLockfile.Touch()
 	if err := r.saveLayers(); err != nil {
@@ -477,16 +543,12 @@ func (r *layerStore) saveLayers() error {
 	if !r.Locked() {
 		return errors.New("layer store is not locked for writing")
 	}
-	rpath := r.layerspath()
-	if err := os.MkdirAll(filepath.Dir(rpath), 0700); err != nil {
-		return err
-	}
-	jldata, err := json.Marshal(&r.layers)
-	if err != nil {
-		return err
+	records := make([]interface{}, len(r.layers))
+	for i := range r.layers {
+		records[i] = r.layers[i]
 	}
 	defer r.Touch()
-	return ioutils.AtomicWriteFile(rpath, jldata, 0600)
+	return r.metadata.Save(records)
 }
 
 func (r *layerStore) saveMounts() error {
@@ -497,6 +559,9 @@ func (r *layerStore) saveMounts() error {
 		return errors.New("layer store mount information is not locked for writing")
 	}
 	mpath := r.mountspath()
+	if err := checkMetadataVersion(mpath, r.mountsVersion); err != nil {
+		return err
+	}
 	if err := os.MkdirAll(filepath.Dir(mpath), 0700); err != nil {
 		return err
 	}
@@ -514,7 +579,7 @@ func (r *layerStore) saveMounts() error {
 	if err != nil {
 		return err
 	}
-	if err = ioutils.AtomicWriteFile(mpath, jmdata, 0600); err != nil {
+	if err = ioutils.AtomicWriteFile(mpath, encodeMetadataFile(r.mountsVersion, jmdata), 0600); err != nil {
 		return err
 	}
 	return r.loadMounts()
@@ -535,6 +600,10 @@ func (s *store) newLayerStore(rundir string, layerdir string, driver context.Dri
 	if err != nil {
 		return nil, err
 	}
+	metadata, err := newLayerMetadataBackend(s.metadataBackend, filepath.Join(layerdir, "layers.json"))
+	if err != nil {
+		return nil, err
+	}
 	rlstore := layerStore{
 		lockfile:       lockfile,
 		mountsLockfile: mountsLockfile,
@@ -546,6 +615,8 @@ func (s *store) newLayerStore(rundir string, layerdir string, driver context.Dri
 		byname:         make(map[string]*Layer),
 		uidMap:         copyIDMap(s.uidMap),
 		gidMap:         copyIDMap(s.gidMap),
+		metadata:       metadata,
+		lockTimeout:    s.lockTimeout,
 	}
 	if err := rlstore.Load(); err != nil {
 		return nil, err
@@ -558,6 +629,10 @@ func newROLayerStore(rundir string, layerdir string, driver context.Driver) (ROL
 	if err != nil {
 		return nil, err
 	}
+	metadata, err := newLayerMetadataBackend(MetadataBackendJSON, filepath.Join(layerdir, "layers.json"))
+	if err != nil {
+		return nil, err
+	}
 	rlstore := layerStore{
 		lockfile:       lockfile,
 		mountsLockfile: nil,
@@ -567,6 +642,7 @@ func newROLayerStore(rundir string, layerdir string, driver context.Driver) (ROL
 		byid:           make(map[string]*Layer),
 		bymount:        make(map[string]*Layer),
 		byname:         make(map[string]*Layer),
+		metadata:       metadata,
 	}
 	if err := rlstore.Load(); err != nil {
 		return nil, err
@@ -574,6 +650,16 @@ func newROLayerStore(rundir string, layerdir string, driver context.Driver) (ROL
 	return &rlstore, nil
 }
 
+// newLayerMetadataBackend returns a metadataBackend which reads and writes the
+// list of layers in the layers.json file at path.
+func newLayerMetadataBackend(kind, path string) (metadataBackend, error) {
+	return newMetadataBackend(kind, path, func() interface{} {
+		return &Layer{}
+	}, func(record interface{}) string {
+		return record.(*Layer).ID
+	})
+}
+
 func (r *layerStore) lookup(id string) (*Layer, bool) {
 	if layer, ok := r.byid[id]; ok {
 		return layer, ok
@@ -609,6 +695,7 @@ func (r *layerStore) ClearFlag(id string, flag string) error {
 		return ErrLayerUnknown
 	}
 	delete(layer.Flags, flag)
+	r.metadata.Changed(layer.ID)
 	return r.Save()
 }
 
@@ -624,6 +711,28 @@ func (r *layerStore) SetFlag(id string, flag string, value interface{}) error {
 		layer.Flags = make(map[string]interface{})
 	}
 	layer.Flags[flag] = value
+	r.metadata.Changed(layer.ID)
+	return r.Save()
+}
+
+// touch records that a layer was used at the specified time.  The layer list
+// is only rewritten if the previously-recorded time is at least
+// lastUsedInterval older than the new one.  Otherwise, the new time is
+// discarded, so that the recorded time always matches the one in the list,
+// and it's the one that we compare against the next time.
+func (r *layerStore) touch(id string, when time.Time) error {
+	if !r.IsReadWrite() {
+		return nil
+	}
+	layer, ok := r.lookup(id)
+	if !ok {
+		return ErrLayerUnknown
+	}
+	if when.Sub(layer.LastUsed) < lastUsedInterval {
+		return nil
+	}
+	layer.LastUsed = when
+	r.metadata.Changed(layer.ID)
 	return r.Save()
 }
 
@@ -784,6 +893,7 @@ func (r *layerStore) Put(id string, parentLayer *Layer, names []string, mountLab
 			UIDMap:       copyIDMap(moreOptions.UIDMap),
 			GIDMap:       copyIDMap(moreOptions.GIDMap),
 			BigDataNames: []string{},
+			StorageOpt:   copyStringStringMap(options),
 		}
 		r.layers = append(r.layers, layer)
 		r.idindex.Add(id)
@@ -813,6 +923,7 @@ func (r *layerStore) Put(id string, parentLayer *Layer, names []string, mountLab
 				return nil, -1, err
 			}
 			delete(layer.Flags, incompleteFlag)
+			r.metadata.Changed(layer.ID)
 		}
 		err = r.Save()
 		if err != nil {
@@ -839,7 +950,9 @@ func (r *layerStore) Mounted(id string) (int, error) {
 	if !r.IsReadWrite() {
 		return 0, errors.Wrapf(ErrStoreIsReadOnly, "no mount information for layers at %q", r.mountspath())
 	}
-	r.mountsLockfile.RLock()
+	if err := r.rlockMounts(); err != nil {
+		return 0, err
+	}
 	defer r.mountsLockfile.Unlock()
 	if modified, err := r.mountsLockfile.Modified(); modified || err != nil {
 		if err = r.loadMounts(); err != nil {
@@ -870,7 +983,9 @@ func (r *layerStore) Mount(id string, options context.MountOpts) (string, error)
 	if !r.IsReadWrite() && !hasReadOnlyOpt(options.Options) {
 		return "", errors.Wrapf(ErrStoreIsReadOnly, "not allowed to update mount locations for layers at %q", r.mountspath())
 	}
-	r.mountsLockfile.Lock()
+	if err := r.lockMounts(); err != nil {
+		return "", err
+	}
 	defer r.mountsLockfile.Unlock()
 	if modified, err := r.mountsLockfile.Modified(); modified || err != nil {
 		if err = r.loadMounts(); err != nil {
@@ -882,6 +997,9 @@ func (r *layerStore) Mount(id string, options context.MountOpts) (string, error)
 	if !ok {
 		return "", ErrLayerUnknown
 	}
+	if err := r.checkComplete(layer); err != nil {
+		return "", err
+	}
 	if layer.MountCount > 0 {
 		mounted, err := mount.Mounted(layer.MountPoint)
 		if err != nil {
@@ -921,7 +1039,9 @@ func (r *layerStore) Unmount(id string, force bool) (bool, error) {
 	if !r.IsReadWrite() {
 		return false, errors.Wrapf(ErrStoreIsReadOnly, "not allowed to update mount locations for layers at %q", r.mountspath())
 	}
-	r.mountsLockfile.Lock()
+	if err := r.lockMounts(); err != nil {
+		return false, err
+	}
 	defer r.mountsLockfile.Unlock()
 	if modified, err := r.mountsLockfile.Modified(); modified || err != nil {
 		if err = r.loadMounts(); err != nil {
@@ -960,7 +1080,9 @@ func (r *layerStore) ParentOwners(id string) (uids, gids []int, err error) {
 	if !r.IsReadWrite() {
 		return nil, nil, errors.Wrapf(ErrStoreIsReadOnly, "no mount information for layers at %q", r.mountspath())
 	}
-	r.mountsLockfile.RLock()
+	if err := r.rlockMounts(); err != nil {
+		return nil, nil, err
+	}
 	defer r.mountsLockfile.Unlock()
 	if modified, err := r.mountsLockfile.Modified(); modified || err != nil {
 		if err = r.loadMounts(); err != nil {
@@ -1029,6 +1151,7 @@ func (r *layerStore) ParentOwners(id string) (uids, gids []int, err error) {
 
 func (r *layerStore) removeName(layer *Layer, name string) {
 	layer.Names = stringSliceWithoutValue(layer.Names, name)
+	r.metadata.Changed(layer.ID)
 }
 
 func (r *layerStore) SetNames(id string, names []string) error {
@@ -1047,6 +1170,7 @@ func (r *layerStore) SetNames(id string, names []string) error {
 			r.byname[name] = layer
 		}
 		layer.Names = names
+		r.metadata.Changed(layer.ID)
 		return r.Save()
 	}
 	return ErrLayerUnknown
@@ -1113,6 +1237,7 @@ func (r *layerStore) SetBigData(id, key string, data io.Reader) error {
 	}
 	if addName {
 		layer.BigDataNames = append(layer.BigDataNames, key)
+		r.metadata.Changed(layer.ID)
 		return r.Save()
 	}
 	return nil
@@ -1139,6 +1264,7 @@ func (r *layerStore) SetMetadata(id, metadata string) error {
 	}
 	if layer, ok := r.lookup(id); ok {
 		layer.Metadata = metadata
+		r.metadata.Changed(layer.ID)
 		return r.Save()
 	}
 	return ErrLayerUnknown
@@ -1232,6 +1358,9 @@ func (r *layerStore) Delete(id string) error {
 		return ErrLayerUnknown
 	}
 	id = layer.ID
+	if isIncomplete(layer.Flags) && r.isBeingWritten(id) {
+		return errors.Wrapf(ErrLayerIncomplete, "error removing layer %q", id)
+	}
 	// The layer may already have been explicitly unmounted, but if not, we
 	// should try to clean that up before we start deleting anything at the
 	// driver level.
@@ -1365,6 +1494,14 @@ func (r *layerStore) Diff(from, to string, options *DiffOptions) (io.ReadCloser,
 	if err != nil {
 		return nil, ErrLayerUnknown
 	}
+	if err := r.checkComplete(toLayer); err != nil {
+		return nil, err
+	}
+	if fromLayer != nil {
+		if err := r.checkComplete(fromLayer); err != nil {
+			return nil, err
+		}
+	}
 	// Default to applying the type of compression that we noted was used
 	// for the layerdiff when it was applied.
 	compression := toLayer.CompressionType
@@ -1505,6 +1642,12 @@ func (r *layerStore) DiffSize(from, to string) (size int64, err error) {
 }
 
 func (r *layerStore) ApplyDiff(to string, diff io.Reader) (size int64, err error) {
+	return r.applyDiff(gocontext.Background(), to, diff)
+}
+
+// applyDiff is ApplyDiff, except that the driver is asked to stop applying the
+// diff if ctx is done first.
+func (r *layerStore) applyDiff(ctx gocontext.Context, to string, diff io.Reader) (size int64, err error) {
 	if !r.IsReadWrite() {
 		return -1, errors.Wrapf(ErrStoreIsReadOnly, "not allowed to modify layer contents at %q", r.layerspath())
 	}
@@ -1514,10 +1657,38 @@ func (r *layerStore) ApplyDiff(to string, diff io.Reader) (size int64, err error
 		return -1, ErrLayerUnknown
 	}
 
+	applied, err := r.extractDiff(ctx, layer.ID, layer.Parent, r.layerMappings(layer), layer.MountLabel, diff)
+	if err != nil {
+		return -1, err
+	}
+	r.recordAppliedDiff(layer, applied)
+
+	err = r.Save()
+
+	return applied.size, err
+}
+
+// appliedDiff is what extractDiff() learns about a diff while applying it.
+type appliedDiff struct {
+	size               int64
+	compression        archive.Compression
+	compressedDigest   digest.Digest
+	compressedSize     int64
+	uncompressedDigest digest.Digest
+	uncompressedSize   int64
+	uidLog, gidLog     map[uint32]struct{}
+}
+
+// extractDiff applies a diff to the driver's copy of a layer and writes the
+// layer's tar-split data, but doesn't update the layer's record.  Since it
+// doesn't use any of the store's in-memory state, it can be called without
+// the store being locked, so long as nobody else is using the layer.  If ctx
+// can be done, the driver is asked to stop applying the diff when it is.
+func (r *layerStore) extractDiff(ctx gocontext.Context, id, parent string, mappings *idtools.IDMappings, mountLabel string, diff io.Reader) (*appliedDiff, error) {
 	header := make([]byte, 10240)
 	n, err := diff.Read(header)
 	if err != nil && err != io.EOF {
-		return -1, err
+		return nil, err
 	}
 
 	compression := archive.DetectCompression(header[:n])
@@ -1536,7 +1707,7 @@ func (r *layerStore) ApplyDiff(to string, diff io.Reader) (size int64, err error
 	metadata := storage.NewJSONPacker(compressor)
 	uncompressed, err := archive.DecompressStream(defragmented)
 	if err != nil {
-		return -1, err
+		return nil, err
 	}
 	defer uncompressed.Close()
 	uncompressedDigest := digest.Canonical.Digester()
@@ -1550,56 +1721,84 @@ func (r *layerStore) ApplyDiff(to string, diff io.Reader) (size int64, err error
 		}
 	})
 	if err != nil {
-		return -1, err
+		return nil, err
 	}
 	defer idLogger.Close()
 	payload, err := asm.NewInputTarStream(io.TeeReader(uncompressed, io.MultiWriter(uncompressedCounter, idLogger)), metadata, storage.NewDiscardFilePutter())
 	if err != nil {
-		return -1, err
+		return nil, err
 	}
 	options := context.ApplyDiffOpts{
 		Diff:       payload,
-		Mappings:   r.layerMappings(layer),
-		MountLabel: layer.MountLabel,
+		Mappings:   mappings,
+		MountLabel: mountLabel,
+	}
+	if ctx.Done() != nil {
+		options.Context = ctx
 	}
-	size, err = r.driver.ApplyDiff(layer.ID, layer.Parent, options)
+	size, err := r.driver.ApplyDiff(id, parent, options)
 	if err != nil {
-		return -1, err
+		return nil, err
 	}
 	compressor.Close()
 	if err == nil {
-		if err := os.MkdirAll(filepath.Dir(r.tspath(layer.ID)), 0700); err != nil {
-			return -1, err
+		if err := os.MkdirAll(filepath.Dir(r.tspath(id)), 0700); err != nil {
+			return nil, err
 		}
-		if err := ioutils.AtomicWriteFile(r.tspath(layer.ID), tsdata.Bytes(), 0600); err != nil {
-			return -1, err
+		if err := ioutils.AtomicWriteFile(r.tspath(id), tsdata.Bytes(), 0600); err != nil {
+			return nil, err
 		}
 	}
 
-	updateDigestMap := func(m *map[digest.Digest][]string, oldvalue, newvalue digest.Digest, id string) {
-		var newList []string
-		if oldvalue != "" {
-			for _, value := range (*m)[oldvalue] {
-				if value != id {
-					newList = append(newList, value)
-				}
-			}
-			if len(newList) > 0 {
-				(*m)[oldvalue] = newList
-			} else {
-				delete(*m, oldvalue)
+	return &appliedDiff{
+		size:               size,
+		compression:        compression,
+		compressedDigest:   compressedDigest.Digest(),
+		compressedSize:     compressedCounter.Count,
+		uncompressedDigest: uncompressedDigest.Digest(),
+		uncompressedSize:   uncompressedCounter.Count,
+		uidLog:             uidLog,
+		gidLog:             gidLog,
+	}, nil
+}
+
+// recordAppliedDiff updates a layer's record using what extractDiff() learned
+// about the diff that it applied to the layer.
+func (r *layerStore) recordAppliedDiff(layer *Layer, applied *appliedDiff) {
+	r.recordDiff(layer, applied.compression, applied.compressedDigest, applied.compressedSize, applied.uncompressedDigest, applied.uncompressedSize, applied.uidLog, applied.gidLog)
+}
+
+// updateDigestMap moves id from the list of layers with the digest oldvalue to
+// the list of layers with the digest newvalue.
+func updateDigestMap(m *map[digest.Digest][]string, oldvalue, newvalue digest.Digest, id string) {
+	var newList []string
+	if oldvalue != "" {
+		for _, value := range (*m)[oldvalue] {
+			if value != id {
+				newList = append(newList, value)
 			}
 		}
-		if newvalue != "" {
-			(*m)[newvalue] = append((*m)[newvalue], id)
+		if len(newList) > 0 {
+			(*m)[oldvalue] = newList
+		} else {
+			delete(*m, oldvalue)
 		}
 	}
-	updateDigestMap(&r.bycompressedsum, layer.CompressedDigest, compressedDigest.Digest(), layer.ID)
-	layer.CompressedDigest = compressedDigest.Digest()
-	layer.CompressedSize = compressedCounter.Count
-	updateDigestMap(&r.byuncompressedsum, layer.UncompressedDigest, uncompressedDigest.Digest(), layer.ID)
-	layer.UncompressedDigest = uncompressedDigest.Digest()
-	layer.UncompressedSize = uncompressedCounter.Count
+	if newvalue != "" {
+		(*m)[newvalue] = append((*m)[newvalue], id)
+	}
+}
+
+// recordDiff updates the digests, sizes, and lists of IDs that we keep for a
+// layer, along with the indexes which we use to look up layers by digest.
+func (r *layerStore) recordDiff(layer *Layer, compression archive.Compression, compressedDigest digest.Digest, compressedSize int64, uncompressedDigest digest.Digest, uncompressedSize int64, uidLog, gidLog map[uint32]struct{}) {
+	r.metadata.Changed(layer.ID)
+	updateDigestMap(&r.bycompressedsum, layer.CompressedDigest, compressedDigest, layer.ID)
+	layer.CompressedDigest = compressedDigest
+	layer.CompressedSize = compressedSize
+	updateDigestMap(&r.byuncompressedsum, layer.UncompressedDigest, uncompressedDigest, layer.ID)
+	layer.UncompressedDigest = uncompressedDigest
+	layer.UncompressedSize = uncompressedSize
 	layer.CompressionType = compression
 	layer.UIDs = make([]uint32, 0, len(uidLog))
 	for uid := range uidLog {
@@ -1615,9 +1814,403 @@ func (r *layerStore) ApplyDiff(to string, diff io.Reader) (size int64, err error
 	sort.Slice(layer.GIDs, func(i, j int) bool {
 		return layer.GIDs[i] < layer.GIDs[j]
 	})
+}
 
-	err = r.Save()
+// recordDriverDiff reads the driver's diff for a layer whose contents were
+// populated without a diff having been applied to it, and records the
+// tar-split data, digests, sizes, and lists of IDs that ApplyDiff() would
+// have recorded if the layer had been populated using that diff.
+// parentLayer is the layer's parent, which can be in another layer store.
+func (r *layerStore) recordDriverDiff(layer, parentLayer *Layer) error {
+	rc, err := r.driver.Diff(layer.ID, r.layerMappings(layer), layer.Parent, r.layerMappings(parentLayer), layer.MountLabel)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
 
+	tsdata := bytes.Buffer{}
+	compressor, err := pgzip.NewWriterLevel(&tsdata, pgzip.BestSpeed)
+	if err != nil {
+		compressor = pgzip.NewWriter(&tsdata)
+	}
+	if err := compressor.SetConcurrency(1024*1024, 1); err != nil { // 1024*1024 is the hard-coded default; we're not changing that
+		logrus.Infof("error setting compression concurrency threads to 1: %v; ignoring", err)
+	}
+	metadata := storage.NewJSONPacker(compressor)
+	uncompressedDigest := digest.Canonical.Digester()
+	uncompressedCounter := ioutils.NewWriteCounter(uncompressedDigest.Hash())
+	uidLog := make(map[uint32]struct{})
+	gidLog := make(map[uint32]struct{})
+	idLogger, err := tarlogger.NewLogger(func(h *tar.Header) {
+		if !strings.HasPrefix(path.Base(h.Name), archive.WhiteoutPrefix) {
+			uidLog[uint32(h.Uid)] = struct{}{}
+			gidLog[uint32(h.Gid)] = struct{}{}
+		}
+	})
+	if err != nil {
+		return err
+	}
+	payload, err := asm.NewInputTarStream(io.TeeReader(rc, io.MultiWriter(uncompressedCounter, idLogger)), metadata, storage.NewDiscardFilePutter())
+	if err != nil {
+		idLogger.Close()
+		return err
+	}
+	_, err = io.Copy(ioutil.Discard, payload)
+	compressor.Close()
+	// Closing the logger waits for it to finish reading the headers.
+	idLogger.Close()
+	if err != nil {
+		return errors.Wrapf(err, "error reading diff for layer %q", layer.ID)
+	}
+	if err := os.MkdirAll(filepath.Dir(r.tspath(layer.ID)), 0700); err != nil {
+		return err
+	}
+	if err := ioutils.AtomicWriteFile(r.tspath(layer.ID), tsdata.Bytes(), 0600); err != nil {
+		return err
+	}
+
+	r.recordDiff(layer, archive.Uncompressed, uncompressedDigest.Digest(), uncompressedCounter.Count, uncompressedDigest.Digest(), uncompressedCounter.Count, uidLog, gidLog)
+	return nil
+}
+
+// commit creates a read-only layer with the same contents as the layer "from",
+// which uses parentLayer, which can be in another layer store, as its parent,
+// and which doesn't use ID mappings.  parentLayer should have the same
+// contents as "from"'s parent, though it can be an unmapped version of it.
+// If the driver's CreateFromTemplate() makes
+// copies which don't depend on the template, the new layer is created using
+// it, otherwise the driver's diff for "from" is applied to the new layer.
+func (r *layerStore) commit(id, from string, parentLayer *Layer, names []string, flags map[string]interface{}) (*Layer, error) {
+	if !r.IsReadWrite() {
+		return nil, errors.Wrapf(ErrStoreIsReadOnly, "not allowed to create new layers at %q", r.layerspath())
+	}
+	fromLayer, ok := r.lookup(from)
+	if !ok {
+		return nil, ErrLayerUnknown
+	}
+
+	if copier, ok := r.driver.(context.TemplateCopierDriver); !ok || !copier.CopiesTemplates() {
+		uncompressed := archive.Uncompressed
+		diff, err := r.Diff(fromLayer.Parent, fromLayer.ID, &DiffOptions{Compression: &uncompressed})
+		if err != nil {
+			return nil, err
+		}
+		defer diff.Close()
+		layer, _, err := r.Put(id, parentLayer, names, "", nil, &LayerOptions{}, false, flags, diff)
+		return layer, err
+	}
+
+	// Mark the layer as incomplete until we've finished reading its diff,
+	// so that it'll be cleaned up if we're interrupted.
+	incompleteFlags := map[string]interface{}{incompleteFlag: true}
+	for flag, value := range flags {
+		incompleteFlags[flag] = value
+	}
+	layer, _, err := r.Put(id, parentLayer, names, "", nil, &LayerOptions{TemplateLayer: fromLayer.ID}, false, incompleteFlags, nil)
+	if err != nil {
+		return nil, err
+	}
+	layer, ok = r.lookup(layer.ID)
+	if !ok {
+		return nil, ErrLayerUnknown
+	}
+	if err := r.recordDriverDiff(layer, parentLayer); err != nil {
+		if err2 := r.Delete(layer.ID); err2 != nil {
+			logrus.Debugf("error removing layer %q after failing to commit it: %v", layer.ID, err2)
+		}
+		return nil, err
+	}
+	delete(layer.Flags, incompleteFlag)
+	r.metadata.Changed(layer.ID)
+	if err := r.Save(); err != nil {
+		return nil, err
+	}
+	return copyLayer(layer), nil
+}
+
+// squash creates a read-only layer with the contents of the layer "top" as
+// they appear when it is mounted, using the parent of the layer "base" as its
+// parent.  "base" must be "top" or one of its ancestors.  If "base" is "", the
+// new layer has no parent, and includes everything in "top"'s mounted view.
+func (r *layerStore) squash(id, top, base string, names []string, flags map[string]interface{}) (*Layer, error) {
+	if !r.IsReadWrite() {
+		return nil, errors.Wrapf(ErrStoreIsReadOnly, "not allowed to create new layers at %q", r.layerspath())
+	}
+	topLayer, ok := r.lookup(top)
+	if !ok {
+		return nil, ErrLayerUnknown
+	}
+	parent := ""
+	if base != "" {
+		baseLayer, ok := r.lookup(base)
+		if !ok {
+			return nil, ErrLayerUnknown
+		}
+		for layer := topLayer; layer.ID != baseLayer.ID; {
+			if layer.Parent == "" {
+				return nil, errors.Errorf("layer %q is not layer %q or one of its parents", baseLayer.ID, topLayer.ID)
+			}
+			if layer, ok = r.lookup(layer.Parent); !ok {
+				return nil, ErrLayerUnknown
+			}
+		}
+		parent = baseLayer.Parent
+	}
+	var parentLayer *Layer
+	if parent != "" {
+		if parentLayer, ok = r.lookup(parent); !ok {
+			return nil, ErrLayerUnknown
+		}
+	}
+
+	// The driver's diff between the top layer and the new layer's parent
+	// has the merged contents of the layers in between, with whiteouts
+	// only for what they removed from the parent.
+	diff, err := r.driver.Diff(topLayer.ID, r.layerMappings(topLayer), parent, r.layerMappings(parentLayer), topLayer.MountLabel)
+	if err != nil {
+		return nil, err
+	}
+	defer diff.Close()
+	layer, _, err := r.Put(id, parentLayer, names, "", nil, &LayerOptions{}, false, flags, diff)
+	return layer, err
+}
+
+// rebase creates a read-only layer by applying the diff for the layer "from"
+// on top of the layer "parent", or on top of nothing if "parent" is "".  It
+// also returns the paths of files which the diff modifies that differ between
+// the layer's original parent and its new one, since the rebased layer's
+// versions of those files may not work with the new parent.
+func (r *layerStore) rebase(from, parent string, names []string) (*Layer, []string, error) {
+	if !r.IsReadWrite() {
+		return nil, nil, errors.Wrapf(ErrStoreIsReadOnly, "not allowed to create new layers at %q", r.layerspath())
+	}
+	fromLayer, ok := r.lookup(from)
+	if !ok {
+		return nil, nil, ErrLayerUnknown
+	}
+	var oldParentLayer, parentLayer *Layer
+	if fromLayer.Parent != "" {
+		if oldParentLayer, ok = r.lookup(fromLayer.Parent); !ok {
+			return nil, nil, ErrLayerUnknown
+		}
+	}
+	if parent != "" {
+		if parentLayer, ok = r.lookup(parent); !ok {
+			return nil, nil, ErrLayerUnknown
+		}
+		for layer := parentLayer; layer != nil; layer, _ = r.lookup(layer.Parent) {
+			if layer.ID == fromLayer.ID {
+				return nil, nil, errors.Errorf("layer %q can not be rebased onto itself or one of its children", fromLayer.ID)
+			}
+			if layer.Parent == "" {
+				break
+			}
+		}
+		parent = parentLayer.ID
+	}
+
+	// Note what's different between the old parent and the new one.
+	changed := make(map[string]bool)
+	if parent != fromLayer.Parent {
+		var changes []archive.Change
+		var err error
+		if parentLayer != nil {
+			changes, err = r.driver.Changes(parentLayer.ID, r.layerMappings(parentLayer), fromLayer.Parent, r.layerMappings(oldParentLayer), parentLayer.MountLabel)
+		} else {
+			changes, err = r.driver.Changes(oldParentLayer.ID, r.layerMappings(oldParentLayer), "", r.layerMappings(nil), oldParentLayer.MountLabel)
+		}
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "error comparing the old and new parents of layer %q", fromLayer.ID)
+		}
+		for _, change := range changes {
+			changed[path.Clean("/"+change.Path)] = true
+		}
+	}
+
+	uncompressed := archive.Uncompressed
+	diff, err := r.Diff(fromLayer.Parent, fromLayer.ID, &DiffOptions{Compression: &uncompressed})
+	if err != nil {
+		return nil, nil, err
+	}
+	defer diff.Close()
+	conflicts := make(map[string]bool)
+	conflictLogger, err := tarlogger.NewLogger(func(h *tar.Header) {
+		if h.Typeflag == tar.TypeDir {
+			return
+		}
+		name := path.Clean("/" + h.Name)
+		if base := path.Base(name); base == archive.WhiteoutOpaqueDir {
+			name = path.Dir(name)
+		} else if strings.HasPrefix(base, archive.WhiteoutPrefix) {
+			name = path.Join(path.Dir(name), strings.TrimPrefix(base, archive.WhiteoutPrefix))
+		}
+		if changed[name] {
+			conflicts[name] = true
+		}
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	moreOptions := &LayerOptions{
+		IDMappingOptions: IDMappingOptions{
+			UIDMap: copyIDMap(fromLayer.UIDMap),
+			GIDMap: copyIDMap(fromLayer.GIDMap),
+		},
+	}
+	layer, _, err := r.Put("", parentLayer, names, fromLayer.MountLabel, nil, moreOptions, false, nil, io.TeeReader(diff, conflictLogger))
+	// Closing the logger waits for it to finish reading the headers.
+	conflictLogger.Close()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	conflictList := make([]string, 0, len(conflicts))
+	for name := range conflicts {
+		conflictList = append(conflictList, name)
+	}
+	sort.Strings(conflictList)
+	return layer, conflictList, nil
+}
+
+// clone creates a read-write layer with the same parent and contents as the
+// layer "from".  If the driver's CreateFromTemplate() makes copies which don't
+// depend on the template, the new layer is created using it, otherwise the
+// driver's diff for "from" is applied to the new layer.
+func (r *layerStore) clone(id, from, mountLabel string, flags map[string]interface{}) (*Layer, error) {
+	if !r.IsReadWrite() {
+		return nil, errors.Wrapf(ErrStoreIsReadOnly, "not allowed to create new layers at %q", r.layerspath())
+	}
+	fromLayer, ok := r.lookup(from)
+	if !ok {
+		return nil, ErrLayerUnknown
+	}
+	var parentLayer *Layer
+	if fromLayer.Parent != "" {
+		if parentLayer, ok = r.lookup(fromLayer.Parent); !ok {
+			return nil, ErrLayerUnknown
+		}
+	}
+	moreOptions := &LayerOptions{
+		IDMappingOptions: IDMappingOptions{
+			HostUIDMapping: len(fromLayer.UIDMap) == 0,
+			HostGIDMapping: len(fromLayer.GIDMap) == 0,
+			UIDMap:         copyIDMap(fromLayer.UIDMap),
+			GIDMap:         copyIDMap(fromLayer.GIDMap),
+		},
+	}
+
+	if copier, ok := r.driver.(context.TemplateCopierDriver); ok && copier.CopiesTemplates() {
+		moreOptions.TemplateLayer = fromLayer.ID
+		layer, _, err := r.Put(id, parentLayer, nil, mountLabel, nil, moreOptions, true, flags, nil)
+		return layer, err
+	}
+
+	uncompressed := archive.Uncompressed
+	diff, err := r.Diff(fromLayer.Parent, fromLayer.ID, &DiffOptions{Compression: &uncompressed})
+	if err != nil {
+		return nil, err
+	}
+	defer diff.Close()
+	layer, _, err := r.Put(id, parentLayer, nil, mountLabel, nil, moreOptions, true, flags, diff)
+	return layer, err
+}
+
+// reset discards the contents of a layer by having the driver recreate it,
+// with the same ID, parent, mount label, ID mappings, and storage options,
+// and forgets any digests and tar-split data that we had recorded for it.
+// The layer is marked as incomplete until it has been recreated, so that it
+// is cleaned up if we're interrupted.
+func (r *layerStore) reset(id string) error {
+	if !r.IsReadWrite() {
+		return errors.Wrapf(ErrStoreIsReadOnly, "not allowed to modify layer contents at %q", r.layerspath())
+	}
+	layer, ok := r.lookup(id)
+	if !ok {
+		return ErrLayerUnknown
+	}
+	var parentLayer *Layer
+	if layer.Parent != "" {
+		if parentLayer, ok = r.lookup(layer.Parent); !ok {
+			return ErrLayerUnknown
+		}
+	}
+	if layer.MountCount > 0 {
+		return errors.Wrapf(ErrLayerMounted, "error resetting layer %q", layer.ID)
+	}
+	if layer.StorageOpt == nil {
+		logrus.Warnf("no storage options were recorded for layer %q, recreating it with the driver's defaults", layer.ID)
+	}
+
+	layer.Flags[incompleteFlag] = true
+	r.metadata.Changed(layer.ID)
+	if err := r.Save(); err != nil {
+		delete(layer.Flags, incompleteFlag)
+		return err
+	}
+	if err := r.driver.Remove(layer.ID); err != nil {
+		return errors.Wrapf(err, "error removing contents of layer %q", layer.ID)
+	}
+	idMappings := r.layerMappings(layer)
+	opts := context.CreateOpts{
+		MountLabel: layer.MountLabel,
+		StorageOpt: copyStringStringMap(layer.StorageOpt),
+		IDMappings: idMappings,
+	}
+	if err := r.driver.CreateReadWrite(layer.ID, layer.Parent, &opts); err != nil {
+		return errors.Wrapf(err, "error recreating read-write layer with ID %q", layer.ID)
+	}
+	parentMappings := r.layerMappings(parentLayer)
+	if !reflect.DeepEqual(parentMappings.UIDs(), idMappings.UIDs()) || !reflect.DeepEqual(parentMappings.GIDs(), idMappings.GIDs()) {
+		if err := r.driver.UpdateLayerIDMap(layer.ID, parentMappings, idMappings, layer.MountLabel); err != nil {
+			return err
+		}
+	}
+
+	if err := os.Remove(r.tspath(layer.ID)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	r.recordDiff(layer, archive.Uncompressed, "", 0, "", 0, nil, nil)
+	delete(layer.Flags, incompleteFlag)
+	return r.Save()
+}
+
+// applyDiffWithContext is ApplyDiff, except that it stops reading the diff,
+// and stops the driver from applying it, if ctx is cancelled.  The layer is
+// marked as incomplete while the diff is being applied, and is removed if
+// applying it is cancelled.
+func (r *layerStore) applyDiffWithContext(ctx gocontext.Context, to string, diff io.Reader) (size int64, err error) {
+	if !r.IsReadWrite() {
+		return -1, errors.Wrapf(ErrStoreIsReadOnly, "not allowed to modify layer contents at %q", r.layerspath())
+	}
+
+	layer, ok := r.lookup(to)
+	if !ok {
+		return -1, ErrLayerUnknown
+	}
+
+	layer.Flags[incompleteFlag] = true
+	r.metadata.Changed(layer.ID)
+	if err := r.Save(); err != nil {
+		delete(layer.Flags, incompleteFlag)
+		return -1, err
+	}
+
+	reader := ioutils.NewCancelReadCloser(ctx, ioutil.NopCloser(diff))
+	defer reader.Close()
+	size, err = r.applyDiff(ctx, layer.ID, reader)
+	if err != nil && ctx.Err() != nil {
+		if err2 := r.Delete(layer.ID); err2 != nil {
+			// The incomplete flag will get the layer removed
+			// the next time the store is loaded.
+			logrus.Debugf("error removing layer %q after cancelling: %v", layer.ID, err2)
+		}
+		return -1, errors.Wrapf(ctx.Err(), "error applying diff to layer %q", layer.ID)
+	}
+	delete(layer.Flags, incompleteFlag)
+	r.metadata.Changed(layer.ID)
+	if err2 := r.Save(); err == nil {
+		err = err2
+	}
 	return size, err
 }
 
@@ -1657,6 +2250,7 @@ func (r *layerStore) ApplyDiffFromStagingDirectory(id, stagingDirectory string,
 	layer.UncompressedDigest = diffOutput.UncompressedDigest
 	layer.UncompressedSize = diffOutput.Size
 	layer.Metadata = diffOutput.Metadata
+	r.metadata.Changed(layer.ID)
 	if err = r.Save(); err != nil {
 		return err
 	}
@@ -1696,6 +2290,7 @@ func (r *layerStore) ApplyDiffWithDiffer(to string, options *context.ApplyDiffOp
 	}
 	layer.UIDs = output.UIDs
 	layer.GIDs = output.GIDs
+	r.metadata.Changed(layer.ID)
 	err = r.Save()
 	return &output, err
 }
@@ -1740,6 +2335,22 @@ func (r *layerStore) RLock() {
 	r.lockfile.RLock()
 }
 
+func (r *layerStore) TryLock() error {
+	return r.lockfile.TryLock()
+}
+
+func (r *layerStore) TryRLock() error {
+	return r.lockfile.TryRLock()
+}
+
+func (r *layerStore) LockWithContext(ctx gocontext.Context) error {
+	return r.lockfile.LockWithContext(ctx)
+}
+
+func (r *layerStore) RLockWithContext(ctx gocontext.Context) error {
+	return r.lockfile.RLockWithContext(ctx)
+}
+
 func (r *layerStore) Unlock() {
 	r.lockfile.Unlock()
 }
@@ -1748,6 +2359,18 @@ func (r *layerStore) Touch() error {
 	return r.lockfile.Touch()
 }
 
+// lockMounts takes a write lock on the layers' mount information.  If the
+// store has a lock timeout, and it passes before the lock is acquired, it
+// returns ErrLockTimeout.
+func (r *layerStore) lockMounts() error {
+	return lockWithTimeout(r.mountsLockfile, true, r.lockTimeout)
+}
+
+// rlockMounts is lockMounts, except that it takes a read lock.
+func (r *layerStore) rlockMounts() error {
+	return lockWithTimeout(r.mountsLockfile, false, r.lockTimeout)
+}
+
 func (r *layerStore) Modified() (bool, error) {
 	var mmodified, tmodified bool
 	lmodified, err := r.lockfile.Modified()
@@ -1755,7 +2378,9 @@ func (r *layerStore) Modified() (bool, error) {
 		return lmodified, err
 	}
 	if r.IsReadWrite() {
-		r.mountsLockfile.RLock()
+		if err := r.rlockMounts(); err != nil {
+			return lmodified, err
+		}
 		defer r.mountsLockfile.Unlock()
 		mmodified, err = r.mountsLockfile.Modified()
 		if err != nil {
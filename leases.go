@@ -0,0 +1,282 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/gepis/strge/pkg/ioutils"
+	"github.com/gepis/strge/pkg/stringid"
+	"github.com/gepis/strge/pkg/stringutils"
+	"github.com/pkg/errors"
+)
+
+// Lease protects the layers and images which are attached to it from being
+// removed by DeleteLayer(), DeleteImage(), DeleteWithOptions(), Wipe(), and
+// GarbageCollect(), until it is released or it expires.  Layers which leased layers are built
+// on, and the layers which leased images use, are protected along with them.
+type Lease struct {
+	ID      string    `json:"id"`
+	Created time.Time `json:"created"`
+	Expires time.Time `json:"expires"`
+	Layers  []string  `json:"layers,omitempty"`
+	Images  []string  `json:"images,omitempty"`
+}
+
+func (l *Lease) expired(now time.Time) bool {
+	return !now.Before(l.Expires)
+}
+
+func copyLease(l *Lease) *Lease {
+	return &Lease{
+		ID:      l.ID,
+		Created: l.Created,
+		Expires: l.Expires,
+		Layers:  copyStringSlice(l.Layers),
+		Images:  copyStringSlice(l.Images),
+	}
+}
+
+func (s *store) leasesPath() string {
+	return filepath.Join(s.graphRoot, "leases.json")
+}
+
+func (s *store) leasesLock() (Locker, error) {
+	return GetLockfile(filepath.Join(s.graphRoot, "leases.lock"))
+}
+
+// readLeases reads the list of leases which haven't expired.  The caller
+// should be holding the leases lock.
+func (s *store) readLeases() ([]*Lease, error) {
+	data, err := ioutil.ReadFile(s.leasesPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var all []*Lease
+	if err := json.Unmarshal(data, &all); err != nil {
+		return nil, errors.Wrapf(err, "error decoding leases from %q", s.leasesPath())
+	}
+	now := time.Now().UTC()
+	leases := all[:0]
+	for _, lease := range all {
+		if !lease.expired(now) {
+			leases = append(leases, lease)
+		}
+	}
+	return leases, nil
+}
+
+// writeLeases saves the list of leases.  The caller should be holding the
+// leases lock.
+func (s *store) writeLeases(leases []*Lease) error {
+	if leases == nil {
+		leases = []*Lease{}
+	}
+	data, err := json.Marshal(leases)
+	if err != nil {
+		return err
+	}
+	return ioutils.AtomicWriteFile(s.leasesPath(), data, 0600)
+}
+
+// updateLeases reads the list of leases, lets fn modify it, and saves it,
+// while holding the leases lock.
+func (s *store) updateLeases(fn func([]*Lease) ([]*Lease, error)) error {
+	lock, err := s.leasesLock()
+	if err != nil {
+		return err
+	}
+	if err := s.lock(lock); err != nil {
+		return err
+	}
+	defer lock.Unlock()
+	leases, err := s.readLeases()
+	if err != nil {
+		return err
+	}
+	if leases, err = fn(leases); err != nil {
+		return err
+	}
+	return s.writeLeases(leases)
+}
+
+func findLease(leases []*Lease, id string) (int, error) {
+	for i, lease := range leases {
+		if lease.ID == id {
+			return i, nil
+		}
+	}
+	return -1, errors.Wrapf(ErrLeaseUnknown, "error locating lease %q", id)
+}
+
+// leasedItems returns the IDs of the layers and images which are attached to
+// leases which haven't expired.
+func (s *store) leasedItems() (map[string]bool, map[string]bool, error) {
+	lock, err := s.leasesLock()
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := s.rlock(lock); err != nil {
+		return nil, nil, err
+	}
+	defer lock.Unlock()
+	leases, err := s.readLeases()
+	if err != nil {
+		return nil, nil, err
+	}
+	layers := make(map[string]bool)
+	images := make(map[string]bool)
+	for _, lease := range leases {
+		for _, id := range lease.Layers {
+			layers[id] = true
+		}
+		for _, id := range lease.Images {
+			images[id] = true
+		}
+	}
+	return layers, images, nil
+}
+
+// protectedLayers returns the IDs of the leased layers, the layers which
+// leased images use, and all of their parents.
+func protectedLayers(layers []Layer, images []Image, leasedLayers, leasedImages map[string]bool) map[string]bool {
+	layersByID := make(map[string]*Layer)
+	for i := range layers {
+		layersByID[layers[i].ID] = &layers[i]
+	}
+	protected := make(map[string]bool)
+	protect := func(id string) {
+		for id != "" && !protected[id] {
+			protected[id] = true
+			layer, ok := layersByID[id]
+			if !ok {
+				break
+			}
+			id = layer.Parent
+		}
+	}
+	for id := range leasedLayers {
+		protect(id)
+	}
+	for _, image := range images {
+		if leasedImages[image.ID] {
+			protect(image.TopLayer)
+			for _, id := range image.MappedTopLayers {
+				protect(id)
+			}
+		}
+	}
+	return protected
+}
+
+func (s *store) AcquireLease(ttl time.Duration) (*Lease, error) {
+	if ttl <= 0 {
+		return nil, errors.Errorf("invalid lease duration %v", ttl)
+	}
+	now := time.Now().UTC()
+	lease := &Lease{
+		ID:      stringid.GenerateRandomID(),
+		Created: now,
+		Expires: now.Add(ttl),
+	}
+	if err := s.updateLeases(func(leases []*Lease) ([]*Lease, error) {
+		return append(leases, lease), nil
+	}); err != nil {
+		return nil, err
+	}
+	return copyLease(lease), nil
+}
+
+func (s *store) RenewLease(id string, ttl time.Duration) (*Lease, error) {
+	if ttl <= 0 {
+		return nil, errors.Errorf("invalid lease duration %v", ttl)
+	}
+	var renewed *Lease
+	if err := s.updateLeases(func(leases []*Lease) ([]*Lease, error) {
+		i, err := findLease(leases, id)
+		if err != nil {
+			return nil, err
+		}
+		leases[i].Expires = time.Now().UTC().Add(ttl)
+		renewed = copyLease(leases[i])
+		return leases, nil
+	}); err != nil {
+		return nil, err
+	}
+	return renewed, nil
+}
+
+func (s *store) ReleaseLease(id string) error {
+	return s.updateLeases(func(leases []*Lease) ([]*Lease, error) {
+		i, err := findLease(leases, id)
+		if err != nil {
+			return nil, err
+		}
+		return append(leases[:i], leases[i+1:]...), nil
+	})
+}
+
+func (s *store) Leases() ([]Lease, error) {
+	lock, err := s.leasesLock()
+	if err != nil {
+		return nil, err
+	}
+	if err := s.rlock(lock); err != nil {
+		return nil, err
+	}
+	defer lock.Unlock()
+	leases, err := s.readLeases()
+	if err != nil {
+		return nil, err
+	}
+	list := make([]Lease, 0, len(leases))
+	for _, lease := range leases {
+		list = append(list, *copyLease(lease))
+	}
+	return list, nil
+}
+
+// addToLease attaches layers and images, which should already have been
+// resolved to IDs, to a lease.
+func (s *store) addToLease(id string, layers, images []string) error {
+	return s.updateLeases(func(leases []*Lease) ([]*Lease, error) {
+		i, err := findLease(leases, id)
+		if err != nil {
+			return nil, err
+		}
+		for _, layer := range layers {
+			if !stringutils.InSlice(leases[i].Layers, layer) {
+				leases[i].Layers = append(leases[i].Layers, layer)
+			}
+		}
+		for _, image := range images {
+			if !stringutils.InSlice(leases[i].Images, image) {
+				leases[i].Images = append(leases[i].Images, image)
+			}
+		}
+		return leases, nil
+	})
+}
+
+func (s *store) AddToLease(id string, layers, images []string) error {
+	var layerIDs, imageIDs []string
+	for _, name := range layers {
+		layer, err := s.Layer(name)
+		if err != nil {
+			return err
+		}
+		layerIDs = append(layerIDs, layer.ID)
+	}
+	for _, name := range images {
+		image, err := s.Image(name)
+		if err != nil {
+			return err
+		}
+		imageIDs = append(imageIDs, image.ID)
+	}
+	return s.addToLease(id, layerIDs, imageIDs)
+}
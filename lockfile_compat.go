@@ -13,3 +13,9 @@ func GetLockfile(path string) (lockfile.Locker, error) {
 func GetROLockfile(path string) (lockfile.Locker, error) {
 	return lockfile.GetROLockfile(path)
 }
+
+// LockHolder describes a process which holds, or is waiting for, a lock.
+type LockHolder = lockfile.LockHolder
+
+// LockStatus describes the processes which hold, or are waiting for, a lock.
+type LockStatus = lockfile.LockStatus
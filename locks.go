@@ -0,0 +1,273 @@
+package storage
+
+import (
+	gocontext "context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gepis/strge/pkg/lockfile"
+	"github.com/gepis/strge/types"
+	"github.com/pkg/errors"
+)
+
+// lockedStore is the part of a layer, image, or container store which
+// startReading() and startWriting() use.
+type lockedStore interface {
+	LockWithContext(ctx gocontext.Context) error
+	RLockWithContext(ctx gocontext.Context) error
+	Unlock()
+	ReloadIfChanged() error
+}
+
+// timeoutContext returns a context which is done once timeout has passed, if
+// it isn't zero.
+func timeoutContext(timeout time.Duration) (gocontext.Context, gocontext.CancelFunc) {
+	if timeout > 0 {
+		return gocontext.WithTimeout(gocontext.Background(), timeout)
+	}
+	return gocontext.Background(), func() {}
+}
+
+// timeoutError turns the error which a lock returns when a context from
+// timeoutContext() is done into ErrLockTimeout.
+func timeoutError(err error, timeout time.Duration) error {
+	if errors.Cause(err) == gocontext.DeadlineExceeded {
+		return errors.Wrapf(ErrLockTimeout, "waited %v", timeout)
+	}
+	return err
+}
+
+// lockWithTimeout takes a write or read lock on l.  If timeout isn't zero,
+// and it passes before the lock is acquired, it returns ErrLockTimeout.
+func lockWithTimeout(l Locker, write bool, timeout time.Duration) error {
+	ctx, cancel := timeoutContext(timeout)
+	defer cancel()
+	var err error
+	if write {
+		err = l.LockWithContext(ctx)
+	} else {
+		err = l.RLockWithContext(ctx)
+	}
+	return timeoutError(err, timeout)
+}
+
+// lockContext returns a context which is done once the store's lock timeout
+// has passed, if it has one.
+func (s *store) lockContext() (gocontext.Context, gocontext.CancelFunc) {
+	return timeoutContext(s.lockTimeout)
+}
+
+// lockError turns the error which a lock returns when a context from
+// lockContext() is done into ErrLockTimeout.
+func (s *store) lockError(err error) error {
+	return timeoutError(err, s.lockTimeout)
+}
+
+// lock takes a write lock on one of the store's own lock files, such as the
+// graph lock or the userns lock.  If the store has a lock timeout, and it
+// passes before the lock is acquired, it returns ErrLockTimeout.
+func (s *store) lock(l Locker) error {
+	return lockWithTimeout(l, true, s.lockTimeout)
+}
+
+// rlock is lock, except that it takes a read lock.
+func (s *store) rlock(l Locker) error {
+	return lockWithTimeout(l, false, s.lockTimeout)
+}
+
+func (s *store) startUsing(r lockedStore, write bool) error {
+	ctx, cancel := s.lockContext()
+	defer cancel()
+	var err error
+	if write {
+		err = r.LockWithContext(ctx)
+	} else {
+		err = r.RLockWithContext(ctx)
+	}
+	if err != nil {
+		return s.lockError(err)
+	}
+	if err := r.ReloadIfChanged(); err != nil {
+		r.Unlock()
+		return err
+	}
+	return nil
+}
+
+// startWriting takes a write lock on a layer, image, or container store, and
+// reloads the store's contents if another party modified them.  If the store
+// has a lock timeout, and it passes before the lock is acquired, it returns
+// ErrLockTimeout.  If it succeeds, the caller should call Unlock() when it's
+// done.
+func (s *store) startWriting(r lockedStore) error {
+	return s.startUsing(r, true)
+}
+
+// startReading is startWriting, except that it takes a read lock.
+func (s *store) startReading(r lockedStore) error {
+	return s.startUsing(r, false)
+}
+
+// lockHoldersDir returns the directory under a run root in which locks record
+// which processes hold them.
+func lockHoldersDir(runRoot string) string {
+	return filepath.Join(runRoot, "lock-holders")
+}
+
+// recordLockHolders arranges for the locks at the specified paths to record
+// which processes hold them, or are waiting for them, where LockStatuses()
+// can find them.
+func (s *store) recordLockHolders(paths ...string) error {
+	for _, path := range paths {
+		if err := lockfile.RecordHolders(path, lockHoldersDir(s.runRoot)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// storeLockPaths returns the locations of the locks which a store uses,
+// regardless of which graph driver it uses.
+func storeLockPaths(graphRoot string) []string {
+	return []string{
+		filepath.Join(graphRoot, "storage.lock"),
+		filepath.Join(graphRoot, "userns.lock"),
+		filepath.Join(graphRoot, "leases.lock"),
+	}
+}
+
+// driverLockPaths returns the locations of the locks which a store which uses
+// the named graph driver and the specified additional image stores uses,
+// other than digest locks.
+func driverLockPaths(graphRoot, runRoot, driverName string, imageStores []string) []string {
+	driverPrefix := driverName + "-"
+	paths := []string{
+		filepath.Join(graphRoot, driverPrefix+"layers", "layers.lock"),
+		filepath.Join(runRoot, driverPrefix+"layers", "mountpoints.lock"),
+		filepath.Join(graphRoot, driverPrefix+"images", "images.lock"),
+		filepath.Join(graphRoot, driverPrefix+"containers", "containers.lock"),
+	}
+	for _, store := range imageStores {
+		paths = append(paths,
+			filepath.Join(store, driverPrefix+"layers", "layers.lock"),
+			filepath.Join(store, driverPrefix+"images", "images.lock"))
+	}
+	return paths
+}
+
+// digestLockPaths returns the locations of the digest locks which a store
+// which uses the named graph driver has created.
+func digestLockPaths(runRoot, driverName string) ([]string, error) {
+	dir := filepath.Join(runRoot, driverName+"-locks")
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var paths []string
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			paths = append(paths, filepath.Join(dir, entry.Name()))
+		}
+	}
+	return paths, nil
+}
+
+// usedGraphDrivers returns the names of the graph drivers which have been used
+// with a storage root, judging by which layer directories it contains.
+func usedGraphDrivers(graphRoot string) ([]string, error) {
+	matches, err := filepath.Glob(filepath.Join(graphRoot, "*-layers"))
+	if err != nil {
+		return nil, err
+	}
+	var drivers []string
+	for _, match := range matches {
+		drivers = append(drivers, strings.TrimSuffix(filepath.Base(match), "-layers"))
+	}
+	return drivers, nil
+}
+
+// additionalImageStores returns the locations of the additional image stores
+// which are listed in graph driver options.
+func additionalImageStores(graphOptions []string) []string {
+	var imageStores []string
+	for _, option := range graphOptions {
+		kv := strings.SplitN(option, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		key := strings.ToLower(kv[0])
+		if i := strings.LastIndex(key, "."); i != -1 {
+			key = key[i+1:]
+		}
+		if key == "imagestore" || key == "additionalimagestore" {
+			imageStores = append(imageStores, kv[1])
+		}
+	}
+	return imageStores
+}
+
+// LockStatuses returns information about the processes which hold, or are
+// waiting for, each of the locks, including digest locks, which a store that
+// was opened using the specified options would use.  Unlike GetStore(), it
+// doesn't take any locks, so it can be used to find out what is keeping a
+// store from being opened.  If the options don't name a graph driver, the
+// locks for every graph driver which has been used with the storage root are
+// listed.  Locks which have never been created are skipped.
+func LockStatuses(options types.StoreOptions) ([]LockStatus, error) {
+	if options.RunRoot == "" && options.GraphRoot == "" && options.GraphDriverName == "" && len(options.GraphDriverOptions) == 0 {
+		options = types.Options()
+	}
+	if options.GraphRoot == "" {
+		return nil, errors.Wrap(ErrIncompleteOptions, "no storage root specified")
+	}
+	if options.RunRoot == "" {
+		return nil, errors.Wrap(ErrIncompleteOptions, "no storage runroot specified")
+	}
+	graphRoot, err := filepath.Abs(options.GraphRoot)
+	if err != nil {
+		return nil, err
+	}
+	runRoot, err := filepath.Abs(options.RunRoot)
+	if err != nil {
+		return nil, err
+	}
+
+	drivers := []string{options.GraphDriverName}
+	if options.GraphDriverName == "" {
+		if drivers, err = usedGraphDrivers(graphRoot); err != nil {
+			return nil, err
+		}
+	}
+	imageStores := additionalImageStores(options.GraphDriverOptions)
+	paths := storeLockPaths(graphRoot)
+	for _, driver := range drivers {
+		paths = append(paths, driverLockPaths(graphRoot, runRoot, driver, imageStores)...)
+		digestLocks, err := digestLockPaths(runRoot, driver)
+		if err != nil {
+			return nil, err
+		}
+		paths = append(paths, digestLocks...)
+	}
+
+	statuses := []LockStatus{}
+	for _, path := range paths {
+		if _, err := os.Stat(path); err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		status, err := lockfile.Status(path, lockHoldersDir(runRoot))
+		if err != nil {
+			return nil, err
+		}
+		statuses = append(statuses, *status)
+	}
+	return statuses, nil
+}
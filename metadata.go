@@ -0,0 +1,689 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gepis/strge/pkg/ioutils"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+const (
+	// MetadataBackendJSON is the name of the metadata backend which
+	// rewrites layers.json, images.json, and containers.json in their
+	// entirety whenever anything in them changes.  It is the default.
+	MetadataBackendJSON = "json"
+	// MetadataBackendJournal is the name of the metadata backend which
+	// appends records that changed to a journal kept alongside
+	// layers.json, images.json, and containers.json, and folds the
+	// journal back into those files once it grows large.
+	MetadataBackendJournal = "journal"
+
+	// journalSuffix is appended to the name of a metadata file, minus its
+	// ".json" extension, to get the name of its journal.
+	journalSuffix = ".journal"
+	// minJournalCompactionSize is how large a journal has to be before we
+	// consider folding it back into the file that it amends.
+	minJournalCompactionSize = 1024 * 1024
+
+	// MetadataVersion is the newest version of the format of the
+	// layers.json, images.json, containers.json, and mountpoints.json
+	// files that we know how to read and write, and the one that we
+	// create them in.  Version 1 files hold a bare list of records.
+	// Version 2 files wrap the list in an object which also records the
+	// version.  Version 3 records can also hold last-used times and the
+	// storage options that layers were created with, which versions of
+	// this library that only know version 2 would drop.  Versions of this
+	// library which predate versioning can only read version 1 files, so
+	// a store has to be converted back to version 1 using
+	// MigrateMetadata() before they can be used with it.
+	MetadataVersion = 3
+
+	// minJournalMetadataVersion is the oldest version of the format that
+	// we keep a journal alongside.  Versions of this library which
+	// predate versioning don't know about journals, so we make sure that
+	// they can't read a file that a journal amends.
+	minJournalMetadataVersion = 2
+)
+
+// metadataBackend loads and saves the list of records which is kept in one of
+// the layers.json, images.json, or containers.json files.
+type metadataBackend interface {
+	// Load returns the changes that other processes made to the records
+	// since the last call to Load or Save, in the order that they were
+	// made, reading and decoding only what they changed where it can.
+	// If the caller has to discard what it knows and start over, which
+	// is always the case the first time Load is called, reloaded is true
+	// and the changes add every record, in order.  The records in the
+	// changes are shared with the backend and must be copied before they
+	// are modified.
+	Load() (changes []metadataChange, reloaded bool, err error)
+
+	// Changed notes that the caller modified the record with the
+	// specified ID, so that the next call to Save will write it.  Records
+	// which were added or removed don't need to be noted.
+	Changed(id string)
+
+	// Forget discards everything that the backend knows about the
+	// records, so that the next call to Load starts over.  Callers use
+	// it when they fail to apply the changes that Load returned.
+	Forget()
+
+	// Save persists the records, in order.  Where it can, it only encodes
+	// and writes the records which were added, removed, or passed to
+	// Changed since the last call to Load or Save.  It fails if the
+	// metadata file is in a newer version of the format than
+	// MetadataVersion.
+	Save(records []interface{}) error
+
+	// Migrate rewrites the metadata file using the specified version of
+	// the format.
+	Migrate(version int) error
+
+	// Version returns the version of the format that the metadata file
+	// is in, as of the last call to Load, Save, or Migrate.
+	Version() int
+}
+
+// metadataChange is a record which was added or modified, or, if Record is
+// nil, the ID of a record which was removed.
+type metadataChange struct {
+	ID     string
+	Record interface{}
+}
+
+// newMetadataBackend returns a metadataBackend of the named kind for the
+// metadata file at path.  newRecord returns a pointer to a new, empty record,
+// and recordID returns the ID of a record.
+func newMetadataBackend(kind, path string, newRecord func() interface{}, recordID func(interface{}) string) (metadataBackend, error) {
+	j := &metadataJournal{
+		path:        path,
+		journalPath: strings.TrimSuffix(path, ".json") + journalSuffix,
+		newRecord:   newRecord,
+		recordID:    recordID,
+		version:     MetadataVersion,
+	}
+	switch kind {
+	case "", MetadataBackendJSON:
+		j.alwaysCompact = true
+	case MetadataBackendJournal:
+	default:
+		return nil, errors.Wrapf(ErrInvalidMetadataBackend, "%q", kind)
+	}
+	return j, nil
+}
+
+// metadataEnvelope is the layout of metadata files starting with version 2 of
+// the format.
+type metadataEnvelope struct {
+	Version int     `json:"version"`
+	Records rawJSON `json:"records"`
+}
+
+// decodeMetadataFile returns the version of the format of the contents of the
+// metadata file at path, and the encoded list of records that it holds.  An
+// empty or missing file is treated as an empty list in defaultVersion.
+func decodeMetadataFile(path string, data []byte, defaultVersion int) (int, []byte, error) {
+	data = bytes.TrimSpace(data)
+	if len(data) == 0 {
+		return defaultVersion, nil, nil
+	}
+	if data[0] == '[' {
+		return 1, data, nil
+	}
+	var envelope metadataEnvelope
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		return -1, nil, errors.Wrapf(err, "error decoding %q", path)
+	}
+	if envelope.Version < 2 {
+		return -1, nil, errors.Errorf("%q has an invalid metadata version %d", path, envelope.Version)
+	}
+	return envelope.Version, envelope.Records, nil
+}
+
+// encodeMetadataFile returns the contents of a metadata file in the specified
+// version of the format, given the encoded list of records that it holds.
+func encodeMetadataFile(version int, records []byte) []byte {
+	if version == 1 {
+		return records
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, `{"version":%d,"records":`, version)
+	buf.Write(records)
+	buf.WriteByte('}')
+	return buf.Bytes()
+}
+
+// checkMetadataVersion returns an error if the metadata file at path is in a
+// version of the format which is newer than the ones we know how to write.
+func checkMetadataVersion(path string, version int) error {
+	if version > MetadataVersion {
+		return errors.Wrapf(ErrMetadataVersion, "%q uses version %d of the metadata format, and we only know versions up to %d", path, version, MetadataVersion)
+	}
+	return nil
+}
+
+// metadataJournalHeader is the first line of a journal.  It records the
+// digest of the metadata file that the journal amends, so that we can tell
+// when that file has been rewritten by something that didn't know about the
+// journal.
+type metadataJournalHeader struct {
+	Snapshot digest.Digest `json:"snapshot"`
+}
+
+// metadataJournalEntry is a line in a journal.  It either replaces or adds a
+// record, or removes one.
+type metadataJournalEntry struct {
+	ID      string  `json:"id"`
+	Record  rawJSON `json:"record,omitempty"`
+	Deleted bool    `json:"deleted,omitempty"`
+}
+
+// rawJSON is an already-encoded JSON value.
+type rawJSON []byte
+
+func (r rawJSON) MarshalJSON() ([]byte, error) {
+	if len(r) == 0 {
+		return []byte("null"), nil
+	}
+	return r, nil
+}
+
+func (r *rawJSON) UnmarshalJSON(data []byte) error {
+	*r = append((*r)[:0], data...)
+	return nil
+}
+
+// metadataRecord is our cached copy of a record: its encoded form, which we
+// compare against when saving, and the decoded value that Load returns.
+type metadataRecord struct {
+	raw   []byte
+	value interface{}
+}
+
+// metadataJournal is a metadataBackend which keeps the metadata file, which
+// it calls the snapshot, and an append-only journal of changes to it.  Loading
+// replays the parts of the journal that we haven't already seen, and saving
+// appends entries for only the records that were added, removed, or marked as
+// changed.  When the journal grows larger than the snapshot, or if
+// alwaysCompact is set, saving rewrites the snapshot and removes the journal
+// instead, and with alwaysCompact every record is encoded every time.
+//
+// The caller is expected to serialize calls to Load and Save with other
+// processes by holding the store's lock.
+type metadataJournal struct {
+	path          string
+	journalPath   string
+	newRecord     func() interface{}
+	recordID      func(interface{}) string
+	alwaysCompact bool
+
+	loaded         bool
+	version        int
+	snapshotInfo   os.FileInfo
+	snapshotSize   int64
+	snapshotDigest digest.Digest
+	journalOffset  int64
+	journalStale   bool
+	order          []string
+	records        map[string]*metadataRecord
+	dirty          map[string]bool
+
+	// reloaded and changes collect what Load will report.
+	reloaded bool
+	changes  []metadataChange
+}
+
+func (j *metadataJournal) Load() ([]metadataChange, bool, error) {
+	j.reloaded = false
+	j.changes = nil
+	defer func() {
+		j.changes = nil
+	}()
+	info, err := os.Stat(j.path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, false, err
+	}
+	if !j.loaded || !sameSnapshot(info, j.snapshotInfo) {
+		if err := j.loadSnapshot(); err != nil {
+			return nil, false, err
+		}
+	}
+	if err := j.replayJournal(); err != nil {
+		return nil, false, err
+	}
+	if j.reloaded {
+		changes := make([]metadataChange, 0, len(j.order))
+		for _, id := range j.order {
+			changes = append(changes, metadataChange{ID: id, Record: j.records[id].value})
+		}
+		return changes, true, nil
+	}
+	return j.changes, false, nil
+}
+
+func (j *metadataJournal) Forget() {
+	j.loaded = false
+}
+
+func (j *metadataJournal) Changed(id string) {
+	if j.dirty == nil {
+		j.dirty = make(map[string]bool)
+	}
+	j.dirty[id] = true
+}
+
+// sameSnapshot returns true if a and b describe the same, unmodified, file,
+// or if neither of them describes a file.
+func sameSnapshot(a, b os.FileInfo) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	return os.SameFile(a, b) && a.Size() == b.Size() && a.ModTime().Equal(b.ModTime())
+}
+
+// loadSnapshot discards everything that we know and reads the snapshot,
+// leaving the journal for replayJournal to read.
+func (j *metadataJournal) loadSnapshot() error {
+	j.loaded = false
+	j.reloaded = true
+	j.version = MetadataVersion
+	j.snapshotInfo = nil
+	j.snapshotSize = 0
+	j.snapshotDigest = ""
+	j.journalOffset = 0
+	j.journalStale = false
+	j.order = nil
+	j.records = make(map[string]*metadataRecord)
+
+	f, err := os.Open(j.path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	var data []byte
+	if f != nil {
+		defer f.Close()
+		if j.snapshotInfo, err = f.Stat(); err != nil {
+			return err
+		}
+		if data, err = ioutil.ReadAll(f); err != nil {
+			return err
+		}
+	}
+	j.snapshotSize = int64(len(data))
+	j.snapshotDigest = digest.FromBytes(data)
+
+	version, list, err := decodeMetadataFile(j.path, data, MetadataVersion)
+	if err != nil {
+		return err
+	}
+	var raws []rawJSON
+	if len(list) > 0 {
+		if err := json.Unmarshal(list, &raws); err != nil {
+			return errors.Wrapf(err, "error decoding %q", j.path)
+		}
+	}
+	j.version = version
+	j.order = make([]string, 0, len(raws))
+	for _, raw := range raws {
+		record, err := j.decode(raw)
+		if err != nil {
+			return err
+		}
+		id := j.recordID(record.value)
+		if _, ok := j.records[id]; !ok {
+			j.order = append(j.order, id)
+		}
+		j.records[id] = record
+	}
+	j.loaded = true
+	return nil
+}
+
+// replayJournal applies whatever has been added to the journal since we last
+// looked at it.
+func (j *metadataJournal) replayJournal() error {
+	f, err := os.Open(j.journalPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			if j.journalOffset != 0 {
+				return j.reload()
+			}
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() < j.journalOffset {
+		// Someone truncated the journal without rewriting the
+		// snapshot.  Start over.
+		f.Close()
+		return j.reload()
+	}
+	if j.journalStale || info.Size() == j.journalOffset {
+		return nil
+	}
+	if _, err := f.Seek(j.journalOffset, io.SeekStart); err != nil {
+		return err
+	}
+	reader := bufio.NewReader(f)
+	offset := j.journalOffset
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			if err == io.EOF {
+				// Anything after the last newline is the
+				// remains of an interrupted write, which the
+				// next Save will discard.
+				break
+			}
+			return err
+		}
+		if offset == 0 {
+			var header metadataJournalHeader
+			if err := json.Unmarshal(line, &header); err != nil {
+				return errors.Wrapf(err, "error decoding header of %q", j.journalPath)
+			}
+			if header.Snapshot != j.snapshotDigest {
+				// The journal amends a version of the
+				// snapshot that has since been replaced.
+				j.journalStale = true
+				return nil
+			}
+		} else if err := j.applyEntry(line); err != nil {
+			return err
+		}
+		offset += int64(len(line))
+		j.journalOffset = offset
+	}
+	return nil
+}
+
+// reload rereads both the snapshot and the journal from scratch.
+func (j *metadataJournal) reload() error {
+	if err := j.loadSnapshot(); err != nil {
+		return err
+	}
+	return j.replayJournal()
+}
+
+func (j *metadataJournal) applyEntry(line []byte) error {
+	var entry metadataJournalEntry
+	if err := json.Unmarshal(line, &entry); err != nil {
+		return errors.Wrapf(err, "error decoding entry in %q", j.journalPath)
+	}
+	if entry.Deleted {
+		if _, ok := j.records[entry.ID]; ok {
+			delete(j.records, entry.ID)
+			for i := range j.order {
+				if j.order[i] == entry.ID {
+					j.order = append(j.order[:i], j.order[i+1:]...)
+					break
+				}
+			}
+			j.changes = append(j.changes, metadataChange{ID: entry.ID})
+		}
+		return nil
+	}
+	record, err := j.decode(entry.Record)
+	if err != nil {
+		return err
+	}
+	if _, ok := j.records[entry.ID]; !ok {
+		j.order = append(j.order, entry.ID)
+	}
+	j.records[entry.ID] = record
+	j.changes = append(j.changes, metadataChange{ID: entry.ID, Record: record.value})
+	return nil
+}
+
+func (j *metadataJournal) decode(raw []byte) (*metadataRecord, error) {
+	value := j.newRecord()
+	if err := json.Unmarshal(raw, value); err != nil {
+		return nil, errors.Wrapf(err, "error decoding record in %q", j.path)
+	}
+	return &metadataRecord{raw: append([]byte(nil), raw...), value: value}, nil
+}
+
+func (j *metadataJournal) Save(records []interface{}) (err error) {
+	if err := checkMetadataVersion(j.path, j.version); err != nil {
+		return err
+	}
+	// If we don't manage to save everything, remember what was changed
+	// so that we'll try to write it again next time.
+	dirty := j.dirty
+	j.dirty = nil
+	defer func() {
+		if err != nil {
+			for id := range dirty {
+				j.Changed(id)
+			}
+		}
+	}()
+
+	order := make([]string, len(records))
+	for i, value := range records {
+		order[i] = j.recordID(value)
+	}
+
+	// Records that aren't where we left them were removed.  Anything
+	// after the last of the records that we already had has to be new,
+	// or replaying the journal would leave the records in a different
+	// order than the one we were given.
+	var entries []metadataJournalEntry
+	kept := 0
+	rewrite := j.alwaysCompact || !j.loaded || j.journalStale
+	if j.version < MetadataVersion && (j.version >= minJournalMetadataVersion || !j.alwaysCompact) {
+		// Versions of this library which know about versions but not
+		// about everything in our records would drop what they don't
+		// know if they rewrote the file, and versions which predate
+		// versioning would ignore a journal, so switch to a version of
+		// the format that they'll refuse to write, or to read.
+		j.version = MetadataVersion
+		rewrite = true
+	}
+	if !rewrite {
+		for _, id := range j.order {
+			if kept < len(order) && order[kept] == id {
+				kept++
+				continue
+			}
+			entries = append(entries, metadataJournalEntry{ID: id, Deleted: true})
+		}
+		for _, id := range order[kept:] {
+			if _, ok := j.records[id]; ok {
+				rewrite = true
+				break
+			}
+		}
+	}
+
+	// Encode the records that were changed or added.  If we're going to
+	// rewrite the snapshot, our copies of the others are still current.
+	raws := make(map[string][]byte)
+	for i, value := range records {
+		id := order[i]
+		if i < kept && !dirty[id] {
+			continue
+		}
+		raw, err := json.Marshal(value)
+		if err != nil {
+			return err
+		}
+		if i < kept && bytes.Equal(raw, j.records[id].raw) {
+			continue
+		}
+		raws[id] = raw
+		entries = append(entries, metadataJournalEntry{ID: id, Record: raw})
+	}
+	if rewrite {
+		return j.compact(order, raws)
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+
+	var buf bytes.Buffer
+	if j.journalOffset == 0 {
+		header, err := json.Marshal(&metadataJournalHeader{Snapshot: j.snapshotDigest})
+		if err != nil {
+			return err
+		}
+		buf.Write(header)
+		buf.WriteByte('\n')
+	}
+	for i := range entries {
+		line, err := json.Marshal(&entries[i])
+		if err != nil {
+			return err
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	if j.journalOffset+int64(buf.Len()) > minJournalCompactionSize && j.journalOffset+int64(buf.Len()) > j.snapshotSize {
+		return j.compact(order, raws)
+	}
+	if err := j.appendJournal(buf.Bytes()); err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if entry.Deleted {
+			delete(j.records, entry.ID)
+			continue
+		}
+		record, err := j.decode(entry.Record)
+		if err != nil {
+			return err
+		}
+		j.records[entry.ID] = record
+	}
+	j.order = order
+	return nil
+}
+
+// appendJournal adds data to the end of the journal, first discarding anything
+// after the last entry that we read, which can only be left over from a write
+// that was interrupted.
+func (j *metadataJournal) appendJournal(data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(j.journalPath), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(j.journalPath, os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	if err := f.Truncate(j.journalOffset); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.WriteAt(data, j.journalOffset); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	j.journalOffset += int64(len(data))
+	return nil
+}
+
+// compact writes all of the records to the snapshot and removes the journal.
+// Records which aren't in raws are written using our copy of them.
+func (j *metadataJournal) compact(order []string, raws map[string][]byte) error {
+	var buf bytes.Buffer
+	buf.WriteByte('[')
+	for i, id := range order {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		if raw, ok := raws[id]; ok {
+			buf.Write(raw)
+		} else {
+			buf.Write(j.records[id].raw)
+		}
+	}
+	buf.WriteByte(']')
+	data := encodeMetadataFile(j.version, buf.Bytes())
+
+	if err := os.MkdirAll(filepath.Dir(j.path), 0700); err != nil {
+		return err
+	}
+	if err := ioutils.AtomicWriteFile(j.path, data, 0600); err != nil {
+		return err
+	}
+	// If we fail to remove the journal, its header will no longer match
+	// the snapshot, so it will be ignored.
+	if err := os.Remove(j.journalPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	// Rebuild our cache to match what we just wrote, decoding only the
+	// records that changed.
+	records := make(map[string]*metadataRecord, len(order))
+	for _, id := range order {
+		raw, ok := raws[id]
+		if record, known := j.records[id]; known && j.loaded && (!ok || bytes.Equal(record.raw, raw)) {
+			records[id] = record
+			continue
+		}
+		record, err := j.decode(raw)
+		if err != nil {
+			return err
+		}
+		records[id] = record
+	}
+	info, err := os.Stat(j.path)
+	if err != nil {
+		return err
+	}
+	j.loaded = true
+	j.snapshotInfo = info
+	j.snapshotSize = int64(len(data))
+	j.snapshotDigest = digest.FromBytes(data)
+	j.journalOffset = 0
+	j.journalStale = false
+	j.order = order
+	j.records = records
+	return nil
+}
+
+func (j *metadataJournal) Migrate(version int) error {
+	if !j.loaded {
+		if _, _, err := j.Load(); err != nil {
+			return err
+		}
+	}
+	if err := checkMetadataVersion(j.path, j.version); err != nil {
+		return err
+	}
+	if version < minJournalMetadataVersion {
+		if !j.alwaysCompact {
+			return errors.Wrapf(ErrMetadataVersion, "unable to convert %q to version %d while using the %q metadata backend", j.path, version, MetadataBackendJournal)
+		}
+		if j.journalOffset > 0 && !j.journalStale {
+			return errors.Wrapf(ErrMetadataVersion, "unable to convert %q to version %d while %q holds changes to it, convert it to version %d first to fold them in", j.path, version, j.journalPath, j.version)
+		}
+	}
+	j.version = version
+	return j.compact(append([]string(nil), j.order...), nil)
+}
+
+func (j *metadataJournal) Version() int {
+	return j.version
+}
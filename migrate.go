@@ -0,0 +1,102 @@
+package storage
+
+import (
+	gocontext "context"
+
+	"github.com/pkg/errors"
+)
+
+// migrate rewrites layers.json and mountpoints.json using the specified
+// version of the metadata format, giving up on waiting for the lock on
+// mountpoints.json when ctx is done.  The caller should be holding the layer
+// store's lock.
+func (r *layerStore) migrate(ctx gocontext.Context, version int) error {
+	if !r.IsReadWrite() {
+		return errors.Wrapf(ErrStoreIsReadOnly, "not allowed to modify the layer store at %q", r.layerspath())
+	}
+	if err := r.metadata.Migrate(version); err != nil {
+		return err
+	}
+	defer r.Touch()
+
+	if err := r.mountsLockfile.LockWithContext(ctx); err != nil {
+		return err
+	}
+	defer r.mountsLockfile.Unlock()
+	defer r.mountsLockfile.Touch()
+	if err := r.loadMounts(); err != nil {
+		return err
+	}
+	if err := checkMetadataVersion(r.mountspath(), r.mountsVersion); err != nil {
+		return err
+	}
+	r.mountsVersion = version
+	return r.saveMounts()
+}
+
+func (s *store) MigrateMetadata(version int) error {
+	if version < 1 || version > MetadataVersion {
+		return errors.Wrapf(ErrMetadataVersion, "unable to convert metadata to version %d, only versions 1 through %d are known", version, MetadataVersion)
+	}
+	if version > 1 && version < MetadataVersion {
+		// Versions of this library which only know the older version
+		// would drop parts of our records that they don't know about.
+		return errors.Wrapf(ErrMetadataVersion, "unable to convert metadata to version %d, which can't hold everything that we record, convert it to version 1 or %d", version, MetadataVersion)
+	}
+
+	rlstore, err := s.LayerStore()
+	if err != nil {
+		return err
+	}
+	ristore, err := s.ImageStore()
+	if err != nil {
+		return err
+	}
+	rcstore, err := s.ContainerStore()
+	if err != nil {
+		return err
+	}
+
+	if err := s.startWriting(rlstore); err != nil {
+		return err
+	}
+	defer rlstore.Unlock()
+	if err := s.startWriting(ristore); err != nil {
+		return err
+	}
+	defer ristore.Unlock()
+	if err := s.startWriting(rcstore); err != nil {
+		return err
+	}
+	defer rcstore.Unlock()
+
+	ctx, cancel := s.lockContext()
+	defer cancel()
+	if err := rlstore.(*layerStore).migrate(ctx, version); err != nil {
+		return s.lockError(err)
+	}
+	if err := ristore.(*imageStore).migrate(version); err != nil {
+		return err
+	}
+	return rcstore.(*containerStore).migrate(version)
+}
+
+// migrate rewrites images.json using the specified version of the metadata
+// format.  The caller should be holding the image store's lock.
+func (r *imageStore) migrate(version int) error {
+	if !r.IsReadWrite() {
+		return errors.Wrapf(ErrStoreIsReadOnly, "not allowed to modify the image store at %q", r.imagespath())
+	}
+	defer r.Touch()
+	return r.metadata.Migrate(version)
+}
+
+// migrate rewrites containers.json using the specified version of the
+// metadata format.  The caller should be holding the container store's lock.
+func (r *containerStore) migrate(version int) error {
+	if !r.IsReadWrite() {
+		return errors.Wrapf(ErrStoreIsReadOnly, "not allowed to modify the container store at %q", r.containerspath())
+	}
+	defer r.Touch()
+	return r.metadata.Migrate(version)
+}
@@ -0,0 +1,88 @@
+package storage
+
+import (
+	"github.com/pkg/errors"
+)
+
+// PinnedFlag is the flag which is set on images and layers which have been
+// pinned.  DeleteImage(), DeleteLayer(), Delete(), and Wipe() refuse to
+// remove pinned images and layers unless they are asked to ignore pins, and
+// GarbageCollect() leaves them alone.
+const PinnedFlag = "pinned"
+
+// DeleteOptions are used to control how DeleteLayerWithOptions(),
+// DeleteImageWithOptions(), DeleteWithOptions(), and WipeWithOptions()
+// remove things.
+type DeleteOptions struct {
+	// IgnorePins allows pinned images and layers to be removed.
+	IgnorePins bool
+}
+
+func isPinned(flags map[string]interface{}) bool {
+	pinned, _ := flags[PinnedFlag].(bool)
+	return pinned
+}
+
+func ignorePins(options *DeleteOptions) bool {
+	return options != nil && options.IgnorePins
+}
+
+// setPinned sets or clears the pinned flag on the image or layer with the
+// specified name or ID.
+func (s *store) setPinned(id string, pinned bool) error {
+	rlstore, err := s.LayerStore()
+	if err != nil {
+		return err
+	}
+	ristore, err := s.ImageStore()
+	if err != nil {
+		return err
+	}
+
+	if err := s.startWriting(rlstore); err != nil {
+		return err
+	}
+	defer rlstore.Unlock()
+	if err := s.startWriting(ristore); err != nil {
+		return err
+	}
+	defer ristore.Unlock()
+
+	eventType := EventPin
+	if !pinned {
+		eventType = EventUnpin
+	}
+	if ristore.Exists(id) {
+		image, err := ristore.Get(id)
+		if err != nil {
+			return err
+		}
+		if pinned {
+			err = ristore.SetFlag(image.ID, PinnedFlag, true)
+		} else {
+			err = ristore.ClearFlag(image.ID, PinnedFlag)
+		}
+		return s.notifyUnlessError(err, Event{Type: eventType, Object: EventImage, ID: image.ID})
+	}
+	if rlstore.Exists(id) {
+		layer, err := rlstore.Get(id)
+		if err != nil {
+			return err
+		}
+		if pinned {
+			err = rlstore.SetFlag(layer.ID, PinnedFlag, true)
+		} else {
+			err = rlstore.ClearFlag(layer.ID, PinnedFlag)
+		}
+		return s.notifyUnlessError(err, Event{Type: eventType, Object: EventLayer, ID: layer.ID})
+	}
+	return errors.Wrapf(ErrLayerUnknown, "error locating image or layer %q", id)
+}
+
+func (s *store) Pin(id string) error {
+	return s.setPinned(id, true)
+}
+
+func (s *store) Unpin(id string) error {
+	return s.setPinned(id, false)
+}
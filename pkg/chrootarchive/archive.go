@@ -2,6 +2,7 @@ package chrootarchive
 
 import (
 	stdtar "archive/tar"
+	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -43,7 +44,7 @@ func NewArchiverWithChown(tarIDMappings *idtools.IDMappings, chownOpts *idtools.
 // The archive may be compressed with one of the following algorithms:
 //  identity (uncompressed), gzip, bzip2, xz.
 func Untar(tarArchive io.Reader, dest string, options *archive.TarOptions) error {
-	return untarHandler(tarArchive, dest, options, true, dest)
+	return untarHandler(context.Background(), tarArchive, dest, options, true, dest)
 }
 
 // UntarWithRoot is the same as `Untar`, but allows you to pass in a root directory
@@ -59,18 +60,25 @@ func Untar(tarArchive io.Reader, dest string, options *archive.TarOptions) error
 // sanitizing symlinks in this manner is inherrently racey:
 // ref: CVE-2018-15664
 func UntarWithRoot(tarArchive io.Reader, dest string, options *archive.TarOptions, root string) error {
-	return untarHandler(tarArchive, dest, options, true, root)
+	return untarHandler(context.Background(), tarArchive, dest, options, true, root)
 }
 
 // UntarUncompressed reads a stream of bytes from `archive`, parses it as a tar archive,
 // and unpacks it into the directory at `dest`.
 // The archive must be an uncompressed stream.
 func UntarUncompressed(tarArchive io.Reader, dest string, options *archive.TarOptions) error {
-	return untarHandler(tarArchive, dest, options, false, dest)
+	return untarHandler(context.Background(), tarArchive, dest, options, false, dest)
+}
+
+// UntarUncompressedWithContext is UntarUncompressed, except that it gives up,
+// killing the process which is unpacking the archive, if ctx is done before
+// the archive has been unpacked.
+func UntarUncompressedWithContext(ctx context.Context, tarArchive io.Reader, dest string, options *archive.TarOptions) error {
+	return untarHandler(ctx, tarArchive, dest, options, false, dest)
 }
 
 // Handler for teasing out the automatic decompression
-func untarHandler(tarArchive io.Reader, dest string, options *archive.TarOptions, decompress bool, root string) error {
+func untarHandler(ctx context.Context, tarArchive io.Reader, dest string, options *archive.TarOptions, decompress bool, root string) error {
 	if tarArchive == nil {
 		return fmt.Errorf("Empty archive")
 	}
@@ -102,7 +110,7 @@ func untarHandler(tarArchive io.Reader, dest string, options *archive.TarOptions
 		r = decompressedArchive
 	}
 
-	return invokeUnpack(r, dest, options, root)
+	return invokeUnpack(ctx, r, dest, options, root)
 }
 
 // Tar tars the requested path while chrooted to the specified root.
@@ -4,6 +4,7 @@ package chrootarchive
 
 import (
 	"bytes"
+	"context"
 	"flag"
 	"fmt"
 	"io"
@@ -58,7 +59,7 @@ func untar() {
 	os.Exit(0)
 }
 
-func invokeUnpack(decompressedArchive io.Reader, dest string, options *archive.TarOptions, root string) error {
+func invokeUnpack(ctx context.Context, decompressedArchive io.Reader, dest string, options *archive.TarOptions, root string) error {
 	if root == "" {
 		return errors.New("must specify a root to chroot to")
 	}
@@ -90,7 +91,7 @@ func invokeUnpack(decompressedArchive io.Reader, dest string, options *archive.T
 		dest = relDest
 	}
 
-	cmd := reexec.Command("storage-untar", dest, root)
+	cmd := reexec.CommandContext(ctx, "storage-untar", dest, root)
 	cmd.Stdin = decompressedArchive
 
 	cmd.ExtraFiles = append(cmd.ExtraFiles, r)
@@ -117,6 +118,9 @@ func invokeUnpack(decompressedArchive io.Reader, dest string, options *archive.T
 		// pending on write pipe forever
 		io.Copy(ioutil.Discard, decompressedArchive)
 
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
 		return fmt.Errorf("Error processing tar file(%v): %s", err, output)
 	}
 
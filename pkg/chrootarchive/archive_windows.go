@@ -1,9 +1,11 @@
 package chrootarchive
 
 import (
+	"context"
 	"io"
 
 	"github.com/gepis/strge/pkg/archive"
+	"github.com/gepis/strge/pkg/ioutils"
 	"github.com/gepis/strge/pkg/longpath"
 )
 
@@ -12,12 +14,16 @@ func chroot(path string) error {
 	return nil
 }
 
-func invokeUnpack(decompressedArchive io.ReadCloser,
+func invokeUnpack(ctx context.Context, decompressedArchive io.ReadCloser,
 	dest string,
 	options *archive.TarOptions, root string) error {
 	// Windows is different to Linux here because Windows does not support
 	// chroot. Hence there is no point sandboxing a chrooted process to
 	// do the unpack. We call inline instead within the daemon process.
+	if ctx.Done() != nil {
+		decompressedArchive = ioutils.NewCancelReadCloser(ctx, decompressedArchive)
+		defer decompressedArchive.Close()
+	}
 	return archive.Unpack(decompressedArchive, longpath.AddPrefix(dest), options)
 }
 
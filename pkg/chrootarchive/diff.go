@@ -1,6 +1,7 @@
 package chrootarchive
 
 import (
+	"context"
 	"io"
 
 	"github.com/gepis/strge/pkg/archive"
@@ -11,7 +12,7 @@ import (
 // uncompressed.
 // Returns the size in bytes of the contents of the layer.
 func ApplyLayer(dest string, layer io.Reader) (size int64, err error) {
-	return applyLayerHandler(dest, layer, &archive.TarOptions{}, true)
+	return applyLayerHandler(context.Background(), dest, layer, &archive.TarOptions{}, true)
 }
 
 // ApplyUncompressedLayer parses a diff in the standard layer format from
@@ -19,5 +20,12 @@ func ApplyLayer(dest string, layer io.Reader) (size int64, err error) {
 // can only be uncompressed.
 // Returns the size in bytes of the contents of the layer.
 func ApplyUncompressedLayer(dest string, layer io.Reader, options *archive.TarOptions) (int64, error) {
-	return applyLayerHandler(dest, layer, options, false)
+	return applyLayerHandler(context.Background(), dest, layer, options, false)
+}
+
+// ApplyUncompressedLayerWithContext is ApplyUncompressedLayer, except that
+// it gives up, killing the process which is applying the layer, if ctx is
+// done before the layer has been applied.
+func ApplyUncompressedLayerWithContext(ctx context.Context, dest string, layer io.Reader, options *archive.TarOptions) (int64, error) {
+	return applyLayerHandler(ctx, dest, layer, options, false)
 }
@@ -1,6 +1,7 @@
 package chrootarchive
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -8,15 +9,23 @@ import (
 	"path/filepath"
 
 	"github.com/gepis/strge/pkg/archive"
+	"github.com/gepis/strge/pkg/ioutils"
 	"github.com/gepis/strge/pkg/longpath"
 )
 
 // applyLayerHandler parses a diff in the standard layer format from `layer`, and
 // applies it to the directory `dest`. Returns the size in bytes of the
-// contents of the layer.
-func applyLayerHandler(dest string, layer io.Reader, options *archive.TarOptions, decompress bool) (size int64, err error) {
+// contents of the layer.  If ctx is done before the layer has been applied,
+// reading the layer fails.
+func applyLayerHandler(ctx context.Context, dest string, layer io.Reader, options *archive.TarOptions, decompress bool) (size int64, err error) {
 	dest = filepath.Clean(dest)
 
+	if ctx.Done() != nil {
+		reader := ioutils.NewCancelReadCloser(ctx, ioutil.NopCloser(layer))
+		defer reader.Close()
+		layer = reader
+	}
+
 	// Ensure it is a Windows-style volume path
 	dest = longpath.AddPrefix(dest)
 
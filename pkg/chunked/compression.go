@@ -50,6 +50,39 @@ func isZstdChunkedFrameMagic(data []byte) bool {
 	return bytes.Equal(internal.ZstdChunkedFrameMagic, data[:8])
 }
 
+type compressedFileType int
+
+const (
+	fileTypeZstdChunked compressedFileType = iota
+	fileTypeEstargz
+)
+
+// detectChunkedFileType looks at the footer of a blob which has no annotations to find out which
+// format it uses.
+func detectChunkedFileType(blobStream ImageSourceSeekable, blobSize int64) (compressedFileType, error) {
+	size := int64(estargzFooterSize)
+	if blobSize < size {
+		size = blobSize
+	}
+	if size < int64(internal.FooterSizeSupported) {
+		return 0, errors.New("blob too small")
+	}
+
+	footer, err := readBlobAt(blobStream, uint64(blobSize-size), uint64(size))
+	if err != nil {
+		return 0, err
+	}
+
+	if isZstdChunkedFrameMagic(footer[len(footer)-len(internal.ZstdChunkedFrameMagic):]) {
+		return fileTypeZstdChunked, nil
+	}
+	if _, _, ok := parseEstargzFooter(footer); ok {
+		return fileTypeEstargz, nil
+	}
+
+	return 0, errors.New("blob type not supported for partial retrieval")
+}
+
 // readZstdChunkedManifest reads the zstd:chunked manifest from the seekable stream blobStream.  The blob total size must
 // be specified.
 // This function uses the io.containers.zstd-chunked. annotations when specified.
@@ -66,43 +66,82 @@ func writeZstdChunkedStream(destFile io.Writer, outMetadata map[string]string, r
 			return err
 		}
 
+		// Now handle the payload, if any.  Each chunk of it goes into a
+		// zstd frame of its own, so that it can be retrieved separately.
 		payloadDigester := digest.Canonical.Digester()
-		payloadChecksum := payloadDigester.Hash()
+		chunkDigester := digest.Canonical.Digester()
+		payloadDest := io.MultiWriter(payloadDigester.Hash(), chunkDigester.Hash(), zstdWriter)
 
-		payloadDest := io.MultiWriter(payloadChecksum, zstdWriter)
+		var chunks []internal.ZstdFileMetadata
+		var chunkStart, chunkOffset, fileOffset int64
+		inChunk := false
+		rs := newRollSum()
+
+		endChunk := func() error {
+			endOffset, err := restartCompression()
+			if err != nil {
+				return err
+			}
+			chunks = append(chunks, internal.ZstdFileMetadata{
+				Type:        internal.TypeChunk,
+				Name:        hdr.Name,
+				Offset:      chunkStart,
+				EndOffset:   endOffset,
+				ChunkOffset: chunkOffset,
+				ChunkSize:   fileOffset - chunkOffset,
+				ChunkDigest: chunkDigester.Digest().String(),
+			})
+			chunkDigester.Hash().Reset()
+			chunkStart = endOffset
+			chunkOffset = fileOffset
+			inChunk = false
+			return nil
+		}
 
-		// Now handle the payload, if any
-		var startOffset, endOffset int64
-		checksum := ""
 		for {
 			read, errRead := tr.Read(buf)
 			if errRead != nil && errRead != io.EOF {
-				return err
+				return errRead
 			}
 
-			// restart the compression only if there is
-			// a payload.
-			if read > 0 {
-				if startOffset == 0 {
-					startOffset, err = restartCompression()
+			data := buf[:read]
+			for len(data) > 0 {
+				// restart the compression only if there is
+				// a payload.
+				if len(chunks) == 0 && !inChunk {
+					chunkStart, err = restartCompression()
 					if err != nil {
 						return err
 					}
 				}
+				inChunk = true
+
+				n, split := 0, false
+				for n < len(data) && !split {
+					rs.roll(data[n])
+					n++
+					size := fileOffset + int64(n) - chunkOffset
+					split = size >= maxChunkSize || (size >= minChunkSize && rs.onSplit())
+				}
 
-				_, err := payloadDest.Write(buf[:read])
-				if err != nil {
+				if _, err := payloadDest.Write(data[:n]); err != nil {
 					return err
 				}
+				fileOffset += int64(n)
+				data = data[n:]
+
+				if split {
+					if err := endChunk(); err != nil {
+						return err
+					}
+				}
 			}
 
 			if errRead == io.EOF {
-				if startOffset > 0 {
-					endOffset, err = restartCompression()
-					if err != nil {
+				if inChunk {
+					if err := endChunk(); err != nil {
 						return err
 					}
-					checksum = payloadDigester.Digest().String()
 				}
 
 				break
@@ -133,17 +172,22 @@ func writeZstdChunkedStream(destFile io.Writer, outMetadata map[string]string, r
 			Devmajor:   hdr.Devmajor,
 			Devminor:   hdr.Devminor,
 			Xattrs:     xattrs,
-			Digest:     checksum,
-			Offset:     startOffset,
-			EndOffset:  endOffset,
-
-			// ChunkSize is 0 for the last chunk
-			ChunkSize:   0,
-			ChunkOffset: 0,
-			ChunkDigest: checksum,
+		}
+
+		// The entry for the file itself describes its first chunk, and
+		// any other chunks follow it as entries of their own.
+		if len(chunks) > 0 {
+			m.Digest = payloadDigester.Digest().String()
+			m.Offset = chunks[0].Offset
+			m.EndOffset = chunks[0].EndOffset
+			m.ChunkSize = chunks[0].ChunkSize
+			m.ChunkDigest = chunks[0].ChunkDigest
 		}
 
 		metadata = append(metadata, m)
+		if len(chunks) > 1 {
+			metadata = append(metadata, chunks[1:]...)
+		}
 	}
 
 	rawBytes := tr.RawBytes()
@@ -181,11 +225,11 @@ func (w zstdChunkedWriter) Close() error {
 
 func (w zstdChunkedWriter) Write(p []byte) (int, error) {
 	select {
-		case err := <-w.tarSplitErr:
-			w.tarSplitOut.Close()
-			return 0, err
-		default:
-			return w.tarSplitOut.Write(p)
+	case err := <-w.tarSplitErr:
+		w.tarSplitOut.Close()
+		return 0, err
+	default:
+		return w.tarSplitOut.Write(p)
 	}
 }
 
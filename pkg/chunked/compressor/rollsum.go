@@ -0,0 +1,51 @@
+package compressor
+
+// rollSum is the rolling checksum used by bup and rsync-style tools to find
+// content-defined chunk boundaries.  Boundaries depend only on the bytes in
+// a small window, so an insertion or deletion in a file only changes the
+// chunks around it.
+
+const (
+	windowSize = 64
+	charOffset = 31
+
+	// splitBits sets the average distance between boundaries to 64KiB.
+	splitBits = 16
+	splitMask = (1 << splitBits) - 1
+
+	// minChunkSize and maxChunkSize keep the number of zstd frames, and
+	// the size of each one, within reasonable limits.
+	minChunkSize = 8 * 1024
+	maxChunkSize = 1024 * 1024
+)
+
+type rollSum struct {
+	s1, s2 uint32
+	window [windowSize]uint8
+	wofs   int
+}
+
+func newRollSum() *rollSum {
+	return &rollSum{
+		s1: windowSize * charOffset,
+		s2: windowSize * (windowSize - 1) * charOffset,
+	}
+}
+
+func (rs *rollSum) add(drop, add uint32) {
+	rs.s1 += add - drop
+	rs.s2 += rs.s1 - uint32(windowSize)*(drop+charOffset)
+}
+
+// roll adds ch to the window, dropping the oldest byte in it.
+func (rs *rollSum) roll(ch byte) {
+	wp := &rs.window[rs.wofs]
+	rs.add(uint32(*wp), uint32(ch))
+	*wp = ch
+	rs.wofs = (rs.wofs + 1) % windowSize
+}
+
+// onSplit reports whether the window ends at a chunk boundary.
+func (rs *rollSum) onSplit() bool {
+	return (rs.s2 & splitMask) == splitMask
+}
@@ -0,0 +1,269 @@
+package chunked
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strconv"
+
+	"github.com/gepis/strge/pkg/chunked/internal"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+const (
+	// EstargzTOCDigestKey is the annotation which records the digest of the
+	// uncompressed TOC of an eStargz blob.
+	EstargzTOCDigestKey = "containerd.io/snapshot/stargz/toc.digest"
+
+	estargzTOCName = "stargz.index.json"
+
+	// estargzFooterSize is the largest size of the empty gzip stream which
+	// ends an eStargz blob.  Blobs written by the original stargz
+	// implementation end with a slightly smaller one.
+	estargzFooterSize       = 51
+	estargzFooterMagic      = "STARGZ"
+	estargzFooterOffsetSize = 16
+
+	// landmark files are added to eStargz blobs to mark the end of the
+	// files which should be prefetched.  They are not part of the layer.
+	estargzPrefetchLandmark   = ".prefetch.landmark"
+	estargzNoPrefetchLandmark = ".no.prefetch.landmark"
+)
+
+// estargzFooterHeader starts a gzip stream which has an extra field.
+var estargzFooterHeader = []byte{0x1f, 0x8b, 0x08, 0x04}
+
+// estargzTOCEntry is an entry in an eStargz TOC.  Other than InnerOffset,
+// its fields are the ones a zstd:chunked TOC uses.
+type estargzTOCEntry struct {
+	internal.ZstdFileMetadata
+	InnerOffset int64 `json:"innerOffset,omitempty"`
+}
+
+type estargzTOC struct {
+	Version int               `json:"version"`
+	Entries []estargzTOCEntry `json:"entries"`
+}
+
+// readBlobAt reads length bytes from the blob, starting at offset.
+func readBlobAt(blobStream ImageSourceSeekable, offset, length uint64) ([]byte, error) {
+	chunk := ImageSourceChunk{
+		Offset: offset,
+		Length: length,
+	}
+
+	parts, errs, err := blobStream.GetBlobAt([]ImageSourceChunk{chunk})
+	if err != nil {
+		return nil, err
+	}
+
+	var reader io.ReadCloser
+	select {
+	case r := <-parts:
+		reader = r
+	case err := <-errs:
+		return nil, err
+	}
+	defer reader.Close()
+
+	data := make([]byte, length)
+	if _, err := io.ReadFull(reader, data); err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+// parseEstargzFooter returns the offset of the TOC, and the size of the
+// footer, if data ends with an eStargz or stargz footer.  The footer is an
+// empty gzip stream, and its size depends on how the deflate encoder ends
+// an empty stream, so look for any gzip header which can start it.
+func parseEstargzFooter(data []byte) (int64, int64, bool) {
+	for start := 0; start+len(estargzFooterHeader) <= len(data); start++ {
+		if !bytes.Equal(data[start:start+len(estargzFooterHeader)], estargzFooterHeader) {
+			continue
+		}
+
+		gz, err := gzip.NewReader(bytes.NewReader(data[start:]))
+		if err != nil {
+			continue
+		}
+		_, err = io.Copy(ioutil.Discard, gz)
+		gz.Close()
+		if err != nil {
+			continue
+		}
+
+		extra := gz.Header.Extra
+		// eStargz wraps the offset in a gzip extra field subfield.
+		if len(extra) >= 4 && extra[0] == 'S' && extra[1] == 'G' && int(binary.LittleEndian.Uint16(extra[2:4])) == len(extra)-4 {
+			extra = extra[4:]
+		}
+
+		if len(extra) != estargzFooterOffsetSize+len(estargzFooterMagic) || string(extra[estargzFooterOffsetSize:]) != estargzFooterMagic {
+			continue
+		}
+
+		offset, err := strconv.ParseInt(string(extra[:estargzFooterOffsetSize]), 16, 64)
+		if err != nil {
+			continue
+		}
+
+		return offset, int64(len(data) - start), true
+	}
+
+	return 0, 0, false
+}
+
+// readEstargzManifest reads the TOC from an eStargz blob and converts it to the
+// zstd:chunked manifest format, which is what the rest of this package, and
+// the layers which are created from it, use.
+// The TOC is verified against the annotation which records its digest, when
+// specified.
+func readEstargzManifest(blobStream ImageSourceSeekable, blobSize int64, annotations map[string]string) ([]byte, error) {
+	if blobSize <= estargzFooterSize {
+		return nil, errors.New("blob too small")
+	}
+
+	footer, err := readBlobAt(blobStream, uint64(blobSize-estargzFooterSize), estargzFooterSize)
+	if err != nil {
+		return nil, err
+	}
+
+	tocOffset, footerSize, ok := parseEstargzFooter(footer)
+	if !ok {
+		return nil, errors.New("invalid eStargz footer")
+	}
+
+	if tocOffset <= 0 || tocOffset >= blobSize-footerSize {
+		return nil, errors.Errorf("invalid eStargz TOC offset %d", tocOffset)
+	}
+
+	// set a reasonable limit
+	length := blobSize - footerSize - tocOffset
+	if length > (1<<20)*50 {
+		return nil, errors.New("manifest too big")
+	}
+
+	compressedTOC, err := readBlobAt(blobStream, uint64(tocOffset), uint64(length))
+	if err != nil {
+		return nil, err
+	}
+
+	gz, err := gzip.NewReader(bytes.NewReader(compressedTOC))
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+
+	var tocData []byte
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			if err == io.EOF {
+				return nil, errors.Errorf("%q not found in the eStargz TOC", estargzTOCName)
+			}
+			return nil, err
+		}
+		if hdr.Name != estargzTOCName {
+			continue
+		}
+		if tocData, err = ioutil.ReadAll(io.LimitReader(tr, (1<<20)*50)); err != nil {
+			return nil, err
+		}
+		break
+	}
+
+	if tocDigestAnnotation := annotations[EstargzTOCDigestKey]; tocDigestAnnotation != "" {
+		d, err := digest.Parse(tocDigestAnnotation)
+		if err != nil {
+			return nil, err
+		}
+		if d.Algorithm().FromBytes(tocData) != d {
+			return nil, errors.New("invalid eStargz TOC digest")
+		}
+	}
+
+	var toc estargzTOC
+	if err := json.Unmarshal(tocData, &toc); err != nil {
+		return nil, errors.Wrapf(err, "error decoding the eStargz TOC")
+	}
+
+	manifest, err := convertEstargzTOC(&toc, tocOffset)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(manifest)
+}
+
+// convertEstargzTOC fills in the fields which the eStargz TOC leaves out.
+// Every file's contents start in a gzip stream of their own, which ends where
+// the next one starts, or where the TOC starts.
+func convertEstargzTOC(toc *estargzTOC, tocOffset int64) (*internal.ZstdTOC, error) {
+	offsets := []int64{tocOffset}
+	for _, e := range toc.Entries {
+		if e.Offset > 0 {
+			offsets = append(offsets, e.Offset)
+		}
+	}
+	sort.Slice(offsets, func(i, j int) bool {
+		return offsets[i] < offsets[j]
+	})
+
+	manifest := &internal.ZstdTOC{
+		Version: toc.Version,
+	}
+	for _, e := range toc.Entries {
+		if e.Name == estargzPrefetchLandmark || e.Name == estargzNoPrefetchLandmark {
+			continue
+		}
+		if e.InnerOffset != 0 {
+			return nil, errors.Errorf("chunks sharing a gzip stream are not supported (%q)", e.Name)
+		}
+
+		m := e.ZstdFileMetadata
+		if m.Offset > 0 {
+			i := sort.Search(len(offsets), func(i int) bool {
+				return offsets[i] > m.Offset
+			})
+			if i == len(offsets) || m.Offset >= tocOffset {
+				return nil, errors.Errorf("invalid offset %d for %q", m.Offset, m.Name)
+			}
+			m.EndOffset = offsets[i]
+		}
+
+		manifest.Entries = append(manifest.Entries, m)
+	}
+
+	// A chunk without a size extends to the next chunk, or to the end of
+	// the file.
+	var fileSize int64
+	for i := range manifest.Entries {
+		m := &manifest.Entries[i]
+		if m.Type == TypeReg {
+			fileSize = m.Size
+		} else if m.Type != TypeChunk {
+			continue
+		}
+		lastChunk := i+1 == len(manifest.Entries) || manifest.Entries[i+1].Type != TypeChunk
+		if m.ChunkSize == 0 {
+			m.ChunkSize = fileSize - m.ChunkOffset
+			if !lastChunk {
+				m.ChunkSize = manifest.Entries[i+1].ChunkOffset - m.ChunkOffset
+			}
+		}
+		if m.Type == TypeReg && m.ChunkDigest == "" && lastChunk {
+			m.ChunkDigest = m.Digest
+		}
+	}
+
+	return manifest, nil
+}
@@ -36,7 +36,11 @@ type ZstdFileMetadata struct {
 	Offset     int64             `json:"offset,omitempty"`
 	EndOffset  int64             `json:"endOffset,omitempty"`
 
-	// Currently chunking is not supported.
+	// Regular files are split into chunks at content-defined boundaries.
+	// The entry for the file describes its first chunk, and a TypeChunk
+	// entry with the same Name follows it for each of the others.
+	// ChunkOffset is the position of the chunk in the file, and
+	// ChunkDigest is the digest of its uncompressed contents.
 	ChunkSize   int64  `json:"chunkSize,omitempty"`
 	ChunkOffset int64  `json:"chunkOffset,omitempty"`
 	ChunkDigest string `json:"chunkDigest,omitempty"`
@@ -2,6 +2,7 @@ package chunked
 
 import (
 	archivetar "archive/tar"
+	"compress/gzip"
 	"context"
 	"encoding/base64"
 	"encoding/json"
@@ -11,17 +12,17 @@ import (
 	"os"
 	"path/filepath"
 	"sort"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
 
 	strge "github.com/gepis/strge"
-	"github.com/gepis/strge/context"
+	cntx "github.com/gepis/strge/context"
 	CCopy "github.com/gepis/strge/context/copy"
 	"github.com/gepis/strge/pkg/archive"
 	"github.com/gepis/strge/pkg/chunked/internal"
 	"github.com/gepis/strge/pkg/idtools"
-	"github.com/gepis/strge/types"
 	"github.com/klauspost/compress/zstd"
 	digest "github.com/opencontainers/go-digest"
 	"github.com/pkg/errors"
@@ -37,9 +38,70 @@ const (
 	bigDataKey              = "zstd-chunked-manifest"
 )
 
-type chunkedZstdDiffer struct {
+// Keys in the store's pull options which control partial pulls.
+const (
+	// EnablePartialImagesOption enables partial pulls when set to "true".
+	EnablePartialImagesOption = "enable_partial_images"
+	// EnableHostDeduplicationOption allows files to be copied from the host
+	// when set to "true".
+	EnableHostDeduplicationOption = "enable_host_deduplication"
+	// HostDeduplicationRootsOption is a comma-separated list of the
+	// directories on the host where files can be copied from.  It defaults
+	// to "/usr".
+	HostDeduplicationRootsOption = "host_deduplication_roots"
+	// DeduplicationMaxLayersOption limits how many of the store's layers,
+	// most recently created first, are searched for files and chunks which
+	// can be reused.  There is no limit if it is unset or "0".
+	DeduplicationMaxLayersOption = "deduplication_max_layers"
+)
+
+// pullOptions are the settings which the differ takes from the store's pull options.
+type pullOptions struct {
+	enablePartialImages    bool
+	enableHostDedup        bool
+	hostDedupRoots         []string
+	deduplicationMaxLayers int
+}
+
+func parsePullOptions(options map[string]string) (pullOptions, error) {
+	const trueVal = "true"
+
+	opts := pullOptions{
+		enablePartialImages: strings.ToLower(options[EnablePartialImagesOption]) == trueVal,
+		enableHostDedup:     strings.ToLower(options[EnableHostDeduplicationOption]) == trueVal,
+		hostDedupRoots:      []string{"/usr"},
+	}
+
+	if value := options[HostDeduplicationRootsOption]; value != "" {
+		opts.hostDedupRoots = nil
+		for _, root := range strings.Split(value, ",") {
+			root = strings.TrimSpace(root)
+			if root == "" {
+				continue
+			}
+			if !filepath.IsAbs(root) {
+				return opts, errors.Errorf("invalid value %q for %q: %q is not an absolute path", value, HostDeduplicationRootsOption, root)
+			}
+			opts.hostDedupRoots = append(opts.hostDedupRoots, filepath.Clean(root))
+		}
+	}
+
+	if value := options[DeduplicationMaxLayersOption]; value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return opts, errors.Errorf("invalid value %q for %q", value, DeduplicationMaxLayersOption)
+		}
+		opts.deduplicationMaxLayers = n
+	}
+
+	return opts, nil
+}
+
+type chunkedDiffer struct {
 	stream         ImageSourceSeekable
+	fileType       compressedFileType
 	manifest       []byte
+	pullOptions    pullOptions
 	layersMetadata map[string][]internal.ZstdFileMetadata
 	layersTarget   map[string]string
 }
@@ -84,6 +146,9 @@ func prepareOtherLayersCache(layersMetadata map[string][]internal.ZstdFileMetada
 	for layerID, v := range layersMetadata {
 		r := make(map[string]*internal.ZstdFileMetadata)
 		for i := range v {
+			if v[i].Digest == "" {
+				continue
+			}
 			r[v[i].Digest] = &v[i]
 		}
 		maps[layerID] = r
@@ -92,12 +157,58 @@ func prepareOtherLayersCache(layersMetadata map[string][]internal.ZstdFileMetada
 	return maps
 }
 
-func getLayersCache(store strge.Store) (map[string][]internal.ZstdFileMetadata, map[string]string, error) {
+// chunkLocation is where a copy of a chunk can be found in another layer.
+type chunkLocation struct {
+	layerID string
+	name    string
+	offset  int64
+	size    int64
+}
+
+func prepareOtherLayersChunksCache(layersMetadata map[string][]internal.ZstdFileMetadata) map[string]chunkLocation {
+	chunks := make(map[string]chunkLocation)
+
+	for layerID, v := range layersMetadata {
+		for _, e := range v {
+			if e.ChunkDigest == "" || (e.Type != TypeReg && e.Type != TypeChunk) {
+				continue
+			}
+			size := e.ChunkSize
+			if size == 0 && e.Type == TypeReg {
+				// Manifests written before files were split into chunks
+				// describe the whole file as a single chunk.
+				size = e.Size
+			}
+			if size == 0 {
+				continue
+			}
+			chunks[e.ChunkDigest] = chunkLocation{
+				layerID: layerID,
+				name:    e.Name,
+				offset:  e.ChunkOffset,
+				size:    size,
+			}
+		}
+	}
+
+	return chunks
+}
+
+// getLayersCache reads the manifests of the layers in the store which were created from partial pulls.
+// If maxLayers is not 0, only that many of the most recently created layers are looked at.
+func getLayersCache(store strge.Store, maxLayers int) (map[string][]internal.ZstdFileMetadata, map[string]string, error) {
 	allLayers, err := store.Layers()
 	if err != nil {
 		return nil, nil, err
 	}
 
+	if maxLayers > 0 && len(allLayers) > maxLayers {
+		sort.Slice(allLayers, func(i, j int) bool {
+			return allLayers[i].Created.After(allLayers[j].Created)
+		})
+		allLayers = allLayers[:maxLayers]
+	}
+
 	layersMetadata := make(map[string][]internal.ZstdFileMetadata)
 	layersTarget := make(map[string]string)
 	for _, r := range allLayers {
@@ -106,8 +217,8 @@ func getLayersCache(store strge.Store) (map[string][]internal.ZstdFileMetadata,
 			continue
 		}
 
-		defer manifestReader.Close()
 		manifest, err := ioutil.ReadAll(manifestReader)
+		manifestReader.Close()
 		if err != nil {
 			return nil, nil, err
 		}
@@ -130,28 +241,63 @@ func getLayersCache(store strge.Store) (map[string][]internal.ZstdFileMetadata,
 }
 
 // GetDiffer returns a differ than can be used with ApplyDiffWithDiffer.
-func GetDiffer(ctx context.Context, store strge.Store, blobSize int64, annotations map[string]string, iss ImageSourceSeekable) (context.Differ, error) {
+// The format of the blob is taken from its annotations, or from its footer
+// if it has none that are recognized.
+func GetDiffer(ctx context.Context, store strge.Store, blobSize int64, annotations map[string]string, iss ImageSourceSeekable) (cntx.Differ, error) {
 	if _, ok := annotations[internal.ManifestChecksumKey]; ok {
 		return makeZstdChunkedDiffer(ctx, store, blobSize, annotations, iss)
 	}
+	if _, ok := annotations[EstargzTOCDigestKey]; ok {
+		return makeEstargzChunkedDiffer(ctx, store, blobSize, annotations, iss)
+	}
 
-	return nil, errors.New("blob type not supported for partial retrieval")
+	fileType, err := detectChunkedFileType(iss, blobSize)
+	if err != nil {
+		return nil, err
+	}
+
+	switch fileType {
+	case fileTypeEstargz:
+		return makeEstargzChunkedDiffer(ctx, store, blobSize, annotations, iss)
+	default:
+		return makeZstdChunkedDiffer(ctx, store, blobSize, annotations, iss)
+	}
 }
 
-func makeZstdChunkedDiffer(ctx context.Context, store strge.Store, blobSize int64, annotations map[string]string, iss ImageSourceSeekable) (*chunkedZstdDiffer, error) {
+func makeZstdChunkedDiffer(ctx context.Context, store strge.Store, blobSize int64, annotations map[string]string, iss ImageSourceSeekable) (*chunkedDiffer, error) {
 	manifest, err := readZstdChunkedManifest(iss, blobSize, annotations)
 	if err != nil {
 		return nil, err
 	}
 
-	layersMetadata, layersTarget, err := getLayersCache(store)
+	return makeChunkedDiffer(store, fileTypeZstdChunked, manifest, iss)
+}
+
+func makeEstargzChunkedDiffer(ctx context.Context, store strge.Store, blobSize int64, annotations map[string]string, iss ImageSourceSeekable) (*chunkedDiffer, error) {
+	manifest, err := readEstargzManifest(iss, blobSize, annotations)
+	if err != nil {
+		return nil, err
+	}
+
+	return makeChunkedDiffer(store, fileTypeEstargz, manifest, iss)
+}
+
+func makeChunkedDiffer(store strge.Store, fileType compressedFileType, manifest []byte, iss ImageSourceSeekable) (*chunkedDiffer, error) {
+	pullOptions, err := parsePullOptions(store.PullOptions())
+	if err != nil {
+		return nil, err
+	}
+
+	layersMetadata, layersTarget, err := getLayersCache(store, pullOptions.deduplicationMaxLayers)
 	if err != nil {
 		return nil, err
 	}
 
-	return &chunkedZstdDiffer{
+	return &chunkedDiffer{
 		stream:         iss,
+		fileType:       fileType,
 		manifest:       manifest,
+		pullOptions:    pullOptions,
 		layersMetadata: layersMetadata,
 		layersTarget:   layersTarget,
 	}, nil
@@ -197,6 +343,83 @@ func findFileInOtherLayers(file internal.ZstdFileMetadata, root string, dirfd in
 	return nil, 0, nil
 }
 
+func copyChunkFromOtherLayer(dstFile *os.File, chunk *internal.ZstdFileMetadata, location chunkLocation, layersTarget map[string]string) error {
+	source, ok := layersTarget[location.layerID]
+	if !ok {
+		return errors.Errorf("layer %q has no target", location.layerID)
+	}
+
+	srcDirfd, err := unix.Open(source, unix.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+
+	defer unix.Close(srcDirfd)
+
+	srcFile, err := openFileUnderRoot(location.name, source, srcDirfd, unix.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+
+	defer srcFile.Close()
+
+	if _, err := dstFile.Seek(chunk.ChunkOffset, io.SeekStart); err != nil {
+		return err
+	}
+
+	digester := digest.Canonical.Digester()
+	written, err := io.Copy(io.MultiWriter(dstFile, digester.Hash()), io.NewSectionReader(srcFile, location.offset, location.size))
+	if err != nil {
+		return err
+	}
+
+	if written != chunk.ChunkSize || digester.Digest().String() != chunk.ChunkDigest {
+		return fmt.Errorf("chunk mismatch for %q at offset %d", location.name, location.offset)
+	}
+
+	return nil
+}
+
+// findChunksInOtherLayers creates the file and copies into it the chunks which are also present in other layers.
+// It returns the chunks which still need to be retrieved, and whether the file was created at all.  The file is
+// not created if none of its chunks are available locally.
+func findChunksInOtherLayers(file *internal.ZstdFileMetadata, chunks []internal.ZstdFileMetadata, root string, dirfd int, chunksCache map[string]chunkLocation, layersTarget map[string]string) ([]internal.ZstdFileMetadata, bool, error) {
+	found := false
+	for _, c := range chunks {
+		if c.ChunkDigest == "" {
+			return chunks, false, nil
+		}
+		if _, ok := chunksCache[c.ChunkDigest]; ok {
+			found = true
+		}
+	}
+	if !found {
+		return chunks, false, nil
+	}
+
+	dstFile, err := openFileUnderRoot(file.Name, root, dirfd, newFileFlags, 0)
+	if err != nil {
+		return nil, false, err
+	}
+
+	defer dstFile.Close()
+
+	var missing []internal.ZstdFileMetadata
+	for i := range chunks {
+		location, ok := chunksCache[chunks[i].ChunkDigest]
+		if ok {
+			err := copyChunkFromOtherLayer(dstFile, &chunks[i], location, layersTarget)
+			if err == nil {
+				continue
+			}
+			logrus.Debugf("Cannot reuse chunk at offset %d of %q: %v", chunks[i].ChunkOffset, file.Name, err)
+		}
+		missing = append(missing, chunks[i])
+	}
+
+	return missing, true, nil
+}
+
 func getFileDigest(f *os.File) (digest.Digest, error) {
 	digester := digest.Canonical.Digester()
 	if _, err := io.Copy(digester.Hash(), f); err != nil {
@@ -209,10 +432,17 @@ func getFileDigest(f *os.File) (digest.Digest, error) {
 // findFileOnTheHost checks whether the requested file already exist on the host and copies the file content from there if possible.
 // It is currently implemented to look only at the file with the same path.  Ideally it can detect the same content also at different
 // paths.
-func findFileOnTheHost(file internal.ZstdFileMetadata, root string, dirfd int, missingDirsMode os.FileMode) (*os.File, int64, error) {
+func findFileOnTheHost(file internal.ZstdFileMetadata, root string, dirfd int, missingDirsMode os.FileMode, dedupRoots []string) (*os.File, int64, error) {
 	sourceFile := filepath.Clean(filepath.Join("/", file.Name))
-	if !strings.HasPrefix(sourceFile, "/usr/") {
-		// limit host deduplication to files under /usr.
+	underRoot := false
+	for _, dedupRoot := range dedupRoots {
+		if dedupRoot == "/" || strings.HasPrefix(sourceFile, dedupRoot+"/") {
+			underRoot = true
+			break
+		}
+	}
+	if !underRoot {
+		// limit host deduplication to files under the configured roots.
 		return nil, 0, nil
 	}
 
@@ -298,10 +528,16 @@ func maybeDoIDRemap(manifest []internal.ZstdFileMetadata, options *archive.TarOp
 
 type missingFile struct {
 	File *internal.ZstdFileMetadata
-	Gap  int64
+	// Chunk, if set, is the only part of File which is retrieved.  The
+	// rest of the file was already copied from other layers.
+	Chunk *internal.ZstdFileMetadata
+	Gap   int64
 }
 
 func (m missingFile) Length() int64 {
+	if m.Chunk != nil {
+		return m.Chunk.EndOffset - m.Chunk.Offset
+	}
 	return m.File.EndOffset - m.File.Offset
 }
 
@@ -368,7 +604,22 @@ func openFileUnderRoot(name, root string, dirfd int, flags uint64, mode os.FileM
 	return os.NewFile(uintptr(fd), name), nil
 }
 
-func createFileFromZstdStream(dest string, dirfd int, reader io.Reader, missingDirsMode, mode os.FileMode, metadata *internal.ZstdFileMetadata, options *archive.TarOptions) (err error) {
+// newDecompressor returns a reader for the contents of a range of the blob.
+func newDecompressor(fileType compressedFileType, reader io.Reader) (io.ReadCloser, error) {
+	switch fileType {
+	case fileTypeEstargz:
+		return gzip.NewReader(reader)
+	case fileTypeZstdChunked:
+		z, err := zstd.NewReader(reader)
+		if err != nil {
+			return nil, err
+		}
+		return z.IOReadCloser(), nil
+	}
+	return nil, errors.Errorf("unknown file type %d", fileType)
+}
+
+func createFileFromCompressedStream(fileType compressedFileType, dest string, dirfd int, reader io.Reader, missingDirsMode, mode os.FileMode, metadata *internal.ZstdFileMetadata, options *archive.TarOptions) (err error) {
 	file, err := openFileUnderRoot(metadata.Name, dest, dirfd, newFileFlags, 0)
 	if err != nil {
 		return err
@@ -380,16 +631,18 @@ func createFileFromZstdStream(dest string, dirfd int, reader io.Reader, missingD
 		}
 	}()
 
-	z, err := zstd.NewReader(reader)
+	z, err := newDecompressor(fileType, reader)
 	if err != nil {
 		return err
 	}
 
 	defer z.Close()
 
+	// the stream can continue past the end of the file's contents, with
+	// the headers for the next entries in the tarball
 	digester := digest.Canonical.Digester()
 	checksum := digester.Hash()
-	_, err = z.WriteTo(io.MultiWriter(file, checksum))
+	_, err = io.CopyN(io.MultiWriter(file, checksum), z, metadata.Size)
 	if err != nil {
 		return err
 	}
@@ -406,7 +659,63 @@ func createFileFromZstdStream(dest string, dirfd int, reader io.Reader, missingD
 	return setFileAttrs(file, mode, metadata, options)
 }
 
-func storeMissingFiles(streams chan io.ReadCloser, errs chan error, dest string, dirfd int, missingChunks []missingChunk, missingDirsMode os.FileMode, options *archive.TarOptions) error {
+func writeChunkFromCompressedStream(fileType compressedFileType, dest string, dirfd int, reader io.Reader, metadata, chunk *internal.ZstdFileMetadata) (err error) {
+	file, err := openFileUnderRoot(metadata.Name, dest, dirfd, unix.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err2 := file.Close()
+		if err == nil {
+			err = err2
+		}
+	}()
+
+	if _, err := file.Seek(chunk.ChunkOffset, io.SeekStart); err != nil {
+		return err
+	}
+
+	z, err := newDecompressor(fileType, reader)
+	if err != nil {
+		return err
+	}
+
+	defer z.Close()
+
+	digester := digest.Canonical.Digester()
+	if _, err := io.CopyN(io.MultiWriter(file, digester.Hash()), z, chunk.ChunkSize); err != nil {
+		return err
+	}
+
+	if digester.Digest().String() != chunk.ChunkDigest {
+		return fmt.Errorf("checksum mismatch for chunk at offset %d of %q", chunk.ChunkOffset, metadata.Name)
+	}
+
+	return nil
+}
+
+// finishPartialFile verifies a file which was assembled from chunks, and sets its attributes.
+func finishPartialFile(dest string, dirfd int, mode os.FileMode, metadata *internal.ZstdFileMetadata, options *archive.TarOptions) error {
+	file, err := openFileUnderRoot(metadata.Name, dest, dirfd, unix.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	checksum, err := getFileDigest(file)
+	if err != nil {
+		return err
+	}
+
+	if checksum.String() != metadata.Digest {
+		return fmt.Errorf("checksum mismatch for %q", metadata.Name)
+	}
+
+	return setFileAttrs(file, mode, metadata, options)
+}
+
+func storeMissingFiles(streams chan io.ReadCloser, errs chan error, fileType compressedFileType, dest string, dirfd int, missingChunks []missingChunk, missingDirsMode os.FileMode, options *archive.TarOptions) error {
 	for mc := 0; ; mc++ {
 		var part io.ReadCloser
 		select {
@@ -441,7 +750,17 @@ func storeMissingFiles(streams chan io.ReadCloser, errs chan error, dest string,
 
 			limitReader := io.LimitReader(part, mf.Length())
 
-			if err := createFileFromZstdStream(dest, dirfd, limitReader, missingDirsMode, os.FileMode(mf.File.Mode), mf.File, options); err != nil {
+			var err error
+			if mf.Chunk != nil {
+				err = writeChunkFromCompressedStream(fileType, dest, dirfd, limitReader, mf.File, mf.Chunk)
+			} else {
+				err = createFileFromCompressedStream(fileType, dest, dirfd, limitReader, missingDirsMode, os.FileMode(mf.File.Mode), mf.File, options)
+			}
+			if err == nil {
+				// skip whatever follows the file's contents in its range
+				_, err = io.Copy(ioutil.Discard, limitReader)
+			}
+			if err != nil {
 				part.Close()
 				return err
 			}
@@ -494,7 +813,7 @@ func mergeMissingChunks(missingChunks []missingChunk, target int) []missingChunk
 	return newMissingChunks
 }
 
-func retrieveMissingFiles(input *chunkedZstdDiffer, dest string, dirfd int, missingChunks []missingChunk, missingDirsMode os.FileMode, options *archive.TarOptions) error {
+func retrieveMissingFiles(input *chunkedDiffer, dest string, dirfd int, missingChunks []missingChunk, missingDirsMode os.FileMode, options *archive.TarOptions) error {
 	var chunksToRequest []ImageSourceChunk
 	for _, c := range missingChunks {
 		chunksToRequest = append(chunksToRequest, c.RawChunk)
@@ -525,7 +844,7 @@ func retrieveMissingFiles(input *chunkedZstdDiffer, dest string, dirfd int, miss
 		return err
 	}
 
-	if err := storeMissingFiles(streams, errs, dest, dirfd, missingChunks, missingDirsMode, options); err != nil {
+	if err := storeMissingFiles(streams, errs, input.fileType, dest, dirfd, missingChunks, missingDirsMode, options); err != nil {
 		return err
 	}
 
@@ -675,6 +994,11 @@ func (d whiteoutHandler) Chown(path string, uid, gid int) error {
 	return nil
 }
 
+type partialFileToFinish struct {
+	mode     os.FileMode
+	metadata *internal.ZstdFileMetadata
+}
+
 type hardLinkToCreate struct {
 	dest     string
 	dirfd    int
@@ -682,30 +1006,18 @@ type hardLinkToCreate struct {
 	metadata *internal.ZstdFileMetadata
 }
 
-func (d *chunkedZstdDiffer) ApplyDiff(dest string, options *archive.TarOptions) (context.DriverWithDifferOutput, error) {
+func (d *chunkedDiffer) ApplyDiff(dest string, options *archive.TarOptions) (cntx.DriverWithDifferOutput, error) {
 	bigData := map[string][]byte{
 		bigDataKey: d.manifest,
 	}
 
-	output := context.DriverWithDifferOutput{
+	output := cntx.DriverWithDifferOutput{
 		Differ:  d,
 		BigData: bigData,
 	}
 
-	storeOpts, err := types.DefaultStoreOptionsAutoDetectUID()
-	if err != nil {
-		return output, err
-	}
-
-	const trueVal = "true"
-
-	if value := storeOpts.PullOptions["enable_partial_images"]; strings.ToLower(value) != trueVal {
-		return output, errors.New("enable_partial_images not configured")
-	}
-
-	enableHostDedup := false
-	if value := storeOpts.PullOptions["enable_host_deduplication"]; strings.ToLower(value) == trueVal {
-		enableHostDedup = true
+	if !d.pullOptions.enablePartialImages {
+		return output, errors.Errorf("%s not configured", EnablePartialImagesOption)
 	}
 
 	// Generate the manifest
@@ -718,6 +1030,8 @@ func (d *chunkedZstdDiffer) ApplyDiff(dest string, options *archive.TarOptions)
 
 	var missingChunks []missingChunk
 	var mergedEntries []internal.ZstdFileMetadata
+	// fileChunks has the chunks of each regular file in mergedEntries.
+	var fileChunks [][]internal.ZstdFileMetadata
 
 	if err := maybeDoIDRemap(toc.Entries, options); err != nil {
 		return output, err
@@ -731,10 +1045,16 @@ func (d *chunkedZstdDiffer) ApplyDiff(dest string, options *archive.TarOptions)
 			}
 
 			mergedEntries[l-1].EndOffset = e.EndOffset
+			fileChunks[l-1] = append(fileChunks[l-1], e)
 			continue
 		}
 
+		var chunks []internal.ZstdFileMetadata
+		if e.Type == TypeReg {
+			chunks = []internal.ZstdFileMetadata{e}
+		}
 		mergedEntries = append(mergedEntries, e)
+		fileChunks = append(fileChunks, chunks)
 	}
 
 	if options.ForceMask != nil {
@@ -755,6 +1075,7 @@ func (d *chunkedZstdDiffer) ApplyDiff(dest string, options *archive.TarOptions)
 	defer unix.Close(dirfd)
 
 	otherLayersCache := prepareOtherLayersCache(d.layersMetadata)
+	otherLayersChunksCache := prepareOtherLayersChunksCache(d.layersMetadata)
 
 	missingDirsMode := os.FileMode(0700)
 	if options.ForceMask != nil {
@@ -765,6 +1086,10 @@ func (d *chunkedZstdDiffer) ApplyDiff(dest string, options *archive.TarOptions)
 	// are retrieved
 	var hardLinks []hardLinkToCreate
 
+	// files which were partially copied from other layers can be verified
+	// only after the missing chunks are retrieved
+	var partialFiles []partialFileToFinish
+
 	missingChunksSize, totalChunksSize := int64(0), int64(0)
 	for i, r := range mergedEntries {
 		if options.ForceMask != nil {
@@ -885,8 +1210,8 @@ func (d *chunkedZstdDiffer) ApplyDiff(dest string, options *archive.TarOptions)
 			continue
 		}
 
-		if enableHostDedup {
-			dstFile, _, err = findFileOnTheHost(r, dest, dirfd, missingDirsMode)
+		if d.pullOptions.enableHostDedup {
+			dstFile, _, err = findFileOnTheHost(r, dest, dirfd, missingDirsMode, d.pullOptions.hostDedupRoots)
 			if err != nil {
 				return output, err
 			}
@@ -900,14 +1225,45 @@ func (d *chunkedZstdDiffer) ApplyDiff(dest string, options *archive.TarOptions)
 			}
 		}
 
+		if t == tar.TypeReg && len(fileChunks[i]) > 1 {
+			missing, created, err := findChunksInOtherLayers(&r, fileChunks[i], dest, dirfd, otherLayersChunksCache, d.layersTarget)
+			if err != nil {
+				return output, err
+			}
+			if created {
+				entry := r
+				partialFiles = append(partialFiles, partialFileToFinish{
+					mode:     mode,
+					metadata: &entry,
+				})
+				for j := range missing {
+					missingChunksSize += missing[j].ChunkSize
+					missingChunks = append(missingChunks, missingChunk{
+						RawChunk: ImageSourceChunk{
+							Offset: uint64(missing[j].Offset),
+							Length: uint64(missing[j].EndOffset - missing[j].Offset),
+						},
+						Files: []missingFile{
+							{
+								File:  &entry,
+								Chunk: &missing[j],
+							},
+						},
+					})
+				}
+				continue
+			}
+		}
+
 		missingChunksSize += r.Size
 		if t == tar.TypeReg {
 			rawChunk := ImageSourceChunk{
 				Offset: uint64(r.Offset),
 				Length: uint64(r.EndOffset - r.Offset),
 			}
+			entry := r
 			file := missingFile{
-				File: &toc.Entries[i],
+				File: &entry,
 			}
 			missingChunks = append(missingChunks, missingChunk{
 				RawChunk: rawChunk,
@@ -925,6 +1281,12 @@ func (d *chunkedZstdDiffer) ApplyDiff(dest string, options *archive.TarOptions)
 		}
 	}
 
+	for _, p := range partialFiles {
+		if err := finishPartialFile(dest, dirfd, p.mode, p.metadata, options); err != nil {
+			return output, err
+		}
+	}
+
 	for _, m := range hardLinks {
 		if err := safeLink(m.dest, m.dirfd, m.mode, m.metadata, options); err != nil {
 			return output, err
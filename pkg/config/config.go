@@ -106,6 +106,13 @@ type OptionsConfig struct {
 	// This API is experimental and can be changed without bumping the major version number.
 	PullOptions map[string]string `toml:"pull_options"`
 	DisableVolatile bool `toml:"disable-volatile"`
+	// LockTimeout is how long to wait for a lock, for example "30s",
+	// before giving up.  If it is not set, we wait forever.
+	LockTimeout string `toml:"lock_timeout"`
+	// MetadataBackend is either "json", to rewrite the layer, image, and
+	// container lists whenever they change, or "journal", to append only
+	// the changes to a journal.
+	MetadataBackend string `toml:"metadata_backend"`
 }
 
 func GetGraphDriverOptions(driverName string, options OptionsConfig) []string {
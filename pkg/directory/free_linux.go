@@ -0,0 +1,15 @@
+package directory
+
+import (
+	"syscall"
+)
+
+// Free returns the number of bytes which are available to unprivileged users
+// on the filesystem which contains the specified directory.
+func Free(dir string) (uint64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return 0, err
+	}
+	return st.Bavail * uint64(st.Bsize), nil
+}
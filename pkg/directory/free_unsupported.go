@@ -0,0 +1,13 @@
+// +build !linux
+
+package directory
+
+import (
+	"errors"
+)
+
+// Free returns the number of bytes which are available to unprivileged users
+// on the filesystem which contains the specified directory.
+func Free(dir string) (uint64, error) {
+	return 0, errors.New("directory.Free is not supported on this platform")
+}
@@ -0,0 +1,185 @@
+package lockfile
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gepis/strge/pkg/ioutils"
+	"github.com/pkg/errors"
+)
+
+// LockHolder describes a process which holds, or is waiting for, a lock.
+type LockHolder struct {
+	// PID is the holder's process ID.
+	PID int `json:"pid"`
+	// Process is the name of the holder's executable, if it is known.
+	Process string `json:"process,omitempty"`
+	// Type is either "read" or "write", if it is known.
+	Type string `json:"type,omitempty"`
+	// Since is the time when the holder acquired the lock, or started
+	// waiting for it, if it is known.
+	Since time.Time `json:"since,omitempty"`
+}
+
+// LockStatus describes the processes which hold, or are waiting for, a lock.
+type LockStatus struct {
+	// Path is the location of the lock file.
+	Path string `json:"path"`
+	// Holders are the processes which hold the lock.
+	Holders []LockHolder `json:"holders,omitempty"`
+	// Waiters are the processes which are waiting to acquire the lock.
+	Waiters []LockHolder `json:"waiters,omitempty"`
+}
+
+// holderRecord is what we write to a process's record file.
+type holderRecord struct {
+	LockHolder
+	Waiting bool `json:"waiting,omitempty"`
+}
+
+// holderRecorder is implemented by lock files which can record who holds
+// them.
+type holderRecorder interface {
+	setHoldersDir(dir string)
+}
+
+// RecordHolders arranges for the lock at path to record the process which
+// holds it, or is waiting for it, in a file under dir, where Status() can
+// find it.  It can be called either before or after the lock is opened using
+// GetLockfile() or GetROLockfile().  The dir should be somewhere that is
+// cleared when the system reboots.
+func RecordHolders(path, dir string) error {
+	cleanPath, err := filepath.Abs(path)
+	if err != nil {
+		return errors.Wrapf(err, "error ensuring that path %q is an absolute path", path)
+	}
+	lockfilesLock.Lock()
+	defer lockfilesLock.Unlock()
+	if holdersDirs == nil {
+		holdersDirs = make(map[string]string)
+	}
+	holdersDirs[cleanPath] = dir
+	if recorder, ok := lockfiles[cleanPath].(holderRecorder); ok {
+		recorder.setHoldersDir(dir)
+	}
+	return nil
+}
+
+// holderRecordDir returns the directory under dir in which the holders of the
+// lock at path record themselves.
+func holderRecordDir(dir, path string) string {
+	sum := sha256.Sum256([]byte(path))
+	return filepath.Join(dir, hex.EncodeToString(sum[:]))
+}
+
+// holderState tracks the record which a lock file has written for the
+// current process, so that acquiring and releasing the lock only touches the
+// filesystem when the record actually changes.
+type holderState struct {
+	// dir is the record directory which we know exists.
+	dir string
+	// recorded is set if we've written a record which we haven't removed.
+	recorded bool
+	lockType string
+	waiting  bool
+}
+
+// writeHolderRecord records that the current process holds, or is waiting
+// for, the lock at path.  The record is only a diagnostic aid, so we don't
+// bother syncing it to disk.
+func (h *holderState) writeHolderRecord(dir, path, lockType string, waiting bool) error {
+	recordDir := holderRecordDir(dir, path)
+	if h.recorded && h.dir == recordDir && h.lockType == lockType && h.waiting == waiting {
+		return nil
+	}
+	if h.dir != recordDir {
+		if err := os.MkdirAll(recordDir, 0700); err != nil {
+			return err
+		}
+		h.dir = recordDir
+		h.recorded = false
+	}
+	record := holderRecord{
+		LockHolder: LockHolder{
+			PID:     os.Getpid(),
+			Process: filepath.Base(os.Args[0]),
+			Type:    lockType,
+			Since:   time.Now().UTC(),
+		},
+		Waiting: waiting,
+	}
+	data, err := json.Marshal(&record)
+	if err != nil {
+		return err
+	}
+	w, err := ioutils.NewAtomicFileWriterWithOpts(filepath.Join(recordDir, strconv.Itoa(os.Getpid())), 0600, &ioutils.AtomicFileWriterOptions{NoSync: true})
+	if err != nil {
+		// The directory may have been removed out from under us.
+		h.dir = ""
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		w.Close()
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	h.recorded = true
+	h.lockType = lockType
+	h.waiting = waiting
+	return nil
+}
+
+// removeHolderRecord removes the current process's record for the lock at
+// path, if we wrote one.
+func (h *holderState) removeHolderRecord(dir, path string) error {
+	if !h.recorded {
+		return nil
+	}
+	err := os.Remove(filepath.Join(holderRecordDir(dir, path), strconv.Itoa(os.Getpid())))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	h.recorded = false
+	return nil
+}
+
+// readHolderRecords reads the records for the lock at path, sorted by process
+// ID.  Records which can't be parsed are skipped.
+func readHolderRecords(dir, path string) ([]holderRecord, error) {
+	recordDir := holderRecordDir(dir, path)
+	entries, err := ioutil.ReadDir(recordDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var records []holderRecord
+	for _, entry := range entries {
+		// Skip anything that isn't named after a process ID, such as
+		// a temporary file which is about to become a record.
+		if _, err := strconv.Atoi(entry.Name()); err != nil {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(recordDir, entry.Name()))
+		if err != nil {
+			continue
+		}
+		var record holderRecord
+		if err := json.Unmarshal(data, &record); err != nil || record.PID == 0 {
+			continue
+		}
+		records = append(records, record)
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].PID < records[j].PID })
+	return records, nil
+}
@@ -0,0 +1,8 @@
+package lockfile
+
+import "golang.org/x/sys/unix"
+
+// getLockCmd is the fcntl(2) command which we use to find out who holds a
+// lock.  Unlike F_GETLK, F_OFD_GETLK also reports locks which are held by
+// the current process.
+const getLockCmd = unix.F_OFD_GETLK
@@ -0,0 +1,119 @@
+// +build linux solaris darwin freebsd
+
+package lockfile
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+func (l *lockfile) setHoldersDir(dir string) {
+	l.stateMutex.Lock()
+	defer l.stateMutex.Unlock()
+	l.holders = dir
+}
+
+// lockTypeName returns the name which we record for a lock type.
+func lockTypeName(lType int16) string {
+	switch lType {
+	case unix.F_RDLCK:
+		return "read"
+	case unix.F_WRLCK:
+		return "write"
+	}
+	return ""
+}
+
+// processExists checks if a process with the specified ID is running.
+func processExists(pid int) bool {
+	err := unix.Kill(pid, 0)
+	return err == nil || err == unix.EPERM
+}
+
+// processName returns the name of the process with the specified ID, if we
+// can find it out.
+func processName(pid int) string {
+	comm, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/comm", pid))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(comm))
+}
+
+// lockHolder asks the kernel which process holds the lock file at path.  If
+// several processes hold it for reading, only one of them is returned.
+func lockHolder(path string) (*LockHolder, error) {
+	fd, err := unix.Open(path, os.O_RDONLY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer unix.Close(fd)
+	lk := unix.Flock_t{
+		Type:   unix.F_WRLCK,
+		Whence: int16(os.SEEK_SET),
+		Start:  0,
+		Len:    0,
+	}
+	if err := unix.FcntlFlock(uintptr(fd), getLockCmd, &lk); err != nil {
+		return nil, err
+	}
+	if lk.Type == unix.F_UNLCK {
+		return nil, nil
+	}
+	return &LockHolder{
+		PID:     int(lk.Pid),
+		Process: processName(int(lk.Pid)),
+		Type:    lockTypeName(lk.Type),
+	}, nil
+}
+
+// Status returns information about the processes which hold, or are waiting
+// for, the lock at path.  Processes which have been asked to record
+// themselves in dir by RecordHolders() are listed with all of the information
+// that they recorded.  The kernel is asked about the lock itself, so a
+// process which holds it without having recorded itself, or which is using an
+// older version of this package, is also listed, but if several such
+// processes hold it for reading, only one of them is listed.
+func Status(path, dir string) (*LockStatus, error) {
+	status := &LockStatus{Path: path}
+	holder, err := lockHolder(path)
+	if err != nil {
+		return nil, fmt.Errorf("error checking who holds lock %q: %v", path, err)
+	}
+	records, err := readHolderRecords(dir, path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading holders of lock %q: %v", path, err)
+	}
+	recorded := false
+	for _, record := range records {
+		// Skip records left behind by processes which have exited.
+		if !processExists(record.PID) {
+			continue
+		}
+		if record.Waiting {
+			status.Waiters = append(status.Waiters, record.LockHolder)
+			continue
+		}
+		// If nobody holds the lock, the record is stale.
+		if holder == nil {
+			continue
+		}
+		status.Holders = append(status.Holders, record.LockHolder)
+		if record.PID == holder.PID {
+			recorded = true
+		}
+	}
+	// The kernel reports -1 as the process ID for open file description
+	// locks, which aren't owned by any one process.
+	if holder != nil && !recorded && (holder.PID > 0 || len(status.Holders) == 0) {
+		status.Holders = append(status.Holders, *holder)
+	}
+	return status, nil
+}
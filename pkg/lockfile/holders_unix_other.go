@@ -0,0 +1,9 @@
+// +build solaris darwin freebsd
+
+package lockfile
+
+import "golang.org/x/sys/unix"
+
+// getLockCmd is the fcntl(2) command which we use to find out who holds a
+// lock.  F_GETLK doesn't report locks which are held by the current process.
+const getLockCmd = unix.F_GETLK
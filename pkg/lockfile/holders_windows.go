@@ -0,0 +1,10 @@
+// +build windows
+
+package lockfile
+
+// Status returns information about the processes which hold, or are waiting
+// for, the lock at path.  On Windows, locks are not shared with other
+// processes, so it never lists any.
+func Status(path, dir string) (*LockStatus, error) {
+	return &LockStatus{Path: path}, nil
+}
@@ -1,6 +1,7 @@
 package lockfile
 
 import (
+	"context"
 	"path/filepath"
 	"sync"
 	"time"
@@ -31,6 +32,24 @@ type Locker interface {
 	// Acquire a reader lock.
 	RLock()
 
+	// TryLock acquires a writer lock if it can do so without waiting, and
+	// returns ErrWouldBlock if it can't.
+	TryLock() error
+
+	// TryRLock acquires a reader lock if it can do so without waiting, and
+	// returns ErrWouldBlock if it can't.
+	TryRLock() error
+
+	// LockWithContext acquires a writer lock, giving up and returning
+	// ctx.Err() if ctx is done before the lock is acquired.  Unlike Lock(),
+	// it returns errors instead of panicking.
+	LockWithContext(ctx context.Context) error
+
+	// RLockWithContext acquires a reader lock, giving up and returning
+	// ctx.Err() if ctx is done before the lock is acquired.  Unlike
+	// RLock(), it returns errors instead of panicking.
+	RLockWithContext(ctx context.Context) error
+
 	// Touch records, for others sharing the lock, that the caller was the
 	// last writer.  It should only be called with the lock held.
 	Touch() error
@@ -49,9 +68,16 @@ type Locker interface {
 	Locked() bool
 }
 
+// ErrWouldBlock is returned by TryLock() and TryRLock() when the lock is held
+// by another party.
+var ErrWouldBlock = errors.New("lock is held by another party")
+
 var (
 	lockfiles     map[string]Locker
 	lockfilesLock sync.Mutex
+	// holdersDirs maps the paths of locks to the directories which were
+	// passed to RecordHolders() for them
+	holdersDirs map[string]string
 )
 
 // GetLockfile opens a read-write lock file, creating it if necessary.  The
@@ -108,6 +134,10 @@ func getLockfile(path string, ro bool) (Locker, error) {
 		return nil, err
 	}
 
+	if recorder, ok := locker.(holderRecorder); ok && holdersDirs[cleanPath] != "" {
+		recorder.setHoldersDir(holdersDirs[cleanPath])
+	}
+
 	lockfiles[cleanPath] = locker
 	return locker, nil
 }
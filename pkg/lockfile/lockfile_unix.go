@@ -3,6 +3,7 @@
 package lockfile
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -17,7 +18,7 @@ import (
 
 type lockfile struct {
 	// rwMutex serializes concurrent reader-writer acquisitions in the same process space
-	rwMutex *sync.RWMutex
+	rwMutex *rwMutex
 	// stateMutex is used to synchronize concurrent accesses to the state below
 	stateMutex *sync.Mutex
 	counter    int64
@@ -28,6 +29,14 @@ type lockfile struct {
 	locked     bool
 	ro         bool
 	recursive  bool
+	// acquiring is set while a reader is waiting for the file lock, and is
+	// closed when it stops waiting
+	acquiring chan struct{}
+	// holders is the directory in which we record that we hold the lock,
+	// or are waiting for it, if RecordHolders() has been called
+	holders string
+	// holder tracks the record we've written in holders, if any
+	holder holderState
 }
 
 // openLock opens the file at path and returns the corresponding file
@@ -87,7 +96,7 @@ func createLockerForPath(path string, ro bool) (Locker, error) {
 	}
 	return &lockfile{
 		stateMutex: &sync.Mutex{},
-		rwMutex:    &sync.RWMutex{},
+		rwMutex:    &rwMutex{},
 		file:       path,
 		lw:         stringid.GenerateRandomID(),
 		locktype:   int16(locktype),
@@ -95,58 +104,134 @@ func createLockerForPath(path string, ro bool) (Locker, error) {
 		ro:         ro}, nil
 }
 
-// lock locks the lockfile via FCTNL(2) based on the specified type and
-// command.
-func (l *lockfile) lock(lType int16, recursive bool) {
+// lockFile takes the lock on the file itself via FCNTL(2).  If try is set, it
+// returns ErrWouldBlock instead of waiting for the lock, and otherwise it
+// waits until it acquires the lock or ctx is done.
+func lockFile(ctx context.Context, fd int, lk *unix.Flock_t, try bool) error {
+	if !try && ctx.Done() == nil {
+		for unix.FcntlFlock(uintptr(fd), unix.F_SETLKW, lk) != nil {
+			time.Sleep(10 * time.Millisecond)
+		}
+		return nil
+	}
+	for {
+		err := unix.FcntlFlock(uintptr(fd), unix.F_SETLK, lk)
+		if err == nil {
+			return nil
+		}
+		if err != unix.EAGAIN && err != unix.EACCES && err != unix.EINTR {
+			return err
+		}
+		if try {
+			return ErrWouldBlock
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+// lock locks the lockfile via FCTNL(2) based on the specified type.  If try
+// is set, it returns ErrWouldBlock instead of waiting for the lock, and
+// otherwise it waits until it acquires the lock or ctx is done.
+func (l *lockfile) lock(ctx context.Context, lType int16, recursive, try bool) error {
 	lk := unix.Flock_t{
 		Type:   lType,
 		Whence: int16(os.SEEK_SET),
 		Start:  0,
 		Len:    0,
 	}
+	exclusive := false
 	switch lType {
 	case unix.F_RDLCK:
-		l.rwMutex.RLock()
 	case unix.F_WRLCK:
-		if recursive {
-			// NOTE: that's okay as recursive is only set in RecursiveLock(), so
-			// there's no need to protect against hypothetical RDLCK cases.
-			l.rwMutex.RLock()
-		} else {
-			l.rwMutex.Lock()
-		}
+		// NOTE: that's okay as recursive is only set in RecursiveLock(), so
+		// there's no need to protect against hypothetical RDLCK cases.
+		exclusive = !recursive
 	default:
-		panic(fmt.Sprintf("attempted to acquire a file lock of unrecognized type %d", lType))
+		return errors.Errorf("attempted to acquire a file lock of unrecognized type %d", lType)
+	}
+	if err := l.rwMutex.acquire(ctx, exclusive, try); err != nil {
+		return err
 	}
 	l.stateMutex.Lock()
-	defer l.stateMutex.Unlock()
+	for l.counter == 0 && l.acquiring != nil {
+		// Another reader is waiting for the file lock, so wait for it
+		// to either get the lock or give up.
+		acquiring := l.acquiring
+		l.stateMutex.Unlock()
+		if try {
+			l.rwMutex.release(exclusive)
+			return ErrWouldBlock
+		}
+		select {
+		case <-acquiring:
+		case <-ctx.Done():
+			l.rwMutex.release(exclusive)
+			return ctx.Err()
+		}
+		l.stateMutex.Lock()
+	}
 	if l.counter == 0 {
-		// If we're the first reference on the lock, we need to open the file again.
+		// If we're the first reference on the lock, we need to open the
+		// file again.  Don't hold the state mutex while we wait for the
+		// file lock, so that other readers can give up on waiting.
+		acquiring := make(chan struct{})
+		l.acquiring = acquiring
+		holders := l.holders
+		l.stateMutex.Unlock()
 		fd, err := openLock(l.file, l.ro)
 		if err != nil {
-			panic(fmt.Sprintf("error opening %q: %v", l.file, err))
+			err = errors.Wrapf(err, "error opening %q", l.file)
+		} else {
+			// Records of who holds the lock are only there to help
+			// diagnose problems, so we don't let failing to update
+			// them get in the way.  Only record that we're waiting
+			// if we actually have to wait.
+			err = lockFile(ctx, fd, &lk, true)
+			if err == ErrWouldBlock && !try {
+				if holders != "" {
+					_ = l.holder.writeHolderRecord(holders, l.file, lockTypeName(lType), true)
+				}
+				err = lockFile(ctx, fd, &lk, false)
+			}
+			if err != nil {
+				unix.Close(fd)
+			}
+			if holders != "" {
+				if err != nil {
+					_ = l.holder.removeHolderRecord(holders, l.file)
+				} else {
+					_ = l.holder.writeHolderRecord(holders, l.file, lockTypeName(lType), false)
+				}
+			}
 		}
-		l.fd = uintptr(fd)
-
-		// Optimization: only use the (expensive) fcntl syscall when
-		// the counter is 0.  In this case, we're either the first
-		// reader lock or a writer lock.
-		for unix.FcntlFlock(l.fd, unix.F_SETLKW, &lk) != nil {
-			time.Sleep(10 * time.Millisecond)
+		l.stateMutex.Lock()
+		l.acquiring = nil
+		close(acquiring)
+		if err != nil {
+			l.stateMutex.Unlock()
+			l.rwMutex.release(exclusive)
+			return err
 		}
+		l.fd = uintptr(fd)
 	}
 	l.locktype = lType
 	l.locked = true
 	l.recursive = recursive
 	l.counter++
+	l.stateMutex.Unlock()
+	return nil
 }
 
 // Lock locks the lockfile as a writer.  Panic if the lock is a read-only one.
 func (l *lockfile) Lock() {
 	if l.ro {
 		panic("can't take write lock on read-only lock file")
-	} else {
-		l.lock(unix.F_WRLCK, false)
+	} else if err := l.lock(context.Background(), unix.F_WRLCK, false, false); err != nil {
+		panic(err.Error())
 	}
 }
 
@@ -156,14 +241,42 @@ func (l *lockfile) Lock() {
 func (l *lockfile) RecursiveLock() {
 	if l.ro {
 		l.RLock()
-	} else {
-		l.lock(unix.F_WRLCK, true)
+	} else if err := l.lock(context.Background(), unix.F_WRLCK, true, false); err != nil {
+		panic(err.Error())
 	}
 }
 
 // LockRead locks the lockfile as a reader.
 func (l *lockfile) RLock() {
-	l.lock(unix.F_RDLCK, false)
+	if err := l.lock(context.Background(), unix.F_RDLCK, false, false); err != nil {
+		panic(err.Error())
+	}
+}
+
+// TryLock locks the lockfile as a writer if it can do so without waiting.
+func (l *lockfile) TryLock() error {
+	if l.ro {
+		return errors.Errorf("can't take write lock on read-only lock file %q", l.file)
+	}
+	return l.lock(context.Background(), unix.F_WRLCK, false, true)
+}
+
+// TryRLock locks the lockfile as a reader if it can do so without waiting.
+func (l *lockfile) TryRLock() error {
+	return l.lock(context.Background(), unix.F_RDLCK, false, true)
+}
+
+// LockWithContext locks the lockfile as a writer, unless ctx is done first.
+func (l *lockfile) LockWithContext(ctx context.Context) error {
+	if l.ro {
+		return errors.Errorf("can't take write lock on read-only lock file %q", l.file)
+	}
+	return l.lock(ctx, unix.F_WRLCK, false, false)
+}
+
+// RLockWithContext locks the lockfile as a reader, unless ctx is done first.
+func (l *lockfile) RLockWithContext(ctx context.Context) error {
+	return l.lock(ctx, unix.F_RDLCK, false, false)
 }
 
 // Unlock unlocks the lockfile.
@@ -188,13 +301,12 @@ func (l *lockfile) Unlock() {
 		l.locked = false
 		// Close the file descriptor on the last unlock, releasing the
 		// file lock.
+		if l.holders != "" {
+			_ = l.holder.removeHolderRecord(l.holders, l.file)
+		}
 		unix.Close(int(l.fd))
 	}
-	if l.locktype == unix.F_RDLCK || l.recursive {
-		l.rwMutex.RUnlock()
-	} else {
-		l.rwMutex.Unlock()
-	}
+	l.rwMutex.release(l.locktype == unix.F_WRLCK && !l.recursive)
 	l.stateMutex.Unlock()
 }
 
@@ -208,10 +320,10 @@ func (l *lockfile) Locked() bool {
 // Touch updates the lock file with the UID of the user.
 func (l *lockfile) Touch() error {
 	l.stateMutex.Lock()
+	defer l.stateMutex.Unlock()
 	if !l.locked || (l.locktype != unix.F_WRLCK) {
-		panic("attempted to update last-writer in lockfile without the write lock")
+		return errors.Errorf("attempted to update last-writer in lockfile %q without the write lock", l.file)
 	}
-	defer l.stateMutex.Unlock()
 	l.lw = stringid.GenerateRandomID()
 	id := []byte(l.lw)
 	n, err := unix.Pwrite(int(l.fd), id, 0)
@@ -228,11 +340,11 @@ func (l *lockfile) Touch() error {
 // was loaded.
 func (l *lockfile) Modified() (bool, error) {
 	l.stateMutex.Lock()
+	defer l.stateMutex.Unlock()
 	id := []byte(l.lw)
 	if !l.locked {
-		panic("attempted to check last-writer in lockfile without locking it first")
+		return true, errors.Errorf("attempted to check last-writer in lockfile %q without locking it first", l.file)
 	}
-	defer l.stateMutex.Unlock()
 	n, err := unix.Pread(int(l.fd), id, 0)
 	if err != nil {
 		return true, err
@@ -3,8 +3,8 @@
 package lockfile
 
 import (
+	"context"
 	"os"
-	"sync"
 	"time"
 )
 
@@ -26,14 +26,21 @@ func createLockerForPath(path string, ro bool) (Locker, error) {
 }
 
 type lockfile struct {
-	mu     sync.Mutex
+	mu     rwMutex
 	file   string
 	locked bool
 }
 
-func (l *lockfile) Lock() {
-	l.mu.Lock()
+func (l *lockfile) lock(ctx context.Context, try bool) error {
+	if err := l.mu.acquire(ctx, true, try); err != nil {
+		return err
+	}
 	l.locked = true
+	return nil
+}
+
+func (l *lockfile) Lock() {
+	l.lock(context.Background(), false)
 }
 
 func (l *lockfile) RecursiveLock() {
@@ -43,13 +50,28 @@ func (l *lockfile) RecursiveLock() {
 }
 
 func (l *lockfile) RLock() {
-	l.mu.Lock()
-	l.locked = true
+	l.lock(context.Background(), false)
+}
+
+func (l *lockfile) TryLock() error {
+	return l.lock(context.Background(), true)
+}
+
+func (l *lockfile) TryRLock() error {
+	return l.lock(context.Background(), true)
+}
+
+func (l *lockfile) LockWithContext(ctx context.Context) error {
+	return l.lock(ctx, false)
+}
+
+func (l *lockfile) RLockWithContext(ctx context.Context) error {
+	return l.lock(ctx, false)
 }
 
 func (l *lockfile) Unlock() {
 	l.locked = false
-	l.mu.Unlock()
+	l.mu.release(true)
 }
 
 func (l *lockfile) Locked() bool {
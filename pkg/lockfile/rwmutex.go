@@ -0,0 +1,90 @@
+package lockfile
+
+import (
+	"context"
+	"sync"
+)
+
+// rwMutex is a reader/writer mutual exclusion lock which, unlike
+// sync.RWMutex, can be acquired without blocking, or given up on when a
+// context is done.  Like sync.RWMutex, once a writer is waiting for the lock,
+// new readers have to wait until that writer has acquired and released it.
+// The zero value is an unlocked mutex.
+type rwMutex struct {
+	mu             sync.Mutex
+	readers        int
+	writer         bool
+	writersWaiting int
+	// changed is closed, and replaced, whenever the state of the lock
+	// changes in a way which might let someone who is waiting acquire it.
+	changed chan struct{}
+}
+
+// wake wakes everyone who is waiting for the lock.  The caller should be
+// holding m.mu.
+func (m *rwMutex) wake() {
+	if m.changed != nil {
+		close(m.changed)
+	}
+	m.changed = make(chan struct{})
+}
+
+// acquire acquires the lock, exclusively if write is set.  If try is set, it
+// returns ErrWouldBlock instead of waiting, and otherwise it waits until it
+// acquires the lock or ctx is done.
+func (m *rwMutex) acquire(ctx context.Context, write, try bool) error {
+	waiting := false
+	for {
+		m.mu.Lock()
+		if m.changed == nil {
+			m.changed = make(chan struct{})
+		}
+		if write && !m.writer && m.readers == 0 {
+			m.writer = true
+			if waiting {
+				m.writersWaiting--
+			}
+			m.mu.Unlock()
+			return nil
+		}
+		if !write && !m.writer && m.writersWaiting == 0 {
+			m.readers++
+			m.mu.Unlock()
+			return nil
+		}
+		if try {
+			m.mu.Unlock()
+			return ErrWouldBlock
+		}
+		if write && !waiting {
+			m.writersWaiting++
+			waiting = true
+		}
+		changed := m.changed
+		m.mu.Unlock()
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			if waiting {
+				m.mu.Lock()
+				m.writersWaiting--
+				m.wake()
+				m.mu.Unlock()
+			}
+			return ctx.Err()
+		}
+	}
+}
+
+// release releases the lock, which should have been acquired exclusively if
+// write is set.
+func (m *rwMutex) release(write bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if write {
+		m.writer = false
+	} else {
+		m.readers--
+	}
+	m.wake()
+}
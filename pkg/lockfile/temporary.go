@@ -0,0 +1,13 @@
+package lockfile
+
+// A TemporaryLock is an exclusive lock on a file which is removed when the
+// lock is released.  Unlike the Lockers which GetLockfile() returns, it isn't
+// cached for the life of the process, so it suits locks which are only needed
+// for a while, such as one for each layer which is being written.
+//
+// Two TemporaryLocks for the same path conflict even if they are held by the
+// same process.
+type TemporaryLock struct {
+	path string
+	fd   int
+}
@@ -0,0 +1,50 @@
+// +build !linux,!darwin,!freebsd
+
+package lockfile
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// On platforms where we don't have flock(2), temporary locks only keep other
+// goroutines in this process out.
+var (
+	temporaryLocks     = make(map[string]bool)
+	temporaryLocksLock sync.Mutex
+)
+
+// LockTemporary takes a TemporaryLock on the file at path, unless ctx is done
+// first.
+func LockTemporary(ctx context.Context, path string) (*TemporaryLock, error) {
+	for {
+		temporaryLocksLock.Lock()
+		if !temporaryLocks[path] {
+			temporaryLocks[path] = true
+			temporaryLocksLock.Unlock()
+			return &TemporaryLock{path: path}, nil
+		}
+		temporaryLocksLock.Unlock()
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+// Unlock releases the lock.
+func (l *TemporaryLock) Unlock() error {
+	temporaryLocksLock.Lock()
+	defer temporaryLocksLock.Unlock()
+	delete(temporaryLocks, l.path)
+	return nil
+}
+
+// TemporaryLockHeld checks if a TemporaryLock on the file at path is held.
+func TemporaryLockHeld(path string) bool {
+	temporaryLocksLock.Lock()
+	defer temporaryLocksLock.Unlock()
+	return temporaryLocks[path]
+}
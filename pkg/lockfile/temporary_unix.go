@@ -0,0 +1,92 @@
+// +build linux darwin freebsd
+
+package lockfile
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// LockTemporary takes a TemporaryLock on the file at path, creating the file
+// if necessary, unless ctx is done first.
+func LockTemporary(ctx context.Context, path string) (*TemporaryLock, error) {
+	for {
+		fd, err := openLock(path, false)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error opening %q", path)
+		}
+		if err := flockFile(ctx, fd); err != nil {
+			unix.Close(fd)
+			return nil, err
+		}
+		// Whoever held the lock before us may have removed the file
+		// after we opened it, in which case nobody else can find the
+		// file that we locked, and we have to start over.
+		var held, current unix.Stat_t
+		if err := unix.Fstat(fd, &held); err != nil {
+			unix.Close(fd)
+			return nil, errors.Wrapf(err, "error checking %q", path)
+		}
+		err = unix.Stat(path, &current)
+		if err == nil && held.Dev == current.Dev && held.Ino == current.Ino {
+			return &TemporaryLock{path: path, fd: fd}, nil
+		}
+		unix.Close(fd)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, errors.Wrapf(err, "error checking %q", path)
+		}
+	}
+}
+
+// flockFile takes an exclusive flock(2) lock on fd, unless ctx is done first.
+// Unlike fcntl(2) locks, these belong to the open file, so they conflict with
+// other locks that the same process takes, and closing other descriptors for
+// the same file doesn't release them.
+func flockFile(ctx context.Context, fd int) error {
+	if ctx.Done() == nil {
+		for {
+			err := unix.Flock(fd, unix.LOCK_EX)
+			if err != unix.EINTR {
+				return err
+			}
+		}
+	}
+	for {
+		err := unix.Flock(fd, unix.LOCK_EX|unix.LOCK_NB)
+		if err != unix.EWOULDBLOCK && err != unix.EINTR {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+// Unlock removes the lock's file and releases the lock.
+func (l *TemporaryLock) Unlock() error {
+	err := os.Remove(l.path)
+	if err != nil && os.IsNotExist(err) {
+		err = nil
+	}
+	if err2 := unix.Close(l.fd); err == nil {
+		err = err2
+	}
+	return err
+}
+
+// TemporaryLockHeld checks if a TemporaryLock on the file at path is held, by
+// this process or another one.
+func TemporaryLockHeld(path string) bool {
+	fd, err := unix.Open(path, os.O_RDONLY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return false
+	}
+	defer unix.Close(fd)
+	return unix.Flock(fd, unix.LOCK_EX|unix.LOCK_NB) == unix.EWOULDBLOCK
+}
@@ -0,0 +1,472 @@
+// Package snapshots implements a containerd-style snapshotter on top of a
+// Store's layers and graph driver.  Snapshots are layers whose names are their
+// keys, with a prefix which keeps them apart from other layers, and whose
+// metadata records their kind, parent, and labels.
+package snapshots
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"time"
+
+	storage "github.com/gepis/strge"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// Kind identifies the kind of a snapshot.
+type Kind int
+
+const (
+	// KindUnknown is the Kind of something which isn't a snapshot.
+	KindUnknown Kind = iota
+	// KindView is the Kind of a read-only snapshot, created by View().
+	KindView
+	// KindActive is the Kind of a writable snapshot, created by Prepare().
+	KindActive
+	// KindCommitted is the Kind of a snapshot which was created by
+	// Commit(), and which can be used as the parent of other snapshots.
+	KindCommitted
+)
+
+func (k Kind) String() string {
+	switch k {
+	case KindView:
+		return "View"
+	case KindActive:
+		return "Active"
+	case KindCommitted:
+		return "Committed"
+	}
+	return "Unknown"
+}
+
+func parseKind(s string) Kind {
+	for _, k := range []Kind{KindView, KindActive, KindCommitted} {
+		if s == k.String() {
+			return k
+		}
+	}
+	return KindUnknown
+}
+
+// layerNamePrefix is prepended to snapshot keys to produce layer names.
+const layerNamePrefix = "snapshot:"
+
+var (
+	// ErrSnapshotUnknown is returned when there is no snapshot with the
+	// specified key.
+	ErrSnapshotUnknown = errors.New("snapshot not known")
+	// ErrSnapshotExists is returned when a snapshot with the specified key
+	// already exists.
+	ErrSnapshotExists = errors.New("snapshot already exists")
+	// ErrSnapshotNotActive is returned when the operation requires an
+	// active snapshot, and the snapshot is not active.
+	ErrSnapshotNotActive = errors.New("snapshot is not active")
+	// ErrSnapshotNotCommitted is returned when the operation requires a
+	// committed snapshot, and the snapshot is not committed.
+	ErrSnapshotNotCommitted = errors.New("snapshot is not committed")
+)
+
+// Info describes a snapshot.
+type Info struct {
+	Kind    Kind              `json:"kind"`
+	Name    string            `json:"name"`
+	Parent  string            `json:"parent,omitempty"`
+	Labels  map[string]string `json:"labels,omitempty"`
+	Created time.Time         `json:"created"`
+	Updated time.Time         `json:"updated"`
+}
+
+// Usage describes how much space a snapshot's own contents take up, not
+// counting its parents.
+type Usage struct {
+	Inodes int64 `json:"inodes"`
+	Size   int64 `json:"size"`
+}
+
+// Mount describes how to mount a snapshot.  It mirrors the mount descriptions
+// which containerd's snapshotters return.
+type Mount struct {
+	Type    string   `json:"type"`
+	Source  string   `json:"source"`
+	Options []string `json:"options,omitempty"`
+}
+
+// Opt modifies the Info of a snapshot which is being created or committed.
+type Opt func(info *Info) error
+
+// WithLabels adds labels to a snapshot which is being created or committed.
+func WithLabels(labels map[string]string) Opt {
+	return func(info *Info) error {
+		if info.Labels == nil {
+			info.Labels = make(map[string]string)
+		}
+		for k, v := range labels {
+			info.Labels[k] = v
+		}
+		return nil
+	}
+}
+
+// metadata is what we store as the metadata of a snapshot's layer.
+type metadata struct {
+	Kind    string            `json:"snapshot-kind"`
+	Parent  string            `json:"snapshot-parent,omitempty"`
+	Labels  map[string]string `json:"snapshot-labels,omitempty"`
+	Created time.Time         `json:"snapshot-created"`
+	Updated time.Time         `json:"snapshot-updated"`
+}
+
+func (m *metadata) info(key string) Info {
+	return Info{
+		Kind:    parseKind(m.Kind),
+		Name:    key,
+		Parent:  m.Parent,
+		Labels:  copyLabels(m.Labels),
+		Created: m.Created,
+		Updated: m.Updated,
+	}
+}
+
+func copyLabels(labels map[string]string) map[string]string {
+	if len(labels) == 0 {
+		return nil
+	}
+	m := make(map[string]string, len(labels))
+	for k, v := range labels {
+		m[k] = v
+	}
+	return m
+}
+
+// Snapshotter implements snapshot operations using a Store.
+type Snapshotter struct {
+	store storage.Store
+}
+
+// New returns a Snapshotter which keeps its snapshots in the store.
+func New(store storage.Store) *Snapshotter {
+	return &Snapshotter{store: store}
+}
+
+func layerName(key string) string {
+	return layerNamePrefix + key
+}
+
+// get finds the layer for a snapshot, and decodes its metadata.
+func (s *Snapshotter) get(key string) (*storage.Layer, *metadata, error) {
+	layer, err := s.store.Layer(layerName(key))
+	if err != nil {
+		if errors.Cause(err) == storage.ErrLayerUnknown {
+			return nil, nil, errors.Wrapf(ErrSnapshotUnknown, "error locating snapshot %q", key)
+		}
+		return nil, nil, err
+	}
+	var m metadata
+	if err := json.Unmarshal([]byte(layer.Metadata), &m); err != nil || parseKind(m.Kind) == KindUnknown {
+		return nil, nil, errors.Wrapf(ErrSnapshotUnknown, "layer %q is not a snapshot", layer.ID)
+	}
+	return layer, &m, nil
+}
+
+func (s *Snapshotter) setMetadata(layer *storage.Layer, m *metadata) error {
+	encoded, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return s.store.SetMetadata(layer.ID, string(encoded))
+}
+
+// Stat returns information about the snapshot with the specified key.
+func (s *Snapshotter) Stat(ctx context.Context, key string) (Info, error) {
+	if err := ctx.Err(); err != nil {
+		return Info{}, err
+	}
+	_, m, err := s.get(key)
+	if err != nil {
+		return Info{}, err
+	}
+	return m.info(key), nil
+}
+
+// Update changes a snapshot's labels.  If fieldpaths are specified, only the
+// listed labels ("labels.name"), or all labels ("labels"), are changed,
+// otherwise the snapshot's labels are replaced with info.Labels.
+func (s *Snapshotter) Update(ctx context.Context, info Info, fieldpaths ...string) (Info, error) {
+	if err := ctx.Err(); err != nil {
+		return Info{}, err
+	}
+	layer, m, err := s.get(info.Name)
+	if err != nil {
+		return Info{}, err
+	}
+	if len(fieldpaths) == 0 {
+		m.Labels = copyLabels(info.Labels)
+	}
+	for _, path := range fieldpaths {
+		switch {
+		case path == "labels":
+			m.Labels = copyLabels(info.Labels)
+		case strings.HasPrefix(path, "labels."):
+			label := strings.TrimPrefix(path, "labels.")
+			if value, ok := info.Labels[label]; ok {
+				if m.Labels == nil {
+					m.Labels = make(map[string]string)
+				}
+				m.Labels[label] = value
+			} else {
+				delete(m.Labels, label)
+			}
+		default:
+			return Info{}, errors.Errorf("can not update field %q of snapshot %q", path, info.Name)
+		}
+	}
+	m.Updated = time.Now().UTC()
+	if err := s.setMetadata(layer, m); err != nil {
+		return Info{}, err
+	}
+	return m.info(info.Name), nil
+}
+
+// Usage returns how much space the snapshot's own contents take up.  For
+// active snapshots, this is what the driver reports for the snapshot's
+// writable layer, and for other snapshots it is the size of their diff.
+func (s *Snapshotter) Usage(ctx context.Context, key string) (Usage, error) {
+	if err := ctx.Err(); err != nil {
+		return Usage{}, err
+	}
+	layer, m, err := s.get(key)
+	if err != nil {
+		return Usage{}, err
+	}
+	if parseKind(m.Kind) == KindActive {
+		driver, err := s.store.GraphDriver()
+		if err != nil {
+			return Usage{}, err
+		}
+		du, err := driver.ReadWriteDiskUsage(layer.ID)
+		if err != nil {
+			return Usage{}, errors.Wrapf(err, "error determining disk usage of snapshot %q", key)
+		}
+		return Usage{Inodes: du.InodeCount, Size: du.Size}, nil
+	}
+	size, err := s.store.DiffSize("", layer.ID)
+	if err != nil {
+		return Usage{}, errors.Wrapf(err, "error determining size of snapshot %q", key)
+	}
+	return Usage{Size: size}, nil
+}
+
+// Mounts returns the mounts for an active or view snapshot, mounting its
+// layer if it is not already mounted.
+func (s *Snapshotter) Mounts(ctx context.Context, key string) ([]Mount, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	layer, m, err := s.get(key)
+	if err != nil {
+		return nil, err
+	}
+	kind := parseKind(m.Kind)
+	if kind == KindCommitted {
+		return nil, errors.Wrapf(ErrSnapshotNotActive, "can not mount committed snapshot %q", key)
+	}
+	return s.mounts(layer, kind)
+}
+
+func (s *Snapshotter) mounts(layer *storage.Layer, kind Kind) ([]Mount, error) {
+	mountPoint := layer.MountPoint
+	if layer.MountCount == 0 || mountPoint == "" {
+		var err error
+		if mountPoint, err = s.store.Mount(layer.ID, layer.MountLabel); err != nil {
+			return nil, err
+		}
+	}
+	options := []string{"rbind", "rw"}
+	if kind == KindView {
+		options = []string{"rbind", "ro"}
+	}
+	return []Mount{{Type: "bind", Source: mountPoint, Options: options}}, nil
+}
+
+// Prepare creates an active snapshot with the specified key, using the
+// committed snapshot named parent, if one is specified, as its parent, and
+// returns its mounts.
+func (s *Snapshotter) Prepare(ctx context.Context, key, parent string, opts ...Opt) ([]Mount, error) {
+	return s.create(ctx, KindActive, key, parent, opts)
+}
+
+// View creates a read-only snapshot with the specified key, using the
+// committed snapshot named parent, if one is specified, as its parent, and
+// returns its mounts.
+func (s *Snapshotter) View(ctx context.Context, key, parent string, opts ...Opt) ([]Mount, error) {
+	return s.create(ctx, KindView, key, parent, opts)
+}
+
+func (s *Snapshotter) create(ctx context.Context, kind Kind, key, parent string, opts []Opt) ([]Mount, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if _, err := s.store.Layer(layerName(key)); err == nil {
+		return nil, errors.Wrapf(ErrSnapshotExists, "error creating snapshot %q", key)
+	}
+	parentID := ""
+	if parent != "" {
+		parentLayer, m, err := s.get(parent)
+		if err != nil {
+			return nil, err
+		}
+		if parseKind(m.Kind) != KindCommitted {
+			return nil, errors.Wrapf(ErrSnapshotNotCommitted, "can not use snapshot %q as a parent", parent)
+		}
+		parentID = parentLayer.ID
+	}
+
+	info := Info{Kind: kind, Name: key, Parent: parent}
+	for _, opt := range opts {
+		if err := opt(&info); err != nil {
+			return nil, err
+		}
+	}
+	now := time.Now().UTC()
+	m := &metadata{
+		Kind:    kind.String(),
+		Parent:  parent,
+		Labels:  copyLabels(info.Labels),
+		Created: now,
+		Updated: now,
+	}
+
+	layer, err := s.store.CreateLayer("", parentID, []string{layerName(key)}, "", kind == KindActive, nil)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error creating layer for snapshot %q", key)
+	}
+	if err := s.setMetadata(layer, m); err != nil {
+		s.removeLayer(layer.ID, key)
+		return nil, err
+	}
+	mounts, err := s.mounts(layer, kind)
+	if err != nil {
+		s.removeLayer(layer.ID, key)
+		return nil, err
+	}
+	return mounts, nil
+}
+
+// removeLayer removes a layer which create() made for a snapshot that it
+// then failed to set up.
+func (s *Snapshotter) removeLayer(id, key string) {
+	if err := s.store.DeleteLayer(id); err != nil {
+		logrus.Warnf("error removing layer %q after failing to create snapshot %q: %v", id, key, err)
+	}
+}
+
+// unmount drops the mount which mounts() made for a snapshot's layer, if it
+// is mounted.  If the layer is still mounted after that, something else is
+// using it, and ErrLayerMounted is returned.
+func (s *Snapshotter) unmount(layer *storage.Layer, key string) error {
+	if layer.MountCount == 0 {
+		return nil
+	}
+	mounted, err := s.store.Unmount(layer.ID, false)
+	if err != nil {
+		return err
+	}
+	if mounted {
+		return errors.Wrapf(storage.ErrLayerMounted, "snapshot %q is still in use", key)
+	}
+	return nil
+}
+
+// Commit turns the active snapshot with the specified key into a committed
+// snapshot with the specified name, which can be used as a parent by other
+// snapshots.  The active snapshot is unmounted, and its key can be reused.
+// If its layer is still mounted by something else, ErrLayerMounted is
+// returned.
+func (s *Snapshotter) Commit(ctx context.Context, name, key string, opts ...Opt) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	layer, m, err := s.get(key)
+	if err != nil {
+		return err
+	}
+	if parseKind(m.Kind) != KindActive {
+		return errors.Wrapf(ErrSnapshotNotActive, "can not commit snapshot %q", key)
+	}
+	if _, err := s.store.Layer(layerName(name)); err == nil {
+		return errors.Wrapf(ErrSnapshotExists, "error committing snapshot %q as %q", key, name)
+	}
+
+	info := m.info(name)
+	info.Kind = KindCommitted
+	for _, opt := range opts {
+		if err := opt(&info); err != nil {
+			return err
+		}
+	}
+
+	if err := s.unmount(layer, key); err != nil {
+		return err
+	}
+	if err := s.store.SetNames(layer.ID, []string{layerName(name)}); err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	m.Kind = KindCommitted.String()
+	m.Labels = copyLabels(info.Labels)
+	m.Created = now
+	m.Updated = now
+	return s.setMetadata(layer, m)
+}
+
+// Remove unmounts and removes a snapshot.  Committed snapshots which are the
+// parents of other snapshots, and snapshots whose layers are still mounted by
+// something else, can not be removed.
+func (s *Snapshotter) Remove(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	layer, _, err := s.get(key)
+	if err != nil {
+		return err
+	}
+	if err := s.unmount(layer, key); err != nil {
+		return err
+	}
+	return s.store.DeleteLayer(layer.ID)
+}
+
+// Walk calls fn for each snapshot, stopping if it returns an error.
+func (s *Snapshotter) Walk(ctx context.Context, fn func(context.Context, Info) error) error {
+	layers, err := s.store.Layers()
+	if err != nil {
+		return err
+	}
+	for _, layer := range layers {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		for _, name := range layer.Names {
+			if !strings.HasPrefix(name, layerNamePrefix) {
+				continue
+			}
+			var m metadata
+			if err := json.Unmarshal([]byte(layer.Metadata), &m); err != nil || parseKind(m.Kind) == KindUnknown {
+				continue
+			}
+			if err := fn(ctx, m.info(strings.TrimPrefix(name, layerNamePrefix))); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Close releases resources which are held by the Snapshotter.  The store is
+// not shut down.
+func (s *Snapshotter) Close() error {
+	return nil
+}
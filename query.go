@@ -0,0 +1,319 @@
+package storage
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"time"
+
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+// QueryFilter selects and orders the items which QueryImages(),
+// QueryLayers(), and QueryContainers() return.  Fields which are not set do
+// not limit the results.
+type QueryFilter struct {
+	// Name is a pattern, in the format that path.Match() accepts, which at
+	// least one of an item's names must match.
+	Name string
+	// NameRegexp is a regular expression which at least one of an item's
+	// names must match.
+	NameRegexp string
+	// CreatedBefore and CreatedAfter limit the results to items which
+	// were created before or after the specified times.
+	CreatedBefore time.Time
+	CreatedAfter  time.Time
+	// UnusedSince limits the results to items which have not been used
+	// since the specified time.  Items which have never been used are
+	// treated as if they were last used when they were created.
+	UnusedSince time.Time
+	// Dangling, if set, limits the results to items which have no names,
+	// if it points to true, or to items which have names, if it points to
+	// false.
+	Dangling *bool
+	// HasContainer, if set, limits the results to images which are used
+	// by containers, or layers which are containers' layers, if it points
+	// to true, or to those which are not, if it points to false.  It is
+	// ignored by QueryContainers().
+	HasContainer *bool
+	// Flags limits the results to items which have all of the listed
+	// flags set.  If a flag is listed with a non-empty value, the flag's
+	// value, formatted using "%v", must match it.
+	Flags map[string]string
+	// Digest limits the results to images which have the specified
+	// digest, or to layers whose diff, either compressed or uncompressed,
+	// has it.  It is ignored by QueryContainers().
+	Digest digest.Digest
+	// SortBy is one of "id", "name", "created", or "last-used".  If it is
+	// not set, items are returned in the order in which the store lists
+	// them.
+	SortBy string
+	// Reverse reverses the sort order.
+	Reverse bool
+	// Offset is the number of matching items to skip.
+	Offset int
+	// Limit, if not zero, is the maximum number of items to return.
+	Limit int
+}
+
+// queryItem is the information about an image, layer, or container which a
+// QueryFilter looks at.
+type queryItem struct {
+	id           string
+	names        []string
+	created      time.Time
+	lastUsed     time.Time
+	flags        map[string]interface{}
+	digests      []digest.Digest
+	hasContainer bool
+}
+
+// selectItems returns the indexes of the items which match the filter, in
+// the order in which they should be returned.
+func (f *QueryFilter) selectItems(items []queryItem) ([]int, error) {
+	if f == nil {
+		f = &QueryFilter{}
+	}
+	if f.Name != "" {
+		if _, err := path.Match(f.Name, ""); err != nil {
+			return nil, errors.Wrapf(err, "error parsing name pattern %q", f.Name)
+		}
+	}
+	var nameRegexp *regexp.Regexp
+	if f.NameRegexp != "" {
+		var err error
+		if nameRegexp, err = regexp.Compile(f.NameRegexp); err != nil {
+			return nil, errors.Wrapf(err, "error parsing name regular expression %q", f.NameRegexp)
+		}
+	}
+	lastUsed := func(item *queryItem) time.Time {
+		if item.lastUsed.IsZero() {
+			return item.created
+		}
+		return item.lastUsed
+	}
+	matchesName := func(item *queryItem) bool {
+		for _, name := range item.names {
+			if f.Name != "" {
+				if matched, _ := path.Match(f.Name, name); !matched {
+					continue
+				}
+			}
+			if nameRegexp != nil && !nameRegexp.MatchString(name) {
+				continue
+			}
+			return true
+		}
+		return false
+	}
+	matches := func(item *queryItem) bool {
+		if (f.Name != "" || nameRegexp != nil) && !matchesName(item) {
+			return false
+		}
+		if !f.CreatedBefore.IsZero() && !item.created.Before(f.CreatedBefore) {
+			return false
+		}
+		if !f.CreatedAfter.IsZero() && !item.created.After(f.CreatedAfter) {
+			return false
+		}
+		if !f.UnusedSince.IsZero() && !lastUsed(item).Before(f.UnusedSince) {
+			return false
+		}
+		if f.Dangling != nil && *f.Dangling != (len(item.names) == 0) {
+			return false
+		}
+		if f.HasContainer != nil && *f.HasContainer != item.hasContainer {
+			return false
+		}
+		for flag, value := range f.Flags {
+			v, ok := item.flags[flag]
+			if !ok || (value != "" && fmt.Sprintf("%v", v) != value) {
+				return false
+			}
+		}
+		if f.Digest != "" {
+			found := false
+			for _, d := range item.digests {
+				if d == f.Digest {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return false
+			}
+		}
+		return true
+	}
+
+	var less func(a, b *queryItem) bool
+	switch f.SortBy {
+	case "":
+	case "id":
+		less = func(a, b *queryItem) bool { return a.id < b.id }
+	case "name":
+		firstName := func(item *queryItem) string {
+			if len(item.names) == 0 {
+				return ""
+			}
+			return item.names[0]
+		}
+		less = func(a, b *queryItem) bool { return firstName(a) < firstName(b) }
+	case "created":
+		less = func(a, b *queryItem) bool { return a.created.Before(b.created) }
+	case "last-used":
+		less = func(a, b *queryItem) bool { return lastUsed(a).Before(lastUsed(b)) }
+	default:
+		return nil, errors.Errorf("unknown sort key %q", f.SortBy)
+	}
+
+	selected := []int{}
+	for i := range items {
+		if matches(&items[i]) {
+			selected = append(selected, i)
+		}
+	}
+	if less != nil {
+		sort.SliceStable(selected, func(i, j int) bool {
+			if f.Reverse {
+				return less(&items[selected[j]], &items[selected[i]])
+			}
+			return less(&items[selected[i]], &items[selected[j]])
+		})
+	} else if f.Reverse {
+		for i, j := 0, len(selected)-1; i < j; i, j = i+1, j-1 {
+			selected[i], selected[j] = selected[j], selected[i]
+		}
+	}
+	if f.Offset > 0 {
+		if f.Offset >= len(selected) {
+			return []int{}, nil
+		}
+		selected = selected[f.Offset:]
+	}
+	if f.Limit > 0 && f.Limit < len(selected) {
+		selected = selected[:f.Limit]
+	}
+	return selected, nil
+}
+
+func (s *store) QueryImages(filter *QueryFilter) ([]Image, error) {
+	images, err := s.Images()
+	if err != nil {
+		return nil, err
+	}
+	inUse := make(map[string]bool)
+	if filter != nil && filter.HasContainer != nil {
+		containers, err := s.Containers()
+		if err != nil {
+			return nil, err
+		}
+		for _, container := range containers {
+			inUse[container.ImageID] = true
+		}
+	}
+	items := make([]queryItem, len(images))
+	for i, image := range images {
+		digests := image.Digests
+		if image.Digest != "" {
+			digests = append(digests, image.Digest)
+		}
+		items[i] = queryItem{
+			id:           image.ID,
+			names:        image.Names,
+			created:      image.Created,
+			lastUsed:     image.LastUsed,
+			flags:        image.Flags,
+			digests:      digests,
+			hasContainer: inUse[image.ID],
+		}
+	}
+	selected, err := filter.selectItems(items)
+	if err != nil {
+		return nil, err
+	}
+	results := make([]Image, 0, len(selected))
+	for _, i := range selected {
+		results = append(results, images[i])
+	}
+	return results, nil
+}
+
+func (s *store) QueryLayers(filter *QueryFilter) ([]Layer, error) {
+	layers, err := s.Layers()
+	if err != nil {
+		return nil, err
+	}
+	inUse := make(map[string]bool)
+	if filter != nil && filter.HasContainer != nil {
+		containers, err := s.Containers()
+		if err != nil {
+			return nil, err
+		}
+		for _, container := range containers {
+			inUse[container.LayerID] = true
+		}
+	}
+	items := make([]queryItem, len(layers))
+	for i, layer := range layers {
+		var digests []digest.Digest
+		if layer.CompressedDigest != "" {
+			digests = append(digests, layer.CompressedDigest)
+		}
+		if layer.UncompressedDigest != "" {
+			digests = append(digests, layer.UncompressedDigest)
+		}
+		items[i] = queryItem{
+			id:           layer.ID,
+			names:        layer.Names,
+			created:      layer.Created,
+			lastUsed:     layer.LastUsed,
+			flags:        layer.Flags,
+			digests:      digests,
+			hasContainer: inUse[layer.ID],
+		}
+	}
+	selected, err := filter.selectItems(items)
+	if err != nil {
+		return nil, err
+	}
+	results := make([]Layer, 0, len(selected))
+	for _, i := range selected {
+		results = append(results, layers[i])
+	}
+	return results, nil
+}
+
+func (s *store) QueryContainers(filter *QueryFilter) ([]Container, error) {
+	containers, err := s.Containers()
+	if err != nil {
+		return nil, err
+	}
+	items := make([]queryItem, len(containers))
+	for i, container := range containers {
+		items[i] = queryItem{
+			id:      container.ID,
+			names:   container.Names,
+			created: container.Created,
+			flags:   container.Flags,
+		}
+	}
+	// Containers don't have digests, and aren't used by other containers.
+	if filter != nil {
+		f := *filter
+		f.HasContainer = nil
+		f.Digest = ""
+		filter = &f
+	}
+	selected, err := filter.selectItems(items)
+	if err != nil {
+		return nil, err
+	}
+	results := make([]Container, 0, len(selected))
+	for _, i := range selected {
+		results = append(results, containers[i])
+	}
+	return results, nil
+}
@@ -0,0 +1,23 @@
+package storage
+
+import (
+	"github.com/pkg/errors"
+)
+
+func (s *store) RebaseLayer(id, newParent string, names []string) (*Layer, []string, error) {
+	rlstore, err := s.LayerStore()
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := s.startWriting(rlstore); err != nil {
+		return nil, nil, err
+	}
+	defer rlstore.Unlock()
+
+	layer, conflicts, err := rlstore.(*layerStore).rebase(id, newParent, names)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "error rebasing layer %q", id)
+	}
+	s.notify(Event{Type: EventCreate, Object: EventLayer, ID: layer.ID, Names: layer.Names})
+	return layer, conflicts, nil
+}
@@ -0,0 +1,50 @@
+package storage
+
+func (s *store) ResetContainer(id string, force bool) error {
+	rlstore, err := s.LayerStore()
+	if err != nil {
+		return err
+	}
+	rcstore, err := s.ContainerStore()
+	if err != nil {
+		return err
+	}
+
+	if err := s.startWriting(rlstore); err != nil {
+		return err
+	}
+	defer rlstore.Unlock()
+	if err := s.startReading(rcstore); err != nil {
+		return err
+	}
+	defer rcstore.Unlock()
+
+	container, err := rcstore.Get(id)
+	if err != nil {
+		return err
+	}
+
+	var events []Event
+	defer func() {
+		s.notify(events...)
+	}()
+	if force {
+		mounted, err := rlstore.Mounted(container.LayerID)
+		if err != nil {
+			return err
+		}
+		if mounted > 0 {
+			if _, err := rlstore.Unmount(container.LayerID, true); err != nil {
+				return err
+			}
+			events = append(events, Event{Type: EventUnmount, Object: EventLayer, ID: container.LayerID},
+				Event{Type: EventUnmount, Object: EventContainer, ID: container.ID})
+		}
+	}
+
+	if err := rlstore.(*layerStore).reset(container.LayerID); err != nil {
+		return err
+	}
+	events = append(events, Event{Type: EventReset, Object: EventContainer, ID: container.ID})
+	return nil
+}
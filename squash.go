@@ -0,0 +1,112 @@
+package storage
+
+import (
+	"sort"
+
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// SquashOptions is used for passing options to a Store's SquashLayers()
+// method.
+type SquashOptions struct {
+	// LayerID is the ID to assign to the new layer.  If it is not set, a
+	// random one is generated.
+	LayerID string
+	// LayerNames are names to assign to the new layer.
+	LayerNames []string
+	// LayerFlags are flags to set on the new layer.
+	LayerFlags map[string]interface{}
+	// Image, if set, is the name or ID of an image whose top layer is the
+	// top layer which is being squashed.  The image will be changed to
+	// use the new layer as its top layer.
+	Image string
+	// ImageBigData holds replacements for the image's data items, such as
+	// its manifest and configuration, which would otherwise go on
+	// describing the layers it used before.  If the image has any data
+	// items, at least one replacement is required.  Items which aren't
+	// replaced are left as they are.
+	ImageBigData map[string][]byte
+	// DigestManifest is used to compute the digest of a manifest in
+	// ImageBigData, as it is by SetImageBigData().
+	DigestManifest func([]byte) (digest.Digest, error)
+}
+
+func (s *store) SquashLayers(topID, baseID string, options *SquashOptions) (*Layer, error) {
+	if options == nil {
+		options = &SquashOptions{}
+	}
+
+	rlstore, err := s.LayerStore()
+	if err != nil {
+		return nil, err
+	}
+	if err := s.startWriting(rlstore); err != nil {
+		return nil, err
+	}
+	defer rlstore.Unlock()
+
+	var ristore ImageStore
+	var image *Image
+	if options.Image != "" {
+		if ristore, err = s.ImageStore(); err != nil {
+			return nil, err
+		}
+		if err := s.startWriting(ristore); err != nil {
+			return nil, err
+		}
+		defer ristore.Unlock()
+		if image, err = ristore.Get(options.Image); err != nil {
+			return nil, err
+		}
+	}
+
+	top, err := rlstore.Get(topID)
+	if err != nil {
+		return nil, err
+	}
+	if image != nil && image.TopLayer != top.ID {
+		return nil, errors.Errorf("layer %q is not the top layer of image %q", top.ID, image.ID)
+	}
+	if image == nil && len(options.ImageBigData) > 0 {
+		return nil, errors.New("replacement data items were supplied without an image to use them")
+	}
+	if image != nil && len(image.BigDataNames) > 0 && len(options.ImageBigData) == 0 {
+		return nil, errors.Errorf("image %q has data items which describe its current layers, and no replacements were supplied", image.ID)
+	}
+	keys := make([]string, 0, len(options.ImageBigData))
+	for key := range options.ImageBigData {
+		if bigDataNameIsManifest(key) && options.DigestManifest == nil {
+			return nil, errors.Wrapf(ErrDigestUnknown, "error digesting replacement manifest %q: no manifest digest callback provided", key)
+		}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	layer, err := rlstore.(*layerStore).squash(options.LayerID, top.ID, baseID, options.LayerNames, options.LayerFlags)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error squashing layer %q", top.ID)
+	}
+	s.notify(Event{Type: EventCreate, Object: EventLayer, ID: layer.ID, Names: layer.Names})
+
+	if image != nil {
+		if err := ristore.(*imageStore).setTopLayer(image.ID, layer.ID); err != nil {
+			if err2 := rlstore.Delete(layer.ID); err2 != nil {
+				logrus.Debugf("error removing layer %q after failing to use it in image %q: %v", layer.ID, image.ID, err2)
+			} else {
+				s.notify(Event{Type: EventDelete, Object: EventLayer, ID: layer.ID})
+			}
+			return nil, err
+		}
+		s.notify(Event{Type: EventSetTopLayer, Object: EventImage, ID: image.ID})
+		for _, key := range keys {
+			if err := ristore.SetBigData(image.ID, key, options.ImageBigData[key], options.DigestManifest); err != nil {
+				return nil, errors.Wrapf(err, "error replacing data item %q of image %q, which now uses layer %q", key, image.ID, layer.ID)
+			}
+			s.notify(Event{Type: EventSetBigData, Object: EventImage, ID: image.ID, Key: key})
+		}
+	}
+
+	return layer, nil
+}
@@ -0,0 +1,85 @@
+package storage
+
+import (
+	gocontext "context"
+	"path/filepath"
+
+	"github.com/gepis/strge/pkg/lockfile"
+	"github.com/pkg/errors"
+)
+
+// When PutLayer() is given a diff, it puts the layer into the store in three
+// steps, so that extracting the diff, which can take a while, doesn't keep
+// everyone else from using the layer store:
+//  1. With the layer store locked, the layer is created, with the incomplete
+//     flag set.
+//  2. Without the layer store locked, the diff is extracted into the layer.
+//  3. With the layer store locked again, the digests and sizes that were
+//     computed while extracting the diff are recorded, and the incomplete
+//     flag is cleared.
+// The writer holds the layer's staging lock throughout.  Load() leaves
+// incomplete layers alone if their staging locks are held, instead of
+// removing them as leftovers, and Delete(), Mount(), Diff(), and the Store
+// methods which build on an existing layer refuse to use them.  Staging locks
+// live in the run root, and their files are removed when they're released.
+
+func isIncomplete(flags map[string]interface{}) bool {
+	incomplete, _ := flags[incompleteFlag].(bool)
+	return incomplete
+}
+
+// stagingLockPath returns the location of a layer's staging lock.
+func (r *layerStore) stagingLockPath(id string) string {
+	return filepath.Join(r.rundir, "staging", id+".lock")
+}
+
+// stagingLock takes the lock which is held while a layer's contents are being
+// written without the layer store being locked.  Releasing the lock removes
+// its file.
+func (r *layerStore) stagingLock(ctx gocontext.Context, id string) (*lockfile.TemporaryLock, error) {
+	return lockfile.LockTemporary(ctx, r.stagingLockPath(id))
+}
+
+// isBeingWritten checks if this process, or another one, is writing a layer's
+// contents without having the layer store locked.
+func (r *layerStore) isBeingWritten(id string) bool {
+	return lockfile.TemporaryLockHeld(r.stagingLockPath(id))
+}
+
+// checkComplete returns ErrLayerIncomplete if the layer was created with the
+// incomplete flag set, and its contents are still being written, so that it
+// can't be used yet.
+func (r *layerStore) checkComplete(layer *Layer) error {
+	if isIncomplete(layer.Flags) && r.isBeingWritten(layer.ID) {
+		return errors.Wrapf(ErrLayerIncomplete, "layer %q", layer.ID)
+	}
+	return nil
+}
+
+// finishStaged records what extractDiff() learned about the diff which it
+// applied to a layer which was created with the incomplete flag set, and
+// clears the flag.  The caller should be holding the layer store's lock.
+func (r *layerStore) finishStaged(id string, applied *appliedDiff) (*Layer, error) {
+	layer, ok := r.lookup(id)
+	if !ok {
+		return nil, ErrLayerUnknown
+	}
+	r.recordAppliedDiff(layer, applied)
+	delete(layer.Flags, incompleteFlag)
+	r.metadata.Changed(layer.ID)
+	if err := r.Save(); err != nil {
+		return nil, err
+	}
+	return copyLayer(layer), nil
+}
+
+// abortStaged removes a layer which was created with the incomplete flag set,
+// after its contents couldn't be written.  Unlike Delete(), it doesn't mind
+// that the caller is holding the layer's staging lock.  The caller should be
+// holding the layer store's lock.
+func (r *layerStore) abortStaged(id string) error {
+	if err := r.deleteInternal(id); err != nil {
+		return err
+	}
+	return r.Save()
+}
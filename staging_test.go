@@ -0,0 +1,118 @@
+package storage
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gepis/strge/pkg/archive"
+	"github.com/gepis/strge/pkg/reexec"
+	"github.com/gepis/strge/types"
+	"github.com/pkg/errors"
+)
+
+func TestMain(m *testing.M) {
+	if reexec.Init() {
+		return
+	}
+	os.Exit(m.Run())
+}
+
+func newTestStore(t *testing.T) Store {
+	if os.Getuid() != 0 {
+		t.Skip("test requires root")
+	}
+	dir := t.TempDir()
+	s, err := GetStore(types.StoreOptions{
+		RunRoot:         filepath.Join(dir, "run"),
+		GraphRoot:       filepath.Join(dir, "root"),
+		GraphDriverName: "vfs",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if _, err := s.Shutdown(true); err != nil {
+			t.Error(err)
+		}
+	})
+	return s
+}
+
+func TestPutLayerIncompleteLayerIsUnusable(t *testing.T) {
+	s := newTestStore(t)
+
+	diff, err := archive.Generate("file", "contents")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader, writer := io.Pipe()
+	const id = "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+	type putResult struct {
+		layer *Layer
+		err   error
+	}
+	done := make(chan putResult)
+	go func() {
+		layer, _, err := s.PutLayer(id, "", nil, "", false, nil, reader)
+		done <- putResult{layer, err}
+	}()
+
+	// Wait for the layer to be created, and for its diff to be extracted
+	// without the layer store being locked.
+	deadline := time.Now().Add(30 * time.Second)
+	for !s.Exists(id) {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the layer to be created")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if _, err := s.Mount(id, ""); errors.Cause(err) != ErrLayerIncomplete {
+		t.Errorf("mounting a layer which is being written: expected %v, got %v", ErrLayerIncomplete, err)
+	}
+	if _, err := s.CreateLayer("", id, nil, "", false, nil); errors.Cause(err) != ErrLayerIncomplete {
+		t.Errorf("using a layer which is being written as a parent: expected %v, got %v", ErrLayerIncomplete, err)
+	}
+	if _, err := s.CreateImage("", nil, id, "", &ImageOptions{}); errors.Cause(err) != ErrLayerIncomplete {
+		t.Errorf("creating an image using a layer which is being written: expected %v, got %v", ErrLayerIncomplete, err)
+	}
+	if rc, err := s.Diff("", id, nil); errors.Cause(err) != ErrLayerIncomplete {
+		t.Errorf("reading the diff of a layer which is being written: expected %v, got %v", ErrLayerIncomplete, err)
+		if err == nil {
+			rc.Close()
+		}
+	}
+
+	if _, err := io.Copy(writer, diff); err != nil {
+		t.Fatal(err)
+	}
+	writer.Close()
+	result := <-done
+	if result.err != nil {
+		t.Fatal(result.err)
+	}
+
+	if _, err := s.Mount(id, ""); err != nil {
+		t.Fatalf("mounting a layer after it was written: %v", err)
+	}
+	if _, err := s.Unmount(id, true); err != nil {
+		t.Fatal(err)
+	}
+	child, err := s.CreateLayer("", id, nil, "", false, nil)
+	if err != nil {
+		t.Fatalf("using a layer as a parent after it was written: %v", err)
+	}
+	if child.Parent != id {
+		t.Errorf("expected the new layer's parent to be %q, got %q", id, child.Parent)
+	}
+	rlstore, err := s.(*store).LayerStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(rlstore.(*layerStore).stagingLockPath(id)); !os.IsNotExist(err) {
+		t.Errorf("expected the staging lock to have been removed, got %v", err)
+	}
+}
@@ -1,6 +1,7 @@
 package storage
 
 import (
+	gocontext "context"
 	"encoding/base64"
 	"fmt"
 	"io"
@@ -20,6 +21,7 @@ import (
 	"github.com/gepis/strge/pkg/directory"
 	"github.com/gepis/strge/pkg/idtools"
 	"github.com/gepis/strge/pkg/ioutils"
+	"github.com/gepis/strge/pkg/locker"
 	"github.com/gepis/strge/pkg/parsers"
 	"github.com/gepis/strge/pkg/stringid"
 	"github.com/gepis/strge/pkg/stringutils"
@@ -28,6 +30,7 @@ import (
 	digest "github.com/opencontainers/go-digest"
 	"github.com/opencontainers/selinux/go-selinux/label"
 	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
 )
 
 var (
@@ -167,6 +170,10 @@ type Store interface {
 	UIDMap() []idtools.IDMap
 	GIDMap() []idtools.IDMap
 
+	// PullOptions returns a copy of the options which were passed to
+	// GetStore() for pull managers, such as the one in pkg/chunked.
+	PullOptions() map[string]string
+
 	// GraphDriver obtains and returns a handle to the graph Driver object used
 	// by the Store.
 	GraphDriver() (context.Driver, error)
@@ -513,6 +520,190 @@ type Store interface {
 	// Releasing AdditionalLayer handler is caller's responsibility.
 	// This API is experimental and can be changed without bumping the major version number.
 	LookupAdditionalLayer(d digest.Digest, imageref string) (AdditionalLayer, error)
+
+	// Check looks for inconsistencies between the layer, image, and
+	// container stores and the storage driver, and returns a report
+	// describing each one that it finds.  If options is nil, every check
+	// is performed.
+	Check(options *CheckOptions) (CheckReport, error)
+
+	// Repair attempts to fix the inconsistencies listed in a report which
+	// was returned by Check(), by removing or unlinking the items which are
+	// broken.  Items in read-only stores are left alone.
+	Repair(report CheckReport, options *RepairOptions) []error
+
+	// VerifyLayer regenerates the diff for a layer from its contents and the
+	// tar-split data which was saved when its contents were applied,
+	// compares its digest to the layer's recorded UncompressedDigest, and
+	// reports any files whose contents have changed.
+	VerifyLayer(id string) (*LayerVerification, error)
+
+	// GarbageCollect removes layers which are not used by any image or
+	// container and which have no names, along with, if the policy allows
+	// it, images which have no names and which are not being used by any
+	// containers.  If policy is nil, only unreferenced layers are removed.
+	GarbageCollect(policy *GCPolicy) (*GCReport, error)
+
+	// Events returns a channel on which an Event is delivered for each
+	// layer, image, or container which is created, deleted, renamed,
+	// mounted, unmounted, or has big data set for it from this point on,
+	// whether the change is made by this process or by another process
+	// which is using the same run root.  The channel is closed when ctx is
+	// cancelled.
+	Events(ctx gocontext.Context) (<-chan Event, error)
+
+	// RecordedEvents returns the events which have been recorded in the
+	// journal in the run root and not yet rotated out of it, oldest first.
+	RecordedEvents() ([]Event, error)
+
+	// ExportImage writes an image, including its layers, names, metadata,
+	// and big data items, to a directory as an OCI image layout.
+	ExportImage(id, dir string) error
+
+	// ImportImage reads the images listed in an OCI image layout directory
+	// into the store, reusing any layers which the store already has, and
+	// returns the newly-created images.
+	ImportImage(dir string) ([]*Image, error)
+
+	// DiskUsage reports how much of the space used by each image's layers
+	// is shared with other images and containers, and how much is
+	// exclusive to it, along with the size of each container's writable
+	// layer.  Unlike ImageSize(), it counts each layer once.
+	DiskUsage() (*DiskUsageReport, error)
+
+	// PutLayerWithContext is PutLayer, except that it stops reading the
+	// diff, and stops the driver from applying it, if ctx is cancelled, in
+	// which case the partially-populated layer
+	// is removed and an error which wraps ctx.Err() is returned.
+	PutLayerWithContext(ctx gocontext.Context, id, parent string, names []string, mountLabel string, writeable bool, options *LayerOptions, diff io.Reader) (*Layer, int64, error)
+
+	// ApplyDiffWithContext is ApplyDiff, except that the layer is marked
+	// as incomplete while the diff is being applied, and if ctx is
+	// cancelled before it has been, the layer is removed and an error
+	// which wraps ctx.Err() is returned.
+	ApplyDiffWithContext(ctx gocontext.Context, to string, diff io.Reader) (int64, error)
+
+	// DiffWithContext is Diff, except that reads from the returned stream
+	// fail once ctx is cancelled.
+	DiffWithContext(ctx gocontext.Context, from, to string, options *DiffOptions) (io.ReadCloser, error)
+
+	// ImageSizeWithContext is ImageSize, except that it gives up, returning
+	// ctx.Err(), if ctx is cancelled before it's done.
+	ImageSizeWithContext(ctx gocontext.Context, id string) (int64, error)
+
+	// WipeWithContext is Wipe, except that it stops removing things, and
+	// returns ctx.Err(), if ctx is cancelled before it's done.
+	WipeWithContext(ctx gocontext.Context) error
+
+	// CommitContainer creates a read-only layer with the contents of a
+	// container's writable layer, using the same parent as that layer, and
+	// records its digests and sizes as ApplyDiff() would.  If the options
+	// ask for it, an image which uses the new layer as its top layer is
+	// also created.
+	CommitContainer(id string, options *CommitOptions) (*Layer, *Image, error)
+
+	// SquashLayers creates a read-only layer with the merged contents of
+	// the layers from baseID to topID, using baseID's parent as its parent,
+	// or no parent if baseID is "".  If the options name an image whose top
+	// layer is topID, the image is changed to use the new layer instead,
+	// and its data items are replaced with the ones in the options.
+	SquashLayers(topID, baseID string, options *SquashOptions) (*Layer, error)
+
+	// RebaseLayer creates a read-only layer by applying the diff of the
+	// layer with the specified ID on top of newParent, or on top of nothing
+	// if newParent is "".  It also returns the paths of files which the
+	// diff modifies that are different in newParent than they are in the
+	// layer's original parent.
+	RebaseLayer(id, newParent string, names []string) (*Layer, []string, error)
+
+	// CloneContainer creates a container which is based on the same image
+	// as the source container, with a writable layer which starts out with
+	// the contents of the source container's layer, and copies of its
+	// metadata, big data items, and ContainerDirectory() contents.  Flags
+	// in the options override the source container's flags.  New SELinux
+	// labels are allocated for it unless the options specify them.
+	CloneContainer(srcID, newID string, names []string, options *ContainerOptions) (*Container, error)
+
+	// ResetContainer discards all of the changes which have been made to a
+	// container's writable layer by recreating it on top of the same
+	// parent, leaving the container's record and ContainerDirectory()
+	// untouched.  If the layer is mounted, it fails with ErrLayerMounted,
+	// unless force is set, in which case the layer is unmounted first.
+	ResetContainer(id string, force bool) error
+
+	// AcquireLease creates a lease which expires after ttl.  Layers and
+	// images which are attached to the lease, and the layers which they
+	// use, are not removed by DeleteLayer(), DeleteImage(), Wipe(), or
+	// GarbageCollect() until the lease is released or expires.
+	AcquireLease(ttl time.Duration) (*Lease, error)
+
+	// AddToLease attaches layers and images to a lease.
+	AddToLease(id string, layers, images []string) error
+
+	// RenewLease changes a lease so that it expires ttl from now.
+	RenewLease(id string, ttl time.Duration) (*Lease, error)
+
+	// ReleaseLease removes a lease, leaving the layers and images which
+	// were attached to it unprotected.
+	ReleaseLease(id string) error
+
+	// Leases returns the list of leases which have not expired.
+	Leases() ([]Lease, error)
+
+	// Pin marks the image or layer with the specified name or ID as pinned.
+	// Delete(), DeleteImage(), DeleteLayer(), and Wipe() refuse to remove
+	// pinned images and layers, returning ErrImagePinned or ErrLayerPinned,
+	// and GarbageCollect() leaves them alone.
+	Pin(id string) error
+
+	// Unpin clears the pin on the image or layer with the specified name or
+	// ID.
+	Unpin(id string) error
+
+	// DeleteWithOptions is Delete, except that it can be told to remove
+	// pinned images and layers.
+	DeleteWithOptions(id string, options *DeleteOptions) error
+
+	// DeleteLayerWithOptions is DeleteLayer, except that it can be told to
+	// remove a pinned layer.
+	DeleteLayerWithOptions(id string, options *DeleteOptions) error
+
+	// DeleteImageWithOptions is DeleteImage, except that it can be told to
+	// remove a pinned image, and pinned layers which it would otherwise stop
+	// at.
+	DeleteImageWithOptions(id string, commit bool, options *DeleteOptions) (layers []string, err error)
+
+	// WipeWithOptions is WipeWithContext, except that it can be told to
+	// remove pinned images and layers instead of refusing to remove
+	// anything when some are present.
+	WipeWithOptions(ctx gocontext.Context, options *DeleteOptions) error
+
+	// QueryImages returns the images which Images() would return which
+	// match the filter, sorted and paginated as the filter specifies.  If
+	// filter is nil, all images are returned.
+	QueryImages(filter *QueryFilter) ([]Image, error)
+
+	// QueryLayers returns the layers which Layers() would return which
+	// match the filter, sorted and paginated as the filter specifies.  If
+	// filter is nil, all layers are returned.
+	QueryLayers(filter *QueryFilter) ([]Layer, error)
+
+	// QueryContainers returns the containers which Containers() would
+	// return which match the filter, sorted and paginated as the filter
+	// specifies.  If filter is nil, all containers are returned.
+	QueryContainers(filter *QueryFilter) ([]Container, error)
+
+	// MigrateMetadata rewrites the lists of layers, images, containers,
+	// and mounted layers using the specified version of the metadata
+	// format, which can be older than the version that they are in.  It
+	// fails with ErrMetadataVersion if the version is not one that we
+	// know, or if the lists are in a newer version than MetadataVersion.
+	// Stores are created using MetadataVersion, and stores which use the
+	// journal metadata backend are switched to it.  A store has to be
+	// converted to version 1, using the json metadata backend, before
+	// versions of this library which don't know about versions can be
+	// used with it.
+	MigrateMetadata(version int) error
 }
 
 // AdditionalLayer reprents a layer that is contained in the additional layer store
@@ -547,6 +738,9 @@ type LayerOptions struct {
 	// initialize this layer.  If set, it should be a child of the layer
 	// which we want to use as the parent of the new layer.
 	TemplateLayer string
+	// LeaseID is the ID of a lease which the new layer should be attached
+	// to as soon as it is created.
+	LeaseID string
 }
 
 // ImageOptions is used for passing options to a Store's CreateImage() method.
@@ -576,6 +770,7 @@ type store struct {
 	runRoot         string
 	graphLock       Locker
 	usernsLock      Locker
+	eventsLock      Locker
 	graphRoot       string
 	graphDriverName string
 	graphOptions    []string
@@ -594,6 +789,10 @@ type store struct {
 	containerStore  ContainerStore
 	digestLockRoot  string
 	disableVolatile bool
+	pullOptions     map[string]string
+	lockTimeout     time.Duration
+	metadataBackend string
+	layerLocks      *locker.Locker // Held by PutLayer() for the layer's ID
 }
 
 // GetStore attempts to find an already-created Store object matching the
@@ -671,6 +870,11 @@ func GetStore(options types.StoreOptions) (Store, error) {
 		return nil, err
 	}
 
+	eventsLock, err := GetLockfile(filepath.Join(options.RunRoot, "events.lock"))
+	if err != nil {
+		return nil, err
+	}
+
 	autoNsMinSize := options.AutoNsMinSize
 	autoNsMaxSize := options.AutoNsMaxSize
 	if autoNsMinSize == 0 {
@@ -693,7 +897,12 @@ func GetStore(options types.StoreOptions) (Store, error) {
 		additionalUIDs:  nil,
 		additionalGIDs:  nil,
 		usernsLock:      usernsLock,
+		eventsLock:      eventsLock,
 		disableVolatile: options.DisableVolatile,
+		pullOptions:     copyStringStringMap(options.PullOptions),
+		lockTimeout:     options.LockTimeout,
+		metadataBackend: options.MetadataBackend,
+		layerLocks:      locker.New(),
 	}
 	if err := s.load(); err != nil {
 		return nil, err
@@ -744,6 +953,10 @@ func (s *store) GraphOptions() []string {
 	return s.graphOptions
 }
 
+func (s *store) PullOptions() map[string]string {
+	return copyStringStringMap(s.pullOptions)
+}
+
 func (s *store) UIDMap() []idtools.IDMap {
 	return copyIDMap(s.uidMap)
 }
@@ -761,13 +974,20 @@ func (s *store) load() error {
 	s.graphDriverName = driver.String()
 	driverPrefix := s.graphDriverName + "-"
 
+	lockPaths := append(storeLockPaths(s.graphRoot), driverLockPaths(s.graphRoot, s.runRoot, s.graphDriverName, driver.AdditionalImageStores())...)
+	if err := s.recordLockHolders(lockPaths...); err != nil {
+		return err
+	}
+
 	gipath := filepath.Join(s.graphRoot, driverPrefix+"images")
 	if err := os.MkdirAll(gipath, 0700); err != nil {
 		return err
 	}
-	ris, err := newImageStore(gipath)
+	ctx, cancel := s.lockContext()
+	defer cancel()
+	ris, err := newImageStore(ctx, gipath, s.metadataBackend)
 	if err != nil {
-		return err
+		return s.lockError(err)
 	}
 	s.imageStore = ris
 	if _, err := s.ROImageStores(); err != nil {
@@ -778,9 +998,9 @@ func (s *store) load() error {
 	if err := os.MkdirAll(gcpath, 0700); err != nil {
 		return err
 	}
-	rcs, err := newContainerStore(gcpath)
+	rcs, err := newContainerStore(ctx, gcpath, s.metadataBackend)
 	if err != nil {
-		return err
+		return s.lockError(err)
 	}
 	rcpath := filepath.Join(s.runRoot, driverPrefix+"containers")
 	if err := os.MkdirAll(rcpath, 0700); err != nil {
@@ -790,9 +1010,9 @@ func (s *store) load() error {
 
 	for _, store := range driver.AdditionalImageStores() {
 		gipath := filepath.Join(store, driverPrefix+"images")
-		ris, err := newROImageStore(gipath)
+		ris, err := newROImageStore(ctx, gipath)
 		if err != nil {
-			return err
+			return s.lockError(err)
 		}
 		s.roImageStores = append(s.roImageStores, ris)
 	}
@@ -807,7 +1027,11 @@ func (s *store) load() error {
 
 // GetDigestLock returns a digest-specific Locker.
 func (s *store) GetDigestLock(d digest.Digest) (Locker, error) {
-	return GetLockfile(filepath.Join(s.digestLockRoot, d.String()))
+	path := filepath.Join(s.digestLockRoot, d.String())
+	if err := s.recordLockHolders(path); err != nil {
+		return nil, err
+	}
+	return GetLockfile(path)
 }
 
 func (s *store) getGraphDriver() (context.Driver, error) {
@@ -831,7 +1055,9 @@ func (s *store) getGraphDriver() (context.Driver, error) {
 }
 
 func (s *store) GraphDriver() (context.Driver, error) {
-	s.graphLock.Lock()
+	if err := s.lock(s.graphLock); err != nil {
+		return nil, err
+	}
 	defer s.graphLock.Unlock()
 	if s.graphLock.TouchedSince(s.lastLoaded) {
 		s.graphDriver = nil
@@ -845,7 +1071,9 @@ func (s *store) GraphDriver() (context.Driver, error) {
 // used by the Store.  Accessing this store directly will bypass locking and
 // synchronization, so it is not a part of the exported Store interface.
 func (s *store) LayerStore() (LayerStore, error) {
-	s.graphLock.Lock()
+	if err := s.lock(s.graphLock); err != nil {
+		return nil, err
+	}
 	defer s.graphLock.Unlock()
 	if s.graphLock.TouchedSince(s.lastLoaded) {
 		s.graphDriver = nil
@@ -880,7 +1108,9 @@ func (s *store) LayerStore() (LayerStore, error) {
 // Store.  Accessing these stores directly will bypass locking and
 // synchronization, so it is not part of the exported Store interface.
 func (s *store) ROLayerStores() ([]ROLayerStore, error) {
-	s.graphLock.Lock()
+	if err := s.lock(s.graphLock); err != nil {
+		return nil, err
+	}
 	defer s.graphLock.Unlock()
 	if s.roLayerStores != nil {
 		return s.roLayerStores, nil
@@ -950,32 +1180,95 @@ func (s *store) canUseShifting(uidmap, gidmap []idtools.IDMap) bool {
 }
 
 func (s *store) PutLayer(id, parent string, names []string, mountLabel string, writeable bool, options *LayerOptions, diff io.Reader) (*Layer, int64, error) {
-	var parentLayer *Layer
+	return s.PutLayerWithContext(gocontext.Background(), id, parent, names, mountLabel, writeable, options, diff)
+}
+
+func (s *store) PutLayerWithContext(ctx gocontext.Context, id, parent string, names []string, mountLabel string, writeable bool, options *LayerOptions, diff io.Reader) (*Layer, int64, error) {
 	rlstore, err := s.LayerStore()
 	if err != nil {
 		return nil, -1, err
 	}
-	rlstores, err := s.ROLayerStores()
-	if err != nil {
-		return nil, -1, err
+	if id == "" {
+		id = stringid.GenerateRandomID()
 	}
-	rcstore, err := s.ContainerStore()
-	if err != nil {
+	// Keep anyone else from writing a layer with this ID while we're
+	// applying the diff without the layer store locked.
+	s.layerLocks.Lock(id)
+	defer s.layerLocks.Unlock(id)
+	if diff != nil {
+		lockCtx, cancel := s.lockContext()
+		staging, err := rlstore.(*layerStore).stagingLock(lockCtx, id)
+		cancel()
+		if err != nil {
+			return nil, -1, s.lockError(err)
+		}
+		defer func() {
+			if err := staging.Unlock(); err != nil {
+				logrus.Debugf("error releasing staging lock for layer %q: %v", id, err)
+			}
+		}()
+	}
+
+	layer, err := s.createLayer(rlstore, id, parent, names, mountLabel, writeable, options, diff != nil)
+	if err != nil || diff == nil {
+		return layer, -1, err
+	}
+
+	if ctx.Done() != nil {
+		// If the diff stops being read, we remove the incomplete layer.
+		reader := ioutils.NewCancelReadCloser(ctx, ioutil.NopCloser(diff))
+		defer reader.Close()
+		diff = reader
+	}
+	lstore := rlstore.(*layerStore)
+	applied, applyErr := lstore.extractDiff(ctx, layer.ID, layer.Parent, lstore.layerMappings(layer), layer.MountLabel, diff)
+
+	if err := s.startWriting(rlstore); err != nil {
+		// The incomplete flag will get the layer removed the next
+		// time the store is loaded.
 		return nil, -1, err
 	}
-	rlstore.Lock()
 	defer rlstore.Unlock()
-	if err := rlstore.ReloadIfChanged(); err != nil {
+	if applyErr != nil {
+		if err := lstore.abortStaged(layer.ID); err != nil {
+			logrus.Debugf("error removing layer %q after failing to apply diff: %v", layer.ID, err)
+		}
+		if ctx.Err() != nil {
+			return nil, -1, errors.Wrapf(ctx.Err(), "error creating layer %q", id)
+		}
+		return nil, -1, applyErr
+	}
+	if layer, err = lstore.finishStaged(layer.ID, applied); err != nil {
 		return nil, -1, err
 	}
-	rcstore.Lock()
-	defer rcstore.Unlock()
-	if err := rcstore.ReloadIfChanged(); err != nil {
+	if err := s.leaseNewLayer(rlstore, layer, options); err != nil {
 		return nil, -1, err
 	}
-	if id == "" {
-		id = stringid.GenerateRandomID()
+	s.notify(Event{Type: EventCreate, Object: EventLayer, ID: layer.ID, Names: layer.Names})
+	return layer, applied.size, nil
+}
+
+// createLayer creates a layer for PutLayerWithContext().  If incomplete is
+// set, the layer is marked as incomplete, and it's up to the caller to
+// populate it and then clear the flag.
+func (s *store) createLayer(rlstore LayerStore, id, parent string, names []string, mountLabel string, writeable bool, options *LayerOptions, incomplete bool) (*Layer, error) {
+	var parentLayer *Layer
+	rlstores, err := s.ROLayerStores()
+	if err != nil {
+		return nil, err
 	}
+	rcstore, err := s.ContainerStore()
+	if err != nil {
+		return nil, err
+	}
+	if err := s.startWriting(rlstore); err != nil {
+		return nil, err
+	}
+	defer rlstore.Unlock()
+	if err := s.startWriting(rcstore); err != nil {
+		return nil, err
+	}
+	defer rcstore.Unlock()
 	if options == nil {
 		options = &LayerOptions{}
 	}
@@ -992,11 +1285,10 @@ func (s *store) PutLayer(id, parent string, names []string, mountLabel string, w
 		for _, l := range append([]ROLayerStore{rlstore}, rlstores...) {
 			lstore := l
 			if lstore != rlstore {
-				lstore.RLock()
-				defer lstore.Unlock()
-				if err := lstore.ReloadIfChanged(); err != nil {
-					return nil, -1, err
+				if err := s.startReading(lstore); err != nil {
+					return nil, err
 				}
+				defer lstore.Unlock()
 			}
 			if l, err := lstore.Get(parent); err == nil && l != nil {
 				ilayer = l
@@ -1005,16 +1297,19 @@ func (s *store) PutLayer(id, parent string, names []string, mountLabel string, w
 			}
 		}
 		if ilayer == nil {
-			return nil, -1, ErrLayerUnknown
+			return nil, ErrLayerUnknown
+		}
+		if err := rlstore.(*layerStore).checkComplete(ilayer); err != nil {
+			return nil, err
 		}
 		parentLayer = ilayer
 		containers, err := rcstore.Containers()
 		if err != nil {
-			return nil, -1, err
+			return nil, err
 		}
 		for _, container := range containers {
 			if container.LayerID == parent {
-				return nil, -1, ErrParentIsContainer
+				return nil, ErrParentIsContainer
 			}
 		}
 		if !options.HostUIDMapping && len(options.UIDMap) == 0 {
@@ -1044,7 +1339,47 @@ func (s *store) PutLayer(id, parent string, names []string, mountLabel string, w
 			},
 		}
 	}
-	return rlstore.Put(id, parentLayer, names, mountLabel, nil, layerOptions, writeable, nil, diff)
+	var flags map[string]interface{}
+	if incomplete {
+		// We're holding the layer's staging lock, so if there's an
+		// incomplete layer with this ID, it was left behind by
+		// someone who didn't finish writing it.
+		if layer, err := rlstore.Get(id); err == nil && layer.ID == id && isIncomplete(layer.Flags) {
+			if err := rlstore.(*layerStore).abortStaged(layer.ID); err != nil {
+				return nil, err
+			}
+		}
+		flags = map[string]interface{}{incompleteFlag: true}
+	}
+	layer, _, err := rlstore.Put(id, parentLayer, names, mountLabel, nil, layerOptions, writeable, flags, nil)
+	if err != nil {
+		return layer, err
+	}
+	if !incomplete {
+		if err := s.leaseNewLayer(rlstore, layer, options); err != nil {
+			return nil, err
+		}
+		s.notify(Event{Type: EventCreate, Object: EventLayer, ID: layer.ID, Names: layer.Names})
+	}
+	return layer, nil
+}
+
+// leaseNewLayer attaches a newly-created layer to the lease named in the
+// options, if there is one, and removes the layer if it can't.  The caller
+// should be holding the layer store's lock.
+func (s *store) leaseNewLayer(rlstore LayerStore, layer *Layer, options *LayerOptions) error {
+	if options == nil || options.LeaseID == "" {
+		return nil
+	}
+	// Attach the layer to the lease before anything else can see it as
+	// being unused.
+	if err := s.addToLease(options.LeaseID, []string{layer.ID}, nil); err != nil {
+		if err2 := rlstore.Delete(layer.ID); err2 != nil {
+			logrus.Debugf("error removing layer %q after failing to attach it to lease %q: %v", layer.ID, options.LeaseID, err2)
+		}
+		return err
+	}
+	return nil
 }
 
 func (s *store) CreateLayer(id, parent string, names []string, mountLabel string, writeable bool, options *LayerOptions) (*Layer, error) {
@@ -1067,18 +1402,16 @@ func (s *store) CreateImage(id string, names []string, layer, metadata string, o
 			return nil, err
 		}
 		var ilayer *Layer
-		for _, s := range append([]ROLayerStore{lstore}, lstores...) {
-			store := s
+		for _, store := range append([]ROLayerStore{lstore}, lstores...) {
 			if store == lstore {
-				store.Lock()
+				err = s.startWriting(store)
 			} else {
-				store.RLock()
+				err = s.startReading(store)
 			}
-			defer store.Unlock()
-			err := store.ReloadIfChanged()
 			if err != nil {
 				return nil, err
 			}
+			defer store.Unlock()
 			ilayer, err = store.Get(layer)
 			if err == nil {
 				break
@@ -1087,6 +1420,9 @@ func (s *store) CreateImage(id string, names []string, layer, metadata string, o
 		if ilayer == nil {
 			return nil, ErrLayerUnknown
 		}
+		if err := lstore.(*layerStore).checkComplete(ilayer); err != nil {
+			return nil, err
+		}
 		layer = ilayer.ID
 	}
 
@@ -1094,18 +1430,21 @@ func (s *store) CreateImage(id string, names []string, layer, metadata string, o
 	if err != nil {
 		return nil, err
 	}
-	ristore.Lock()
-	defer ristore.Unlock()
-	if err := ristore.ReloadIfChanged(); err != nil {
+	if err := s.startWriting(ristore); err != nil {
 		return nil, err
 	}
+	defer ristore.Unlock()
 
 	creationDate := time.Now().UTC()
 	if options != nil && !options.CreationDate.IsZero() {
 		creationDate = options.CreationDate
 	}
 
-	return ristore.Create(id, names, layer, metadata, creationDate, options.Digest)
+	image, err := ristore.Create(id, names, layer, metadata, creationDate, options.Digest)
+	if err == nil {
+		s.notify(Event{Type: EventCreate, Object: EventImage, ID: image.ID, Names: image.Names})
+	}
+	return image, err
 }
 
 func (s *store) imageTopLayerForMapping(image *Image, ristore ROImageStore, createMappedLayer bool, rlstore LayerStore, lstores []ROLayerStore, options types.IDMappingOptions) (*Layer, error) {
@@ -1131,14 +1470,12 @@ func (s *store) imageTopLayerForMapping(image *Image, ristore ROImageStore, crea
 	var layer, parentLayer *Layer
 	allStores := append([]ROLayerStore{rlstore}, lstores...)
 	// Locate the image's top layer and its parent, if it has one.
-	for _, s := range allStores {
-		store := s
+	for _, store := range allStores {
 		if store != rlstore {
-			store.RLock()
-			defer store.Unlock()
-			if err := store.ReloadIfChanged(); err != nil {
+			if err := s.startReading(store); err != nil {
 				return nil, err
 			}
+			defer store.Unlock()
 		}
 		// Walk the top layer list.
 		for _, candidate := range append([]string{image.TopLayer}, image.MappedTopLayers...) {
@@ -1246,7 +1583,9 @@ func (s *store) CreateContainer(id string, names []string, image, layer, metadat
 		// are used.
 		// It doesn't prevent containers that specify an explicit mapping to overlap
 		// with AutoUserNs.
-		s.usernsLock.Lock()
+		if err := s.lock(s.usernsLock); err != nil {
+			return nil, err
+		}
 		defer s.usernsLock.Unlock()
 	}
 
@@ -1269,22 +1608,20 @@ func (s *store) CreateContainer(id string, names []string, image, layer, metadat
 		if err != nil {
 			return nil, err
 		}
-		rlstore.Lock()
-		defer rlstore.Unlock()
-		if err := rlstore.ReloadIfChanged(); err != nil {
+		if err := s.startWriting(rlstore); err != nil {
 			return nil, err
 		}
-		for _, s := range append([]ROImageStore{istore}, istores...) {
-			store := s
+		defer rlstore.Unlock()
+		for _, store := range append([]ROImageStore{istore}, istores...) {
 			if store == istore {
-				store.Lock()
+				err = s.startWriting(store)
 			} else {
-				store.RLock()
+				err = s.startReading(store)
 			}
-			defer store.Unlock()
-			if err := store.ReloadIfChanged(); err != nil {
+			if err != nil {
 				return nil, err
 			}
+			defer store.Unlock()
 			cimage, err = store.Get(image)
 			if err == nil {
 				imageHomeStore = store
@@ -1316,6 +1653,9 @@ func (s *store) CreateContainer(id string, names []string, image, layer, metadat
 			if err != nil {
 				return nil, err
 			}
+			if err := rlstore.(*layerStore).checkComplete(ilayer); err != nil {
+				return nil, err
+			}
 			imageTopLayer = ilayer
 
 			if !options.HostUIDMapping && len(options.UIDMap) == 0 {
@@ -1326,11 +1666,10 @@ func (s *store) CreateContainer(id string, names []string, image, layer, metadat
 			}
 		}
 	} else {
-		rlstore.Lock()
-		defer rlstore.Unlock()
-		if err := rlstore.ReloadIfChanged(); err != nil {
+		if err := s.startWriting(rlstore); err != nil {
 			return nil, err
 		}
+		defer rlstore.Unlock()
 		if !options.HostUIDMapping && len(options.UIDMap) == 0 {
 			uidMap = s.uidMap
 		}
@@ -1386,11 +1725,10 @@ func (s *store) CreateContainer(id string, names []string, image, layer, metadat
 	if err != nil {
 		return nil, err
 	}
-	rcstore.Lock()
-	defer rcstore.Unlock()
-	if err := rcstore.ReloadIfChanged(); err != nil {
+	if err := s.startWriting(rcstore); err != nil {
 		return nil, err
 	}
+	defer rcstore.Unlock()
 	options.IDMappingOptions = types.IDMappingOptions{
 		HostUIDMapping: len(options.UIDMap) == 0,
 		HostGIDMapping: len(options.GIDMap) == 0,
@@ -1400,6 +1738,16 @@ func (s *store) CreateContainer(id string, names []string, image, layer, metadat
 	container, err := rcstore.Create(id, names, imageID, layer, metadata, options)
 	if err != nil || container == nil {
 		rlstore.Delete(layer)
+	} else {
+		now := time.Now().UTC()
+		if cimage != nil && imageHomeStore == istore {
+			touchImage(istore, cimage.ID, now)
+		}
+		if imageTopLayer != nil {
+			touchLayer(rlstore, imageTopLayer.ID, now)
+		}
+		s.notify(Event{Type: EventCreate, Object: EventLayer, ID: layer},
+			Event{Type: EventCreate, Object: EventContainer, ID: container.ID, Names: container.Names})
 	}
 	return container, err
 }
@@ -1418,21 +1766,18 @@ func (s *store) SetMetadata(id, metadata string) error {
 		return err
 	}
 
-	rlstore.Lock()
+	if err := s.startWriting(rlstore); err != nil {
+		return err
+	}
 	defer rlstore.Unlock()
-	if err := rlstore.ReloadIfChanged(); err != nil {
+	if err := s.startWriting(ristore); err != nil {
 		return err
 	}
-	ristore.Lock()
 	defer ristore.Unlock()
-	if err := ristore.ReloadIfChanged(); err != nil {
+	if err := s.startWriting(rcstore); err != nil {
 		return err
 	}
-	rcstore.Lock()
 	defer rcstore.Unlock()
-	if err := rcstore.ReloadIfChanged(); err != nil {
-		return err
-	}
 
 	if rlstore.Exists(id) {
 		return rlstore.SetMetadata(id, metadata)
@@ -1455,13 +1800,11 @@ func (s *store) Metadata(id string) (string, error) {
 	if err != nil {
 		return "", err
 	}
-	for _, s := range append([]ROLayerStore{lstore}, lstores...) {
-		store := s
-		store.RLock()
-		defer store.Unlock()
-		if err := store.ReloadIfChanged(); err != nil {
+	for _, store := range append([]ROLayerStore{lstore}, lstores...) {
+		if err := s.startReading(store); err != nil {
 			return "", err
 		}
+		defer store.Unlock()
 		if store.Exists(id) {
 			return store.Metadata(id)
 		}
@@ -1475,13 +1818,11 @@ func (s *store) Metadata(id string) (string, error) {
 	if err != nil {
 		return "", err
 	}
-	for _, s := range append([]ROImageStore{istore}, istores...) {
-		store := s
-		store.RLock()
-		defer store.Unlock()
-		if err := store.ReloadIfChanged(); err != nil {
+	for _, store := range append([]ROImageStore{istore}, istores...) {
+		if err := s.startReading(store); err != nil {
 			return "", err
 		}
+		defer store.Unlock()
 		if store.Exists(id) {
 			return store.Metadata(id)
 		}
@@ -1491,11 +1832,10 @@ func (s *store) Metadata(id string) (string, error) {
 	if err != nil {
 		return "", err
 	}
-	cstore.RLock()
-	defer cstore.Unlock()
-	if err := cstore.ReloadIfChanged(); err != nil {
+	if err := s.startReading(cstore); err != nil {
 		return "", err
 	}
+	defer cstore.Unlock()
 	if cstore.Exists(id) {
 		return cstore.Metadata(id)
 	}
@@ -1511,13 +1851,11 @@ func (s *store) ListImageBigData(id string) ([]string, error) {
 	if err != nil {
 		return nil, err
 	}
-	for _, s := range append([]ROImageStore{istore}, istores...) {
-		store := s
-		store.RLock()
-		defer store.Unlock()
-		if err := store.ReloadIfChanged(); err != nil {
+	for _, store := range append([]ROImageStore{istore}, istores...) {
+		if err := s.startReading(store); err != nil {
 			return nil, err
 		}
+		defer store.Unlock()
 		bigDataNames, err := store.BigDataNames(id)
 		if err == nil {
 			return bigDataNames, err
@@ -1535,13 +1873,11 @@ func (s *store) ImageBigDataSize(id, key string) (int64, error) {
 	if err != nil {
 		return -1, err
 	}
-	for _, s := range append([]ROImageStore{istore}, istores...) {
-		store := s
-		store.RLock()
-		defer store.Unlock()
-		if err := store.ReloadIfChanged(); err != nil {
+	for _, store := range append([]ROImageStore{istore}, istores...) {
+		if err := s.startReading(store); err != nil {
 			return -1, err
 		}
+		defer store.Unlock()
 		size, err := store.BigDataSize(id, key)
 		if err == nil {
 			return size, nil
@@ -1562,11 +1898,10 @@ func (s *store) ImageBigDataDigest(id, key string) (digest.Digest, error) {
 	stores = append([]ROImageStore{ristore}, stores...)
 	for _, r := range stores {
 		ristore := r
-		ristore.RLock()
-		defer ristore.Unlock()
-		if err := ristore.ReloadIfChanged(); err != nil {
+		if err := s.startReading(ristore); err != nil {
 			return "", err
 		}
+		defer ristore.Unlock()
 		d, err := ristore.BigDataDigest(id, key)
 		if err == nil && d.Validate() == nil {
 			return d, nil
@@ -1585,13 +1920,11 @@ func (s *store) ImageBigData(id, key string) ([]byte, error) {
 		return nil, err
 	}
 	foundImage := false
-	for _, s := range append([]ROImageStore{istore}, istores...) {
-		store := s
-		store.RLock()
-		defer store.Unlock()
-		if err := store.ReloadIfChanged(); err != nil {
+	for _, store := range append([]ROImageStore{istore}, istores...) {
+		if err := s.startReading(store); err != nil {
 			return nil, err
 		}
+		defer store.Unlock()
 		data, err := store.BigData(id, key)
 		if err == nil {
 			return data, nil
@@ -1618,13 +1951,11 @@ func (s *store) ListLayerBigData(id string) ([]string, error) {
 		return nil, err
 	}
 	foundLayer := false
-	for _, s := range append([]ROLayerStore{lstore}, lstores...) {
-		store := s
-		store.RLock()
-		defer store.Unlock()
-		if err := store.ReloadIfChanged(); err != nil {
+	for _, store := range append([]ROLayerStore{lstore}, lstores...) {
+		if err := s.startReading(store); err != nil {
 			return nil, err
 		}
+		defer store.Unlock()
 		data, err := store.BigDataNames(id)
 		if err == nil {
 			return data, nil
@@ -1651,13 +1982,11 @@ func (s *store) LayerBigData(id, key string) (io.ReadCloser, error) {
 		return nil, err
 	}
 	foundLayer := false
-	for _, s := range append([]ROLayerStore{lstore}, lstores...) {
-		store := s
-		store.RLock()
-		defer store.Unlock()
-		if err := store.ReloadIfChanged(); err != nil {
+	for _, store := range append([]ROLayerStore{lstore}, lstores...) {
+		if err := s.startReading(store); err != nil {
 			return nil, err
 		}
+		defer store.Unlock()
 		data, err := store.BigData(id, key)
 		if err == nil {
 			return data, nil
@@ -1680,12 +2009,14 @@ func (s *store) SetLayerBigData(id, key string, data io.Reader) error {
 		return err
 	}
 
-	store.Lock()
-	defer store.Unlock()
-	if err := store.ReloadIfChanged(); err != nil {
+	if err := s.startWriting(store); err != nil {
 		return err
 	}
-	return store.SetBigData(id, key, data)
+	defer store.Unlock()
+	if layerID, err := store.Lookup(id); err == nil {
+		id = layerID
+	}
+	return s.notifyUnlessError(store.SetBigData(id, key, data), Event{Type: EventSetBigData, Object: EventLayer, ID: id, Key: key})
 }
 
 func (s *store) SetImageBigData(id, key string, data []byte, digestManifest func([]byte) (digest.Digest, error)) error {
@@ -1694,16 +2025,22 @@ func (s *store) SetImageBigData(id, key string, data []byte, digestManifest func
 		return err
 	}
 
-	ristore.Lock()
-	defer ristore.Unlock()
-	if err := ristore.ReloadIfChanged(); err != nil {
+	if err := s.startWriting(ristore); err != nil {
 		return err
 	}
+	defer ristore.Unlock()
 
-	return ristore.SetBigData(id, key, data, digestManifest)
+	if imageID, err := ristore.Lookup(id); err == nil {
+		id = imageID
+	}
+	return s.notifyUnlessError(ristore.SetBigData(id, key, data, digestManifest), Event{Type: EventSetBigData, Object: EventImage, ID: id, Key: key})
 }
 
 func (s *store) ImageSize(id string) (int64, error) {
+	return s.ImageSizeWithContext(gocontext.Background(), id)
+}
+
+func (s *store) ImageSizeWithContext(ctx gocontext.Context, id string) (int64, error) {
 	var image *Image
 
 	lstore, err := s.LayerStore()
@@ -1714,13 +2051,11 @@ func (s *store) ImageSize(id string) (int64, error) {
 	if err != nil {
 		return -1, errors.Wrapf(err, "error loading additional layer stores")
 	}
-	for _, s := range append([]ROLayerStore{lstore}, lstores...) {
-		store := s
-		store.RLock()
-		defer store.Unlock()
-		if err := store.ReloadIfChanged(); err != nil {
+	for _, store := range append([]ROLayerStore{lstore}, lstores...) {
+		if err := s.startReading(store); err != nil {
 			return -1, err
 		}
+		defer store.Unlock()
 	}
 
 	var imageStore ROBigDataStore
@@ -1734,13 +2069,11 @@ func (s *store) ImageSize(id string) (int64, error) {
 	}
 
 	// Look for the image's record.
-	for _, s := range append([]ROImageStore{istore}, istores...) {
-		store := s
-		store.RLock()
-		defer store.Unlock()
-		if err := store.ReloadIfChanged(); err != nil {
+	for _, store := range append([]ROImageStore{istore}, istores...) {
+		if err := s.startReading(store); err != nil {
 			return -1, err
 		}
+		defer store.Unlock()
 		if image, err = store.Get(id); err == nil {
 			imageStore = store
 			break
@@ -1766,6 +2099,9 @@ func (s *store) ImageSize(id string) (int64, error) {
 			if _, ok := visited[layerID]; ok {
 				continue
 			}
+			if err := ctx.Err(); err != nil {
+				return -1, err
+			}
 			visited[layerID] = struct{}{}
 			// Look for the layer and the store that knows about it.
 			var layerStore ROLayerStore
@@ -1822,13 +2158,11 @@ func (s *store) ContainerSize(id string) (int64, error) {
 	if err != nil {
 		return -1, err
 	}
-	for _, s := range append([]ROLayerStore{lstore}, lstores...) {
-		store := s
-		store.RLock()
-		defer store.Unlock()
-		if err := store.ReloadIfChanged(); err != nil {
+	for _, store := range append([]ROLayerStore{lstore}, lstores...) {
+		if err := s.startReading(store); err != nil {
 			return -1, err
 		}
+		defer store.Unlock()
 	}
 
 	// Get the location of the container directory and container run directory.
@@ -1846,11 +2180,10 @@ func (s *store) ContainerSize(id string) (int64, error) {
 	if err != nil {
 		return -1, err
 	}
-	rcstore.RLock()
-	defer rcstore.Unlock()
-	if err := rcstore.ReloadIfChanged(); err != nil {
+	if err := s.startReading(rcstore); err != nil {
 		return -1, err
 	}
+	defer rcstore.Unlock()
 
 	// Read the container record.
 	container, err := rcstore.Get(id)
@@ -1908,11 +2241,10 @@ func (s *store) ListContainerBigData(id string) ([]string, error) {
 		return nil, err
 	}
 
-	rcstore.RLock()
-	defer rcstore.Unlock()
-	if err := rcstore.ReloadIfChanged(); err != nil {
+	if err := s.startReading(rcstore); err != nil {
 		return nil, err
 	}
+	defer rcstore.Unlock()
 
 	return rcstore.BigDataNames(id)
 }
@@ -1922,11 +2254,10 @@ func (s *store) ContainerBigDataSize(id, key string) (int64, error) {
 	if err != nil {
 		return -1, err
 	}
-	rcstore.RLock()
-	defer rcstore.Unlock()
-	if err := rcstore.ReloadIfChanged(); err != nil {
+	if err := s.startReading(rcstore); err != nil {
 		return -1, err
 	}
+	defer rcstore.Unlock()
 	return rcstore.BigDataSize(id, key)
 }
 
@@ -1935,11 +2266,10 @@ func (s *store) ContainerBigDataDigest(id, key string) (digest.Digest, error) {
 	if err != nil {
 		return "", err
 	}
-	rcstore.RLock()
-	defer rcstore.Unlock()
-	if err := rcstore.ReloadIfChanged(); err != nil {
+	if err := s.startReading(rcstore); err != nil {
 		return "", err
 	}
+	defer rcstore.Unlock()
 	return rcstore.BigDataDigest(id, key)
 }
 
@@ -1948,11 +2278,10 @@ func (s *store) ContainerBigData(id, key string) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
-	rcstore.RLock()
-	defer rcstore.Unlock()
-	if err := rcstore.ReloadIfChanged(); err != nil {
+	if err := s.startReading(rcstore); err != nil {
 		return nil, err
 	}
+	defer rcstore.Unlock()
 	return rcstore.BigData(id, key)
 }
 
@@ -1961,12 +2290,14 @@ func (s *store) SetContainerBigData(id, key string, data []byte) error {
 	if err != nil {
 		return err
 	}
-	rcstore.Lock()
-	defer rcstore.Unlock()
-	if err := rcstore.ReloadIfChanged(); err != nil {
+	if err := s.startWriting(rcstore); err != nil {
 		return err
 	}
-	return rcstore.SetBigData(id, key, data)
+	defer rcstore.Unlock()
+	if containerID, err := rcstore.Lookup(id); err == nil {
+		id = containerID
+	}
+	return s.notifyUnlessError(rcstore.SetBigData(id, key, data), Event{Type: EventSetBigData, Object: EventContainer, ID: id, Key: key})
 }
 
 func (s *store) Exists(id string) bool {
@@ -1978,13 +2309,11 @@ func (s *store) Exists(id string) bool {
 	if err != nil {
 		return false
 	}
-	for _, s := range append([]ROLayerStore{lstore}, lstores...) {
-		store := s
-		store.RLock()
-		defer store.Unlock()
-		if err := store.ReloadIfChanged(); err != nil {
+	for _, store := range append([]ROLayerStore{lstore}, lstores...) {
+		if err := s.startReading(store); err != nil {
 			return false
 		}
+		defer store.Unlock()
 		if store.Exists(id) {
 			return true
 		}
@@ -1998,13 +2327,11 @@ func (s *store) Exists(id string) bool {
 	if err != nil {
 		return false
 	}
-	for _, s := range append([]ROImageStore{istore}, istores...) {
-		store := s
-		store.RLock()
-		defer store.Unlock()
-		if err := store.ReloadIfChanged(); err != nil {
+	for _, store := range append([]ROImageStore{istore}, istores...) {
+		if err := s.startReading(store); err != nil {
 			return false
 		}
+		defer store.Unlock()
 		if store.Exists(id) {
 			return true
 		}
@@ -2014,11 +2341,10 @@ func (s *store) Exists(id string) bool {
 	if err != nil {
 		return false
 	}
-	rcstore.RLock()
-	defer rcstore.Unlock()
-	if err := rcstore.ReloadIfChanged(); err != nil {
+	if err := s.startReading(rcstore); err != nil {
 		return false
 	}
+	defer rcstore.Unlock()
 	if rcstore.Exists(id) {
 		return true
 	}
@@ -2045,26 +2371,30 @@ func (s *store) SetNames(id string, names []string) error {
 	if err != nil {
 		return err
 	}
-	rlstore.Lock()
-	defer rlstore.Unlock()
-	if err := rlstore.ReloadIfChanged(); err != nil {
+	if err := s.startWriting(rlstore); err != nil {
 		return err
 	}
+	defer rlstore.Unlock()
 	if rlstore.Exists(id) {
-		return rlstore.SetNames(id, deduped)
+		if layerID, err := rlstore.Lookup(id); err == nil {
+			id = layerID
+		}
+		return s.notifyUnlessError(rlstore.SetNames(id, deduped), Event{Type: EventRename, Object: EventLayer, ID: id, Names: deduped})
 	}
 
 	ristore, err := s.ImageStore()
 	if err != nil {
 		return err
 	}
-	ristore.Lock()
-	defer ristore.Unlock()
-	if err := ristore.ReloadIfChanged(); err != nil {
+	if err := s.startWriting(ristore); err != nil {
 		return err
 	}
+	defer ristore.Unlock()
 	if ristore.Exists(id) {
-		return ristore.SetNames(id, deduped)
+		if imageID, err := ristore.Lookup(id); err == nil {
+			id = imageID
+		}
+		return s.notifyUnlessError(ristore.SetNames(id, deduped), Event{Type: EventRename, Object: EventImage, ID: id, Names: deduped})
 	}
 
 	// Check is id refers to a RO Store
@@ -2072,13 +2402,12 @@ func (s *store) SetNames(id string, names []string) error {
 	if err != nil {
 		return err
 	}
-	for _, s := range ristores {
-		store := s
-		store.RLock()
-		defer store.Unlock()
-		if err := store.ReloadIfChanged(); err != nil {
+	for _, rs := range ristores {
+		store := rs
+		if err := s.startReading(store); err != nil {
 			return err
 		}
+		defer store.Unlock()
 		if i, err := store.Get(id); err == nil {
 			if len(deduped) > 1 {
 				// Do not want to create image name in R/W storage
@@ -2086,7 +2415,7 @@ func (s *store) SetNames(id string, names []string) error {
 			}
 			_, err := ristore.Create(id, deduped, i.TopLayer, i.Metadata, i.Created, i.Digest)
 			if err == nil {
-				return ristore.Save()
+				return s.notifyUnlessError(ristore.Save(), Event{Type: EventRename, Object: EventImage, ID: i.ID, Names: deduped})
 			}
 			return err
 		}
@@ -2096,13 +2425,15 @@ func (s *store) SetNames(id string, names []string) error {
 	if err != nil {
 		return err
 	}
-	rcstore.Lock()
-	defer rcstore.Unlock()
-	if err := rcstore.ReloadIfChanged(); err != nil {
+	if err := s.startWriting(rcstore); err != nil {
 		return err
 	}
+	defer rcstore.Unlock()
 	if rcstore.Exists(id) {
-		return rcstore.SetNames(id, deduped)
+		if containerID, err := rcstore.Lookup(id); err == nil {
+			id = containerID
+		}
+		return s.notifyUnlessError(rcstore.SetNames(id, deduped), Event{Type: EventRename, Object: EventContainer, ID: id, Names: deduped})
 	}
 	return ErrLayerUnknown
 }
@@ -2116,13 +2447,11 @@ func (s *store) Names(id string) ([]string, error) {
 	if err != nil {
 		return nil, err
 	}
-	for _, s := range append([]ROLayerStore{lstore}, lstores...) {
-		store := s
-		store.RLock()
-		defer store.Unlock()
-		if err := store.ReloadIfChanged(); err != nil {
+	for _, store := range append([]ROLayerStore{lstore}, lstores...) {
+		if err := s.startReading(store); err != nil {
 			return nil, err
 		}
+		defer store.Unlock()
 		if l, err := store.Get(id); l != nil && err == nil {
 			return l.Names, nil
 		}
@@ -2136,13 +2465,11 @@ func (s *store) Names(id string) ([]string, error) {
 	if err != nil {
 		return nil, err
 	}
-	for _, s := range append([]ROImageStore{istore}, istores...) {
-		store := s
-		store.RLock()
-		defer store.Unlock()
-		if err := store.ReloadIfChanged(); err != nil {
+	for _, store := range append([]ROImageStore{istore}, istores...) {
+		if err := s.startReading(store); err != nil {
 			return nil, err
 		}
+		defer store.Unlock()
 		if i, err := store.Get(id); i != nil && err == nil {
 			return i.Names, nil
 		}
@@ -2152,11 +2479,10 @@ func (s *store) Names(id string) ([]string, error) {
 	if err != nil {
 		return nil, err
 	}
-	rcstore.RLock()
-	defer rcstore.Unlock()
-	if err := rcstore.ReloadIfChanged(); err != nil {
+	if err := s.startReading(rcstore); err != nil {
 		return nil, err
 	}
+	defer rcstore.Unlock()
 	if c, err := rcstore.Get(id); c != nil && err == nil {
 		return c.Names, nil
 	}
@@ -2172,13 +2498,11 @@ func (s *store) Lookup(name string) (string, error) {
 	if err != nil {
 		return "", err
 	}
-	for _, s := range append([]ROLayerStore{lstore}, lstores...) {
-		store := s
-		store.RLock()
-		defer store.Unlock()
-		if err := store.ReloadIfChanged(); err != nil {
+	for _, store := range append([]ROLayerStore{lstore}, lstores...) {
+		if err := s.startReading(store); err != nil {
 			return "", err
 		}
+		defer store.Unlock()
 		if l, err := store.Get(name); l != nil && err == nil {
 			return l.ID, nil
 		}
@@ -2192,13 +2516,11 @@ func (s *store) Lookup(name string) (string, error) {
 	if err != nil {
 		return "", err
 	}
-	for _, s := range append([]ROImageStore{istore}, istores...) {
-		store := s
-		store.RLock()
-		defer store.Unlock()
-		if err := store.ReloadIfChanged(); err != nil {
+	for _, store := range append([]ROImageStore{istore}, istores...) {
+		if err := s.startReading(store); err != nil {
 			return "", err
 		}
+		defer store.Unlock()
 		if i, err := store.Get(name); i != nil && err == nil {
 			return i.ID, nil
 		}
@@ -2208,11 +2530,10 @@ func (s *store) Lookup(name string) (string, error) {
 	if err != nil {
 		return "", err
 	}
-	cstore.RLock()
-	defer cstore.Unlock()
-	if err := cstore.ReloadIfChanged(); err != nil {
+	if err := s.startReading(cstore); err != nil {
 		return "", err
 	}
+	defer cstore.Unlock()
 	if c, err := cstore.Get(name); c != nil && err == nil {
 		return c.ID, nil
 	}
@@ -2221,6 +2542,10 @@ func (s *store) Lookup(name string) (string, error) {
 }
 
 func (s *store) DeleteLayer(id string) error {
+	return s.DeleteLayerWithOptions(id, nil)
+}
+
+func (s *store) DeleteLayerWithOptions(id string, options *DeleteOptions) error {
 	rlstore, err := s.LayerStore()
 	if err != nil {
 		return err
@@ -2234,25 +2559,32 @@ func (s *store) DeleteLayer(id string) error {
 		return err
 	}
 
-	rlstore.Lock()
+	if err := s.startWriting(rlstore); err != nil {
+		return err
+	}
 	defer rlstore.Unlock()
-	if err := rlstore.ReloadIfChanged(); err != nil {
+	if err := s.startWriting(ristore); err != nil {
 		return err
 	}
-	ristore.Lock()
 	defer ristore.Unlock()
-	if err := ristore.ReloadIfChanged(); err != nil {
+	if err := s.startWriting(rcstore); err != nil {
 		return err
 	}
-	rcstore.Lock()
 	defer rcstore.Unlock()
-	if err := rcstore.ReloadIfChanged(); err != nil {
-		return err
-	}
 
 	if rlstore.Exists(id) {
-		if l, err := rlstore.Get(id); err != nil {
+		if l, err := rlstore.Get(id); err == nil {
 			id = l.ID
+			if isPinned(l.Flags) && !ignorePins(options) {
+				return errors.Wrapf(ErrLayerPinned, "layer %v", id)
+			}
+		}
+		leasedLayers, _, err := s.leasedItems()
+		if err != nil {
+			return err
+		}
+		if leasedLayers[id] {
+			return errors.Wrapf(ErrLayerLeased, "layer %v", id)
 		}
 		layers, err := rlstore.Layers()
 		if err != nil {
@@ -2291,6 +2623,7 @@ func (s *store) DeleteLayer(id string) error {
 		if err := rlstore.Delete(id); err != nil {
 			return errors.Wrapf(err, "delete layer %v", id)
 		}
+		s.notify(Event{Type: EventDelete, Object: EventLayer, ID: id})
 
 		// The check here is used to avoid iterating the images if we don't need to.
 		// There is already a check above for the imageStore to be writeable when the layer is part of MappedTopLayers.
@@ -2309,6 +2642,10 @@ func (s *store) DeleteLayer(id string) error {
 }
 
 func (s *store) DeleteImage(id string, commit bool) (layers []string, err error) {
+	return s.DeleteImageWithOptions(id, commit, nil)
+}
+
+func (s *store) DeleteImageWithOptions(id string, commit bool, options *DeleteOptions) (layers []string, err error) {
 	rlstore, err := s.LayerStore()
 	if err != nil {
 		return nil, err
@@ -2322,21 +2659,18 @@ func (s *store) DeleteImage(id string, commit bool) (layers []string, err error)
 		return nil, err
 	}
 
-	rlstore.Lock()
+	if err := s.startWriting(rlstore); err != nil {
+		return nil, err
+	}
 	defer rlstore.Unlock()
-	if err := rlstore.ReloadIfChanged(); err != nil {
+	if err := s.startWriting(ristore); err != nil {
 		return nil, err
 	}
-	ristore.Lock()
 	defer ristore.Unlock()
-	if err := ristore.ReloadIfChanged(); err != nil {
+	if err := s.startWriting(rcstore); err != nil {
 		return nil, err
 	}
-	rcstore.Lock()
 	defer rcstore.Unlock()
-	if err := rcstore.ReloadIfChanged(); err != nil {
-		return nil, err
-	}
 	layersToRemove := []string{}
 	if ristore.Exists(id) {
 		image, err := ristore.Get(id)
@@ -2344,6 +2678,16 @@ func (s *store) DeleteImage(id string, commit bool) (layers []string, err error)
 			return nil, err
 		}
 		id = image.ID
+		if isPinned(image.Flags) && !ignorePins(options) {
+			return nil, errors.Wrapf(ErrImagePinned, "image %v", id)
+		}
+		leasedLayers, leasedImages, err := s.leasedItems()
+		if err != nil {
+			return nil, err
+		}
+		if leasedImages[id] {
+			return nil, errors.Wrapf(ErrImageLeased, "image %v", id)
+		}
 		containers, err := rcstore.Containers()
 		if err != nil {
 			return nil, err
@@ -2386,6 +2730,7 @@ func (s *store) DeleteImage(id string, commit bool) (layers []string, err error)
 			if err = ristore.Delete(id); err != nil {
 				return nil, err
 			}
+			s.notify(Event{Type: EventDelete, Object: EventImage, ID: id})
 		}
 		layer := image.TopLayer
 		lastRemoved := ""
@@ -2396,8 +2741,14 @@ func (s *store) DeleteImage(id string, commit bool) (layers []string, err error)
 			if _, ok := otherImagesByTopLayer[layer]; ok {
 				break
 			}
+			if leasedLayers[layer] {
+				break
+			}
 			parent := ""
 			if l, err := rlstore.Get(layer); err == nil {
+				if isPinned(l.Flags) && !ignorePins(options) {
+					break
+				}
 				parent = l.Parent
 			}
 			hasOtherRefs := func() bool {
@@ -2435,6 +2786,7 @@ func (s *store) DeleteImage(id string, commit bool) (layers []string, err error)
 			if err = rlstore.Delete(layer); err != nil {
 				return nil, err
 			}
+			s.notify(Event{Type: EventDelete, Object: EventLayer, ID: layer})
 		}
 	}
 	return layersToRemove, nil
@@ -2454,21 +2806,18 @@ func (s *store) DeleteContainer(id string) error {
 		return err
 	}
 
-	rlstore.Lock()
+	if err := s.startWriting(rlstore); err != nil {
+		return err
+	}
 	defer rlstore.Unlock()
-	if err := rlstore.ReloadIfChanged(); err != nil {
+	if err := s.startWriting(ristore); err != nil {
 		return err
 	}
-	ristore.Lock()
 	defer ristore.Unlock()
-	if err := ristore.ReloadIfChanged(); err != nil {
+	if err := s.startWriting(rcstore); err != nil {
 		return err
 	}
-	rcstore.Lock()
 	defer rcstore.Unlock()
-	if err := rcstore.ReloadIfChanged(); err != nil {
-		return err
-	}
 
 	if rcstore.Exists(id) {
 		if container, err := rcstore.Get(id); err == nil {
@@ -2513,7 +2862,9 @@ func (s *store) DeleteContainer(id string) error {
 				select {
 				case err, ok := <-errChan:
 					if !ok {
-						return multierror.Append(nil, errors...).ErrorOrNil()
+						return s.notifyUnlessError(multierror.Append(nil, errors...).ErrorOrNil(),
+							Event{Type: EventDelete, Object: EventContainer, ID: container.ID},
+							Event{Type: EventDelete, Object: EventLayer, ID: container.LayerID})
 					}
 					if err != nil {
 						errors = append(errors, err)
@@ -2526,6 +2877,10 @@ func (s *store) DeleteContainer(id string) error {
 }
 
 func (s *store) Delete(id string) error {
+	return s.DeleteWithOptions(id, nil)
+}
+
+func (s *store) DeleteWithOptions(id string, options *DeleteOptions) error {
 	rlstore, err := s.LayerStore()
 	if err != nil {
 		return err
@@ -2539,21 +2894,18 @@ func (s *store) Delete(id string) error {
 		return err
 	}
 
-	rlstore.Lock()
+	if err := s.startWriting(rlstore); err != nil {
+		return err
+	}
 	defer rlstore.Unlock()
-	if err := rlstore.ReloadIfChanged(); err != nil {
+	if err := s.startWriting(ristore); err != nil {
 		return err
 	}
-	ristore.Lock()
 	defer ristore.Unlock()
-	if err := ristore.ReloadIfChanged(); err != nil {
+	if err := s.startWriting(rcstore); err != nil {
 		return err
 	}
-	rcstore.Lock()
 	defer rcstore.Unlock()
-	if err := rcstore.ReloadIfChanged(); err != nil {
-		return err
-	}
 
 	if rcstore.Exists(id) {
 		if container, err := rcstore.Get(id); err == nil {
@@ -2573,21 +2925,61 @@ func (s *store) Delete(id string) error {
 				if err = os.RemoveAll(rcpath); err != nil {
 					return err
 				}
+				s.notify(Event{Type: EventDelete, Object: EventContainer, ID: container.ID},
+					Event{Type: EventDelete, Object: EventLayer, ID: container.LayerID})
 				return nil
 			}
 			return ErrNotALayer
 		}
 	}
+	leasedLayers, leasedImages, err := s.leasedItems()
+	if err != nil {
+		return err
+	}
 	if ristore.Exists(id) {
-		return ristore.Delete(id)
+		if image, err := ristore.Get(id); err == nil {
+			id = image.ID
+			if isPinned(image.Flags) && !ignorePins(options) {
+				return errors.Wrapf(ErrImagePinned, "image %v", id)
+			}
+		}
+		if leasedImages[id] {
+			return errors.Wrapf(ErrImageLeased, "image %v", id)
+		}
+		return s.notifyUnlessError(ristore.Delete(id), Event{Type: EventDelete, Object: EventImage, ID: id})
 	}
 	if rlstore.Exists(id) {
-		return rlstore.Delete(id)
+		if layer, err := rlstore.Get(id); err == nil {
+			id = layer.ID
+			if isPinned(layer.Flags) && !ignorePins(options) {
+				return errors.Wrapf(ErrLayerPinned, "layer %v", id)
+			}
+		}
+		layers, err := rlstore.Layers()
+		if err != nil {
+			return err
+		}
+		images, err := ristore.Images()
+		if err != nil {
+			return err
+		}
+		if protectedLayers(layers, images, leasedLayers, leasedImages)[id] {
+			return errors.Wrapf(ErrLayerLeased, "layer %v", id)
+		}
+		return s.notifyUnlessError(rlstore.Delete(id), Event{Type: EventDelete, Object: EventLayer, ID: id})
 	}
 	return ErrLayerUnknown
 }
 
 func (s *store) Wipe() error {
+	return s.WipeWithContext(gocontext.Background())
+}
+
+func (s *store) WipeWithContext(ctx gocontext.Context) error {
+	return s.WipeWithOptions(ctx, nil)
+}
+
+func (s *store) WipeWithOptions(ctx gocontext.Context, options *DeleteOptions) error {
 	rcstore, err := s.ContainerStore()
 	if err != nil {
 		return err
@@ -2601,29 +2993,102 @@ func (s *store) Wipe() error {
 		return err
 	}
 
-	rlstore.Lock()
+	if err := s.startWriting(rlstore); err != nil {
+		return err
+	}
 	defer rlstore.Unlock()
-	if err := rlstore.ReloadIfChanged(); err != nil {
+	if err := s.startWriting(ristore); err != nil {
 		return err
 	}
-	ristore.Lock()
 	defer ristore.Unlock()
-	if err := ristore.ReloadIfChanged(); err != nil {
+	if err := s.startWriting(rcstore); err != nil {
 		return err
 	}
-	rcstore.Lock()
 	defer rcstore.Unlock()
-	if err := rcstore.ReloadIfChanged(); err != nil {
+
+	// Refuse to remove anything if something is pinned.
+	images, err := ristore.Images()
+	if err != nil {
 		return err
 	}
+	layers, err := rlstore.Layers()
+	if err != nil {
+		return err
+	}
+	if !ignorePins(options) {
+		for _, image := range images {
+			if isPinned(image.Flags) {
+				return errors.Wrapf(ErrImagePinned, "image %v", image.ID)
+			}
+		}
+		for _, layer := range layers {
+			if isPinned(layer.Flags) {
+				return errors.Wrapf(ErrLayerPinned, "layer %v", layer.ID)
+			}
+		}
+	}
 
-	if err = rcstore.Wipe(); err != nil {
+	// Remove things one at a time, so that we can stop in between, and
+	// so that we can leave the things that are protected by leases, and
+	// layers which are still being written.
+	var events []Event
+	defer func() {
+		s.notify(events...)
+	}()
+	leasedLayers, leasedImages, err := s.leasedItems()
+	if err != nil {
 		return err
 	}
-	if err = ristore.Wipe(); err != nil {
+	containers, err := rcstore.Containers()
+	if err != nil {
 		return err
 	}
-	return rlstore.Wipe()
+	for _, container := range containers {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := rcstore.Delete(container.ID); err != nil {
+			return err
+		}
+		events = append(events, Event{Type: EventDelete, Object: EventContainer, ID: container.ID})
+	}
+	for _, image := range images {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if leasedImages[image.ID] {
+			continue
+		}
+		if err := ristore.Delete(image.ID); err != nil {
+			return err
+		}
+		events = append(events, Event{Type: EventDelete, Object: EventImage, ID: image.ID})
+	}
+	keepLayers := make(map[string]bool)
+	for id := range leasedLayers {
+		keepLayers[id] = true
+	}
+	for _, layer := range layers {
+		if isIncomplete(layer.Flags) && rlstore.(*layerStore).isBeingWritten(layer.ID) {
+			keepLayers[layer.ID] = true
+		}
+	}
+	protected := protectedLayers(layers, images, keepLayers, leasedImages)
+	// Layers are listed in the order they were created in, so this
+	// removes children before their parents.
+	for i := len(layers) - 1; i >= 0; i-- {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if protected[layers[i].ID] {
+			continue
+		}
+		if err := rlstore.Delete(layers[i].ID); err != nil {
+			return err
+		}
+		events = append(events, Event{Type: EventDelete, Object: EventLayer, ID: layers[i].ID})
+	}
+	return nil
 }
 
 func (s *store) Status() ([][2]string, error) {
@@ -2644,13 +3109,14 @@ func (s *store) mount(id string, options context.MountOpts) (string, error) {
 		return "", err
 	}
 
-	s.graphLock.Lock()
+	if err := s.lock(s.graphLock); err != nil {
+		return "", err
+	}
 	defer s.graphLock.Unlock()
-	rlstore.Lock()
-	defer rlstore.Unlock()
-	if err := rlstore.ReloadIfChanged(); err != nil {
+	if err := s.startWriting(rlstore); err != nil {
 		return "", err
 	}
+	defer rlstore.Unlock()
 
 	modified, err := s.graphLock.Modified()
 	if err != nil {
@@ -2673,7 +3139,15 @@ func (s *store) mount(id string, options context.MountOpts) (string, error) {
 	}
 
 	if rlstore.Exists(id) {
-		return rlstore.Mount(id, options)
+		if layerID, err := rlstore.Lookup(id); err == nil {
+			id = layerID
+		}
+		mountPoint, err := rlstore.Mount(id, options)
+		if err == nil {
+			touchLayer(rlstore, id, time.Now().UTC())
+			s.notify(Event{Type: EventMount, Object: EventLayer, ID: id})
+		}
+		return mountPoint, err
 	}
 	return "", ErrLayerUnknown
 }
@@ -2693,7 +3167,17 @@ func (s *store) MountImage(id string, mountOpts []string, mountLabel string) (st
 		Options:    append(mountOpts, "ro"),
 	}
 
-	return s.mount(img.TopLayer, options)
+	mountPoint, err := s.mount(img.TopLayer, options)
+	if err != nil {
+		return "", err
+	}
+	if ristore, err := s.ImageStore(); err == nil {
+		if err := s.startWriting(ristore); err == nil {
+			defer ristore.Unlock()
+			touchImage(ristore, img.ID, time.Now().UTC())
+		}
+	}
+	return mountPoint, nil
 }
 
 func (s *store) Mount(id, mountLabel string) (string, error) {
@@ -2712,6 +3196,11 @@ func (s *store) Mount(id, mountLabel string) (string, error) {
 				options.Volatile = v.(bool)
 			}
 		}
+		mountPoint, err := s.mount(id, options)
+		if err == nil {
+			s.notify(Event{Type: EventMount, Object: EventContainer, ID: container.ID})
+		}
+		return mountPoint, err
 	}
 	return s.mount(id, options)
 }
@@ -2724,11 +3213,10 @@ func (s *store) Mounted(id string) (int, error) {
 	if err != nil {
 		return 0, err
 	}
-	rlstore.RLock()
-	defer rlstore.Unlock()
-	if err := rlstore.ReloadIfChanged(); err != nil {
+	if err := s.startReading(rlstore); err != nil {
 		return 0, err
 	}
+	defer rlstore.Unlock()
 
 	return rlstore.Mounted(id)
 }
@@ -2742,20 +3230,34 @@ func (s *store) UnmountImage(id string, force bool) (bool, error) {
 }
 
 func (s *store) Unmount(id string, force bool) (bool, error) {
-	if layerID, err := s.ContainerLayerID(id); err == nil {
-		id = layerID
+	containerID := ""
+	if container, err := s.Container(id); err == nil {
+		id = container.LayerID
+		containerID = container.ID
 	}
 	rlstore, err := s.LayerStore()
 	if err != nil {
 		return false, err
 	}
-	rlstore.Lock()
-	defer rlstore.Unlock()
-	if err := rlstore.ReloadIfChanged(); err != nil {
+	if err := s.startWriting(rlstore); err != nil {
 		return false, err
 	}
+	defer rlstore.Unlock()
 	if rlstore.Exists(id) {
-		return rlstore.Unmount(id, force)
+		if layerID, err := rlstore.Lookup(id); err == nil {
+			id = layerID
+		}
+		unmounted, err := rlstore.Unmount(id, force)
+		if err == nil && !unmounted {
+			// Only report the unmount once the last user of the
+			// mount is done with it.
+			events := []Event{{Type: EventUnmount, Object: EventLayer, ID: id}}
+			if containerID != "" {
+				events = append(events, Event{Type: EventUnmount, Object: EventContainer, ID: containerID})
+			}
+			s.notify(events...)
+		}
+		return unmounted, err
 	}
 	return false, ErrLayerUnknown
 }
@@ -2769,13 +3271,11 @@ func (s *store) Changes(from, to string) ([]archive.Change, error) {
 	if err != nil {
 		return nil, err
 	}
-	for _, s := range append([]ROLayerStore{lstore}, lstores...) {
-		store := s
-		store.RLock()
-		defer store.Unlock()
-		if err := store.ReloadIfChanged(); err != nil {
+	for _, store := range append([]ROLayerStore{lstore}, lstores...) {
+		if err := s.startReading(store); err != nil {
 			return nil, err
 		}
+		defer store.Unlock()
 		if store.Exists(to) {
 			return store.Changes(from, to)
 		}
@@ -2792,13 +3292,11 @@ func (s *store) DiffSize(from, to string) (int64, error) {
 	if err != nil {
 		return -1, err
 	}
-	for _, s := range append([]ROLayerStore{lstore}, lstores...) {
-		store := s
-		store.RLock()
-		defer store.Unlock()
-		if err := store.ReloadIfChanged(); err != nil {
+	for _, store := range append([]ROLayerStore{lstore}, lstores...) {
+		if err := s.startReading(store); err != nil {
 			return -1, err
 		}
+		defer store.Unlock()
 		if store.Exists(to) {
 			return store.DiffSize(from, to)
 		}
@@ -2807,6 +3305,10 @@ func (s *store) DiffSize(from, to string) (int64, error) {
 }
 
 func (s *store) Diff(from, to string, options *DiffOptions) (io.ReadCloser, error) {
+	return s.DiffWithContext(gocontext.Background(), from, to, options)
+}
+
+func (s *store) DiffWithContext(ctx gocontext.Context, from, to string, options *DiffOptions) (io.ReadCloser, error) {
 	lstore, err := s.LayerStore()
 	if err != nil {
 		return nil, err
@@ -2815,10 +3317,8 @@ func (s *store) Diff(from, to string, options *DiffOptions) (io.ReadCloser, erro
 	if err != nil {
 		return nil, err
 	}
-	for _, s := range append([]ROLayerStore{lstore}, lstores...) {
-		store := s
-		store.RLock()
-		if err := store.ReloadIfChanged(); err != nil {
+	for _, store := range append([]ROLayerStore{lstore}, lstores...) {
+		if err := s.startReading(store); err != nil {
 			return nil, err
 		}
 		if store.Exists(to) {
@@ -2829,6 +3329,9 @@ func (s *store) Diff(from, to string, options *DiffOptions) (io.ReadCloser, erro
 					store.Unlock()
 					return err
 				})
+				if ctx.Done() != nil {
+					return ioutils.NewCancelReadCloser(ctx, wrapped), nil
+				}
 				return wrapped, nil
 			}
 			store.Unlock()
@@ -2844,13 +3347,10 @@ func (s *store) ApplyDiffFromStagingDirectory(to, stagingDirectory string, diffO
 	if err != nil {
 		return err
 	}
-	rlstore.Lock()
-	defer rlstore.Unlock()
-	if modified, err := rlstore.Modified(); modified || err != nil {
-		if err = rlstore.Load(); err != nil {
-			return err
-		}
+	if err := s.startWriting(rlstore); err != nil {
+		return err
 	}
+	defer rlstore.Unlock()
 	if !rlstore.Exists(to) {
 		return ErrLayerUnknown
 	}
@@ -2862,13 +3362,10 @@ func (s *store) CleanupStagingDirectory(stagingDirectory string) error {
 	if err != nil {
 		return err
 	}
-	rlstore.Lock()
-	defer rlstore.Unlock()
-	if modified, err := rlstore.Modified(); modified || err != nil {
-		if err = rlstore.Load(); err != nil {
-			return err
-		}
+	if err := s.startWriting(rlstore); err != nil {
+		return err
 	}
+	defer rlstore.Unlock()
 	return rlstore.CleanupStagingDirectory(stagingDirectory)
 }
 
@@ -2877,13 +3374,10 @@ func (s *store) ApplyDiffWithDiffer(to string, options *context.ApplyDiffOpts, d
 	if err != nil {
 		return nil, err
 	}
-	rlstore.Lock()
-	defer rlstore.Unlock()
-	if modified, err := rlstore.Modified(); modified || err != nil {
-		if err = rlstore.Load(); err != nil {
-			return nil, err
-		}
+	if err := s.startWriting(rlstore); err != nil {
+		return nil, err
 	}
+	defer rlstore.Unlock()
 	if to != "" && !rlstore.Exists(to) {
 		return nil, ErrLayerUnknown
 	}
@@ -2895,13 +3389,10 @@ func (s *store) DifferTarget(id string) (string, error) {
 	if err != nil {
 		return "", err
 	}
-	rlstore.Lock()
-	defer rlstore.Unlock()
-	if modified, err := rlstore.Modified(); modified || err != nil {
-		if err = rlstore.Load(); err != nil {
-			return "", err
-		}
+	if err := s.startWriting(rlstore); err != nil {
+		return "", err
 	}
+	defer rlstore.Unlock()
 	if rlstore.Exists(id) {
 		return rlstore.DifferTarget(id)
 	}
@@ -2909,17 +3400,27 @@ func (s *store) DifferTarget(id string) (string, error) {
 }
 
 func (s *store) ApplyDiff(to string, diff io.Reader) (int64, error) {
+	return s.ApplyDiffWithContext(gocontext.Background(), to, diff)
+}
+
+func (s *store) ApplyDiffWithContext(ctx gocontext.Context, to string, diff io.Reader) (int64, error) {
 	rlstore, err := s.LayerStore()
 	if err != nil {
 		return -1, err
 	}
-	rlstore.Lock()
-	defer rlstore.Unlock()
-	if err := rlstore.ReloadIfChanged(); err != nil {
+	if err := s.startWriting(rlstore); err != nil {
 		return -1, err
 	}
+	defer rlstore.Unlock()
 	if rlstore.Exists(to) {
-		return rlstore.ApplyDiff(to, diff)
+		if ctx.Done() == nil {
+			return rlstore.ApplyDiff(to, diff)
+		}
+		store, ok := rlstore.(*layerStore)
+		if !ok {
+			return -1, ErrNotSupported
+		}
+		return store.applyDiffWithContext(ctx, to, diff)
 	}
 	return -1, ErrLayerUnknown
 }
@@ -2935,13 +3436,11 @@ func (s *store) layersByMappedDigest(m func(ROLayerStore, digest.Digest) ([]Laye
 	if err != nil {
 		return nil, err
 	}
-	for _, s := range append([]ROLayerStore{lstore}, lstores...) {
-		store := s
-		store.RLock()
-		defer store.Unlock()
-		if err := store.ReloadIfChanged(); err != nil {
+	for _, store := range append([]ROLayerStore{lstore}, lstores...) {
+		if err := s.startReading(store); err != nil {
 			return nil, err
 		}
+		defer store.Unlock()
 		storeLayers, err := m(store, d)
 		if err != nil {
 			if errors.Cause(err) != ErrLayerUnknown {
@@ -2980,13 +3479,11 @@ func (s *store) LayerSize(id string) (int64, error) {
 	if err != nil {
 		return -1, err
 	}
-	for _, s := range append([]ROLayerStore{lstore}, lstores...) {
-		store := s
-		store.RLock()
-		defer store.Unlock()
-		if err := store.ReloadIfChanged(); err != nil {
+	for _, store := range append([]ROLayerStore{lstore}, lstores...) {
+		if err := s.startReading(store); err != nil {
 			return -1, err
 		}
+		defer store.Unlock()
 		if store.Exists(id) {
 			return store.Size(id)
 		}
@@ -2999,11 +3496,10 @@ func (s *store) LayerParentOwners(id string) ([]int, []int, error) {
 	if err != nil {
 		return nil, nil, err
 	}
-	rlstore.RLock()
-	defer rlstore.Unlock()
-	if err := rlstore.ReloadIfChanged(); err != nil {
+	if err := s.startReading(rlstore); err != nil {
 		return nil, nil, err
 	}
+	defer rlstore.Unlock()
 	if rlstore.Exists(id) {
 		return rlstore.ParentOwners(id)
 	}
@@ -3019,16 +3515,14 @@ func (s *store) ContainerParentOwners(id string) ([]int, []int, error) {
 	if err != nil {
 		return nil, nil, err
 	}
-	rlstore.RLock()
-	defer rlstore.Unlock()
-	if err := rlstore.ReloadIfChanged(); err != nil {
+	if err := s.startReading(rlstore); err != nil {
 		return nil, nil, err
 	}
-	rcstore.RLock()
-	defer rcstore.Unlock()
-	if err := rcstore.ReloadIfChanged(); err != nil {
+	defer rlstore.Unlock()
+	if err := s.startReading(rcstore); err != nil {
 		return nil, nil, err
 	}
+	defer rcstore.Unlock()
 	container, err := rcstore.Get(id)
 	if err != nil {
 		return nil, nil, err
@@ -3044,9 +3538,10 @@ func (s *store) Layers() ([]Layer, error) {
 	if err != nil {
 		return nil, err
 	}
-	if err := lstore.LoadLocked(); err != nil {
+	if err := s.startWriting(lstore); err != nil {
 		return nil, err
 	}
+	defer lstore.Unlock()
 	layers, err := lstore.Layers()
 	if err != nil {
 		return nil, err
@@ -3057,13 +3552,11 @@ func (s *store) Layers() ([]Layer, error) {
 		return nil, err
 	}
 
-	for _, s := range lstores {
-		store := s
-		store.RLock()
-		defer store.Unlock()
-		if err := store.ReloadIfChanged(); err != nil {
+	for _, store := range lstores {
+		if err := s.startReading(store); err != nil {
 			return nil, err
 		}
+		defer store.Unlock()
 		storeLayers, err := store.Layers()
 		if err != nil {
 			return nil, err
@@ -3084,13 +3577,11 @@ func (s *store) Images() ([]Image, error) {
 	if err != nil {
 		return nil, err
 	}
-	for _, s := range append([]ROImageStore{istore}, istores...) {
-		store := s
-		store.RLock()
-		defer store.Unlock()
-		if err := store.ReloadIfChanged(); err != nil {
+	for _, store := range append([]ROImageStore{istore}, istores...) {
+		if err := s.startReading(store); err != nil {
 			return nil, err
 		}
+		defer store.Unlock()
 		storeImages, err := store.Images()
 		if err != nil {
 			return nil, err
@@ -3106,11 +3597,10 @@ func (s *store) Containers() ([]Container, error) {
 		return nil, err
 	}
 
-	rcstore.RLock()
-	defer rcstore.Unlock()
-	if err := rcstore.ReloadIfChanged(); err != nil {
+	if err := s.startReading(rcstore); err != nil {
 		return nil, err
 	}
+	defer rcstore.Unlock()
 
 	return rcstore.Containers()
 }
@@ -3124,13 +3614,11 @@ func (s *store) Layer(id string) (*Layer, error) {
 	if err != nil {
 		return nil, err
 	}
-	for _, s := range append([]ROLayerStore{lstore}, lstores...) {
-		store := s
-		store.RLock()
-		defer store.Unlock()
-		if err := store.ReloadIfChanged(); err != nil {
+	for _, store := range append([]ROLayerStore{lstore}, lstores...) {
+		if err := s.startReading(store); err != nil {
 			return nil, err
 		}
+		defer store.Unlock()
 		layer, err := store.Get(id)
 		if err == nil {
 			return layer, nil
@@ -3183,11 +3671,10 @@ func (al *additionalLayer) PutAs(id, parent string, names []string) (*Layer, err
 	if err != nil {
 		return nil, err
 	}
-	rlstore.Lock()
-	defer rlstore.Unlock()
-	if err := rlstore.ReloadIfChanged(); err != nil {
+	if err := al.s.startWriting(rlstore); err != nil {
 		return nil, err
 	}
+	defer rlstore.Unlock()
 	rlstores, err := al.s.ROLayerStores()
 	if err != nil {
 		return nil, err
@@ -3197,11 +3684,10 @@ func (al *additionalLayer) PutAs(id, parent string, names []string) (*Layer, err
 	if parent != "" {
 		for _, lstore := range append([]ROLayerStore{rlstore}, rlstores...) {
 			if lstore != rlstore {
-				lstore.RLock()
-				defer lstore.Unlock()
-				if err := lstore.ReloadIfChanged(); err != nil {
+				if err := al.s.startReading(lstore); err != nil {
 					return nil, err
 				}
+				defer lstore.Unlock()
 			}
 			parentLayer, err = lstore.Get(parent)
 			if err == nil {
@@ -3229,13 +3715,11 @@ func (s *store) Image(id string) (*Image, error) {
 	if err != nil {
 		return nil, err
 	}
-	for _, s := range append([]ROImageStore{istore}, istores...) {
-		store := s
-		store.RLock()
-		defer store.Unlock()
-		if err := store.ReloadIfChanged(); err != nil {
+	for _, store := range append([]ROImageStore{istore}, istores...) {
+		if err := s.startReading(store); err != nil {
 			return nil, err
 		}
+		defer store.Unlock()
 		image, err := store.Get(id)
 		if err == nil {
 			return image, nil
@@ -3260,13 +3744,11 @@ func (s *store) ImagesByTopLayer(id string) ([]*Image, error) {
 	if err != nil {
 		return nil, err
 	}
-	for _, s := range append([]ROImageStore{istore}, istores...) {
-		store := s
-		store.RLock()
-		defer store.Unlock()
-		if err := store.ReloadIfChanged(); err != nil {
+	for _, store := range append([]ROImageStore{istore}, istores...) {
+		if err := s.startReading(store); err != nil {
 			return nil, err
 		}
+		defer store.Unlock()
 		imageList, err := store.Images()
 		if err != nil {
 			return nil, err
@@ -3293,11 +3775,10 @@ func (s *store) ImagesByDigest(d digest.Digest) ([]*Image, error) {
 		return nil, err
 	}
 	for _, store := range append([]ROImageStore{istore}, istores...) {
-		store.RLock()
-		defer store.Unlock()
-		if err := store.ReloadIfChanged(); err != nil {
+		if err := s.startReading(store); err != nil {
 			return nil, err
 		}
+		defer store.Unlock()
 		imageList, err := store.ByDigest(d)
 		if err != nil && errors.Cause(err) != ErrImageUnknown {
 			return nil, err
@@ -3312,11 +3793,10 @@ func (s *store) Container(id string) (*Container, error) {
 	if err != nil {
 		return nil, err
 	}
-	rcstore.RLock()
-	defer rcstore.Unlock()
-	if err := rcstore.ReloadIfChanged(); err != nil {
+	if err := s.startReading(rcstore); err != nil {
 		return nil, err
 	}
+	defer rcstore.Unlock()
 
 	return rcstore.Get(id)
 }
@@ -3326,11 +3806,10 @@ func (s *store) ContainerLayerID(id string) (string, error) {
 	if err != nil {
 		return "", err
 	}
-	rcstore.RLock()
-	defer rcstore.Unlock()
-	if err := rcstore.ReloadIfChanged(); err != nil {
+	if err := s.startReading(rcstore); err != nil {
 		return "", err
 	}
+	defer rcstore.Unlock()
 	container, err := rcstore.Get(id)
 	if err != nil {
 		return "", err
@@ -3347,11 +3826,10 @@ func (s *store) ContainerByLayer(id string) (*Container, error) {
 	if err != nil {
 		return nil, err
 	}
-	rcstore.RLock()
-	defer rcstore.Unlock()
-	if err := rcstore.ReloadIfChanged(); err != nil {
+	if err := s.startReading(rcstore); err != nil {
 		return nil, err
 	}
+	defer rcstore.Unlock()
 	containerList, err := rcstore.Containers()
 	if err != nil {
 		return nil, err
@@ -3370,11 +3848,10 @@ func (s *store) ContainerDirectory(id string) (string, error) {
 	if err != nil {
 		return "", err
 	}
-	rcstore.RLock()
-	defer rcstore.Unlock()
-	if err := rcstore.ReloadIfChanged(); err != nil {
+	if err := s.startReading(rcstore); err != nil {
 		return "", err
 	}
+	defer rcstore.Unlock()
 
 	id, err = rcstore.Lookup(id)
 	if err != nil {
@@ -3395,11 +3872,10 @@ func (s *store) ContainerRunDirectory(id string) (string, error) {
 		return "", err
 	}
 
-	rcstore.RLock()
-	defer rcstore.Unlock()
-	if err := rcstore.ReloadIfChanged(); err != nil {
+	if err := s.startReading(rcstore); err != nil {
 		return "", err
 	}
+	defer rcstore.Unlock()
 
 	id, err = rcstore.Lookup(id)
 	if err != nil {
@@ -3463,14 +3939,15 @@ func (s *store) Shutdown(force bool) ([]string, error) {
 		return mounted, err
 	}
 
-	s.graphLock.Lock()
+	if err := s.lock(s.graphLock); err != nil {
+		return mounted, err
+	}
 	defer s.graphLock.Unlock()
 
-	rlstore.Lock()
-	defer rlstore.Unlock()
-	if err := rlstore.ReloadIfChanged(); err != nil {
+	if err := s.startWriting(rlstore); err != nil {
 		return nil, err
 	}
+	defer rlstore.Unlock()
 
 	layers, err := rlstore.Layers()
 	if err != nil {
@@ -3554,6 +4031,14 @@ func copyStringInt64Map(m map[string]int64) map[string]int64 {
 	return ret
 }
 
+func copyStringStringMap(m map[string]string) map[string]string {
+	ret := make(map[string]string, len(m))
+	for k, v := range m {
+		ret[k] = v
+	}
+	return ret
+}
+
 func copyStringDigestMap(m map[string]digest.Digest) map[string]digest.Digest {
 	ret := make(map[string]digest.Digest, len(m))
 	for k, v := range m {
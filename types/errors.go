@@ -17,6 +17,10 @@ var (
 	ErrDuplicateLayerNames = errors.New("read-only layer store assigns the same name to multiple layers")
 	// ErrDuplicateName indicates that a name which is to be assigned to a new item is already being used.
 	ErrDuplicateName = errors.New("that name is already in use")
+	// ErrImageLeased is returned when the caller attempts to delete an image that is attached to a lease.
+	ErrImageLeased = errors.New("image is protected by a lease")
+	// ErrImagePinned is returned when the caller attempts to delete an image that is pinned.
+	ErrImagePinned = errors.New("image is pinned")
 	// ErrImageUnknown indicates that there was no image with the specified name or ID.
 	ErrImageUnknown = errors.New("image not known")
 	// ErrImageUsedByContainer is returned when the caller attempts to delete an image that is a container's image.
@@ -25,18 +29,34 @@ var (
 	ErrIncompleteOptions = errors.New("missing necessary StoreOptions")
 	// ErrInvalidBigDataName indicates that the name for a big data item is not acceptable; it may be empty.
 	ErrInvalidBigDataName = errors.New("not a valid name for a big data item")
+	// ErrInvalidMetadataBackend is returned when the configured metadata backend is not one that we know how to use.
+	ErrInvalidMetadataBackend = errors.New("not a valid metadata backend")
 	// ErrLayerHasChildren is returned when the caller attempts to delete a layer that has children.
 	ErrLayerHasChildren = errors.New("layer has children")
+	// ErrLayerIncomplete is returned when the caller attempts to delete a layer whose contents are still being written.
+	ErrLayerIncomplete = errors.New("layer is still being written")
+	// ErrLayerLeased is returned when the caller attempts to delete a layer that is attached to a lease.
+	ErrLayerLeased = errors.New("layer is protected by a lease")
+	// ErrLayerMounted is returned when the caller attempts to modify a layer in a way which requires that it not be mounted, and it is.
+	ErrLayerMounted = errors.New("layer is mounted")
 	// ErrLayerNotMounted is returned when the requested information can only be computed for a mounted layer, and the layer is not mounted.
 	ErrLayerNotMounted = errors.New("layer is not mounted")
+	// ErrLayerPinned is returned when the caller attempts to delete a layer that is pinned.
+	ErrLayerPinned = errors.New("layer is pinned")
 	// ErrLayerUnknown indicates that there was no layer with the specified name or ID.
 	ErrLayerUnknown = errors.New("layer not known")
 	// ErrLayerUsedByContainer is returned when the caller attempts to delete a layer that is a container's layer.
 	ErrLayerUsedByContainer = errors.New("layer is in use by a container")
 	// ErrLayerUsedByImage is returned when the caller attempts to delete a layer that is an image's top layer.
 	ErrLayerUsedByImage = errors.New("layer is in use by an image")
+	// ErrLeaseUnknown indicates that there was no lease with the specified ID, or that it has expired.
+	ErrLeaseUnknown = errors.New("lease not known")
 	// ErrLoadError indicates that there was an initialization error.
 	ErrLoadError = errors.New("error loading storage metadata")
+	// ErrLockTimeout is returned when a lock could not be acquired before the configured lock timeout passed.
+	ErrLockTimeout = errors.New("timed out waiting for a lock")
+	// ErrMetadataVersion is returned when the caller attempts to modify metadata which is stored in a newer format than we know how to write, or to convert metadata to a format we do not know.
+	ErrMetadataVersion = errors.New("unsupported metadata format version")
 	// ErrNotAContainer is returned when the caller attempts to delete a container that isn't a container.
 	ErrNotAContainer = errors.New("identifier is not a container")
 	// ErrNotALayer is returned when the caller attempts to delete a layer that isn't a layer.
@@ -162,6 +162,13 @@ type StoreOptions struct {
 	PullOptions map[string]string `toml:"pull_options"`
 	// DisableVolatile doesn't allow volatile mounts when it is set.
 	DisableVolatile bool `json:"disable-volatile,omitempty"`
+	// LockTimeout, if not zero, is how long to wait for a lock before
+	// giving up and returning ErrLockTimeout.
+	LockTimeout time.Duration `json:"lock-timeout,omitempty"`
+	// MetadataBackend selects how layers.json, images.json, and
+	// containers.json are updated: "json", the default, rewrites them
+	// whole, while "journal" appends changes to a journal next to them.
+	MetadataBackend string `json:"metadata-backend,omitempty"`
 }
 
 // isRootlessDriver returns true if the given storage driver is valid for containers running as non root
@@ -411,6 +418,19 @@ func ReloadConfigurationFile(configFile string, storeOptions *StoreOptions) {
 
 	storeOptions.DisableVolatile = config.Storage.Options.DisableVolatile
 
+	if config.Storage.Options.LockTimeout != "" {
+		lockTimeout, err := time.ParseDuration(config.Storage.Options.LockTimeout)
+		if err != nil {
+			logrus.Warningf("Failed to parse lock_timeout %q from %q: %v", config.Storage.Options.LockTimeout, configFile, err)
+		} else {
+			storeOptions.LockTimeout = lockTimeout
+		}
+	}
+
+	if config.Storage.Options.MetadataBackend != "" {
+		storeOptions.MetadataBackend = config.Storage.Options.MetadataBackend
+	}
+
 	storeOptions.GraphDriverOptions = append(storeOptions.GraphDriverOptions, cfg.GetGraphDriverOptions(storeOptions.GraphDriverName, config.Storage.Options)...)
 
 	if opts, ok := os.LookupEnv("STORAGE_OPTS"); ok {
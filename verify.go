@@ -0,0 +1,187 @@
+package storage
+
+import (
+	"bytes"
+	"hash/crc64"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/gepis/strge/pkg/archive"
+	"github.com/klauspost/pgzip"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"github.com/vbatts/tar-split/tar/storage"
+)
+
+// LayerFileProblem identifies the way in which a file in a layer differs from
+// what was recorded when the layer's contents were applied.
+type LayerFileProblem string
+
+const (
+	// LayerFileMissing is reported for a file which could not be opened.
+	LayerFileMissing LayerFileProblem = "missing"
+	// LayerFileSizeChanged is reported for a file whose size has changed.
+	LayerFileSizeChanged LayerFileProblem = "size"
+	// LayerFileContentChanged is reported for a file whose size is the same
+	// but whose contents have changed.
+	LayerFileContentChanged LayerFileProblem = "content"
+)
+
+// LayerFileMismatch describes a file in a layer whose contents no longer
+// match what was recorded when the layer's contents were applied.
+type LayerFileMismatch struct {
+	Path    string           `json:"path"`
+	Problem LayerFileProblem `json:"problem"`
+}
+
+// LayerVerification is the result of comparing a layer's contents with the
+// digest which was recorded for them when they were applied.
+type LayerVerification struct {
+	// ID is the ID of the layer which was verified.
+	ID string `json:"id"`
+	// Expected is the layer's recorded UncompressedDigest.
+	Expected digest.Digest `json:"expected"`
+	// Actual is the digest of the diff which was regenerated from the
+	// layer's contents.
+	Actual digest.Digest `json:"actual"`
+	// TarSplit is set if the diff was reassembled using the tar-split
+	// data which was saved when the layer's contents were applied.  If it
+	// is not set, the diff was generated by the storage driver, and it may
+	// not match Expected even if the layer's contents are unchanged.
+	TarSplit bool `json:"tar-split"`
+	// Files lists the files whose contents differ from what was recorded.
+	// It is only populated if TarSplit is set.
+	Files []LayerFileMismatch `json:"files,omitempty"`
+}
+
+// Verified returns true if the regenerated diff matched the recorded digest
+// and no files were found to have changed.
+func (v *LayerVerification) Verified() bool {
+	return v.Actual == v.Expected && len(v.Files) == 0
+}
+
+// verify regenerates the diff for the specified layer from its tar-split data
+// and on-disk contents, in the same way that Diff() does, but it keeps going
+// when it finds a file which doesn't match, so that every such file can be
+// reported.
+func (r *layerStore) verify(id string) (*LayerVerification, error) {
+	layer, ok := r.lookup(id)
+	if !ok {
+		return nil, ErrLayerUnknown
+	}
+	if layer.UncompressedDigest == "" {
+		return nil, errors.Wrapf(ErrDigestUnknown, "layer %q has no recorded uncompressed digest", layer.ID)
+	}
+	if err := layer.UncompressedDigest.Validate(); err != nil {
+		return nil, errors.Wrapf(err, "layer %q has an invalid uncompressed digest", layer.ID)
+	}
+	verification := &LayerVerification{
+		ID:       layer.ID,
+		Expected: layer.UncompressedDigest,
+	}
+	digester := layer.UncompressedDigest.Algorithm().Digester()
+
+	tsfile, err := os.Open(r.tspath(layer.ID))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+		// No tar-split data, so the best that we can do is to ask the
+		// driver for a diff and hope that it's identical.
+		uncompressed := archive.Uncompressed
+		diff, err := r.Diff("", layer.ID, &DiffOptions{Compression: &uncompressed})
+		if err != nil {
+			return nil, errors.Wrapf(err, "error generating diff for layer %q", layer.ID)
+		}
+		defer diff.Close()
+		if _, err := io.Copy(digester.Hash(), diff); err != nil {
+			return nil, errors.Wrapf(err, "error reading diff for layer %q", layer.ID)
+		}
+		verification.Actual = digester.Digest()
+		return verification, nil
+	}
+	defer tsfile.Close()
+	verification.TarSplit = true
+
+	decompressor, err := pgzip.NewReader(tsfile)
+	if err != nil {
+		return nil, err
+	}
+	defer decompressor.Close()
+	tsbytes, err := ioutil.ReadAll(decompressor)
+	if err != nil {
+		return nil, err
+	}
+	metadata := storage.NewJSONUnpacker(bytes.NewBuffer(tsbytes))
+
+	fgetter, err := r.newFileGetter(layer.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer fgetter.Close()
+
+	crc := crc64.New(storage.CRCTable)
+	for {
+		entry, err := metadata.Next()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, errors.Wrapf(err, "error reading tar-split data for layer %q", layer.ID)
+		}
+		switch entry.Type {
+		case storage.SegmentType:
+			if _, err := digester.Hash().Write(entry.Payload); err != nil {
+				return nil, err
+			}
+		case storage.FileType:
+			if entry.Size == 0 {
+				continue
+			}
+			fh, err := fgetter.Get(entry.GetName())
+			if err != nil {
+				verification.Files = append(verification.Files, LayerFileMismatch{Path: entry.GetName(), Problem: LayerFileMissing})
+				continue
+			}
+			crc.Reset()
+			n, err := io.Copy(io.MultiWriter(digester.Hash(), crc), fh)
+			fh.Close()
+			if err != nil {
+				return nil, errors.Wrapf(err, "error reading %q in layer %q", entry.GetName(), layer.ID)
+			}
+			if n != entry.Size {
+				verification.Files = append(verification.Files, LayerFileMismatch{Path: entry.GetName(), Problem: LayerFileSizeChanged})
+			} else if !bytes.Equal(crc.Sum(nil), entry.Payload) {
+				verification.Files = append(verification.Files, LayerFileMismatch{Path: entry.GetName(), Problem: LayerFileContentChanged})
+			}
+		}
+	}
+	verification.Actual = digester.Digest()
+	return verification, nil
+}
+
+func (s *store) VerifyLayer(id string) (*LayerVerification, error) {
+	lstore, err := s.LayerStore()
+	if err != nil {
+		return nil, err
+	}
+	lstores, err := s.ROLayerStores()
+	if err != nil {
+		return nil, err
+	}
+	for _, store := range append([]ROLayerStore{lstore}, lstores...) {
+		if err := s.startReading(store); err != nil {
+			return nil, err
+		}
+		defer store.Unlock()
+		if !store.Exists(id) {
+			continue
+		}
+		if r, ok := store.(*layerStore); ok {
+			return r.verify(id)
+		}
+		return nil, errors.Wrapf(ErrNotSupported, "verifying layer %q", id)
+	}
+	return nil, ErrLayerUnknown
+}